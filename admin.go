@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminUserRequest is the body accepted when adding a user through the admin
+// API.
+type AdminUserRequest struct {
+	Name        string `json:"name"`
+	Password    string `json:"password"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// AdminUserResponse describes a user affected by an admin API call.
+type AdminUserResponse struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	Locks       *int   `json:"locks,omitempty"`
+}
+
+// AdminObjectResponse describes an object listed through the admin API.
+// Objects stored before uploads were recorded have no uploader or creation
+// time.
+type AdminObjectResponse struct {
+	Oid         string     `json:"oid"`
+	Size        int64      `json:"size"`
+	HashAlgo    string     `json:"hash_algo,omitempty"`
+	UploadedBy  string     `json:"uploaded_by,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	ContentType string     `json:"content_type"`
+}
+
+// newAdminObjectResponse describes o for the admin API.
+func newAdminObjectResponse(o *MetaObject) *AdminObjectResponse {
+	resp := &AdminObjectResponse{Oid: o.Oid, Size: o.Size, HashAlgo: o.HashAlgo, UploadedBy: o.UploadedBy, Tags: o.Tags, ContentType: o.MediaType()}
+	if !o.CreatedAt.IsZero() {
+		createdAt := o.CreatedAt
+		resp.CreatedAt = &createdAt
+	}
+	return resp
+}
+
+// AdminTagsRequest is the body accepted when setting an object's tags
+// through the admin API.
+type AdminTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+// AdminDeleteObjectsRequest is the body accepted when deleting objects
+// through the admin API.
+type AdminDeleteObjectsRequest struct {
+	Oids []string `json:"oids"`
+}
+
+// AdminDeleteObjectsResponse reports which objects were deleted, or would be
+// on a dry run.
+type AdminDeleteObjectsResponse struct {
+	Deleted int      `json:"deleted"`
+	Oids    []string `json:"oids"`
+	DryRun  bool     `json:"dry_run,omitempty"`
+}
+
+// AdminPurgeObjectsResponse reports which soft deleted objects were purged,
+// or would be on a dry run.
+type AdminPurgeObjectsResponse struct {
+	Purged int      `json:"purged"`
+	Oids   []string `json:"oids"`
+	DryRun bool     `json:"dry_run,omitempty"`
+}
+
+// AdminClearLocksResponse reports how many locks were deleted from a repo.
+type AdminClearLocksResponse struct {
+	Repo    string `json:"repo"`
+	Deleted int    `json:"deleted"`
+}
+
+// AdminTransferLocksRequest is the body accepted when transferring a user's
+// locks to another user through the admin API.
+type AdminTransferLocksRequest struct {
+	To string `json:"to"`
+}
+
+// AdminTransferLocksResponse reports how many locks were transferred from a
+// user to another.
+type AdminTransferLocksResponse struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Transferred int    `json:"transferred"`
+}
+
+// AdminRepairLocksResponse reports how many lock counts were repaired and
+// the inconsistencies that remain.
+type AdminRepairLocksResponse struct {
+	Repaired        int                 `json:"repaired"`
+	Inconsistencies []LockInconsistency `json:"inconsistencies"`
+}
+
+// defaultAuditLimit is how many audit entries are listed when no limit is
+// given.
+const defaultAuditLimit = 100
+
+func (a *App) addAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/users", adminAuth(a.adminUsersHandler)).Methods("GET").Name("admin_users")
+	r.HandleFunc("/admin/users", adminAuth(a.adminAddUserHandler)).Methods("POST").Name("admin_add_user")
+	r.HandleFunc("/admin/users/{name}", adminAuth(a.adminDeleteUserHandler)).Methods("DELETE").Name("admin_delete_user")
+	r.HandleFunc("/admin/users/{name}/locks", adminAuth(a.adminUserLocksHandler)).Methods("GET").Name("admin_user_locks")
+	r.HandleFunc("/admin/users/{name}/locks/transfer", adminAuth(a.adminTransferLocksHandler)).Methods("POST").Name("admin_transfer_locks")
+	r.HandleFunc("/admin/objects", objectListing(adminAuth(a.adminObjectsHandler))).Methods("GET").Name("admin_objects")
+	r.HandleFunc("/admin/objects/{oid}", adminAuth(a.adminObjectHandler)).Methods("GET").Name("admin_object")
+	r.HandleFunc("/admin/objects/{oid}/tags", adminAuth(a.adminTagsHandler)).Methods("PUT").Name("admin_tags")
+	r.HandleFunc("/admin/objects/delete", adminAuth(a.adminDeleteObjectsHandler)).Methods("POST").Name("admin_delete_objects")
+	r.HandleFunc("/admin/objects/purge", adminAuth(a.adminPurgeObjectsHandler)).Methods("POST").Name("admin_purge_objects")
+	r.HandleFunc("/admin/export", objectListing(adminAuth(a.adminExportHandler))).Methods("GET").Name("admin_export")
+	r.HandleFunc("/admin/import", adminAuth(a.adminImportHandler)).Methods("POST").Name("admin_import")
+	r.HandleFunc("/admin/stats", adminAuth(a.adminStatsHandler)).Methods("GET").Name("admin_stats")
+	r.HandleFunc("/admin/audit", adminAuth(a.adminAuditHandler)).Methods("GET").Name("admin_audit")
+	r.HandleFunc("/admin/repos/{repo}/locks", adminAuth(a.adminClearLocksHandler)).Methods("DELETE").Name("admin_clear_locks")
+	r.HandleFunc("/admin/locks", adminAuth(a.adminLocksHandler)).Methods("GET").Name("admin_locks")
+	r.HandleFunc("/admin/locks/integrity", adminAuth(a.adminLockIntegrityHandler)).Methods("GET").Name("admin_lock_integrity")
+	r.HandleFunc("/admin/locks/integrity/repair", adminAuth(a.adminRepairLocksHandler)).Methods("POST").Name("admin_repair_locks")
+	r.HandleFunc("/admin/verify", adminAuth(a.adminVerifyHandler)).Methods("GET").Name("admin_verify")
+	r.HandleFunc("/admin/compact", adminAuth(a.adminCompactHandler)).Methods("POST").Name("admin_compact")
+}
+
+// objectListing responds with 404 to requests for h when listing objects is
+// turned off.
+func objectListing(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Config().IsListingObjects() {
+			writeStatus(w, r, 404)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminAuth only lets requests authenticated as an admin through.
+// Requests without credentials get a 401, other users get a 403.
+func adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Config().HasAdmins() {
+			writeStatus(w, r, 404)
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", basicChallenge("admin"))
+			writeStatus(w, r, http.StatusUnauthorized)
+			return
+		}
+
+		if !checkBasicAuth(user, pass, ok) {
+			writeStatus(w, r, http.StatusForbidden)
+			return
+		}
+
+		logAdminAction(r, user)
+		h(w, r)
+	}
+}
+
+func (a *App) adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := a.metaStore.Users()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := make([]*AdminUserResponse, 0, len(users))
+	for _, u := range users {
+		resp = append(resp, &AdminUserResponse{Name: u.Name, DisplayName: u.DisplayName})
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (a *App) adminAddUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Name == "" || req.Password == "" {
+		writeError(w, r, http.StatusUnprocessableEntity, "Invalid username or password")
+		return
+	}
+
+	exists, err := a.metaStore.UserExists(req.Name)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if exists {
+		writeError(w, r, http.StatusConflict, "User already exists")
+		return
+	}
+
+	if err := a.metaStore.AddUser(req.Name, req.Password, req.DisplayName); err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, &AdminUserResponse{Name: req.Name, DisplayName: req.DisplayName})
+}
+
+func (a *App) adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	exists, err := a.metaStore.UserExists(name)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !exists {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+
+	release := isTrue(r.FormValue("release_locks"))
+	owned, err := a.metaStore.DeleteUser(name, release)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	if release {
+		a.notifyLocks("lock.deleted", owned)
+	}
+
+	locks := countRepoLocks(owned)
+	writeJSON(w, r, http.StatusOK, &AdminUserResponse{Name: name, Locks: &locks})
+}
+
+// adminUserLocksHandler lists the locks owned by a user in every repo, with
+// each lock's path prepended with its repo.
+func (a *App) adminUserLocksHandler(w http.ResponseWriter, r *http.Request) {
+	locks, err := a.metaStore.LocksByOwner(mux.Vars(r)["name"])
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, &LockList{Locks: locks})
+}
+
+// adminTransferLocksHandler makes the user named in the request body the
+// owner of every lock owned by a user. When local users are the only ones
+// that can authenticate, the new owner must be one of them.
+func (a *App) adminTransferLocksHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminTransferLocksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.To == "" {
+		writeError(w, r, http.StatusBadRequest, "Missing user to transfer locks to")
+		return
+	}
+
+	if !Config().IsUsingLDAP() {
+		exists, err := a.metaStore.UserExists(req.To)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !exists {
+			writeError(w, r, http.StatusUnprocessableEntity, "Unknown user to transfer locks to")
+			return
+		}
+	}
+
+	from := mux.Vars(r)["name"]
+	transferred, err := a.metaStore.TransferLocks(from, req.To)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	a.notifyLocks("lock.transferred", transferred)
+
+	writeJSON(w, r, http.StatusOK, &AdminTransferLocksResponse{From: from, To: req.To, Transferred: countRepoLocks(transferred)})
+}
+
+// adminObjectsHandler lists objects, optionally only those with a size
+// between the min and max query parameters, inclusive, and only those tagged
+// with the tag query parameter.
+func (a *App) adminObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	min, max := int64(0), int64(math.MaxInt64)
+	for param, bound := range map[string]*int64{"min": &min, "max": &max} {
+		value := r.FormValue(param)
+		if value == "" {
+			continue
+		}
+
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			writeError(w, r, http.StatusBadRequest, "Invalid "+param+" size: "+value)
+			return
+		}
+		*bound = size
+	}
+
+	ctx, cancel := scanContext(r)
+	defer cancel()
+
+	objects, err := a.metaStore.ObjectsBySize(ctx, min, max)
+	if err != nil {
+		writeScanError(w, r, err)
+		return
+	}
+
+	tag := r.FormValue("tag")
+	resp := make([]*AdminObjectResponse, 0, len(objects))
+	for _, o := range objects {
+		if tag != "" && !o.HasTag(tag) {
+			continue
+		}
+		resp = append(resp, newAdminObjectResponse(o))
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// adminObjectHandler describes a single object. Soft deleted objects aren't
+// found.
+func (a *App) adminObjectHandler(w http.ResponseWriter, r *http.Request) {
+	meta, err := a.metaStore.Get(&RequestVars{Oid: mux.Vars(r)["oid"]})
+	if err != nil {
+		writeObjectError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, newAdminObjectResponse(meta))
+}
+
+// adminTagsHandler replaces the tags of an object with those in the request
+// body.
+func (a *App) adminTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminTagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	meta, err := a.metaStore.SetTags(mux.Vars(r)["oid"], req.Tags)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, newAdminObjectResponse(meta))
+}
+
+// adminDeleteObjectsHandler deletes the objects listed in the request body,
+// ignoring oids that don't exist. With ?dry_run=true nothing is deleted.
+func (a *App) adminDeleteObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdminDeleteObjectsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dryRun := isTrue(r.FormValue("dry_run"))
+	deleted, err := a.metaStore.DeleteMany(req.Oids, dryRun)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	if deleted == nil {
+		deleted = []string{}
+	}
+	writeJSON(w, r, http.StatusOK, &AdminDeleteObjectsResponse{Deleted: len(deleted), Oids: deleted, DryRun: dryRun})
+}
+
+// adminPurgeObjectsHandler purges soft deleted objects older than
+// Config.TombstoneMaxAge, as is done at startup. With ?dry_run=true nothing
+// is purged.
+func (a *App) adminPurgeObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := isTrue(r.FormValue("dry_run"))
+	purged, err := a.metaStore.Purge(Config().TombstoneMaxAgeDuration(), dryRun)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	if purged == nil {
+		purged = []string{}
+	}
+	writeJSON(w, r, http.StatusOK, &AdminPurgeObjectsResponse{Purged: len(purged), Oids: purged, DryRun: dryRun})
+}
+
+func (a *App) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.metaStore.Stats()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, stats)
+}
+
+// adminAuditHandler lists the most recent audit entries, newest first. The
+// limit query parameter sets how many, defaulting to defaultAuditLimit.
+func (a *App) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultAuditLimit
+	if value := r.FormValue("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest, "Invalid limit amount: "+value)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := a.metaStore.AuditLog(limit)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if entries == nil {
+		entries = []*AuditEntry{}
+	}
+	writeJSON(w, r, http.StatusOK, entries)
+}
+
+// adminLocksHandler lists the locks of every repo, with paths prefixed by
+// "repo:" as in AllLocks. They are listed as CSV for ?format=csv or an Accept
+// header of text/csv, and as a LockList otherwise.
+func (a *App) adminLocksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := scanContext(r)
+	defer cancel()
+
+	locks, err := a.lockStore.AllLocks(ctx)
+	if err != nil {
+		writeScanError(w, r, err)
+		return
+	}
+
+	if !wantsCSV(r) {
+		if locks == nil {
+			locks = []Lock{}
+		}
+		writeJSON(w, r, http.StatusOK, &LockList{Locks: locks})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "path", "owner", "locked_at"})
+	for _, l := range locks {
+		cw.Write([]string{csvField(l.Id), csvField(l.Path), csvField(l.Owner.Name), l.LockedAt.UTC().Format(time.RFC3339)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logger.Log(kv{"fn": "locks", "err": err.Error()})
+	}
+}
+
+// csvField keeps a spreadsheet from running a value as a formula, by
+// prefixing values that start like one with a quote.
+func csvField(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// wantsCSV returns true if r asks for CSV, with ?format=csv or an Accept
+// header that prefers text/csv to JSON. Media ranges of equal quality are
+// preferred in the order they are listed.
+func wantsCSV(r *http.Request) bool {
+	if r.FormValue("format") == "csv" {
+		return true
+	}
+
+	csvQ, jsonQ := 0.0, 0.0
+	csvAt, jsonAt := -1, -1
+	for i, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "text/csv", "text/*":
+			if q > csvQ {
+				csvQ, csvAt = q, i
+			}
+		case "application/json", "application/*", "*/*":
+			if q > jsonQ {
+				jsonQ, jsonAt = q, i
+			}
+		}
+	}
+	return csvQ > 0 && (csvQ > jsonQ || csvQ == jsonQ && csvAt < jsonAt)
+}
+
+// adminLockIntegrityHandler lists inconsistencies between the stored locks
+// and lock counts.
+func (a *App) adminLockIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	problems, err := a.metaStore.VerifyLockIntegrity()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if problems == nil {
+		problems = []LockInconsistency{}
+	}
+	writeJSON(w, r, http.StatusOK, problems)
+}
+
+// adminRepairLocksHandler rebuilds the lock counts, then lists what's still
+// inconsistent.
+func (a *App) adminRepairLocksHandler(w http.ResponseWriter, r *http.Request) {
+	repaired, err := a.metaStore.RepairLockCounts()
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	problems, err := a.metaStore.VerifyLockIntegrity()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if problems == nil {
+		problems = []LockInconsistency{}
+	}
+	writeJSON(w, r, http.StatusOK, &AdminRepairLocksResponse{Repaired: repaired, Inconsistencies: problems})
+}
+
+// adminClearLocksHandler deletes every lock in a repo, such as after it has
+// been archived.
+func (a *App) adminClearLocksHandler(w http.ResponseWriter, r *http.Request) {
+	repo := mux.Vars(r)["repo"]
+
+	deleted, err := a.metaStore.LockClear(repo)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+	a.notifyLocks("lock.deleted", map[string][]Lock{repo: deleted})
+
+	writeJSON(w, r, http.StatusOK, &AdminClearLocksResponse{Repo: repo, Deleted: len(deleted)})
+}
+
+// adminCompactHandler compacts the meta store, reporting the database size
+// before and after.
+func (a *App) adminCompactHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := a.metaStore.Compact()
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// adminVerifyHandler checks the content store against the objects' meta
+// information, streaming the problems found as they are found, followed by
+// the number of objects checked. With ?limit= only that many objects are
+// checked. Errors after the status has been sent are logged.
+func (a *App) adminVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var limit int
+	if value := r.FormValue("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest, "Invalid limit: "+value)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e := &jsonStreamWriter{w: w}
+	err := e.list("problems")
+	if err == nil {
+		var checked int
+		checked, err = a.metaStore.VerifyContent(r.Context(), a.contentStore, limit, func(problem ContentInconsistency) error {
+			return e.record(&problem)
+		})
+		if err == nil {
+			err = e.end(kv{"checked": checked})
+		}
+	}
+	if err != nil {
+		logger.Log(kv{"fn": "verify", "err": err.Error()})
+	}
+}
+
+// adminExportHandler streams an ExportDocument of the whole meta store. The
+// status has been sent by the time most errors could happen, so they are
+// logged and the document is left unfinished.
+func (a *App) adminExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := a.metaStore.Export(r.Context(), w); err != nil {
+		logger.Log(kv{"fn": "export", "err": err.Error()})
+	}
+}
+
+// adminImportHandler adds the contents of an ExportDocument in the request
+// body to the meta store.
+func (a *App) adminImportHandler(w http.ResponseWriter, r *http.Request) {
+	doc, err := decodeExport(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := a.metaStore.Import(doc)
+	if err != nil {
+		writeAdminError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// writeAdminError writes err with the status matching the store error.
+func writeAdminError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case errReadOnly:
+		w.Header().Set("Retry-After", readOnlyRetryAfter)
+		status = http.StatusServiceUnavailable
+	case errObjectNotFound:
+		status = http.StatusNotFound
+	case errInvalidTag:
+		status = http.StatusUnprocessableEntity
+	}
+	writeError(w, r, status, err.Error())
+}
+
+// writeJSON writes v as the JSON body of a response with the given status,
+// indented when the request asks for it with ?pretty=true. It is only used
+// for admin responses, the Git LFS API is always compact.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	if isTrue(r.URL.Query().Get("pretty")) {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
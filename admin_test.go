@@ -0,0 +1,1042 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	testAdminUser = "gandalf"
+	testAdminPass = "mithrandir"
+)
+
+func TestAdminUsers(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	res, err := api("GET", "/admin/users", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var users []AdminUserResponse
+	if err := json.NewDecoder(res.Body).Decode(&users); err != nil {
+		t.Fatalf("expected response body to be a user list, got error: %s", err)
+	}
+
+	found := false
+	for _, u := range users {
+		if u.Name == testUser {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected %s to be listed, got: %v", testUser, users)
+	}
+}
+
+func TestAdminAddAndDeleteUser(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	buf := bytes.NewBufferString(`{"name":"frodo","password":"ring"}`)
+	res, err := api("POST", "/admin/users", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	if !testMetaStore.ValidateUser("frodo", "ring") {
+		t.Errorf("expected added user to authenticate")
+	}
+
+	buf = bytes.NewBufferString(`{"name":"frodo","password":"ring"}`)
+	res, err = api("POST", "/admin/users", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 409 {
+		t.Fatalf("expected status 409 adding an existing user, got %d", res.StatusCode)
+	}
+
+	res, err = adminDelete("/admin/users/frodo", testAdminUser, testAdminPass)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	if testMetaStore.ValidateUser("frodo", "ring") {
+		t.Errorf("expected deleted user to not authenticate")
+	}
+
+	res, err = adminDelete("/admin/users/frodo", testAdminUser, testAdminPass)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 deleting a missing user, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminUsersNotAdmin(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	res, err := api("GET", "/admin/users", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+
+	buf := bytes.NewBufferString(`{"name":"frodo","password":"ring"}`)
+	res, err = api("POST", "/admin/users", "", testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+
+	res, err = adminDelete("/admin/users/"+testUser1, testUser, testPass)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminPrettyJSON(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	for path, indented := range map[string]bool{
+		"/admin/stats?pretty=true":  true,
+		"/admin/stats":              false,
+		"/admin/stats?pretty=false": false,
+	} {
+		res, err := api("GET", path, "", testAdminUser, testAdminPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("expected response to contain content, got error: %s", err)
+		}
+
+		if indented && !bytes.HasPrefix(body, []byte("{\n  \"")) {
+			t.Errorf("expected %s to be indented, got: %s", path, body)
+		}
+		if !indented && bytes.Count(body, []byte("\n")) != 1 {
+			t.Errorf("expected %s to be compact, got: %s", path, body)
+		}
+	}
+
+	// The Git LFS API stays compact
+	res, err := api("GET", "/user/repo/locks?pretty=true", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+	if bytes.Count(body, []byte("\n")) != 1 {
+		t.Errorf("expected the lock list to be compact, got: %s", body)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	res, err := api("GET", "/admin/stats", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var stats MetaStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatalf("expected response body to be stats, got error: %s", err)
+	}
+
+	expected, err := testMetaStore.Stats()
+	if err != nil {
+		t.Fatalf("expected Stats to succeed, got : %s", err)
+	}
+	if stats.Users != expected.Users || stats.Objects != expected.Objects || stats.Locks != expected.Locks {
+		t.Errorf("expected stats to match the meta store, got: %+v, expected: %+v", stats, *expected)
+	}
+	if stats.ObjectsSize != expected.ObjectsSize || stats.DBSize != expected.DBSize {
+		t.Errorf("expected sizes to match the meta store, got: %+v, expected: %+v", stats, *expected)
+	}
+
+	res, err = api("GET", "/admin/stats", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminObjects(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	path := fmt.Sprintf("/admin/objects?min=%d&max=%d", contentSize, contentSize)
+	res, err := api("GET", path, "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var objects []AdminObjectResponse
+	if err := json.NewDecoder(res.Body).Decode(&objects); err != nil {
+		t.Fatalf("expected response body to be a list of objects, got error: %s", err)
+	}
+	found := false
+	for _, o := range objects {
+		if o.Size != contentSize {
+			t.Errorf("expected only objects of %d bytes, got: %+v", contentSize, o)
+		}
+		if o.Oid == contentOid {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected content oid to be listed, got: %+v", objects)
+	}
+
+	res, err = api("GET", "/admin/objects?min=big", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 400, "Invalid min size: big")
+
+	res, err = api("GET", "/admin/objects", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminObject(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	if _, err := testMetaStore.SetTags(contentOid, []string{"release"}); err != nil {
+		t.Fatalf("expected SetTags to succeed, got : %s", err)
+	}
+	if _, err := testMetaStore.SetContentType(contentOid, "text/plain; charset=utf-8"); err != nil {
+		t.Fatalf("expected SetContentType to succeed, got : %s", err)
+	}
+
+	res, err := api("GET", "/admin/objects/"+contentOid, "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var object map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&object); err != nil {
+		t.Fatalf("expected response body to be an object, got error: %s", err)
+	}
+	if object["oid"] != contentOid || object["size"] != float64(contentSize) {
+		t.Errorf("expected the object's oid and size, got: %v", object)
+	}
+	if tags, ok := object["tags"].([]interface{}); !ok || len(tags) != 1 || tags[0] != "release" {
+		t.Errorf("expected the object's tags, got: %v", object["tags"])
+	}
+	if object["content_type"] != "text/plain; charset=utf-8" {
+		t.Errorf("expected the object's content type, got: %v", object["content_type"])
+	}
+
+	res, err = api("GET", "/admin/objects/"+nonExistingOid, "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Errorf("expected status 404, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/admin/objects/"+contentOid, "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Errorf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminObjectTags(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	buf := bytes.NewBufferString(`{"tags":["release"]}`)
+	res, err := api("PUT", "/admin/objects/"+contentOid+"/tags", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var tagged AdminObjectResponse
+	if err := json.NewDecoder(res.Body).Decode(&tagged); err != nil {
+		t.Fatalf("expected response body to be an object, got error: %s", err)
+	}
+	if tagged.Oid != contentOid || len(tagged.Tags) != 1 || tagged.Tags[0] != "release" {
+		t.Errorf("expected the tagged object, got: %+v", tagged)
+	}
+
+	for tag, expected := range map[string]int{"release": 1, "other": 0} {
+		res, err = api("GET", "/admin/objects?tag="+tag, "", testAdminUser, testAdminPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+
+		var objects []AdminObjectResponse
+		if err := json.NewDecoder(res.Body).Decode(&objects); err != nil {
+			t.Fatalf("expected response body to be a list of objects, got error: %s", err)
+		}
+		if len(objects) != expected {
+			t.Errorf("expected %d objects tagged %s, got: %+v", expected, tag, objects)
+		}
+	}
+
+	buf = bytes.NewBufferString(`{"tags":["release"]}`)
+	res, err = api("PUT", "/admin/objects/"+nonExistingOid+"/tags", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 404, "Object not found")
+
+	buf = bytes.NewBufferString(`{"tags":[""]}`)
+	res, err = api("PUT", "/admin/objects/"+contentOid+"/tags", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 422, "Invalid tag, tags can't be empty")
+}
+
+func TestAdminDeleteObjects(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	const deletedOid = "9b8a4ab1bfbd1d8a3c4cc0dbd1df1d6b6cd3a2e56f0d5b1cbd1c5a0c1a8d6e2f"
+	if _, err := testMetaStore.Put(&RequestVars{User: testUser, Repo: "deleted-repo", Oid: deletedOid, Size: 10}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oids":["%s","%s"]}`, deletedOid, nonExistingOid))
+	res, err := api("POST", "/admin/objects/delete", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var result AdminDeleteObjectsResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("expected response body to be a delete result, got error: %s", err)
+	}
+	if result.Deleted != 1 {
+		t.Errorf("expected 1 object to be deleted, got: %d", result.Deleted)
+	}
+	if len(result.Oids) != 1 || result.Oids[0] != deletedOid {
+		t.Errorf("expected the deleted oid to be returned, got: %v", result.Oids)
+	}
+	if _, err := testMetaStore.Get(&RequestVars{Oid: deletedOid}); err != errObjectNotFound {
+		t.Errorf("expected object to be deleted, got: %v", err)
+	}
+
+	res, err = api("POST", "/admin/objects/delete", "", testUser, testPass, bytes.NewBufferString(`{"oids":[]}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminDeleteObjectsDryRun(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	const keptOid = "4d1f4c5b3e0c4f8a9b2d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b"
+	if _, err := testMetaStore.Put(&RequestVars{User: testUser, Repo: "dry-run-repo", Oid: keptOid, Size: 10}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oids":["%s"]}`, keptOid))
+	res, err := api("POST", "/admin/objects/delete?dry_run=true", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var result AdminDeleteObjectsResponse
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("expected response body to be a delete result, got error: %s", err)
+	}
+	if !result.DryRun || result.Deleted != 1 || len(result.Oids) != 1 || result.Oids[0] != keptOid {
+		t.Errorf("expected a dry run listing the object, got: %+v", result)
+	}
+	if _, err := testMetaStore.Get(&RequestVars{Oid: keptOid}); err != nil {
+		t.Errorf("expected object to be kept on a dry run, got: %v", err)
+	}
+}
+
+func TestAdminPurgeObjects(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	Config().SoftDelete = "true"
+	defer func() { Config().SoftDelete = "false" }()
+	Config().TombstoneMaxAge = "0s"
+	defer func() { Config().TombstoneMaxAge = "168h" }()
+
+	const purgedOid = "7e2f1a0b9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+	v := &RequestVars{User: testUser, Repo: "purge-repo", Oid: purgedOid, Size: 10}
+	if _, err := testMetaStore.Put(v); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+	if err := testMetaStore.Delete(v); err != nil {
+		t.Fatalf("error deleting object: %s", err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		path := "/admin/objects/purge"
+		if dryRun {
+			path += "?dry_run=true"
+		}
+		res, err := api("POST", path, "", testAdminUser, testAdminPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+
+		var result AdminPurgeObjectsResponse
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatalf("expected response body to be a purge result, got error: %s", err)
+		}
+		// The object is still there to purge after the dry run.
+		if result.DryRun != dryRun || result.Purged != 1 || result.Oids[0] != purgedOid {
+			t.Errorf("expected the deleted object to be purged, got: %+v", result)
+		}
+	}
+
+	if _, err := testMetaStore.Restore(purgedOid); err != errObjectNotFound {
+		t.Errorf("expected purged object to not be restorable, got: %v", err)
+	}
+}
+
+func TestAdminExportImport(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	res, err := api("GET", "/admin/export", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var exported bytes.Buffer
+	exported.ReadFrom(res.Body)
+	var doc ExportDocument
+	if err := json.Unmarshal(exported.Bytes(), &doc); err != nil {
+		t.Fatalf("expected response body to be an export, got error: %s", err)
+	}
+	if len(doc.Users) == 0 || len(doc.Objects) == 0 {
+		t.Errorf("expected users and objects to be exported, got: %+v", doc)
+	}
+
+	// Everything in the export is already in the store
+	res, err = api("POST", "/admin/import", "", testAdminUser, testAdminPass, &exported)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var result ImportResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("expected response body to be an import result, got error: %s", err)
+	}
+	if result != (ImportResult{}) {
+		t.Errorf("expected nothing new to be imported, got: %+v", result)
+	}
+
+	res, err = api("POST", "/admin/import", "", testAdminUser, testAdminPass, bytes.NewBufferString(`{"users":`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminVerify(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	const missingOid = "0c6f7d2a4b1e9f8d3c5a6b7e8f9d0c1b2a3e4f5d6c7b8a9e0f1d2c3b4a5e6f7d"
+	if _, err := testMetaStore.Put(&RequestVars{User: testUser, Repo: "verify-repo", Oid: missingOid, Size: 10}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	res, err := api("GET", "/admin/verify", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var result struct {
+		Problems []ContentInconsistency `json:"problems"`
+		Checked  int                    `json:"checked"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("expected response body to be a verify result, got error: %s", err)
+	}
+	if result.Checked == 0 {
+		t.Errorf("expected objects to be checked")
+	}
+	var found bool
+	for _, p := range result.Problems {
+		found = found || (p.Oid == missingOid && p.Problem == contentMissing)
+	}
+	if !found {
+		t.Errorf("expected the object without content to be reported, got: %+v", result.Problems)
+	}
+
+	res, err = api("GET", "/admin/verify?limit=none", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	lock, err := createLockInRepo(testUser1, testPass1, "audit-repo", "audited.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	buf := bytes.NewBufferString(`{"force":true}`)
+	res, err := api("POST", "/user/audit-repo/locks/"+lock.Id+"/unlock", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/admin/audit?limit=1", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var entries []AuditEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		t.Fatalf("expected response body to be a list of audit entries, got error: %s", err)
+	}
+	if len(entries) != 1 || entries[0].LockId != lock.Id || entries[0].Actor != testUser || entries[0].Owner != testUser1 {
+		t.Errorf("expected the force delete to be audited, got: %+v", entries)
+	}
+
+	res, err = api("GET", "/admin/audit", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminTransferLocks(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	for _, repo := range []string{"departed-repo-1", "departed-repo-2"} {
+		if _, err := testMetaStore.AddLocks(repo, NewTestLock(randomLockId(), "a.bin", "departed")); err != nil {
+			t.Fatalf("expected AddLocks to succeed, got : %s", err)
+		}
+	}
+
+	res, err := api("GET", "/admin/users/departed/locks", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 2 || list.Locks[0].Path != "departed-repo-1:a.bin" {
+		t.Errorf("expected the user's locks in both repos, got: %+v", list.Locks)
+	}
+
+	// Without LDAP only local users can own locks
+	res, err = api("POST", "/admin/users/departed/locks/transfer", "", testAdminUser, testAdminPass, bytes.NewBufferString(`{"to":"successor"}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 422, "Unknown user to transfer locks to")
+
+	if err := testMetaStore.AddUser("successor", "pass", ""); err != nil {
+		t.Fatalf("expected AddUser to succeed, got : %s", err)
+	}
+	defer testMetaStore.DeleteUser("successor", false)
+
+	buf := bytes.NewBufferString(`{"to":"successor"}`)
+	res, err = api("POST", "/admin/users/departed/locks/transfer", "", testAdminUser, testAdminPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	var resp AdminTransferLocksResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("expected response body to be AdminTransferLocksResponse, got error: %s", err)
+	}
+	if resp != (AdminTransferLocksResponse{From: "departed", To: "successor", Transferred: 2}) {
+		t.Errorf("expected 2 locks to be transferred, got: %+v", resp)
+	}
+
+	if locks, err := testMetaStore.LocksByOwner("successor"); err != nil || len(locks) != 2 {
+		t.Errorf("expected successor to own the locks, got: %+v (%v)", locks, err)
+	}
+
+	res, err = api("POST", "/admin/users/departed/locks/transfer", "", testAdminUser, testAdminPass, bytes.NewBufferString(`{}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 400, "Missing user to transfer locks to")
+
+	res, err = api("GET", "/admin/users/departed/locks", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Errorf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminLocksCSV(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	lock := NewTestLock(randomLockId(), `reports/q1, "final".xlsx`, `Smith, "Jo"`)
+	if _, err := testMetaStore.AddLocks("csv-repo", lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	expected := []string{lock.Id, `csv-repo:reports/q1, "final".xlsx`, `Smith, "Jo"`, lock.LockedAt.UTC().Format(time.RFC3339)}
+
+	// Values that a spreadsheet would run as a formula are quoted
+	formula := NewTestLock(randomLockId(), "formula.xlsx", "=HYPERLINK(\"http://example.com\")")
+	if _, err := testMetaStore.AddLocks("csv-repo", formula); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	quoted := []string{formula.Id, "csv-repo:formula.xlsx", "'=HYPERLINK(\"http://example.com\")", formula.LockedAt.UTC().Format(time.RFC3339)}
+
+	for name, req := range map[string][2]string{
+		"format":     {"/admin/locks?format=csv", ""},
+		"accept":     {"/admin/locks", "text/csv"},
+		"preference": {"/admin/locks", "text/csv, application/json"},
+		"quality":    {"/admin/locks", "application/json;q=0.5, text/csv"},
+	} {
+		res, err := api("GET", req[0], req[1], testAdminUser, testAdminPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+			t.Fatalf("%s: expected CSV with status 200, got %d %q", name, res.StatusCode, res.Header.Get("Content-Type"))
+		}
+
+		records, err := csv.NewReader(res.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: expected the response to be CSV, got error: %s", name, err)
+		}
+		if len(records) == 0 || !reflect.DeepEqual(records[0], []string{"id", "path", "owner", "locked_at"}) {
+			t.Fatalf("%s: expected the CSV header, got: %q", name, records)
+		}
+		for _, row := range [][]string{expected, quoted} {
+			var found bool
+			for _, record := range records[1:] {
+				found = found || reflect.DeepEqual(record, row)
+			}
+			if !found {
+				t.Errorf("%s: expected a row for the lock %q, got: %q", name, row, records)
+			}
+		}
+	}
+
+	for _, accept := range []string{"", "application/json, text/csv", "text/csv;q=0.5, */*"} {
+		res, err := api("GET", "/admin/locks", accept, testAdminUser, testAdminPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		var list LockList
+		if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+			t.Fatalf("expected response body to be LockList for %q, got error: %s", accept, err)
+		}
+		if len(list.Locks) == 0 {
+			t.Errorf("expected the locks to be listed as JSON for %q", accept)
+		}
+	}
+}
+
+func TestAdminClearLocks(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	for _, path := range []string{"a.bin", "b.bin"} {
+		if _, err := createLockInRepo(testUser, testPass, "archived-repo", path); err != nil {
+			t.Fatalf("error creating lock: %s", err)
+		}
+	}
+	if _, err := createLockInRepo(testUser, testPass, "active-repo", "a.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	res, err := api("DELETE", "/admin/repos/archived-repo/locks", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var resp AdminClearLocksResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("expected response body to be AdminClearLocksResponse, got error: %s", err)
+	}
+	if resp.Repo != "archived-repo" || resp.Deleted != 2 {
+		t.Errorf("expected 2 locks to be deleted from archived-repo, got: %+v", resp)
+	}
+
+	if locks, err := testMetaStore.Locks("archived-repo"); err != nil || len(locks) != 0 {
+		t.Errorf("expected archived-repo to have no locks, got %d (%v)", len(locks), err)
+	}
+	if locks, err := testMetaStore.Locks("active-repo"); err != nil || len(locks) != 1 {
+		t.Errorf("expected active-repo to keep its lock, got %d (%v)", len(locks), err)
+	}
+
+	res, err = api("DELETE", "/admin/repos/archived-repo/locks", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminCompact(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	res, err := api("POST", "/admin/compact", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var result CompactResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatalf("expected response body to be a compact result, got error: %s", err)
+	}
+	if result.Before == 0 || result.After == 0 {
+		t.Errorf("expected database sizes to be reported, got: %+v", result)
+	}
+
+	if !testMetaStore.ValidateUser(testUser, testPass) {
+		t.Errorf("expected users to be kept")
+	}
+
+	res, err = api("POST", "/admin/compact", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminMultipleAdmins(t *testing.T) {
+	Config().Admins = "aragorn:elessar, legolas:greenleaf"
+	defer func() { Config().Admins = "" }()
+
+	res, err := api("GET", "/admin/users", "", "legolas", "greenleaf", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 for a listed admin, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/admin/users", "", "aragorn", "greenleaf", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403 for another admin's password, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminCredentials(t *testing.T) {
+	config := &Configuration{AdminUser: "gandalf", AdminPass: "mithrandir", Admins: "aragorn:elessar,broken,:nouser"}
+
+	admins := config.AdminCredentials()
+	if len(admins) != 2 {
+		t.Fatalf("expected 2 admins, got: %v", admins)
+	}
+	if admins["gandalf"] != "mithrandir" || admins["aragorn"] != "elessar" {
+		t.Errorf("expected admin passwords to match, got: %v", admins)
+	}
+}
+
+func adminDelete(path, username, password string) (*http.Response, error) {
+	req, err := http.NewRequest("DELETE", lfsServer.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(username, password)
+	return http.DefaultClient.Do(req)
+}
+
+func setupAdmin() {
+	Config().AdminUser = testAdminUser
+	Config().AdminPass = testAdminPass
+}
+
+func teardownAdmin() {
+	Config().AdminUser = ""
+	Config().AdminPass = ""
+}
+
+func TestAdminLockIntegrity(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	// A count for a user without locks is left over
+	err := testMetaStore.update(func(tx kvTx) error {
+		return putLockCount(tx.Bucket(lockCountsBucket), "integrity-user", 3)
+	})
+	if err != nil {
+		t.Fatalf("error storing lock count: %s", err)
+	}
+
+	res, err := api("GET", "/admin/locks/integrity", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var problems []LockInconsistency
+	if err := json.NewDecoder(res.Body).Decode(&problems); err != nil {
+		t.Fatalf("expected response body to be a list of inconsistencies, got error: %s", err)
+	}
+	found := false
+	for _, p := range problems {
+		if p.Problem == lockCountMismatch && p.Owner == "integrity-user" && p.Stored == 3 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the stale count to be reported, got: %+v", problems)
+	}
+
+	res, err = api("POST", "/admin/locks/integrity/repair", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var repair AdminRepairLocksResponse
+	if err := json.NewDecoder(res.Body).Decode(&repair); err != nil {
+		t.Fatalf("expected response body to be a repair result, got error: %s", err)
+	}
+	if repair.Repaired < 1 || len(repair.Inconsistencies) != 0 {
+		t.Errorf("expected the counts to be repaired, got: %+v", repair)
+	}
+
+	res, err = api("GET", "/admin/locks/integrity", "", testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminLockOverride(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	repo := "admin-override-repo"
+	lock, err := createLockInRepo(testUser1, testPass1, repo, "theirs.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	// Other users need force to rename the lock
+	res, err := api("POST", "/user/"+repo+"/locks/"+lock.Id+"/rename", metaMediaType, testUser, testPass, bytes.NewBufferString(`{"path":"moved.bin"}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 403, errNotOwner.Error())
+
+	res, err = api("POST", "/user/"+repo+"/locks/"+lock.Id+"/rename", metaMediaType, testAdminUser, testAdminPass, bytes.NewBufferString(`{"path":"moved.bin"}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected admin rename to succeed, got status %d", res.StatusCode)
+	}
+	var renamed LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&renamed); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if renamed.Lock == nil || renamed.Lock.Path != "moved.bin" || renamed.Lock.Owner.Name != testUser1 {
+		t.Errorf("expected the lock to move and keep its owner, got: %+v", renamed.Lock)
+	}
+
+	res, err = api("POST", "/user/"+repo+"/locks/"+lock.Id+"/unlock", metaMediaType, testAdminUser, testAdminPass, bytes.NewBufferString(`{}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected admin unlock to succeed, got status %d", res.StatusCode)
+	}
+
+	if _, err := createLockInRepo(testUser1, testPass1, repo, "theirs.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	res, err = api("DELETE", "/user/"+repo+"/locks?path=theirs.bin", metaMediaType, testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected admin unlock by path to succeed, got status %d", res.StatusCode)
+	}
+
+	if locks, err := testMetaStore.Locks(repo); err != nil || len(locks) != 0 {
+		t.Errorf("expected the admin to have removed every lock, got: %v (%v)", locks, err)
+	}
+}
+
+func TestAdminObjectsListingDisabled(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	for _, path := range []string{"/admin/objects", "/admin/export", "/mgmt/objects"} {
+		res, err := api("GET", path, "", testAdminUser, testAdminPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected %s to be listed, got status %d", path, res.StatusCode)
+		}
+	}
+
+	Config().ListObjects = "false"
+	defer func() { Config().ListObjects = "true" }()
+
+	for _, path := range []string{"/admin/objects", "/admin/export", "/mgmt/objects"} {
+		res, err := api("GET", path, "", testAdminUser, testAdminPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 404 {
+			t.Errorf("expected %s to be turned off with 404, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestAdminObjectsUploader(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	oid := "c3b2a19087f6e5d4c3b2a19087f6e5d4c3b2a19087f6e5d4c3b2a19087f6e5d4"
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":7}]}`, oid))
+	res, err := api("POST", "/user/uploader-repo/objects/batch", metaMediaType, testUser1, testPass1, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/admin/objects?min=7&max=7", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	var objects []AdminObjectResponse
+	if err := json.NewDecoder(res.Body).Decode(&objects); err != nil {
+		t.Fatalf("expected response body to be a list of objects, got error: %s", err)
+	}
+	for _, o := range objects {
+		if o.Oid != oid {
+			continue
+		}
+		if o.UploadedBy != testUser1 || o.CreatedAt == nil || o.CreatedAt.IsZero() {
+			t.Errorf("expected the uploader and creation time to be listed, got: %+v", o)
+		}
+		return
+	}
+	t.Errorf("expected the uploaded object to be listed, got: %+v", objects)
+}
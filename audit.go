@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry records a user force deleting a lock owned by someone else.
+type AuditEntry struct {
+	Actor     string    `json:"actor"`
+	Owner     string    `json:"owner"`
+	Repo      string    `json:"repo"`
+	LockId    string    `json:"lock_id"`
+	Path      string    `json:"path"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// recordAudit appends entry to the audit log. Keys are increasing numbers, so
+// entries are kept in the order they were written. The number follows the
+// last key rather than the bucket's sequence, which isn't kept by Compact.
+func recordAudit(tx kvTx, entry *AuditEntry) error {
+	bucket := tx.Bucket(auditBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	var seq uint64 = 1
+	if last, _ := bucket.Cursor().Last(); last != nil {
+		seq = binary.BigEndian.Uint64(last) + 1
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return bucket.Put(key, data)
+}
+
+// AuditLog returns up to limit of the most recent audit entries, newest
+// first. A limit of 0 returns every entry.
+func (s *MetaStore) AuditLog(limit int) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(auditBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if limit > 0 && len(entries) == limit {
+				break
+			}
+
+			var entry AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, &entry)
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditForceDelete(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	_, err := metaStoreTest.AddLocks(testRepo,
+		NewTestLock("own-lock", "own.bin", testUser),
+		NewTestLock("other-lock", "other.bin", testUser1))
+	if err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	// Deleting your own lock, even with force, isn't audited
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser, "own-lock", true, time.Time{}); err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+	if entries, err := metaStoreTest.AuditLog(0); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no audit entries, got: %v (%v)", entries, err)
+	}
+
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser, "other-lock", true, time.Time{}); err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+
+	entries, err := metaStoreTest.AuditLog(0)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got : %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry, got: %v", entries)
+	}
+	e := entries[0]
+	if e.Actor != testUser || e.Owner != testUser1 || e.Repo != testRepo || e.LockId != "other-lock" || e.Path != "other.bin" {
+		t.Errorf("expected entry for the force delete, got: %+v", e)
+	}
+	if e.DeletedAt.IsZero() {
+		t.Errorf("expected entry to have a timestamp")
+	}
+}
+
+func TestAuditLogNewestFirst(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for _, id := range []string{"lock-1", "lock-2", "lock-3"} {
+		if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(id, id+".bin", testUser1)); err != nil {
+			t.Fatalf("expected AddLocks to succeed, got : %s", err)
+		}
+		if _, err := metaStoreTest.DeleteLock(testRepo, testUser, id, true, time.Time{}); err != nil {
+			t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+		}
+	}
+
+	entries, err := metaStoreTest.AuditLog(2)
+	if err != nil {
+		t.Fatalf("expected AuditLog to succeed, got : %s", err)
+	}
+	if len(entries) != 2 || entries[0].LockId != "lock-3" || entries[1].LockId != "lock-2" {
+		t.Errorf("expected the 2 newest entries, got: %+v %+v", entries[0], entries[len(entries)-1])
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+// Authenticator validates user credentials.
+type Authenticator interface {
+	Validate(user, pass string) bool
+}
+
+// authChain tries each Authenticator in turn, accepting credentials as soon
+// as one of them does.
+type authChain []Authenticator
+
+func (c authChain) Validate(user, pass string) bool {
+	for _, a := range c {
+		if a.Validate(user, pass) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAuthenticator returns the Authenticators configured in Config, after
+// the local users.
+func newAuthenticator(local Authenticator) Authenticator {
+	chain := authChain{local}
+	if Config().IsUsingLDAP() {
+		chain = append(chain, NewLDAPAuthenticator(Config().LDAPURL, Config().LDAPUserDN, Config().LDAPCacheTTLDuration()))
+	}
+	return chain
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestBlake2b(t *testing.T) {
+	cases := map[string]string{
+		"":    "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce",
+		"abc": "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923",
+		// Exactly two blocks, the second is only compressed when summing
+		strings.Repeat("a", 256): "0eee13d0c73a2710c5015a8b4be0a16120bb88f826b662951ffe4b3b81441cfdce1f712c58e237dba72a0dad7f9c86b9745ea0b4b3b850ff3a260fb7df9d3e81",
+	}
+
+	for input, expected := range cases {
+		h := newBlake2b()
+		h.Write([]byte(input))
+		if got := hex.EncodeToString(h.Sum(nil)); got != expected {
+			t.Errorf("blake2b(%q) = %s, expected %s", input, got, expected)
+		}
+
+		// Writing a byte at a time gives the same digest
+		h.Reset()
+		for i := 0; i < len(input); i++ {
+			h.Write([]byte{input[i]})
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != expected {
+			t.Errorf("blake2b(%q) written bytewise = %s, expected %s", input, got, expected)
+		}
+	}
+}
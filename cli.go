@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+var errObjectListingDisabled = errors.New("Listing objects is turned off by LFS_LISTOBJECTS")
+
+// commands are the subcommands that list what's in the meta store instead of
+// starting the server.
+var commands = map[string]func(*MetaStore, io.Writer, bool) error{
+	"users":   listUsers,
+	"objects": listObjects,
+}
+
+// isCommand returns true if args name one of the listing subcommands.
+func isCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	_, ok := commands[args[0]]
+	return ok
+}
+
+// runCommand runs the subcommand in args against store, writing a table to
+// w, or JSON with the --json flag.
+func runCommand(store *MetaStore, w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("No command given")
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", args[0])
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(w)
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	return cmd(store, w, *asJSON)
+}
+
+func listUsers(store *MetaStore, w io.Writer, asJSON bool) error {
+	users, err := store.Users()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		resp := make([]*AdminUserResponse, 0, len(users))
+		for _, u := range users {
+			resp = append(resp, &AdminUserResponse{Name: u.Name, DisplayName: u.DisplayName})
+		}
+		return json.NewEncoder(w).Encode(resp)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDISPLAY NAME")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\n", u.Name, u.DisplayName)
+	}
+	return tw.Flush()
+}
+
+func listObjects(store *MetaStore, w io.Writer, asJSON bool) error {
+	if !Config().IsListingObjects() {
+		return errObjectListingDisabled
+	}
+
+	objects, err := store.Objects(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		resp := make([]*AdminObjectResponse, 0, len(objects))
+		for _, o := range objects {
+			resp = append(resp, newAdminObjectResponse(o))
+		}
+		return json.NewEncoder(w).Encode(resp)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OID\tSIZE")
+	for _, o := range objects {
+		fmt.Fprintf(tw, "%s\t%d\n", o.Oid, o.Size)
+	}
+	return tw.Flush()
+}
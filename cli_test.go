@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestListUsersJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := runCommand(testMetaStore, &buf, []string{"users", "--json"}); err != nil {
+		t.Fatalf("error running command: %s", err)
+	}
+
+	var users []*AdminUserResponse
+	if err := json.Unmarshal(buf.Bytes(), &users); err != nil {
+		t.Fatalf("expected valid JSON, got %q: %s", buf.String(), err)
+	}
+
+	found := false
+	for _, u := range users {
+		if u.Name == testUser {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected %s in users, got %v", testUser, users)
+	}
+}
+
+func TestListObjectsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := runCommand(testMetaStore, &buf, []string{"objects", "--json"}); err != nil {
+		t.Fatalf("error running command: %s", err)
+	}
+
+	var objects []*AdminObjectResponse
+	if err := json.Unmarshal(buf.Bytes(), &objects); err != nil {
+		t.Fatalf("expected valid JSON, got %q: %s", buf.String(), err)
+	}
+
+	found := false
+	for _, o := range objects {
+		if o.Oid == contentOid {
+			found = true
+			if o.Size != contentSize {
+				t.Errorf("expected size %d, got %d", contentSize, o.Size)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected %s in objects, got %v", contentOid, objects)
+	}
+}
+
+func TestListObjectsTable(t *testing.T) {
+	var buf bytes.Buffer
+	if err := runCommand(testMetaStore, &buf, []string{"objects"}); err != nil {
+		t.Fatalf("error running command: %s", err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "OID") || !strings.Contains(buf.String(), contentOid) {
+		t.Errorf("expected a table of objects, got %q", buf.String())
+	}
+}
+
+func TestRunCommandUnknown(t *testing.T) {
+	if isCommand([]string{"frobnicate"}) {
+		t.Errorf("expected frobnicate not to be a command")
+	}
+	if err := runCommand(testMetaStore, &bytes.Buffer{}, []string{"frobnicate"}); err == nil {
+		t.Errorf("expected an error for an unknown command")
+	}
+}
+
+func TestListObjectsDisabled(t *testing.T) {
+	Config().ListObjects = "false"
+	defer func() { Config().ListObjects = "true" }()
+
+	var buf bytes.Buffer
+	if err := runCommand(testMetaStore, &buf, []string{"objects", "--json"}); err != errObjectListingDisabled {
+		t.Errorf("expected errObjectListingDisabled, got: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output, got %q", buf.String())
+	}
+}
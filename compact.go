@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+var errNotCompactable = errors.New("In-memory meta stores can't be compacted")
+
+// CompactResult reports the size of the database file before and after
+// compacting it.
+type CompactResult struct {
+	Before int64 `json:"before"`
+	After  int64 `json:"after"`
+}
+
+// Compact copies the meta store into a new database file and swaps it in
+// place of the old one, so that space freed by deletes is given back to the
+// OS. Other transactions wait until the copy is done.
+func (s *MetaStore) Compact() (*CompactResult, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+	if s.mem != nil {
+		return nil, errNotCompactable
+	}
+
+	s.swap.Lock()
+	defer s.swap.Unlock()
+
+	path := s.db.Path()
+	before, err := fileSize(path)
+	if err != nil {
+		return nil, err
+	}
+
+	compacted := path + ".compact"
+	if err := copyDB(s.db, compacted); err != nil {
+		os.Remove(compacted)
+		return nil, err
+	}
+
+	s.db.Close()
+	if err := os.Rename(compacted, path); err != nil {
+		os.Remove(compacted)
+		if db, openErr := openDB(path); openErr == nil {
+			s.db = db
+		}
+		return nil, err
+	}
+
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+
+	after, err := fileSize(path)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Log(kv{"fn": "Compact", "before": before, "after": after})
+	return &CompactResult{Before: before, After: after}, nil
+}
+
+// copyDB writes every bucket in src to a new database at path.
+func copyDB(src *bolt.DB, path string) error {
+	dst, err := bolt.Open(path, Config().MetaDBFileMode(), nil)
+	if err != nil {
+		return err
+	}
+
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				bucket, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(bucket, b)
+			})
+		})
+	})
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyBucket copies the keys and nested buckets of src into dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	metaStoreTest.db.NoSync = true
+	var oids []string
+	for i := 0; i < 2000; i++ {
+		oid := fmt.Sprintf("%064x", i)
+		if _, err := metaStoreTest.Put(&RequestVars{Oid: oid, Size: 42}); err != nil {
+			t.Fatalf("error adding object: %s", err)
+		}
+		oids = append(oids, oid)
+	}
+	for _, oid := range oids {
+		if err := metaStoreTest.Delete(&RequestVars{Oid: oid}); err != nil {
+			t.Fatalf("error deleting object: %s", err)
+		}
+	}
+
+	result, err := metaStoreTest.Compact()
+	if err != nil {
+		t.Fatalf("expected Compact to succeed, got: %s", err)
+	}
+	if result.After >= result.Before {
+		t.Errorf("expected the database to shrink, got: %+v", result)
+	}
+
+	size, err := fileSize("test-meta-store.db")
+	if err != nil {
+		t.Fatalf("error reading database size: %s", err)
+	}
+	if size != result.After {
+		t.Errorf("expected the compacted database to be in place, got size %d, expected: %d", size, result.After)
+	}
+
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: contentOid}); err != nil {
+		t.Errorf("expected objects to be kept, got: %s", err)
+	}
+	if !metaStoreTest.ValidateUser(testUser, testPass) {
+		t.Errorf("expected users to be kept")
+	}
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Errorf("expected the compacted database to be writable, got: %s", err)
+	}
+}
+
+func TestCompactReadOnly(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().ReadOnly = "true"
+	defer func() { Config().ReadOnly = "false" }()
+
+	if _, err := metaStoreTest.Compact(); err != errReadOnly {
+		t.Errorf("expected Compact to fail with errReadOnly, got: %v", err)
+	}
+}
@@ -2,76 +2,710 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
 	"os"
-	"reflect"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Configuration holds application configuration. Values will be pulled from
 // environment variables, prefixed by keyPrefix. Default values can be added
 // via tags.
 type Configuration struct {
-	Listen      string `config:"tcp://:8080"`
-	Host        string `config:"localhost:8080"`
-	MetaDB      string `config:"lfs.db"`
-	ContentPath string `config:"lfs-content"`
-	AdminUser   string `config:""`
-	AdminPass   string `config:""`
-	Cert        string `config:""`
-	Key         string `config:""`
-	Scheme      string `config:"http"`
-	Public      string `config:"public"`
-	UseTus      string `config:"false"`
-	TusHost     string `config:"localhost:1080"`
+	Listen             string `config:"tcp://:8080"`
+	Host               string `config:"localhost:8080"`
+	ExternalURL        string `config:""`
+	MetaDB             string `config:"lfs.db"`
+	ContentPath        string `config:"lfs-content"`
+	ContentShardDepth  string `config:"2"`
+	AdminUser          string `config:""`
+	AdminPass          string `config:""`
+	Admins             string `config:""`
+	Cert               string `config:""`
+	Key                string `config:""`
+	Scheme             string `config:"http"`
+	Public             string `config:"public"`
+	PublicRead         string `config:"false"`
+	AuthRealm          string `config:"git-lfs-server"`
+	ListObjects        string `config:"true"`
+	RequireKnownRepo   string `config:"false"`
+	KnownRepos         string `config:""`
+	LockPathAllow      string `config:""`
+	LockPathDeny       string `config:""`
+	UseTus             string `config:"false"`
+	TusHost            string `config:"localhost:1080"`
+	LogFormat          string `config:"text"`
+	NormalizeLockPaths string `config:"false"`
+	ReLockOwnIsSuccess string `config:"false"`
+	EnforceLocks       string `config:"false"`
+	Metrics            string `config:"false"`
+	ReadOnly           string `config:"false"`
+	UserQuota          string `config:"0"`
+	MaxObjectSize      string `config:"0"`
+	MaxLockRequestSize string `config:"65536"`
+	MaxRepoLocks       string `config:"0"`
+	MaxUserLocks       string `config:"0"`
+	MaxLockPathLength  string `config:"4096"`
+	MetaDBTimeout      string `config:"1s"`
+	MetaDBMode         string `config:"0600"`
+	MetaDBDirMode      string `config:"0700"`
+	MetaDBSync         string `config:"full"`
+	RateLimit          string `config:"0"`
+	RateBurst          string `config:"0"`
+	SoftDelete         string `config:"false"`
+	DeleteContent      string `config:"false"`
+	TombstoneMaxAge    string `config:"168h"`
+	ContentStore       string `config:"file"`
+	S3Bucket           string `config:""`
+	S3Region           string `config:"us-east-1"`
+	S3Endpoint         string `config:""`
+	S3Prefix           string `config:""`
+	S3AccessKey        string `config:""`
+	S3SecretKey        string `config:""`
+	S3Timeout          string `config:"1m"`
+	ShutdownTimeout    string `config:"30s"`
+	ScanTimeout        string `config:"0s"`
+	IdempotencyTTL     string `config:"10m"`
+	LockIdFormat       string `config:"hex"`
+	LDAPURL            string `config:""`
+	LDAPUserDN         string `config:""`
+	LDAPCacheTTL       string `config:"1m"`
+	CORSOrigins        string `config:""`
+	WebhookURL         string `config:""`
+	WebhookSecret      string `config:""`
+	CursorSecret       string `config:""`
+	TokenSecret        string `config:""`
+	TokenTTL           string `config:"5m"`
+	ConfigFile         string `config:""`
 }
 
 func (c *Configuration) IsHTTPS() bool {
-	return strings.Contains(Config.Scheme, "https")
+	return strings.Contains(c.Scheme, "https")
+}
+
+// BaseURL returns the URL links to the server are made from when neither
+// ExternalURL nor a proxy gives one: Scheme and Host.
+func (c *Configuration) BaseURL() string {
+	if c.IsHTTPS() {
+		return fmt.Sprintf("%s://%s", c.Scheme, c.Host)
+	}
+	return fmt.Sprintf("http://%s", c.Host)
 }
 
 func (c *Configuration) IsPublic() bool {
-	switch Config.Public {
-	case "1", "true", "TRUE":
-		return true
+	return isTrue(c.Public)
+}
+
+// IsPublicRead returns true if downloads and lock listings are allowed
+// without authentication, while writes still require it.
+func (c *Configuration) IsPublicRead() bool {
+	return isTrue(c.PublicRead)
+}
+
+// IsListingObjects returns true if admins may list every object in the
+// store. Shared servers can turn this off so the oids of all tenants can't be
+// listed.
+func (c *Configuration) IsListingObjects() bool {
+	return isTrue(c.ListObjects)
+}
+
+// IsRequiringKnownRepo returns true if locks may only be used in the repos
+// listed in KnownRepos.
+func (c *Configuration) IsRequiringKnownRepo() bool {
+	return isTrue(c.RequireKnownRepo)
+}
+
+// IsKnownRepo returns true if "user/repo" is in KnownRepos, a comma separated
+// list of repos.
+func (c *Configuration) IsKnownRepo(user, repo string) bool {
+	name := user + "/" + repo
+	for _, known := range strings.Split(c.KnownRepos, ",") {
+		if strings.TrimSpace(known) == name {
+			return true
+		}
 	}
 	return false
 }
 
-func (c *Configuration) IsUsingTus() bool {
-	switch Config.UseTus {
-	case "1", "true", "TRUE":
-		return true
+// IsLockPathAllowed returns true if a cleaned lock path may be locked. Paths
+// matching a pattern in LockPathDeny are refused. Otherwise, if LockPathAllow
+// is set, the path must match one of its patterns. Both are comma separated
+// lists of path.Match patterns, where a "**" segment matches any number of
+// directories.
+func (c *Configuration) IsLockPathAllowed(p string) bool {
+	if c.IsNormalizingLockPaths() {
+		p = strings.ToLower(p)
+	}
+	if matchesLockPattern(c.LockPathDeny, p, c.IsNormalizingLockPaths()) {
+		return false
+	}
+	return strings.TrimSpace(c.LockPathAllow) == "" || matchesLockPattern(c.LockPathAllow, p, c.IsNormalizingLockPaths())
+}
+
+// matchesLockPattern returns true if p matches one of the comma separated
+// patterns, lowercasing them first if fold is set.
+func matchesLockPattern(patterns, p string, fold bool) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if fold {
+			pattern = strings.ToLower(pattern)
+		}
+		if matchPathSegments(strings.Split(pattern, "/"), strings.Split(p, "/")) {
+			return true
+		}
 	}
 	return false
 }
 
-// Config is the global app configuration
-var Config = &Configuration{}
+// matchPathSegments matches the segments of a path against those of a
+// pattern, with path.Match for each segment and "**" for any number of them.
+func matchPathSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchPathSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
 
-const keyPrefix = "LFS"
+func (c *Configuration) IsUsingTus() bool {
+	return isTrue(c.UseTus)
+}
 
-func init() {
-	te := reflect.TypeOf(Config).Elem()
-	ve := reflect.ValueOf(Config).Elem()
+func (c *Configuration) IsLoggingJSON() bool {
+	return c.LogFormat == "json"
+}
+
+// IsLoggingCombined returns true if requests are logged in the Combined Log
+// Format used by Apache. Other log entries are written as text.
+func (c *Configuration) IsLoggingCombined() bool {
+	return c.LogFormat == "combined"
+}
+
+// IsUsingUUIDLockIds returns true if new locks are given random UUIDs as ids
+// rather than 40 hex digits.
+func (c *Configuration) IsUsingUUIDLockIds() bool {
+	return c.LockIdFormat == "uuid"
+}
+
+func (c *Configuration) IsNormalizingLockPaths() bool {
+	return isTrue(c.NormalizeLockPaths)
+}
+
+// IsReLockOwnSuccess returns true if locking a path the requester has already
+// locked answers with their existing lock instead of a conflict.
+func (c *Configuration) IsReLockOwnSuccess() bool {
+	return isTrue(c.ReLockOwnIsSuccess)
+}
+
+// IsEnforcingLocks returns true if uploads for a path locked by another user
+// are rejected. Uploads must then name their path, so that it can be checked.
+func (c *Configuration) IsEnforcingLocks() bool {
+	return isTrue(c.EnforceLocks)
+}
+
+func (c *Configuration) IsMetricsEnabled() bool {
+	return isTrue(c.Metrics)
+}
+
+func (c *Configuration) IsReadOnly() bool {
+	return isTrue(c.ReadOnly)
+}
+
+// UserQuotaBytes returns the maximum number of bytes each user may store, or 0
+// if storage is unlimited.
+func (c *Configuration) UserQuotaBytes() int64 {
+	quota, err := strconv.ParseInt(c.UserQuota, 10, 64)
+	if err != nil || quota < 0 {
+		return 0
+	}
+	return quota
+}
 
-	for i := 0; i < te.NumField(); i++ {
-		sf := te.Field(i)
-		name := sf.Name
-		field := ve.FieldByName(name)
+// MaxObjectBytes returns the maximum size in bytes of an object that can be
+// uploaded, or 0 if object size is unlimited.
+func (c *Configuration) MaxObjectBytes() int64 {
+	size, err := strconv.ParseInt(c.MaxObjectSize, 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// ShardDepth returns how many levels of directories, each named by the next
+// two characters of the oid, objects are stored under in the content path.
+func (c *Configuration) ShardDepth() int {
+	depth, err := strconv.Atoi(c.ContentShardDepth)
+	if err != nil || depth < 0 || depth > maxShardDepth {
+		return defaultShardDepth
+	}
+	return depth
+}
+
+// MaxLockRequestBytes returns the maximum size in bytes of the JSON body of a
+// lock request, or 0 if it's unlimited.
+func (c *Configuration) MaxLockRequestBytes() int64 {
+	size, err := strconv.ParseInt(c.MaxLockRequestSize, 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// RepoLockLimit returns the maximum number of locks in a repo, or 0 if the
+// number of locks is unlimited.
+func (c *Configuration) RepoLockLimit() int {
+	limit, err := strconv.Atoi(c.MaxRepoLocks)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// LockPathLimit returns the most bytes a lock path may have, or 0 if lock
+// paths may be any length.
+func (c *Configuration) LockPathLimit() int {
+	limit, err := strconv.Atoi(c.MaxLockPathLength)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
 
-		envVar := strings.ToUpper(fmt.Sprintf("%s_%s", keyPrefix, name))
-		env := os.Getenv(envVar)
-		tag := sf.Tag.Get("config")
+// UserLockLimit returns the maximum number of locks each user may hold across
+// all repos, or 0 if the number of locks is unlimited.
+func (c *Configuration) UserLockLimit() int {
+	limit, err := strconv.Atoi(c.MaxUserLocks)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
 
-		if env == "" && tag != "" {
-			env = tag
+// AdminCredentials returns the passwords of all admin accounts, keyed by user
+// name. These are AdminUser/AdminPass plus any "user:pass" pairs listed in
+// Admins, separated by commas.
+func (c *Configuration) AdminCredentials() map[string]string {
+	admins := make(map[string]string)
+	if c.AdminUser != "" && c.AdminPass != "" {
+		admins[c.AdminUser] = c.AdminPass
+	}
+
+	for _, pair := range strings.Split(c.Admins, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			admins[parts[0]] = parts[1]
 		}
+	}
+	return admins
+}
+
+// HasAdmins returns true if at least one admin account is configured.
+func (c *Configuration) HasAdmins() bool {
+	return len(c.AdminCredentials()) > 0
+}
+
+// MetaDBFileMode returns the permissions the meta store database file is
+// created with, from MetaDBMode in octal.
+func (c *Configuration) MetaDBFileMode() os.FileMode {
+	return parseFileMode(c.MetaDBMode, 0600)
+}
+
+// MetaDBDirFileMode returns the permissions a missing meta store directory is
+// created with, from MetaDBDirMode in octal.
+func (c *Configuration) MetaDBDirFileMode() os.FileMode {
+	return parseFileMode(c.MetaDBDirMode, 0700)
+}
 
-		field.SetString(env)
+// parseFileMode parses v as octal permissions, returning def if v isn't
+// valid.
+func parseFileMode(v string, def os.FileMode) os.FileMode {
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0777 {
+		return def
 	}
+	return os.FileMode(mode)
+}
 
-	if port := os.Getenv("PORT"); port != "" {
-		// If $PORT is set, override LFS_LISTEN. This is useful for deploying to Heroku.
-		Config.Listen = "tcp://:" + port
+// MetaDBTimeoutDuration returns how long to wait for the lock on the meta
+// store database when opening it.
+func (c *Configuration) MetaDBTimeoutDuration() time.Duration {
+	timeout, err := time.ParseDuration(c.MetaDBTimeout)
+	if err != nil || timeout <= 0 {
+		return 1 * time.Second
 	}
+	return timeout
+}
+
+// MetaDBNoSync returns true if the meta store database isn't synced to disk
+// when transactions commit, with Config.MetaDBSync "none". A crash can then
+// lose or corrupt recent changes.
+func (c *Configuration) MetaDBNoSync() bool {
+	return c.MetaDBSync == "none"
+}
+
+func (c *Configuration) IsSoftDeleting() bool {
+	return isTrue(c.SoftDelete)
+}
+
+// IsDeletingContent returns true if deleting the last reference to an object
+// also removes its content. Soft deleted objects keep their content until they
+// are purged.
+func (c *Configuration) IsDeletingContent() bool {
+	return isTrue(c.DeleteContent)
+}
+
+// TombstoneMaxAgeDuration returns how long soft deleted objects are kept
+// before being purged.
+func (c *Configuration) TombstoneMaxAgeDuration() time.Duration {
+	age, err := time.ParseDuration(c.TombstoneMaxAge)
+	if err != nil || age < 0 {
+		return 168 * time.Hour
+	}
+	return age
+}
+
+func (c *Configuration) IsUsingS3() bool {
+	return c.ContentStore == "s3"
+}
+
+// S3EndpointURL returns the base URL of the S3 service, defaulting to AWS
+// in Config.S3Region.
+func (c *Configuration) S3EndpointURL() string {
+	if c.S3Endpoint != "" {
+		return strings.TrimSuffix(c.S3Endpoint, "/")
+	}
+	return fmt.Sprintf("https://s3.%s.amazonaws.com", c.S3Region)
+}
+
+// S3TimeoutDuration returns how long an S3 request may take to connect and
+// to start responding. The transfer of the content itself isn't limited.
+func (c *Configuration) S3TimeoutDuration() time.Duration {
+	timeout, err := time.ParseDuration(c.S3Timeout)
+	if err != nil || timeout <= 0 {
+		return time.Minute
+	}
+	return timeout
+}
+
+// ShutdownTimeoutDuration returns how long to wait for requests in progress
+// to finish when shutting down.
+func (c *Configuration) ShutdownTimeoutDuration() time.Duration {
+	timeout, err := time.ParseDuration(c.ShutdownTimeout)
+	if err != nil || timeout < 0 {
+		return 30 * time.Second
+	}
+	return timeout
+}
+
+// ScanTimeoutDuration returns how long a request may spend listing objects or
+// locks, or 0 for no limit.
+func (c *Configuration) ScanTimeoutDuration() time.Duration {
+	timeout, err := time.ParseDuration(c.ScanTimeout)
+	if err != nil || timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
+// IdempotencyTTLDuration returns how long the Idempotency-Key of a lock
+// create is remembered, or 0 to not remember keys.
+func (c *Configuration) IdempotencyTTLDuration() time.Duration {
+	ttl, err := time.ParseDuration(c.IdempotencyTTL)
+	if err != nil || ttl < 0 {
+		return 10 * time.Minute
+	}
+	return ttl
+}
+
+// TokenTTLDuration returns how long the tokens issued by /authenticate are
+// valid.
+func (c *Configuration) TokenTTLDuration() time.Duration {
+	ttl, err := time.ParseDuration(c.TokenTTL)
+	if err != nil || ttl <= 0 {
+		return 5 * time.Minute
+	}
+	return ttl
+}
+
+func (c *Configuration) IsUsingLDAP() bool {
+	return c.LDAPURL != "" && c.LDAPUserDN != ""
+}
+
+// LDAPCacheTTLDuration returns how long successful LDAP binds are cached.
+func (c *Configuration) LDAPCacheTTLDuration() time.Duration {
+	ttl, err := time.ParseDuration(c.LDAPCacheTTL)
+	if err != nil || ttl < 0 {
+		return time.Minute
+	}
+	return ttl
+}
+
+// CORSAllowOrigin returns the Access-Control-Allow-Origin value for requests
+// from origin, and false if the origin isn't in CORSOrigins. CORSOrigins is a
+// comma separated list of origins, or "*" to allow any origin.
+func (c *Configuration) CORSAllowOrigin(origin string) (string, bool) {
+	for _, allowed := range strings.Split(c.CORSOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			return "*", true
+		}
+		if allowed != "" && allowed == origin {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// RateLimitRate returns the number of requests per second each client may
+// make, or 0 if requests are not rate limited.
+func (c *Configuration) RateLimitRate() float64 {
+	rate, err := strconv.ParseFloat(c.RateLimit, 64)
+	if err != nil || rate < 0 {
+		return 0
+	}
+	return rate
+}
+
+// RateLimitBurst returns how many requests a client may make at once. It
+// defaults to the rate limit, and is always at least 1.
+func (c *Configuration) RateLimitBurst() float64 {
+	burst, err := strconv.ParseFloat(c.RateBurst, 64)
+	if err != nil || burst <= 0 {
+		burst = c.RateLimitRate()
+	}
+	return math.Max(burst, 1)
+}
+
+// ConfigError lists every problem found when validating the configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "Invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the configuration for missing, conflicting or malformed
+// options and that the meta store directory is writable. All problems are
+// reported together in a *ConfigError.
+func (c *Configuration) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if (c.AdminUser == "") != (c.AdminPass == "") {
+		add("LFS_ADMINUSER and LFS_ADMINPASS must be set together")
+	}
+	for _, pair := range strings.Split(c.Admins, ",") {
+		pair = strings.TrimSpace(pair)
+		if parts := strings.SplitN(pair, ":", 2); pair != "" && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+			add("LFS_ADMINS entry %q is not a user:pass pair", pair)
+		}
+	}
+
+	if c.ExternalURL != "" {
+		if u, err := url.Parse(c.ExternalURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("LFS_EXTERNALURL must be an http or https URL, got %q", c.ExternalURL)
+		}
+	}
+
+	if c.IsHTTPS() && (c.Cert == "" || c.Key == "") {
+		add("LFS_CERT and LFS_KEY must be set when LFS_SCHEME is https")
+	}
+
+	switch c.ContentStore {
+	case "file", "s3":
+	default:
+		add("LFS_CONTENTSTORE must be \"file\" or \"s3\", got %q", c.ContentStore)
+	}
+	if c.IsUsingS3() && c.S3Bucket == "" {
+		add("%s", errNoS3Bucket)
+	}
+	if (c.S3AccessKey == "") != (c.S3SecretKey == "") {
+		add("LFS_S3ACCESSKEY and LFS_S3SECRETKEY must be set together")
+	}
+
+	if (c.LDAPURL == "") != (c.LDAPUserDN == "") {
+		add("LFS_LDAPURL and LFS_LDAPUSERDN must be set together")
+	}
+	if c.WebhookSecret != "" && c.WebhookURL == "" {
+		add("LFS_WEBHOOKSECRET is set without LFS_WEBHOOKURL")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" && c.LogFormat != "combined" {
+		add("LFS_LOGFORMAT must be \"text\", \"json\" or \"combined\", got %q", c.LogFormat)
+	}
+	if c.LockIdFormat != "hex" && c.LockIdFormat != "uuid" {
+		add("LFS_LOCKIDFORMAT must be \"hex\" or \"uuid\", got %q", c.LockIdFormat)
+	}
+
+	if depth, err := strconv.Atoi(c.ContentShardDepth); err != nil || depth < 0 || depth > maxShardDepth {
+		add("LFS_CONTENTSHARDDEPTH must be a whole number from 0 to %d, got %q", maxShardDepth, c.ContentShardDepth)
+	}
+
+	numbers := []struct{ name, value string }{
+		{"LFS_USERQUOTA", c.UserQuota},
+		{"LFS_MAXOBJECTSIZE", c.MaxObjectSize},
+		{"LFS_MAXLOCKREQUESTSIZE", c.MaxLockRequestSize},
+		{"LFS_MAXREPOLOCKS", c.MaxRepoLocks},
+		{"LFS_MAXUSERLOCKS", c.MaxUserLocks},
+		{"LFS_MAXLOCKPATHLENGTH", c.MaxLockPathLength},
+		{"LFS_RATELIMIT", c.RateLimit},
+		{"LFS_RATEBURST", c.RateBurst},
+	}
+	for _, n := range numbers {
+		if v, err := strconv.ParseFloat(n.value, 64); err != nil || v < 0 {
+			add("%s must be a number of at least 0, got %q", n.name, n.value)
+		}
+	}
+
+	durations := []struct{ name, value string }{
+		{"LFS_METADBTIMEOUT", c.MetaDBTimeout},
+		{"LFS_TOMBSTONEMAXAGE", c.TombstoneMaxAge},
+		{"LFS_SHUTDOWNTIMEOUT", c.ShutdownTimeout},
+		{"LFS_SCANTIMEOUT", c.ScanTimeout},
+		{"LFS_S3TIMEOUT", c.S3Timeout},
+		{"LFS_IDEMPOTENCYTTL", c.IdempotencyTTL},
+		{"LFS_LDAPCACHETTL", c.LDAPCacheTTL},
+		{"LFS_TOKENTTL", c.TokenTTL},
+	}
+	for _, d := range durations {
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			add("%s must be a duration such as \"30s\", got %q", d.name, d.value)
+		}
+	}
+
+	modes := []struct{ name, value string }{
+		{"LFS_METADBMODE", c.MetaDBMode},
+		{"LFS_METADBDIRMODE", c.MetaDBDirMode},
+	}
+	for _, m := range modes {
+		if v, err := strconv.ParseUint(m.value, 8, 32); err != nil || v > 0777 {
+			add("%s must be octal permissions such as \"0600\", got %q", m.name, m.value)
+		}
+	}
+
+	for _, list := range []struct{ name, value string }{{"LFS_LOCKPATHALLOW", c.LockPathAllow}, {"LFS_LOCKPATHDENY", c.LockPathDeny}} {
+		for _, pattern := range strings.Split(list.value, ",") {
+			if _, err := path.Match(strings.TrimSpace(pattern), ""); err != nil {
+				add("%s has an invalid pattern %q", list.name, strings.TrimSpace(pattern))
+			}
+		}
+	}
+
+	if c.MetaDBSync != "full" && c.MetaDBSync != "none" {
+		add("LFS_METADBSYNC must be \"full\" or \"none\", got %q", c.MetaDBSync)
+	}
+
+	if c.MetaDB != memoryMetaDB {
+		if info, err := os.Stat(c.MetaDB); err == nil && info.IsDir() {
+			add("LFS_METADB is a directory, it must name the database file: %s", c.MetaDB)
+		} else if err := checkWritableDir(existingParent(filepath.Dir(c.MetaDB))); err != nil {
+			add("LFS_METADB directory is not writable: %s", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// Warnings returns settings that are valid but probably not intended.
+func (c *Configuration) Warnings() []string {
+	var warnings []string
+	if c.IsPublic() && !c.IsHTTPS() {
+		warnings = append(warnings, "Running public without TLS, anyone on the network can read and write content")
+	}
+	if c.IsPublic() && c.HasAdmins() {
+		warnings = append(warnings, "LFS_PUBLIC is set with admin accounts, only the admin interface requires a login and anyone can read and write content and locks")
+	}
+	if !c.IsHTTPS() && (c.Cert != "" || c.Key != "") {
+		warnings = append(warnings, "LFS_CERT and LFS_KEY are only used when LFS_SCHEME is https, serving plain HTTP")
+	}
+	if c.IsRequiringKnownRepo() && strings.TrimSpace(c.KnownRepos) == "" {
+		warnings = append(warnings, "LFS_REQUIREKNOWNREPO is set without any LFS_KNOWNREPOS, every lock request will be refused")
+	}
+	if c.MetaDBNoSync() && c.MetaDB != memoryMetaDB {
+		warnings = append(warnings, "LFS_METADBSYNC is \"none\", the meta store isn't synced to disk and a crash can lose or corrupt recent changes")
+	}
+	return warnings
+}
+
+// existingParent returns dir, or its closest parent that exists when dir is
+// missing and would have to be created.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// checkWritableDir returns an error if files can't be created in dir.
+func checkWritableDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".lfs-write-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func isTrue(v string) bool {
+	switch v {
+	case "1", "true", "TRUE":
+		return true
+	}
+	return false
+}
+
+// currentConfig holds the *Configuration returned by Config.
+var currentConfig atomic.Value
+
+// Config returns the global app configuration. It is never changed in place:
+// setConfig publishes a new one instead, so that it can be read without
+// locking while the configuration is reloaded.
+func Config() *Configuration {
+	return currentConfig.Load().(*Configuration)
+}
+
+// setConfig makes c the global app configuration.
+func setConfig(c *Configuration) {
+	currentConfig.Store(c)
+}
+
+const keyPrefix = "LFS"
+
+func init() {
+	c := &Configuration{}
+	loadConfig(c, os.Getenv)
+	setConfig(c)
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloadableOptions are the Configuration fields ReloadConfig changes. Other
+// options only take effect on a restart.
+var reloadableOptions = map[string]bool{
+	"AdminUser": true,
+	"AdminPass": true,
+	"Admins":    true,
+	"RateLimit": true,
+	"RateBurst": true,
+	"ReadOnly":  true,
+	"LogFormat": true,
+}
+
+// reloadMu keeps reloads from overwriting each other's changes.
+var reloadMu sync.Mutex
+
+// loadConfig sets every option of c from the variables lookup returns,
+// falling back to each option's default.
+func loadConfig(c *Configuration, lookup func(name string) string) {
+	te := reflect.TypeOf(c).Elem()
+	ve := reflect.ValueOf(c).Elem()
+
+	for i := 0; i < te.NumField(); i++ {
+		sf := te.Field(i)
+		envVar := strings.ToUpper(fmt.Sprintf("%s_%s", keyPrefix, sf.Name))
+		env := lookup(envVar)
+		tag := sf.Tag.Get("config")
+
+		if env == "" && tag != "" {
+			env = tag
+		}
+
+		ve.Field(i).SetString(env)
+	}
+
+	if port := lookup("PORT"); port != "" {
+		// If $PORT is set, override LFS_LISTEN. This is useful for deploying to Heroku.
+		c.Listen = "tcp://:" + port
+	}
+
+	if lookup(keyPrefix+"_SCHEME") == "" && c.Cert != "" && c.Key != "" {
+		// A certificate and key are there to serve TLS with
+		c.Scheme = "https"
+	}
+}
+
+// readConfigFile reads the LFS_<NAME>=value lines of a config file. Blank
+// lines and lines starting with # are skipped.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 || !strings.HasPrefix(line, keyPrefix+"_") {
+			return nil, fmt.Errorf("%s:%d: expected LFS_<NAME>=value", path, n)
+		}
+		values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return values, scanner.Err()
+}
+
+// loadConfiguration returns the configuration given by the environment, with
+// the options in the config file at path, if there is one, taking precedence.
+func loadConfiguration(path string) (*Configuration, error) {
+	values := make(map[string]string)
+	if path != "" {
+		var err error
+		if values, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Configuration{}
+	loadConfig(c, func(name string) string {
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	})
+	c.ConfigFile = path
+	return c, nil
+}
+
+// ReloadConfig reads the environment and Config().ConfigFile again,
+// publishing a copy of the configuration with the reloadableOptions that
+// changed. Requests already being served may see the new options from then
+// on. The options that changed but can't be reloaded are returned as
+// environment variable names. Nothing is changed if the new configuration is
+// invalid.
+func ReloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fresh, err := loadConfiguration(Config().ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := fresh.Validate(); err != nil {
+		return nil, err
+	}
+
+	reloaded := *Config()
+	var ignored []string
+	te := reflect.TypeOf(reloaded)
+	current, next := reflect.ValueOf(&reloaded).Elem(), reflect.ValueOf(fresh).Elem()
+	for i := 0; i < te.NumField(); i++ {
+		if current.Field(i).String() == next.Field(i).String() {
+			continue
+		}
+
+		name := te.Field(i).Name
+		if !reloadableOptions[name] {
+			ignored = append(ignored, strings.ToUpper(keyPrefix+"_"+name))
+			continue
+		}
+		current.Field(i).SetString(next.Field(i).String())
+	}
+	setConfig(&reloaded)
+
+	sort.Strings(ignored)
+	return ignored, nil
+}
+
+// reloadOnHangup reloads the configuration, and the certificate when certs
+// isn't nil, each time the process gets a SIGHUP. The returned function stops
+// listening for the signal.
+func reloadOnHangup(certs *certReloader) func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					logger.Log(kv{"fn": "reload", "err": "Could not reload certificate: " + err.Error()})
+				} else {
+					logger.Log(kv{"fn": "reload", "msg": "reloaded certificate"})
+				}
+			}
+
+			ignored, err := ReloadConfig()
+			if err != nil {
+				logger.Log(kv{"fn": "reload", "err": "Could not reload configuration: " + err.Error()})
+				continue
+			}
+			for _, name := range ignored {
+				logger.Log(kv{"fn": "reload", "warning": name + " changed but only takes effect on a restart, ignored"})
+			}
+			logger.Log(kv{"fn": "reload", "msg": "reloaded configuration"})
+		}
+	}()
+
+	return func() {
+		signal.Stop(hup)
+		close(hup)
+	}
+}
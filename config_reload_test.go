@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	saved := *Config()
+	defer func() { *Config() = saved }()
+
+	path := writeConfigFile(t, "# reloaded\nLFS_RATELIMIT = 5\nLFS_LISTEN=tcp://:9999\n")
+	defer os.Remove(path)
+	Config().ConfigFile = path
+
+	ignored, err := ReloadConfig()
+	if err != nil {
+		t.Fatalf("expected ReloadConfig to succeed, got : %s", err)
+	}
+	if Config().RateLimit != "5" {
+		t.Errorf("expected the rate limit to be reloaded, got: %q", Config().RateLimit)
+	}
+	if Config().Listen != saved.Listen {
+		t.Errorf("expected the listen address to be kept, got: %q", Config().Listen)
+	}
+	found := false
+	for _, name := range ignored {
+		found = found || name == "LFS_LISTEN"
+	}
+	if !found {
+		t.Errorf("expected LFS_LISTEN to be reported as ignored, got: %v", ignored)
+	}
+
+	for _, content := range []string{"LFS_RATELIMIT=fast\n", "RATELIMIT=1\n"} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("error writing config file: %s", err)
+		}
+		if _, err := ReloadConfig(); err == nil {
+			t.Errorf("expected %q to be rejected", content)
+		}
+		if Config().RateLimit != "5" {
+			t.Errorf("expected nothing to change after %q, got rate limit: %q", content, Config().RateLimit)
+		}
+	}
+}
+
+func TestReloadConfigOnHangup(t *testing.T) {
+	saved := *Config()
+	defer func() { *Config() = saved }()
+
+	path := writeConfigFile(t, "LFS_READONLY=true\n")
+	defer os.Remove(path)
+	Config().ConfigFile = path
+
+	stop := reloadOnHangup(nil)
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("error sending SIGHUP: %s", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !Config().IsReadOnly(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the configuration to be reloaded")
+		}
+	}
+
+	buf := bytes.NewBufferString(`{"path":"reloaded.bin"}`)
+	res, err := api("POST", "/user/reload-repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 503 {
+		t.Errorf("expected the reloaded read-only mode to reject locks with 503, got %d", res.StatusCode)
+	}
+
+	// Options that can't be reloaded are kept
+	if Config().MetaDB != saved.MetaDB || Config().ContentPath != saved.ContentPath {
+		t.Errorf("expected the meta store and content paths to be kept, got: %q, %q", Config().MetaDB, Config().ContentPath)
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "lfs-config")
+	if err != nil {
+		t.Fatalf("error creating config file: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("error writing config file: %s", err)
+	}
+	return f.Name()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs-config")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := *Config()
+	valid.MetaDB = filepath.Join(dir, "lfs.db")
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected default config to be valid, got: %s", err)
+	}
+
+	// Missing directories are created when the store is opened
+	missing := valid
+	missing.MetaDB = filepath.Join(dir, "missing", "lfs.db")
+	if err := missing.Validate(); err != nil {
+		t.Errorf("expected a missing meta store directory to be valid, got: %s", err)
+	}
+
+	notADir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notADir, nil, 0600); err != nil {
+		t.Fatalf("error creating file: %s", err)
+	}
+
+	cases := map[string]struct {
+		change   func(c *Configuration)
+		problems []string
+	}{
+		"admin user without password": {
+			func(c *Configuration) { c.AdminUser = "gandalf" },
+			[]string{"LFS_ADMINUSER and LFS_ADMINPASS must be set together"},
+		},
+		"https without certificate": {
+			func(c *Configuration) { c.Scheme = "https" },
+			[]string{"LFS_CERT and LFS_KEY must be set when LFS_SCHEME is https"},
+		},
+		"external url without scheme": {
+			func(c *Configuration) { c.ExternalURL = "lfs.example.com" },
+			[]string{`LFS_EXTERNALURL must be an http or https URL, got "lfs.example.com"`},
+		},
+		"s3 without bucket": {
+			func(c *Configuration) { c.ContentStore = "s3" },
+			[]string{errNoS3Bucket.Error()},
+		},
+		"shard depth out of range": {
+			func(c *Configuration) { c.ContentShardDepth = "40" },
+			[]string{`LFS_CONTENTSHARDDEPTH must be a whole number from 0 to 16, got "40"`},
+		},
+		"unwritable meta store": {
+			func(c *Configuration) { c.MetaDB = filepath.Join(notADir, "missing", "lfs.db") },
+			[]string{"LFS_METADB directory is not writable"},
+		},
+		"meta store is a directory": {
+			func(c *Configuration) { c.MetaDB = dir },
+			[]string{"LFS_METADB is a directory"},
+		},
+		"meta store mode": {
+			func(c *Configuration) { c.MetaDBMode = "rw" },
+			[]string{`LFS_METADBMODE must be octal permissions such as "0600", got "rw"`},
+		},
+		"lock id format": {
+			func(c *Configuration) { c.LockIdFormat = "int" },
+			[]string{`LFS_LOCKIDFORMAT must be "hex" or "uuid", got "int"`},
+		},
+		"meta store sync": {
+			func(c *Configuration) { c.MetaDBSync = "sometimes" },
+			[]string{`LFS_METADBSYNC must be "full" or "none", got "sometimes"`},
+		},
+		"lock path pattern": {
+			func(c *Configuration) { c.LockPathDeny = "**/*.tmp, [unclosed" },
+			[]string{`LFS_LOCKPATHDENY has an invalid pattern "[unclosed"`},
+		},
+		"every problem is reported": {
+			func(c *Configuration) {
+				c.ContentStore = "floppy"
+				c.LDAPURL = "ldap://localhost"
+				c.MaxRepoLocks = "lots"
+				c.ShutdownTimeout = "soon"
+			},
+			[]string{
+				`LFS_CONTENTSTORE must be "file" or "s3", got "floppy"`,
+				"LFS_LDAPURL and LFS_LDAPUSERDN must be set together",
+				`LFS_MAXREPOLOCKS must be a number of at least 0, got "lots"`,
+				`LFS_SHUTDOWNTIMEOUT must be a duration such as "30s", got "soon"`,
+			},
+		},
+	}
+
+	for name, c := range cases {
+		config := valid
+		c.change(&config)
+
+		err, ok := config.Validate().(*ConfigError)
+		if !ok {
+			t.Errorf("%s: expected a config error, got: %v", name, err)
+			continue
+		}
+		if len(err.Problems) != len(c.problems) {
+			t.Errorf("%s: expected %d problems, got: %q", name, len(c.problems), err.Problems)
+			continue
+		}
+		for i, problem := range c.problems {
+			if !strings.HasPrefix(err.Problems[i], problem) {
+				t.Errorf("%s: expected problem %q, got %q", name, problem, err.Problems[i])
+			}
+		}
+	}
+}
+
+func TestLoadConfigSchemeFromCert(t *testing.T) {
+	cases := map[string]struct {
+		env    map[string]string
+		scheme string
+	}{
+		"no certificate":      {map[string]string{}, "http"},
+		"certificate and key": {map[string]string{"LFS_CERT": "mine.crt", "LFS_KEY": "mine.key"}, "https"},
+		"certificate only":    {map[string]string{"LFS_CERT": "mine.crt"}, "http"},
+		"scheme given":        {map[string]string{"LFS_CERT": "mine.crt", "LFS_KEY": "mine.key", "LFS_SCHEME": "http"}, "http"},
+	}
+
+	for name, tc := range cases {
+		var c Configuration
+		loadConfig(&c, func(name string) string { return tc.env[name] })
+		if c.Scheme != tc.scheme {
+			t.Errorf("%s: expected scheme %q, got %q", name, tc.scheme, c.Scheme)
+		}
+		if c.IsHTTPS() != (tc.scheme == "https") {
+			t.Errorf("%s: expected IsHTTPS to follow the scheme %q", name, tc.scheme)
+		}
+	}
+}
+
+func TestConfigWarnings(t *testing.T) {
+	config := *Config()
+	config.Public = "true"
+	if warnings := config.Warnings(); len(warnings) != 1 {
+		t.Errorf("expected a warning when public without TLS, got: %q", warnings)
+	}
+
+	config.Scheme = "https"
+	if warnings := config.Warnings(); len(warnings) != 0 {
+		t.Errorf("expected no warnings when public with TLS, got: %q", warnings)
+	}
+
+	config.AdminUser, config.AdminPass = "gandalf", "mithrandir"
+	if warnings := config.Warnings(); len(warnings) != 1 {
+		t.Errorf("expected a warning when public with admin accounts, got: %q", warnings)
+	}
+	if err := config.Validate(); err != nil && strings.Contains(err.Error(), "LFS_PUBLIC") {
+		t.Errorf("expected public with admin accounts to still be valid, got: %s", err)
+	}
+	config.AdminUser, config.AdminPass = "", ""
+
+	config.Scheme = "http"
+	config.Public = "false"
+	config.Cert = "mine.crt"
+	if warnings := config.Warnings(); len(warnings) != 1 {
+		t.Errorf("expected a warning when a certificate is set without https, got: %q", warnings)
+	}
+	if err := config.Validate(); err != nil && strings.Contains(err.Error(), "LFS_CERT") {
+		t.Errorf("expected a certificate without https to still be valid, got: %s", err)
+	}
+
+	config.Scheme = "https"
+	config.Cert = ""
+	config.RequireKnownRepo = "true"
+	if warnings := config.Warnings(); len(warnings) != 1 {
+		t.Errorf("expected a warning when requiring known repos without any, got: %q", warnings)
+	}
+
+	config.RequireKnownRepo = "false"
+	config.MetaDBSync = "none"
+	if warnings := config.Warnings(); len(warnings) != 1 {
+		t.Errorf("expected a warning when the meta store isn't synced, got: %q", warnings)
+	}
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultShardDepth stores objects under ab/cd/ for an oid starting abcd.
+	defaultShardDepth = 2
+	maxShardDepth     = 16
+
+	// shardDepthFile records the shard depth the content path is laid out
+	// with, so objects are only moved when the depth changes.
+	shardDepthFile = ".shard-depth"
 )
 
 var (
@@ -14,24 +26,58 @@ var (
 	errSizeMismatch = errors.New("Content size does not match")
 )
 
-// ContentStore provides a simple file system based storage.
-type ContentStore struct {
+// ContentStore stores the content of objects. Content is only stored once its
+// size and hash have been checked against the object's meta information.
+type ContentStore interface {
+	Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error)
+	Put(meta *MetaObject, r io.Reader) error
+	Exists(meta *MetaObject) bool
+	// Size returns the size of the object's content, or errObjectNotFound if
+	// there is none.
+	Size(meta *MetaObject) (int64, error)
+	// Delete removes the object's content. Content that isn't there is not
+	// an error.
+	Delete(meta *MetaObject) error
+}
+
+// NewConfiguredContentStore creates the ContentStore selected by
+// Config.ContentStore.
+func NewConfiguredContentStore() (ContentStore, error) {
+	if Config().IsUsingS3() {
+		client, err := newS3HTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		return NewS3ContentStore(client, Config().S3Prefix), nil
+	}
+	return NewFileContentStore(Config().ContentPath)
+}
+
+// FileContentStore provides a simple file system based storage.
+type FileContentStore struct {
 	basePath string
+	depth    int
 }
 
-// NewContentStore creates a ContentStore at the base directory.
-func NewContentStore(base string) (*ContentStore, error) {
+// NewFileContentStore creates a FileContentStore at the base directory, with
+// objects sharded into Config.ShardDepth levels of directories. Objects
+// stored with a different depth are moved into place.
+func NewFileContentStore(base string) (*FileContentStore, error) {
 	if err := os.MkdirAll(base, 0750); err != nil {
 		return nil, err
 	}
 
-	return &ContentStore{base}, nil
+	s := &FileContentStore{basePath: base, depth: Config().ShardDepth()}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 // Get takes a Meta object and retreives the content from the store, returning
 // it as an io.ReaderCloser. If fromByte > 0, the reader starts from that byte
-func (s *ContentStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
-	path := filepath.Join(s.basePath, transformKey(meta.Oid))
+func (s *FileContentStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	path := s.path(meta.Oid)
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -44,8 +90,14 @@ func (s *ContentStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, err
 }
 
 // Put takes a Meta object and an io.Reader and writes the content to the store.
-func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
-	path := filepath.Join(s.basePath, transformKey(meta.Oid))
+// The content is streamed to a temporary file while its hash is computed, and
+// only moved into place if its size and hash match the Meta object.
+func (s *FileContentStore) Put(meta *MetaObject, r io.Reader) error {
+	if Config().IsReadOnly() {
+		return errReadOnly
+	}
+
+	path := s.path(meta.Oid)
 	tmpPath := path + ".tmp"
 
 	dir := filepath.Dir(path)
@@ -59,7 +111,7 @@ func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
 	}
 	defer os.Remove(tmpPath)
 
-	hash := sha256.New()
+	hash := meta.Hash()
 	hw := io.MultiWriter(hash, file)
 
 	written, err := io.Copy(hw, r)
@@ -84,19 +136,107 @@ func (s *ContentStore) Put(meta *MetaObject, r io.Reader) error {
 	return nil
 }
 
+// Size returns the size of the object's content file.
+func (s *FileContentStore) Size(meta *MetaObject) (int64, error) {
+	info, err := os.Stat(s.path(meta.Oid))
+	if os.IsNotExist(err) {
+		return 0, errObjectNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Delete removes the object's content file.
+func (s *FileContentStore) Delete(meta *MetaObject) error {
+	if err := os.Remove(s.path(meta.Oid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // Exists returns true if the object exists in the content store.
-func (s *ContentStore) Exists(meta *MetaObject) bool {
-	path := filepath.Join(s.basePath, transformKey(meta.Oid))
+func (s *FileContentStore) Exists(meta *MetaObject) bool {
+	path := s.path(meta.Oid)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func transformKey(key string) string {
-	if len(key) < 5 {
-		return key
+// path returns where the content of oid is stored.
+func (s *FileContentStore) path(oid string) string {
+	return filepath.Join(s.basePath, shardKey(oid, s.depth))
+}
+
+// migrate moves objects stored with another shard depth to where they belong
+// at the store's depth. Nothing is moved if the content path was last laid
+// out with the same depth.
+func (s *FileContentStore) migrate() error {
+	marker := filepath.Join(s.basePath, shardDepthFile)
+	depth := strconv.Itoa(s.depth)
+	if data, err := ioutil.ReadFile(marker); err == nil && string(data) == depth {
+		return nil
+	}
+
+	var dirs []string
+	err := filepath.Walk(s.basePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != s.basePath {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.basePath, p)
+		if err != nil {
+			return err
+		}
+
+		// An object's oid is its path with the separators taken out
+		oid := strings.Replace(rel, string(filepath.Separator), "", -1)
+		if validateOid("", oid) != nil {
+			return nil
+		}
+
+		dest := s.path(oid)
+		if dest == p {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+			return err
+		}
+		return os.Rename(p, dest)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove the directories emptied by the move, deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
 	}
 
-	return filepath.Join(key[0:2], key[2:4], key[4:len(key)])
+	return ioutil.WriteFile(marker, []byte(depth), 0640)
+}
+
+// transformKey returns the path of key in the default shard layout, as used
+// for S3 keys.
+func transformKey(key string) string {
+	return shardKey(key, defaultShardDepth)
+}
+
+// shardKey splits depth pairs of characters off the front of key as
+// directories, keeping at least one character for the file name.
+func shardKey(key string, depth int) string {
+	parts := make([]string, 0, depth+1)
+	for i := 0; i < depth && len(key) > 2; i++ {
+		parts = append(parts, key[0:2])
+		key = key[2:]
+	}
+	return filepath.Join(append(parts, key)...)
 }
@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
-var contentStore *ContentStore
+var contentStore *FileContentStore
 
 func TestContentStorePut(t *testing.T) {
 	setup()
@@ -31,6 +32,24 @@ func TestContentStorePut(t *testing.T) {
 	}
 }
 
+func TestContentStorePutBlake2b(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{Oid: blake2bOid, Size: 12, HashAlgo: "blake2b"}
+
+	if err := contentStore.Put(m, bytes.NewBufferString("bogus conten")); err != errHashMismatch {
+		t.Fatalf("expected put with bogus content to fail with errHashMismatch, got: %v", err)
+	}
+
+	if err := contentStore.Put(m, bytes.NewBufferString("test content")); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+	if !contentStore.Exists(m) {
+		t.Fatalf("expected content to exist after putting")
+	}
+}
+
 func TestContentStorePutHashMismatch(t *testing.T) {
 	setup()
 	defer teardown()
@@ -163,8 +182,126 @@ func TestContentStoreExists(t *testing.T) {
 	}
 }
 
+func TestContentStoreDelete(t *testing.T) {
+	setup()
+	defer teardown()
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBufferString("test content")); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	if err := contentStore.Delete(m); err != nil {
+		t.Fatalf("expected delete to succeed, got: %s", err)
+	}
+	if contentStore.Exists(m) {
+		t.Errorf("expected content to be deleted")
+	}
+
+	if err := contentStore.Delete(m); err != nil {
+		t.Errorf("expected deleting missing content to succeed, got: %s", err)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	oid := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	tests := map[int]string{
+		0: oid,
+		1: filepath.Join("6a", oid[2:]),
+		2: filepath.Join("6a", "e8", oid[4:]),
+		3: filepath.Join("6a", "e8", "a7", oid[6:]),
+	}
+	for depth, expected := range tests {
+		if got := shardKey(oid, depth); got != expected {
+			t.Errorf("expected depth %d to give %s, got %s", depth, expected, got)
+		}
+	}
+
+	if got := shardKey("abc", 3); got != filepath.Join("ab", "c") {
+		t.Errorf("expected a short key to keep a file name, got %s", got)
+	}
+}
+
+func TestContentStoreShardDepth(t *testing.T) {
+	Config().ContentShardDepth = "3"
+	defer func() { Config().ContentShardDepth = "2" }()
+
+	setup()
+	defer teardown()
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := contentStore.Put(m, bytes.NewBufferString("test content")); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	path := "content-store-test/6a/e8/a7/5555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected content to be stored at %s, got: %s", path, err)
+	}
+
+	r, err := contentStore.Get(m, 0)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "test content" {
+		t.Fatalf("expected to read content, got: %s", string(by))
+	}
+}
+
+func TestContentStoreMigrateShardDepth(t *testing.T) {
+	defer teardown()
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	// Start with the object in a flat layout
+	if err := os.MkdirAll("content-store-test", 0750); err != nil {
+		t.Fatalf("error creating content path: %s", err)
+	}
+	flat := filepath.Join("content-store-test", m.Oid)
+	if err := ioutil.WriteFile(flat, []byte("test content"), 0640); err != nil {
+		t.Fatalf("error writing object: %s", err)
+	}
+
+	setup()
+	if _, err := os.Stat(flat); !os.IsNotExist(err) {
+		t.Errorf("expected the flat object to be moved")
+	}
+	if !contentStore.Exists(m) {
+		t.Fatalf("expected the object to exist in the sharded layout")
+	}
+
+	// Going back to a flat layout moves it again and removes the empty shards
+	Config().ContentShardDepth = "0"
+	defer func() { Config().ContentShardDepth = "2" }()
+
+	setup()
+	if _, err := os.Stat(flat); err != nil {
+		t.Errorf("expected the object to be moved back, got: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join("content-store-test", "6a")); !os.IsNotExist(err) {
+		t.Errorf("expected the empty shard directories to be removed")
+	}
+	if !contentStore.Exists(m) {
+		t.Errorf("expected the object to exist in the flat layout")
+	}
+}
+
 func setup() {
-	store, err := NewContentStore("content-store-test")
+	store, err := NewFileContentStore("content-store-test")
 	if err != nil {
 		fmt.Printf("error initializing content store: %s\n", err)
 		os.Exit(1)
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+)
+
+// The methods and headers browsers may use in cross-origin requests.
+const (
+	corsAllowMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders = "Accept, Authorization, Content-Type, If-None-Match"
+	corsMaxAge       = "600"
+)
+
+// cors adds CORS headers to responses for requests from the origins in
+// Config.CORSOrigins, and answers their preflight requests. Requests from
+// other origins get no CORS headers, so browsers will block them.
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		allowOrigin, ok := Config().CORSAllowOrigin(origin)
+		if !ok {
+			if preflight {
+				writeStatus(w, r, http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		if allowOrigin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Retry-After")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	Config().CORSOrigins = "https://dashboard.example.com, https://other.example.com"
+	defer func() { Config().CORSOrigins = "" }()
+
+	res, err := corsRequest("OPTIONS", "/user/repo/locks", "https://dashboard.example.com", true)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 204 {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "https://dashboard.example.com" {
+		t.Errorf("expected origin to be allowed, got %q", origin)
+	}
+	if methods := res.Header.Get("Access-Control-Allow-Methods"); methods != corsAllowMethods {
+		t.Errorf("expected allowed methods, got %q", methods)
+	}
+	if headers := res.Header.Get("Access-Control-Allow-Headers"); headers != corsAllowHeaders {
+		t.Errorf("expected allowed headers, got %q", headers)
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	Config().CORSOrigins = "*"
+	defer func() { Config().CORSOrigins = "" }()
+
+	res, err := corsRequest("GET", "/user/repo/locks", "https://anywhere.example.com", false)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("expected any origin to be allowed, got %q", origin)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	Config().CORSOrigins = "https://dashboard.example.com"
+	defer func() { Config().CORSOrigins = "" }()
+
+	res, err := corsRequest("OPTIONS", "/user/repo/locks", "https://evil.example.com", true)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("expected no allowed origin, got %q", origin)
+	}
+
+	res, err = corsRequest("GET", "/user/repo/locks", "https://evil.example.com", false)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("expected no allowed origin, got %q", origin)
+	}
+}
+
+func corsRequest(method, path, origin string, preflight bool) (*http.Response, error) {
+	req, err := http.NewRequest(method, lfsServer.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Origin", origin)
+	if preflight {
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	} else {
+		req.Header.Set("Accept", metaMediaType)
+		req.SetBasicAuth(testUser, testPass)
+	}
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// cursorMACSize is how many bytes of the HMAC are kept in a cursor.
+const cursorMACSize = 16
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+// cursorKey signs cursors when Config.CursorSecret isn't set. It changes on
+// every start, so cursors don't outlive the process.
+var cursorKey = make([]byte, 32)
+
+func init() {
+	rand.Read(cursorKey)
+}
+
+// encodeCursor returns the opaque cursor handed to clients for the lock
+// cursor id in repo, made by lockCursor: the id followed by a truncated HMAC
+// of the repo and id, base64 encoded. The HMAC stops clients from forging
+// cursors or reusing them in other repos.
+func encodeCursor(repo, id string) string {
+	if id == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(append([]byte(id), cursorMAC(repo, id)...))
+}
+
+// decodeCursor returns the lock cursor in one made by encodeCursor for repo,
+// or errInvalidCursor if the cursor wasn't. An empty cursor decodes to an
+// empty id.
+func decodeCursor(repo, cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(data) <= cursorMACSize {
+		return "", errInvalidCursor
+	}
+
+	id := string(data[:len(data)-cursorMACSize])
+	if !hmac.Equal(data[len(data)-cursorMACSize:], cursorMAC(repo, id)) {
+		return "", errInvalidCursor
+	}
+	return id, nil
+}
+
+func cursorMAC(repo, id string) []byte {
+	key := cursorKey
+	if Config().CursorSecret != "" {
+		key = []byte(Config().CursorSecret)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(repo))
+	mac.Write([]byte{0})
+	mac.Write([]byte(id))
+	return mac.Sum(nil)[:cursorMACSize]
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := encodeCursor(testRepo, lockId)
+	if cursor == lockId {
+		t.Fatalf("expected cursor to not be the lock id")
+	}
+
+	id, err := decodeCursor(testRepo, cursor)
+	if err != nil || id != lockId {
+		t.Errorf("expected cursor to decode to %s, got: %q (%v)", lockId, id, err)
+	}
+
+	if cursor := encodeCursor(testRepo, ""); cursor != "" {
+		t.Errorf("expected no cursor for the last page, got: %q", cursor)
+	}
+	if id, err := decodeCursor(testRepo, ""); err != nil || id != "" {
+		t.Errorf("expected an empty cursor to start from the beginning, got: %q (%v)", id, err)
+	}
+}
+
+func TestCursorForged(t *testing.T) {
+	cursor := encodeCursor(testRepo, lockId)
+	data, _ := base64.RawURLEncoding.DecodeString(cursor)
+	data[0] ^= 1
+
+	forged := map[string]string{
+		"lock id":    lockId,
+		"not base64": "!!!",
+		"tampered":   base64.RawURLEncoding.EncodeToString(data),
+		"truncated":  cursor[:len(cursor)-2],
+	}
+	for name, c := range forged {
+		if _, err := decodeCursor(testRepo, c); err != errInvalidCursor {
+			t.Errorf("%s: expected an invalid cursor error, got: %v", name, err)
+		}
+	}
+
+	if _, err := decodeCursor("other-repo", cursor); err != errInvalidCursor {
+		t.Errorf("expected cursor to be rejected in another repo, got: %v", err)
+	}
+
+	Config().CursorSecret = "shire"
+	defer func() { Config().CursorSecret = "" }()
+	if _, err := decodeCursor(testRepo, cursor); err != errInvalidCursor {
+		t.Errorf("expected cursor to be rejected with another secret, got: %v", err)
+	}
+}
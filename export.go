@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportDocument is the format of a full export of the meta store, used to
+// move its contents to another server. Export writes it a record at a time.
+type ExportDocument struct {
+	Users   []ExportUser      `json:"users"`
+	Objects []ExportObject    `json:"objects"`
+	Locks   []ExportRepoLocks `json:"locks"`
+}
+
+// ExportUser is a user in an export. Passwords are not exported, so imported
+// users can't sign in until they are added again with a password.
+type ExportUser struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// ExportObject is an object's meta information in an export, with the repos
+// that reference it as "user/repo".
+type ExportObject struct {
+	Oid         string     `json:"oid"`
+	Size        int64      `json:"size"`
+	HashAlgo    string     `json:"hash_algo,omitempty"`
+	UploadedBy  string     `json:"uploaded_by,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Refs        []string   `json:"refs,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+}
+
+// ExportRepoLocks are the locks of one repo in an export.
+type ExportRepoLocks struct {
+	Repo  string `json:"repo"`
+	Locks []Lock `json:"locks"`
+}
+
+// ImportResult counts what Import added to the meta store.
+type ImportResult struct {
+	Users   int `json:"users"`
+	Objects int `json:"objects"`
+	Locks   int `json:"locks"`
+}
+
+// jsonStreamWriter writes a JSON object made of lists a record at a time, as
+// the records are read, so the object is never held in memory.
+type jsonStreamWriter struct {
+	w       io.Writer
+	started bool
+	first   bool
+}
+
+// list starts the list called name, ending the previous list if there is one.
+func (e *jsonStreamWriter) list(name string) error {
+	prefix := "],"
+	if !e.started {
+		prefix = "{"
+	}
+	e.started = true
+	e.first = true
+	_, err := io.WriteString(e.w, prefix+`"`+name+`":[`)
+	return err
+}
+
+// record writes v as the next record of the current list.
+func (e *jsonStreamWriter) record(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if !e.first {
+		data = append([]byte(","), data...)
+	}
+	e.first = false
+	_, err = e.w.Write(data)
+	return err
+}
+
+// end ends the last list and the object, adding fields to the object after
+// the lists.
+func (e *jsonStreamWriter) end(fields kv) error {
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := []byte("]")
+	for _, k := range keys {
+		data, err := json.Marshal(fields[k])
+		if err != nil {
+			return err
+		}
+		buf = append(buf, `,"`+k+`":`...)
+		buf = append(buf, data...)
+	}
+	_, err := io.WriteString(e.w, string(buf)+"}\n")
+	return err
+}
+
+// Export writes every user, object and lock in the meta store to w as an
+// ExportDocument. The store is read in batches with scanBatches, so an
+// export of a busy store is not a single snapshot of it. Soft deleted objects
+// are included with their deletion time. Export stops with ctx's error if ctx
+// is done.
+func (s *MetaStore) Export(ctx context.Context, w io.Writer) error {
+	e := &jsonStreamWriter{w: w}
+	var records []interface{}
+	flush := func() error {
+		for _, record := range records {
+			if err := e.record(record); err != nil {
+				return err
+			}
+		}
+		records = records[:0]
+		return nil
+	}
+
+	if err := e.list("users"); err != nil {
+		return err
+	}
+	err := s.scanBatches(usersBucket, func(tx kvTx, k, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var record userRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			logCorruptRecord(usersBucket, k, err)
+			return nil
+		}
+		records = append(records, &ExportUser{Name: string(k), DisplayName: record.DisplayName})
+		return nil
+	}, flush)
+	if err != nil {
+		return err
+	}
+
+	if err := e.list("objects"); err != nil {
+		return err
+	}
+	err = s.scanBatches(objectsBucket, func(tx kvTx, k, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		refs := tx.Bucket(refsBucket)
+		if refs == nil {
+			return errNoBucket
+		}
+
+		var meta MetaObject
+		if err := decodeMeta(v, &meta); err != nil {
+			logCorruptRecord(objectsBucket, k, err)
+			return nil
+		}
+		records = append(records, newExportObject(&meta, refs.Bucket(k)))
+		return nil
+	}, flush)
+	if err != nil {
+		return err
+	}
+
+	if err := e.list("locks"); err != nil {
+		return err
+	}
+	err = s.scanBatches(locksBucket, func(tx kvTx, k, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		repoLocks := ExportRepoLocks{Repo: string(k)}
+		if err := json.Unmarshal(v, &repoLocks.Locks); err != nil {
+			logCorruptRecord(locksBucket, k, err)
+			return nil
+		}
+		if len(repoLocks.Locks) == 0 {
+			return nil
+		}
+		records = append(records, &repoLocks)
+		return nil
+	}, flush)
+	if err != nil {
+		return err
+	}
+
+	return e.end(nil)
+}
+
+// newExportObject describes meta for an export, with the refs in objRefs.
+func newExportObject(meta *MetaObject, objRefs kvBucket) *ExportObject {
+	o := &ExportObject{Oid: meta.Oid, Size: meta.Size, HashAlgo: meta.HashAlgo, UploadedBy: meta.UploadedBy, Tags: meta.Tags, ContentType: meta.ContentType}
+	if !meta.CreatedAt.IsZero() {
+		createdAt := meta.CreatedAt
+		o.CreatedAt = &createdAt
+	}
+	if meta.Deleted() {
+		deletedAt := meta.DeletedAt
+		o.DeletedAt = &deletedAt
+	}
+	if objRefs != nil {
+		objRefs.ForEach(func(k, v []byte) error {
+			o.Refs = append(o.Refs, string(k))
+			return nil
+		})
+	}
+	return o
+}
+
+// decodeExport reads an ExportDocument from r, checking that its objects have
+// valid oids.
+func decodeExport(r io.Reader) (*ExportDocument, error) {
+	var doc ExportDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	for _, o := range doc.Objects {
+		if err := validateOid(o.HashAlgo, o.Oid); err != nil {
+			return nil, err
+		}
+	}
+	return &doc, nil
+}
+
+// Import adds the users, objects and locks of doc to the meta store, in a
+// single transaction. Users and objects already in the store are kept as
+// they are, though the imported references to objects are added. Locks whose
+// id or path is already locked in their repo are skipped. Lock counts are
+// kept up to date, but lock limits and storage quotas aren't applied and
+// imported objects don't count towards usage.
+func (s *MetaStore) Import(doc *ExportDocument) (*ImportResult, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	var result ImportResult
+	err := s.update(func(tx kvTx) error {
+		result = ImportResult{}
+
+		users, objects, refs := tx.Bucket(usersBucket), tx.Bucket(objectsBucket), tx.Bucket(refsBucket)
+		if users == nil || objects == nil || refs == nil {
+			return errNoBucket
+		}
+
+		for _, u := range doc.Users {
+			if u.Name == "" || users.Get([]byte(u.Name)) != nil {
+				continue
+			}
+			data, err := json.Marshal(&userRecord{DisplayName: u.DisplayName})
+			if err != nil {
+				return err
+			}
+			if err := users.Put([]byte(u.Name), data); err != nil {
+				return err
+			}
+			result.Users++
+		}
+
+		for _, o := range doc.Objects {
+			if objects.Get([]byte(o.Oid)) == nil {
+				if err := putMeta(objects, o.metaObject()); err != nil {
+					return err
+				}
+				result.Objects++
+			}
+
+			for _, ref := range o.Refs {
+				user, repo := splitRefKey(ref)
+				if err := addRef(refs, &RequestVars{User: user, Repo: repo, Oid: o.Oid}); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, repoLocks := range doc.Locks {
+			added, err := importLocks(tx, repoLocks)
+			if err != nil {
+				return err
+			}
+			result.Locks += added
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// metaObject returns the MetaObject o describes.
+func (o *ExportObject) metaObject() *MetaObject {
+	meta := &MetaObject{Oid: o.Oid, Size: o.Size, HashAlgo: o.HashAlgo, UploadedBy: o.UploadedBy, Tags: o.Tags, ContentType: o.ContentType}
+	if o.CreatedAt != nil {
+		meta.CreatedAt = *o.CreatedAt
+	}
+	if o.DeletedAt != nil {
+		meta.DeletedAt = *o.DeletedAt
+	}
+	return meta
+}
+
+// splitRefKey splits a key made by refKey into its user and repo.
+func splitRefKey(key string) (user, repo string) {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+// importLocks adds the imported locks of a repo that don't clash with its
+// existing locks, returning how many were added.
+func importLocks(tx kvTx, repoLocks ExportRepoLocks) (int, error) {
+	bucket, counts := tx.Bucket(locksBucket), tx.Bucket(lockCountsBucket)
+	if bucket == nil || counts == nil {
+		return 0, errNoBucket
+	}
+
+	var locks []Lock
+	if data := bucket.Get([]byte(repoLocks.Repo)); data != nil {
+		if err := json.Unmarshal(data, &locks); err != nil {
+			return 0, err
+		}
+	}
+
+	var added int
+	for _, l := range repoLocks.Locks {
+		if l.Id == "" || lockIdInUse(locks, l.Id) || findLockByPath(locks, l.Path) != nil {
+			continue
+		}
+
+		owner := l.Owner.Name
+		if err := putLockCount(counts, owner, getLockCount(counts, owner)+1); err != nil {
+			return 0, err
+		}
+		l.DecimalId = ""
+		locks = append(locks, l)
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+
+	if err := touchLocks(tx, repoLocks.Repo); err != nil {
+		return 0, err
+	}
+
+	sort.Stable(LocksByCreatedAt(locks))
+	data, err := json.Marshal(&locks)
+	if err != nil {
+		return 0, err
+	}
+	return added, bucket.Put([]byte(repoLocks.Repo), data)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().SoftDelete = "true"
+	defer func() { Config().SoftDelete = "false" }()
+
+	defer func(n int) { scanBatchSize = n }(scanBatchSize)
+	scanBatchSize = 2
+
+	if err := metaStoreTest.AddUser(testUser1, testPass1, "Someone Else"); err != nil {
+		t.Fatalf("expected AddUser to succeed, got : %s", err)
+	}
+	for _, v := range []*RequestVars{
+		{User: testUser, Repo: "repo1", Oid: otherOid, Size: 10, Uploader: testUser},
+		{User: testUser1, Repo: "repo2", Oid: otherOid, Size: 10, Uploader: testUser1},
+		{User: testUser, Repo: "repo1", Oid: nonExistingOid, Size: 20},
+	} {
+		if _, err := metaStoreTest.Put(v); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
+	}
+	if err := metaStoreTest.Delete(&RequestVars{User: testUser, Repo: "repo1", Oid: nonExistingOid}); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+	seedUserLocks(t)
+
+	var exported bytes.Buffer
+	if err := metaStoreTest.Export(context.Background(), &exported); err != nil {
+		t.Fatalf("expected Export to succeed, got : %s", err)
+	}
+	if strings.Contains(exported.String(), testPass) {
+		t.Errorf("expected passwords to be left out of the export")
+	}
+
+	doc, err := decodeExport(bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatalf("expected the export to decode, got : %s", err)
+	}
+
+	store, err := NewMemoryMetaStore()
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+	defer store.Close()
+
+	result, err := store.Import(doc)
+	if err != nil {
+		t.Fatalf("expected Import to succeed, got : %s", err)
+	}
+	if *result != (ImportResult{Users: 2, Objects: 3, Locks: 3}) {
+		t.Errorf("expected every record to be imported, got: %+v", result)
+	}
+
+	var reexported bytes.Buffer
+	if err := store.Export(context.Background(), &reexported); err != nil {
+		t.Fatalf("expected Export to succeed, got : %s", err)
+	}
+	if reexported.String() != exported.String() {
+		t.Errorf("expected the imported store to export the same document\nexpected: %s\ngot: %s", exported.String(), reexported.String())
+	}
+
+	if count, err := store.RefCount(otherOid); err != nil || count != 2 {
+		t.Errorf("expected the object's refs to be imported, got %d (%v)", count, err)
+	}
+	if problems, err := store.VerifyLockIntegrity(); err != nil || len(problems) != 0 {
+		t.Errorf("expected imported lock counts to match, got: %+v (%v)", problems, err)
+	}
+
+	// Importing again adds nothing
+	result, err = store.Import(doc)
+	if err != nil {
+		t.Fatalf("expected Import to succeed, got : %s", err)
+	}
+	if *result != (ImportResult{}) {
+		t.Errorf("expected nothing new to be imported, got: %+v", result)
+	}
+}
+
+func TestExportCancelled(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var exported bytes.Buffer
+	if err := metaStoreTest.Export(ctx, &exported); err != context.Canceled {
+		t.Errorf("expected the export to be cancelled, got : %v", err)
+	}
+}
+
+func TestDecodeExportInvalidOid(t *testing.T) {
+	_, err := decodeExport(strings.NewReader(`{"objects":[{"oid":"not-an-oid","size":1}]}`))
+	if err != errInvalidOid {
+		t.Errorf("expected errInvalidOid, got : %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMinSize is the smallest response body worth compressing, in bytes.
+const gzipMinSize = 1024
+
+// gzipResponse compresses successful responses of h with gzip for clients that
+// accept it, once the body reaches gzipMinSize. Smaller bodies and error
+// responses are sent as they are.
+func gzipResponse(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.Close()
+		h(gw, r)
+	}
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		if len(parts) > 1 && strings.Replace(parts[1], " ", "", -1) == "q=0" {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the body until it's known whether it will be
+// compressed, which is once it reaches gzipMinSize or the handler finishes.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if status != http.StatusOK {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.passthrough {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+
+	w.buf.Write(p)
+	if w.buf.Len() < gzipMinSize {
+		return len(p), nil
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.buf.WriteTo(w.gz); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends what's left of the response.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	if w.passthrough {
+		return nil
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.buf.WriteTo(w.ResponseWriter)
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestLocksListGzip(t *testing.T) {
+	paths := make([]string, 100)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("assets/texture-%03d.png", i)
+	}
+	if _, _, err := testMetaStore.AddLocksBatch("gzip-repo", paths, testUser); err != nil {
+		t.Fatalf("error adding locks: %s", err)
+	}
+
+	res := getWithEncoding(t, "/user/gzip-repo/locks", "gzip")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip response, got Content-Encoding %q", res.Header.Get("Content-Encoding"))
+	}
+	if res.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", res.Header.Get("Vary"))
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("expected a gzip body, got error: %s", err)
+	}
+	var list LockList
+	if err := json.NewDecoder(gz).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be a lock list, got error: %s", err)
+	}
+	if len(list.Locks) != len(paths) {
+		t.Errorf("expected %d locks, got %d", len(paths), len(list.Locks))
+	}
+}
+
+func TestLocksListGzipSmall(t *testing.T) {
+	res := getWithEncoding(t, "/user/empty-gzip-repo/locks", "gzip")
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Errorf("expected a small listing not to be compressed")
+	}
+
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be a lock list, got error: %s", err)
+	}
+
+	res = getWithEncoding(t, "/user/empty-gzip-repo/locks?cursor=bogus", "gzip")
+	assertErrorResponse(t, res, 400, errInvalidCursor.Error())
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"br, gzip; q=0":     false,
+		"identity":          false,
+	}
+	for header, expected := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(r); got != expected {
+			t.Errorf("expected %q to give %v, got %v", header, expected, got)
+		}
+	}
+}
+
+// getWithEncoding requests path as testUser with the Accept-Encoding header
+// set, which stops the client from decompressing the response itself.
+func getWithEncoding(t *testing.T, path, encoding string) *http.Response {
+	req, err := http.NewRequest("GET", lfsServer.URL+path, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Accept-Encoding", encoding)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	return res
+}
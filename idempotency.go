@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader is the header clients set on lock creates so that a
+// retried create returns the lock made by the first attempt.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyCleanupInterval is how often expired keys are dropped.
+const idempotencyCleanupInterval = time.Minute
+
+// idempotencyKeys remembers the lock created for each idempotency key until
+// Config.IdempotencyTTL has passed. Keys are only kept in memory.
+type idempotencyKeys struct {
+	mu          sync.Mutex
+	entries     map[string]idempotencyEntry
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+type idempotencyEntry struct {
+	path    string
+	lockId  string
+	expires time.Time
+}
+
+func newIdempotencyKeys() *idempotencyKeys {
+	return &idempotencyKeys{entries: make(map[string]idempotencyEntry), lastCleanup: time.Now(), now: time.Now}
+}
+
+// idempotencyKey scopes a client's key to the user and repo, so that clients
+// picking the same key don't see each other's locks.
+func idempotencyKey(user, repo, key string) string {
+	return user + "/" + repo + "\x00" + key
+}
+
+// Get returns the entry recorded for key, if it hasn't expired.
+func (k *idempotencyKeys) Get(key string) (idempotencyEntry, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, ok := k.entries[key]
+	if !ok || k.now().After(entry.expires) {
+		return idempotencyEntry{}, false
+	}
+	return entry, true
+}
+
+// Put records that the lock with lockId was created on path for key. Nothing
+// is recorded if Config.IdempotencyTTL is 0.
+func (k *idempotencyKeys) Put(key, path, lockId string) {
+	ttl := Config().IdempotencyTTLDuration()
+	if ttl <= 0 {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.now()
+	k.cleanup(now)
+	k.entries[key] = idempotencyEntry{path: path, lockId: lockId, expires: now.Add(ttl)}
+}
+
+// cleanup drops the expired entries.
+func (k *idempotencyKeys) cleanup(now time.Time) {
+	if now.Sub(k.lastCleanup) < idempotencyCleanupInterval {
+		return
+	}
+	k.lastCleanup = now
+
+	for key, entry := range k.entries {
+		if now.After(entry.expires) {
+			delete(k.entries, key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	now := time.Now()
+	k := newIdempotencyKeys()
+	k.now = func() time.Time { return now }
+
+	k.Put("key", "a.bin", "lock-1")
+	if entry, ok := k.Get("key"); !ok || entry.lockId != "lock-1" || entry.path != "a.bin" {
+		t.Fatalf("expected the key to be remembered, got: %+v (%v)", entry, ok)
+	}
+
+	now = now.Add(Config().IdempotencyTTLDuration() + time.Second)
+	if _, ok := k.Get("key"); ok {
+		t.Errorf("expected the key to expire")
+	}
+
+	k.Put("other", "b.bin", "lock-2")
+	if _, ok := k.entries["key"]; ok {
+		t.Errorf("expected expired keys to be cleaned up")
+	}
+}
+
+func TestCreateLockIdempotencyKey(t *testing.T) {
+	const repo = "idempotent-repo"
+
+	res := createLockWithKey(t, repo, "retried.bin", "key-1")
+	first := decodeLockResponse(t, res, 201)
+
+	// A retry gets the lock the first attempt made
+	res = createLockWithKey(t, repo, "retried.bin", "key-1")
+	retried := decodeLockResponse(t, res, 201)
+	if retried.Id != first.Id {
+		t.Errorf("expected the retry to return lock %s, got: %s", first.Id, retried.Id)
+	}
+
+	// Without the key, or with another one, the path is still locked
+	for _, key := range []string{"", "key-2"} {
+		res = createLockWithKey(t, repo, "retried.bin", key)
+		assertErrorResponse(t, res, 409, "lock already created")
+	}
+
+	res = createLockWithKey(t, repo, "other.bin", "key-1")
+	assertErrorResponse(t, res, 422, "Idempotency-Key was already used for another path")
+
+	locks, err := testMetaStore.Locks(repo)
+	if err != nil || len(locks) != 1 {
+		t.Errorf("expected a single lock to be created, got: %v (%v)", locks, err)
+	}
+}
+
+// createLockWithKey creates a lock on path in repo, sending key as the
+// Idempotency-Key if it isn't empty.
+func createLockWithKey(t *testing.T, repo, path, key string) *http.Response {
+	body, _ := json.Marshal(&LockRequest{Path: path})
+	req, err := http.NewRequest("POST", lfsServer.URL+"/user/"+repo+"/locks", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	return res
+}
+
+func decodeLockResponse(t *testing.T, res *http.Response, status int) *Lock {
+	if res.StatusCode != status {
+		t.Fatalf("expected status %d, got %d", status, res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	return lockResponse.Lock
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// Kinds of LockInconsistency.
+const (
+	// lockCountMismatch is an owner whose count in lockCountsBucket differs
+	// from the number of locks they own.
+	lockCountMismatch = "lock_count"
+	// duplicateLockPath is a path locked more than once in a repo.
+	duplicateLockPath = "duplicate_path"
+	// duplicateLockId is a lock id used more than once in a repo.
+	duplicateLockId = "duplicate_id"
+	// corruptLocks is a repo whose stored locks can't be decoded. Its locks
+	// aren't counted.
+	corruptLocks = "corrupt_locks"
+)
+
+// logCorruptRecord logs a value in bucket that couldn't be decoded, for scans
+// that skip it and carry on.
+func logCorruptRecord(bucket, key []byte, err error) {
+	logger.Log(kv{"fn": "scan", "bucket": string(bucket), "key": string(key), "err": "Could not decode record: " + err.Error()})
+}
+
+// LockInconsistency is a problem found by VerifyLockIntegrity. Stored and
+// Actual are only set for lock count mismatches, and Error for corrupt locks.
+type LockInconsistency struct {
+	Problem string `json:"problem"`
+	Repo    string `json:"repo,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Path    string `json:"path,omitempty"`
+	LockId  string `json:"lock_id,omitempty"`
+	Stored  int    `json:"stored,omitempty"`
+	Actual  int    `json:"actual,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// VerifyLockIntegrity checks that the lock counts kept for each owner match
+// the locks in the store, and that no repo has two locks on the same path or
+// with the same id. Repos whose locks can't be decoded are reported too.
+func (s *MetaStore) VerifyLockIntegrity() ([]LockInconsistency, error) {
+	var problems []LockInconsistency
+	err := s.view(func(tx kvTx) error {
+		owned, duplicates, err := scanLocks(tx)
+		if err != nil {
+			return err
+		}
+		problems = duplicates
+
+		counts := tx.Bucket(lockCountsBucket)
+		if counts == nil {
+			return errNoBucket
+		}
+
+		stored := make(map[string]int)
+		err = counts.ForEach(func(k, v []byte) error {
+			stored[string(k)], _ = strconv.Atoi(string(v))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		owners := make([]string, 0, len(owned)+len(stored))
+		for owner := range owned {
+			owners = append(owners, owner)
+		}
+		for owner := range stored {
+			if _, ok := owned[owner]; !ok {
+				owners = append(owners, owner)
+			}
+		}
+		sort.Strings(owners)
+
+		for _, owner := range owners {
+			if stored[owner] != owned[owner] {
+				problems = append(problems, LockInconsistency{
+					Problem: lockCountMismatch,
+					Owner:   owner,
+					Stored:  stored[owner],
+					Actual:  owned[owner],
+				})
+			}
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// RepairLockCounts rebuilds the lock counts from the locks in the store,
+// returning how many owners' counts were wrong. Duplicate paths and ids
+// can't be repaired, as there's no telling which lock should be kept.
+func (s *MetaStore) RepairLockCounts() (int, error) {
+	if Config().IsReadOnly() {
+		return 0, errReadOnly
+	}
+
+	var repaired int
+	err := s.update(func(tx kvTx) error {
+		repaired = 0
+
+		owned, _, err := scanLocks(tx)
+		if err != nil {
+			return err
+		}
+
+		counts := tx.Bucket(lockCountsBucket)
+		if counts == nil {
+			return errNoBucket
+		}
+
+		// Keys can't be deleted while iterating, so stale ones are collected first
+		var stale []string
+		err = counts.ForEach(func(k, v []byte) error {
+			if _, ok := owned[string(k)]; !ok {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, owner := range stale {
+			repaired++
+			if err := counts.Delete([]byte(owner)); err != nil {
+				return err
+			}
+		}
+
+		for owner, count := range owned {
+			if getLockCount(counts, owner) == count {
+				continue
+			}
+			repaired++
+			if err := putLockCount(counts, owner, count); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return repaired, err
+}
+
+// scanLocks counts the locks each owner holds across every repo, and reports
+// paths and ids that are used more than once in a repo, along with repos
+// whose locks can't be decoded.
+func scanLocks(tx kvTx) (map[string]int, []LockInconsistency, error) {
+	bucket := tx.Bucket(locksBucket)
+	if bucket == nil {
+		return nil, nil, errNoBucket
+	}
+
+	owned := make(map[string]int)
+	var duplicates []LockInconsistency
+	err := bucket.ForEach(func(k, v []byte) error {
+		repo := string(k)
+		var locks []Lock
+		if err := json.Unmarshal(v, &locks); err != nil {
+			logCorruptRecord(locksBucket, k, err)
+			duplicates = append(duplicates, LockInconsistency{Problem: corruptLocks, Repo: repo, Error: err.Error()})
+			return nil
+		}
+
+		paths := make(map[string]bool)
+		ids := make(map[string]bool)
+		for _, l := range locks {
+			owned[l.Owner.Name]++
+
+			key := lockPathKey(l.Path)
+			if paths[key] {
+				duplicates = append(duplicates, LockInconsistency{Problem: duplicateLockPath, Repo: repo, Path: l.Path, LockId: l.Id})
+			}
+			paths[key] = true
+
+			if ids[l.Id] {
+				duplicates = append(duplicates, LockInconsistency{Problem: duplicateLockId, Repo: repo, Path: l.Path, LockId: l.Id})
+			}
+			ids[l.Id] = true
+		}
+		return nil
+	})
+	return owned, duplicates, err
+}
+
+// errStopScan ends a ForEach early without it being an error.
+var errStopScan = errors.New("Scan stopped")
+
+// Kinds of ContentInconsistency.
+const (
+	// contentMissing is an object with no content in the content store.
+	contentMissing = "missing_content"
+	// contentSizeMismatch is an object whose content isn't the size recorded
+	// in its meta information.
+	contentSizeMismatch = "size_mismatch"
+	// contentUnreadable is an object whose content couldn't be checked.
+	contentUnreadable = "unreadable"
+	// corruptMeta is an object whose meta information can't be decoded.
+	corruptMeta = "corrupt_meta"
+)
+
+// ContentInconsistency is a problem found by VerifyContent. Actual is only set
+// for size mismatches, and Error for content that couldn't be checked or meta
+// information that couldn't be decoded.
+type ContentInconsistency struct {
+	Problem string `json:"problem"`
+	Oid     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actual  int64  `json:"actual,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// VerifyContent checks that content has the content of each object in the
+// store, of the recorded size, calling found with every problem as it is
+// found. Soft deleted objects are skipped. A limit above 0 stops the check
+// after that many objects. It returns the number of objects checked, and
+// stops with ctx's error if ctx is done. Objects are read with scanBatches,
+// so the content store is only called between transactions.
+func (s *MetaStore) VerifyContent(ctx context.Context, content ContentStore, limit int, found func(ContentInconsistency) error) (int, error) {
+	// pending holds the objects of a batch, or the problems with records
+	// that couldn't be decoded, in the order they were read
+	type pendingCheck struct {
+		meta    *MetaObject
+		problem *ContentInconsistency
+	}
+	var pending []pendingCheck
+	var queued, checked int
+
+	read := func(tx kvTx, k, v []byte) error {
+		if limit > 0 && queued == limit {
+			return nil
+		}
+
+		meta := &MetaObject{}
+		if err := decodeMeta(v, meta); err != nil {
+			logCorruptRecord(objectsBucket, k, err)
+			pending = append(pending, pendingCheck{problem: &ContentInconsistency{Problem: corruptMeta, Oid: string(k), Error: err.Error()}})
+			return nil
+		}
+		if meta.Deleted() {
+			return nil
+		}
+		queued++
+		pending = append(pending, pendingCheck{meta: meta})
+		return nil
+	}
+
+	check := func() error {
+		defer func() { pending = pending[:0] }()
+
+		for _, p := range pending {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if p.problem != nil {
+				if err := found(*p.problem); err != nil {
+					return err
+				}
+				continue
+			}
+
+			meta := p.meta
+			checked++
+
+			size, err := content.Size(meta)
+			switch {
+			case err == errObjectNotFound:
+				err = found(ContentInconsistency{Problem: contentMissing, Oid: meta.Oid, Size: meta.Size})
+			case err != nil:
+				err = found(ContentInconsistency{Problem: contentUnreadable, Oid: meta.Oid, Size: meta.Size, Error: err.Error()})
+			case size != meta.Size:
+				err = found(ContentInconsistency{Problem: contentSizeMismatch, Oid: meta.Oid, Size: meta.Size, Actual: size})
+			default:
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if limit > 0 && queued == limit {
+			return errStopScan
+		}
+		return ctx.Err()
+	}
+
+	err := s.scanBatches(objectsBucket, read, check)
+	if err == errStopScan {
+		err = nil
+	}
+	return checked, err
+}
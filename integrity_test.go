@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// putRawLocks stores locks for repo as they are, bypassing the checks and
+// counts kept by AddLocks.
+func putRawLocks(t *testing.T, store *MetaStore, repo string, locks ...Lock) {
+	err := store.update(func(tx kvTx) error {
+		data, err := json.Marshal(&locks)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(locksBucket).Put([]byte(repo), data)
+	})
+	if err != nil {
+		t.Fatalf("error storing locks: %s", err)
+	}
+}
+
+func TestVerifyLockIntegrity(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	_, err := metaStoreTest.AddLocks(testRepo, NewTestLock("lock-1", "a.bin", testUser), NewTestLock("lock-2", "b.bin", testUser1))
+	if err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	problems, err := metaStoreTest.VerifyLockIntegrity()
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("expected no inconsistencies, got: %+v (%v)", problems, err)
+	}
+
+	// Lock a path twice and reuse an id behind the store's back, leaving the
+	// counts behind
+	putRawLocks(t, metaStoreTest, "other-repo",
+		NewTestLock("lock-3", "c.bin", testUser),
+		NewTestLock("lock-4", "c.bin", testUser),
+		NewTestLock("lock-3", "d.bin", testUser1))
+
+	problems, err = metaStoreTest.VerifyLockIntegrity()
+	if err != nil {
+		t.Fatalf("expected VerifyLockIntegrity to succeed, got : %s", err)
+	}
+
+	expected := []LockInconsistency{
+		{Problem: duplicateLockPath, Repo: "other-repo", Path: "c.bin", LockId: "lock-4"},
+		{Problem: duplicateLockId, Repo: "other-repo", Path: "d.bin", LockId: "lock-3"},
+		{Problem: lockCountMismatch, Owner: testUser, Stored: 1, Actual: 3},
+		{Problem: lockCountMismatch, Owner: testUser1, Stored: 1, Actual: 2},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d inconsistencies, got: %+v", len(expected), problems)
+	}
+	for i := range expected {
+		if problems[i] != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], problems[i])
+		}
+	}
+}
+
+func TestRepairLockCounts(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	putRawLocks(t, metaStoreTest, testRepo, NewTestLock("lock-1", "a.bin", testUser), NewTestLock("lock-2", "b.bin", testUser))
+	err := metaStoreTest.update(func(tx kvTx) error {
+		return putLockCount(tx.Bucket(lockCountsBucket), "gone", 4)
+	})
+	if err != nil {
+		t.Fatalf("error storing lock count: %s", err)
+	}
+
+	repaired, err := metaStoreTest.RepairLockCounts()
+	if err != nil {
+		t.Fatalf("expected RepairLockCounts to succeed, got : %s", err)
+	}
+	if repaired != 2 {
+		t.Errorf("expected 2 counts to be repaired, got %d", repaired)
+	}
+
+	problems, err := metaStoreTest.VerifyLockIntegrity()
+	if err != nil || len(problems) != 0 {
+		t.Errorf("expected no inconsistencies after repair, got: %+v (%v)", problems, err)
+	}
+
+	// The repaired count is used for lock limits
+	Config().MaxUserLocks = "2"
+	defer func() { Config().MaxUserLocks = "0" }()
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock("lock-3", "c.bin", testUser)); err != errLockLimit {
+		t.Errorf("expected errLockLimit, got: %v", err)
+	}
+}
+
+func TestVerifyContent(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+	setup()
+	defer teardown()
+
+	if err := contentStore.Put(&MetaObject{Oid: contentOid, Size: contentSize}, bytes.NewBufferString(content)); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+
+	// otherOid has no content, and nonExistingOid's content is cut short
+	for _, oid := range []string{otherOid, nonExistingOid} {
+		if _, err := metaStoreTest.Put(&RequestVars{Oid: oid, Size: contentSize}); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
+	}
+	path := contentStore.path(nonExistingOid)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		t.Fatalf("error creating content dir: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content[:5]), 0640); err != nil {
+		t.Fatalf("error writing content: %s", err)
+	}
+
+	defer func(n int) { scanBatchSize = n }(scanBatchSize)
+	scanBatchSize = 2
+
+	problems := make(map[string]ContentInconsistency)
+	checked, err := metaStoreTest.VerifyContent(context.Background(), contentStore, 0, func(p ContentInconsistency) error {
+		problems[p.Oid] = p
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected VerifyContent to succeed, got : %s", err)
+	}
+	if checked != 3 {
+		t.Errorf("expected 3 objects to be checked, got: %d", checked)
+	}
+
+	expected := map[string]ContentInconsistency{
+		otherOid:       {Problem: contentMissing, Oid: otherOid, Size: contentSize},
+		nonExistingOid: {Problem: contentSizeMismatch, Oid: nonExistingOid, Size: contentSize, Actual: 5},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got: %+v", len(expected), problems)
+	}
+	for oid, p := range expected {
+		if problems[oid] != p {
+			t.Errorf("expected %+v, got %+v", p, problems[oid])
+		}
+	}
+
+	checked, err = metaStoreTest.VerifyContent(context.Background(), contentStore, 1, func(ContentInconsistency) error { return nil })
+	if err != nil || checked != 1 {
+		t.Errorf("expected a limit of 1 to check one object, got %d (%v)", checked, err)
+	}
+}
+
+func TestScanSkipsCorruptRecords(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+	setup()
+	defer teardown()
+
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock("lock-1", "a.bin", testUser)); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	err := metaStoreTest.update(func(tx kvTx) error {
+		if err := tx.Bucket(objectsBucket).Put([]byte(otherOid), []byte("not an object")); err != nil {
+			return err
+		}
+		return tx.Bucket(locksBucket).Put([]byte("corrupt-repo"), []byte("not locks"))
+	})
+	if err != nil {
+		t.Fatalf("error storing corrupt records: %s", err)
+	}
+
+	objects, err := metaStoreTest.Objects(context.Background())
+	if err != nil {
+		t.Fatalf("expected Objects to skip the corrupt object, got : %s", err)
+	}
+	if len(objects) != 1 || objects[0].Oid != contentOid {
+		t.Errorf("expected only the good object, got: %+v", objects)
+	}
+
+	locks, err := metaStoreTest.AllLocks(context.Background())
+	if err != nil {
+		t.Fatalf("expected AllLocks to skip the corrupt locks, got : %s", err)
+	}
+	if len(locks) != 1 || locks[0].Id != "lock-1" {
+		t.Errorf("expected only the good lock, got: %+v", locks)
+	}
+
+	problems, err := metaStoreTest.VerifyLockIntegrity()
+	if err != nil {
+		t.Fatalf("expected VerifyLockIntegrity to succeed, got : %s", err)
+	}
+	if len(problems) != 1 || problems[0].Problem != corruptLocks || problems[0].Repo != "corrupt-repo" || problems[0].Error == "" {
+		t.Errorf("expected the corrupt locks to be reported, got: %+v", problems)
+	}
+
+	var found []ContentInconsistency
+	_, err = metaStoreTest.VerifyContent(context.Background(), contentStore, 0, func(problem ContentInconsistency) error {
+		found = append(found, problem)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected VerifyContent to succeed, got : %s", err)
+	}
+	var corrupt int
+	for _, problem := range found {
+		if problem.Problem == corruptMeta && problem.Oid == otherOid {
+			corrupt++
+		}
+	}
+	if corrupt != 1 {
+		t.Errorf("expected the corrupt object to be reported, got: %+v", found)
+	}
+
+	stats, err := metaStoreTest.Stats()
+	if err != nil {
+		t.Fatalf("expected Stats to skip the corrupt records, got : %s", err)
+	}
+	if stats.Objects != 1 || stats.Locks != 1 {
+		t.Errorf("expected only the good records to be counted, got: %+v", stats)
+	}
+	if count, err := metaStoreTest.CountObjects(); err != nil || count != 1 {
+		t.Errorf("expected CountObjects to skip the corrupt object, got %d (%v)", count, err)
+	}
+	if count, err := metaStoreTest.CountLocks(); err != nil || count != 1 {
+		t.Errorf("expected CountLocks to skip the corrupt locks, got %d (%v)", count, err)
+	}
+	if _, err := metaStoreTest.Purge(0, true); err != nil {
+		t.Errorf("expected Purge to skip the corrupt object, got : %s", err)
+	}
+	if transferred, err := metaStoreTest.TransferLocks(testUser, testUser1); err != nil || countRepoLocks(transferred) != 1 {
+		t.Errorf("expected TransferLocks to skip the corrupt locks, got %+v (%v)", transferred, err)
+	}
+
+	var exported bytes.Buffer
+	if err := metaStoreTest.Export(context.Background(), &exported); err != nil {
+		t.Fatalf("expected Export to skip the corrupt records, got : %s", err)
+	}
+	doc, err := decodeExport(&exported)
+	if err != nil {
+		t.Fatalf("expected the export to decode, got : %s", err)
+	}
+	if len(doc.Objects) != 1 || len(doc.Locks) != 1 {
+		t.Errorf("expected only the good records to be exported, got: %+v", doc)
+	}
+
+	if owned, err := metaStoreTest.DeleteUser(testUser1, true); err != nil || countRepoLocks(owned) != 1 {
+		t.Errorf("expected DeleteUser to skip the corrupt locks, got %+v (%v)", owned, err)
+	}
+
+	err = metaStoreTest.update(func(tx kvTx) error {
+		return tx.Bucket(usersBucket).Put([]byte("corrupt-user"), []byte("not a user"))
+	})
+	if err != nil {
+		t.Fatalf("error storing corrupt user: %s", err)
+	}
+	users, err := metaStoreTest.Users()
+	if err != nil {
+		t.Fatalf("expected Users to skip the corrupt user, got : %s", err)
+	}
+	for _, u := range users {
+		if u.Name == "corrupt-user" {
+			t.Errorf("expected the corrupt user to be left out, got: %+v", u)
+		}
+	}
+}
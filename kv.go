@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// kvTx is the part of a boltdb transaction used by the MetaStore, so that the
+// store can also be kept in memory. See memoryDB.
+type kvTx interface {
+	// Bucket returns the top level bucket with name, or nil if there isn't one.
+	Bucket(name []byte) kvBucket
+	CreateBucketIfNotExists(name []byte) (kvBucket, error)
+	// Size returns the size of the database in bytes.
+	Size() int64
+}
+
+// kvBucket is a boltdb bucket. ForEach and cursors go through keys in byte
+// order, and give a nil value for nested buckets.
+type kvBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() kvCursor
+	Bucket(name []byte) kvBucket
+	CreateBucketIfNotExists(name []byte) (kvBucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// kvCursor walks the keys of a kvBucket.
+type kvCursor interface {
+	Last() (key, value []byte)
+	Prev() (key, value []byte)
+	// Seek moves to the first key at or after seek.
+	Seek(seek []byte) (key, value []byte)
+	Next() (key, value []byte)
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) kvBucket {
+	return wrapBoltBucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	return wrapBoltBucket(b), err
+}
+
+func (t boltTx) Size() int64 {
+	return t.tx.Size()
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// wrapBoltBucket returns b as a kvBucket, keeping a missing bucket nil.
+func wrapBoltBucket(b *bolt.Bucket) kvBucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (b boltBucket) Get(key []byte) []byte          { return b.b.Get(key) }
+func (b boltBucket) Put(key, value []byte) error    { return b.b.Put(key, value) }
+func (b boltBucket) Delete(key []byte) error        { return b.b.Delete(key) }
+func (b boltBucket) Cursor() kvCursor               { return b.b.Cursor() }
+func (b boltBucket) Bucket(name []byte) kvBucket    { return wrapBoltBucket(b.b.Bucket(name)) }
+func (b boltBucket) DeleteBucket(name []byte) error { return b.b.DeleteBucket(name) }
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	nested, err := b.b.CreateBucketIfNotExists(name)
+	return wrapBoltBucket(nested), err
+}
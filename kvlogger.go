@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -39,7 +40,8 @@ func NewKVLogger(out io.Writer) *KVLogger {
 	return &KVLogger{w: out}
 }
 
-// Log logs the key/value pairs to the logger's output.
+// Log logs the key/value pairs to the logger's output. Entries are written as
+// plain text or, when Config.LogFormat is "json", as one JSON object per line.
 func (l *KVLogger) Log(data kv) {
 	var file string
 	var line int
@@ -53,19 +55,42 @@ func (l *KVLogger) Log(data kv) {
 		line = 0
 	}
 
-	out := fmt.Sprintf("%s %s lfs[%d] [%s:%d]: ", time.Now().UTC().Format(time.RFC3339), hostname, pid, file, line)
-	var vals []string
+	now := time.Now().UTC().Format(time.RFC3339)
 
-	for k, v := range data {
-		vals = append(vals, fmt.Sprintf("%s=%v", k, v))
+	var out string
+	if Config().IsLoggingJSON() {
+		entry := kv{"time": now, "host": hostname, "pid": pid, "caller": fmt.Sprintf("%s:%d", file, line)}
+		for k, v := range data {
+			entry[k] = v
+		}
+
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b, _ = json.Marshal(kv{"time": now, "host": hostname, "pid": pid, "err": "Could not encode log entry: " + err.Error()})
+		}
+		out = string(b)
+	} else {
+		out = fmt.Sprintf("%s %s lfs[%d] [%s:%d]: ", now, hostname, pid, file, line)
+		var vals []string
+
+		for k, v := range data {
+			vals = append(vals, fmt.Sprintf("%s=%v", k, v))
+		}
+		out += strings.Join(vals, " ")
 	}
-	out += strings.Join(vals, " ")
 
 	l.mu.Lock()
 	fmt.Fprint(l.w, out+"\n")
 	l.mu.Unlock()
 }
 
+// Print writes line to the logger's output as it is.
+func (l *KVLogger) Print(line string) {
+	l.mu.Lock()
+	fmt.Fprint(l.w, line+"\n")
+	l.mu.Unlock()
+}
+
 // Fatal is equivalent to Log() follwed by a call to os.Exit(1)
 func (l *KVLogger) Fatal(data kv) {
 	l.Log(data)
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ldapTimeout = 10 * time.Second
+
+var errLDAPResponse = errors.New("Malformed LDAP response")
+
+// LDAPAuthenticator validates credentials with a simple bind against an LDAP
+// server. Successful binds are cached for a while to limit the load on the
+// server.
+type LDAPAuthenticator struct {
+	url    string
+	userDN string
+	ttl    time.Duration
+	bind   func(url, dn, pass string) error
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]ldapCacheEntry
+}
+
+type ldapCacheEntry struct {
+	pass    [sha256.Size]byte
+	expires time.Time
+}
+
+// NewLDAPAuthenticator creates an LDAPAuthenticator binding to the server at
+// url. userDN is the DN to bind as, with %s replaced by the user name.
+func NewLDAPAuthenticator(url, userDN string, ttl time.Duration) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		url:    url,
+		userDN: userDN,
+		ttl:    ttl,
+		bind:   ldapBind,
+		now:    time.Now,
+		cache:  make(map[string]ldapCacheEntry),
+	}
+}
+
+func (a *LDAPAuthenticator) Validate(user, pass string) bool {
+	// An empty password would be an unauthenticated bind, which many servers
+	// accept for any DN
+	if user == "" || pass == "" {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(pass))
+	if a.cached(user, hash) {
+		return true
+	}
+
+	dn := strings.Replace(a.userDN, "%s", escapeDN(user), -1)
+	if err := a.bind(a.url, dn, pass); err != nil {
+		logger.Log(kv{"fn": "ldap", "user": user, "err": err.Error()})
+		return false
+	}
+
+	a.mu.Lock()
+	a.cache[user] = ldapCacheEntry{pass: hash, expires: a.now().Add(a.ttl)}
+	a.mu.Unlock()
+	return true
+}
+
+func (a *LDAPAuthenticator) cached(user string, hash [sha256.Size]byte) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.cache[user]
+	if !ok {
+		return false
+	}
+	if a.now().After(entry.expires) {
+		delete(a.cache, user)
+		return false
+	}
+	return secureCompare(string(entry.pass[:]), string(hash[:]))
+}
+
+// escapeDN escapes the characters that are special in a DN attribute value.
+func escapeDN(v string) string {
+	var buf bytes.Buffer
+	for i, c := range v {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(v)-1):
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		case c == 0:
+			buf.WriteString(`\00`)
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+// ldapBind performs a simple bind as dn against the LDAP server at rawurl,
+// returning nil if the server accepted the credentials.
+func ldapBind(rawurl, dn, pass string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", ldapHostPort(u.Host, "389"))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", ldapHostPort(u.Host, "636"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return fmt.Errorf("Unsupported LDAP protocol: %s", u.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	// LDAPMessage ::= SEQUENCE { messageID, BindRequest ::= [APPLICATION 0] SEQUENCE {
+	//     version, name, authentication simple [0] } }
+	request := berTLV(0x30, berTLV(0x02, []byte{1}),
+		berTLV(0x60, berTLV(0x02, []byte{3}), berTLV(0x04, []byte(dn)), berTLV(0x80, []byte(pass))))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// BindResponse ::= [APPLICATION 1] SEQUENCE { resultCode ENUMERATED, ... }
+	tag, message, err := berRead(bufio.NewReader(conn))
+	if err != nil || tag != 0x30 {
+		return errLDAPResponse
+	}
+	r := bytes.NewReader(message)
+	if tag, _, err = berRead(r); err != nil || tag != 0x02 {
+		return errLDAPResponse
+	}
+	if tag, message, err = berRead(r); err != nil || tag != 0x61 {
+		return errLDAPResponse
+	}
+	tag, result, err := berRead(bytes.NewReader(message))
+	if err != nil || tag != 0x0a || len(result) != 1 {
+		return errLDAPResponse
+	}
+
+	if result[0] != 0 {
+		return fmt.Errorf("LDAP bind failed with result code %d", result[0])
+	}
+	return nil
+}
+
+func ldapHostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// berTLV encodes a BER element with the given tag and contents.
+func berTLV(tag byte, contents ...[]byte) []byte {
+	var body []byte
+	for _, c := range contents {
+		body = append(body, c...)
+	}
+
+	out := []byte{tag}
+	if n := len(body); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, body...)
+}
+
+// berRead reads a single BER element, returning its tag and contents.
+func berRead(r io.ByteReader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := int(b)
+	if b&0x80 != 0 {
+		if b&0x7f > 3 {
+			return 0, nil, errLDAPResponse
+		}
+		length = 0
+		for i := byte(0); i < b&0x7f; i++ {
+			if b, err = r.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+
+	contents := make([]byte, length)
+	for i := range contents {
+		if contents[i], err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+	return tag, contents, nil
+}
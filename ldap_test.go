@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// mockLDAP accepts binds for the DNs and passwords it holds.
+type mockLDAP struct {
+	users map[string]string
+	binds int
+}
+
+func (m *mockLDAP) bind(url, dn, pass string) error {
+	m.binds++
+	if p, ok := m.users[dn]; ok && p == pass {
+		return nil
+	}
+	return errors.New("invalid credentials")
+}
+
+func newTestLDAPAuthenticator(m *mockLDAP) *LDAPAuthenticator {
+	a := NewLDAPAuthenticator("ldap://localhost", "uid=%s,ou=people,dc=example,dc=com", time.Minute)
+	a.bind = m.bind
+	return a
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	m := &mockLDAP{users: map[string]string{"uid=frodo,ou=people,dc=example,dc=com": "ring"}}
+	a := newTestLDAPAuthenticator(m)
+
+	if !a.Validate("frodo", "ring") {
+		t.Errorf("expected frodo to bind")
+	}
+	if a.Validate("frodo", "wrong") {
+		t.Errorf("expected a wrong password to be rejected")
+	}
+	if a.Validate("sam", "ring") {
+		t.Errorf("expected an unknown user to be rejected")
+	}
+	if a.Validate("frodo", "") {
+		t.Errorf("expected an empty password to be rejected")
+	}
+}
+
+func TestLDAPAuthenticatorCache(t *testing.T) {
+	m := &mockLDAP{users: map[string]string{"uid=frodo,ou=people,dc=example,dc=com": "ring"}}
+	a := newTestLDAPAuthenticator(m)
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	a.Validate("frodo", "ring")
+	a.Validate("frodo", "ring")
+	if m.binds != 1 {
+		t.Errorf("expected a successful bind to be cached, got %d binds", m.binds)
+	}
+
+	if a.Validate("frodo", "wrong") {
+		t.Errorf("expected a wrong password to be rejected while cached")
+	}
+
+	now = now.Add(2 * time.Minute)
+	a.Validate("frodo", "ring")
+	if m.binds != 3 {
+		t.Errorf("expected to bind again once the cache expired, got %d binds", m.binds)
+	}
+}
+
+func TestAuthChainFallthrough(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	m := &mockLDAP{users: map[string]string{"uid=frodo,ou=people,dc=example,dc=com": "ring"}}
+	chain := authChain{metaStoreTest, newTestLDAPAuthenticator(m)}
+
+	if !chain.Validate(testUser, testPass) {
+		t.Errorf("expected local user to be validated")
+	}
+	if m.binds != 0 {
+		t.Errorf("expected local user to not be checked against LDAP")
+	}
+
+	if !chain.Validate("frodo", "ring") {
+		t.Errorf("expected LDAP user to be validated")
+	}
+	if chain.Validate("sam", "potatoes") {
+		t.Errorf("expected unknown user to be rejected")
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	cases := map[string]string{
+		"frodo":          "frodo",
+		"baggins,frodo":  `baggins\,frodo`,
+		"*)(uid=*":       `*)(uid\=*`,
+		"#frodo ":        `\#frodo\ `,
+		`a+b"c\d<e>f;g`:  `a\+b\"c\\d\<e\>f\;g`,
+		" frodo":         `\ frodo`,
+		"fro\x00do":      `fro\00do`,
+		"frodo#baggins ": `frodo#baggins\ `,
+	}
+
+	for in, expected := range cases {
+		if got := escapeDN(in); got != expected {
+			t.Errorf("escapeDN(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
+
+func TestLDAPBind(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer listener.Close()
+
+	// Answer each bind with success for "ring" and invalidCredentials (49)
+	// for anything else.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			_, message, err := berRead(bufio.NewReader(conn))
+			if err == nil {
+				result := byte(49)
+				if bytes.HasSuffix(message, berTLV(0x80, []byte("ring"))) {
+					result = 0
+				}
+				conn.Write(berTLV(0x30, berTLV(0x02, []byte{1}),
+					berTLV(0x61, berTLV(0x0a, []byte{result}), berTLV(0x04, nil), berTLV(0x04, nil))))
+			}
+			conn.Close()
+		}
+	}()
+
+	url := "ldap://" + listener.Addr().String()
+	if err := ldapBind(url, "uid=frodo,dc=example,dc=com", "ring"); err != nil {
+		t.Errorf("expected bind to succeed, got: %s", err)
+	}
+	if err := ldapBind(url, "uid=frodo,dc=example,dc=com", "wrong"); err == nil {
+		t.Errorf("expected bind with a wrong password to fail")
+	}
+}
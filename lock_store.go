@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// LockStore keeps the locks served by the lock API. The MetaStore keeps them
+// in its boltdb file, which only one server process can open; the interface
+// leaves room for a store that several servers share.
+type LockStore interface {
+	// AddLocks adds locks to a repo and returns them as stored, failing with
+	// errLockIdExists if an id is taken, errPathLocked if a path is locked
+	// and errLockLimit if a lock limit would be exceeded.
+	AddLocks(repo string, l ...Lock) ([]Lock, error)
+	// AddLocksBatch locks paths in a repo for owner, returning the paths that
+	// were already locked as conflicts.
+	AddLocksBatch(repo string, paths []string, owner string) ([]Lock, []LockConflict, error)
+
+	// Lock returns the lock with id in a repo, or nil if there isn't one.
+	Lock(repo, id string) (*Lock, error)
+	// Locks returns every lock in a repo, oldest first.
+	Locks(repo string) ([]Lock, error)
+	// FilteredLocks returns a page of a repo's locks, with the cursor of the
+	// next page.
+	FilteredLocks(ctx context.Context, repo, path, owner, cursor, limit string) ([]Lock, string, error)
+	// AllLocks returns the locks of every repo.
+	AllLocks(ctx context.Context) ([]Lock, error)
+	// LockCount returns how many of a repo's locks are on matchpath, or how
+	// many it has if matchpath is empty.
+	LockCount(repo, matchpath string) (int, error)
+	// LocksModified returns when a repo's locks last changed.
+	LocksModified(repo string) (time.Time, error)
+
+	// DeleteLock and DeleteLockByPath remove a lock, returning nil if there
+	// is no such lock and errNotOwner if user doesn't own it and force isn't
+	// set.
+	DeleteLock(repo, user, id string, force bool, lockedAt time.Time) (*Lock, error)
+	DeleteLockByPath(repo, user, path string, force bool, lockedAt time.Time) (*Lock, error)
+	// RenameLock moves a lock to newPath, keeping its id.
+	RenameLock(repo, user, id, newPath string, force bool) (*Lock, error)
+}
+
+var _ LockStore = (*MetaStore)(nil)
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestLockStore goes through the lock API's operations using only the
+// LockStore interface.
+func TestLockStore(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	var store LockStore = metaStoreTest
+
+	lock := NewTestLock(randomLockId(), "a.bin", testUser)
+	if _, err := store.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	created, conflicts, err := store.AddLocksBatch(testRepo, []string{"a.bin", "b.bin"}, testUser1)
+	if err != nil {
+		t.Fatalf("expected AddLocksBatch to succeed, got : %s", err)
+	}
+	if len(created) != 1 || len(conflicts) != 1 {
+		t.Fatalf("expected 1 lock and 1 conflict, got %d and %d", len(created), len(conflicts))
+	}
+
+	got, err := store.Lock(testRepo, lock.Id)
+	if err != nil || got == nil || got.Path != "a.bin" {
+		t.Errorf("expected Lock to find the lock, got %+v (%v)", got, err)
+	}
+	if got, err := store.Lock(testRepo, "missing"); err != nil || got != nil {
+		t.Errorf("expected no lock for a missing id, got %+v (%v)", got, err)
+	}
+
+	if locks, err := store.Locks(testRepo); err != nil || len(locks) != 2 {
+		t.Errorf("expected 2 locks, got %d (%v)", len(locks), err)
+	}
+	if locks, _, err := store.FilteredLocks(context.Background(), testRepo, "", testUser1, "", ""); err != nil || len(locks) != 1 {
+		t.Errorf("expected 1 lock owned by %s, got %d (%v)", testUser1, len(locks), err)
+	}
+	if locks, err := store.AllLocks(context.Background()); err != nil || len(locks) != 2 {
+		t.Errorf("expected 2 locks across repos, got %d (%v)", len(locks), err)
+	}
+	if count, err := store.LockCount(testRepo, "b.bin"); err != nil || count != 1 {
+		t.Errorf("expected 1 lock on b.bin, got %d (%v)", count, err)
+	}
+	if modified, err := store.LocksModified(testRepo); err != nil || modified.IsZero() {
+		t.Errorf("expected the locks to have been modified, got %s (%v)", modified, err)
+	}
+
+	renamed, err := store.RenameLock(testRepo, testUser, lock.Id, "c.bin", false)
+	if err != nil || renamed == nil || renamed.Path != "c.bin" {
+		t.Errorf("expected RenameLock to move the lock, got %+v (%v)", renamed, err)
+	}
+
+	if _, err := store.DeleteLock(testRepo, testUser1, lock.Id, false, time.Time{}); err != errNotOwner {
+		t.Errorf("expected errNotOwner, got : %v", err)
+	}
+	if deleted, err := store.DeleteLock(testRepo, testUser, lock.Id, false, time.Time{}); err != nil || deleted == nil {
+		t.Errorf("expected DeleteLock to delete the lock, got %+v (%v)", deleted, err)
+	}
+	if deleted, err := store.DeleteLockByPath(testRepo, testUser1, "b.bin", false, time.Time{}); err != nil || deleted == nil {
+		t.Errorf("expected DeleteLockByPath to delete the lock, got %+v (%v)", deleted, err)
+	}
+	if locks, err := store.Locks(testRepo); err != nil || len(locks) != 0 {
+		t.Errorf("expected no locks to be left, got %d (%v)", len(locks), err)
+	}
+}
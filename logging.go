@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// responseWriter wraps an http.ResponseWriter, recording the status code and
+// the number of bytes written so they can be logged once the request is done.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// logRequests wraps h and logs every request it serves along with its status,
+// response size and latency. When Config.LogFormat is "combined" requests are
+// logged as combinedLogLine instead.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := context.Get(r, "RequestID")
+		start := time.Now()
+
+		rw := &responseWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if Config().IsLoggingCombined() {
+			logger.Print(combinedLogLine(r, start, status, rw.bytes))
+			return
+		}
+
+		logger.Log(kv{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      status,
+			"bytes":       rw.bytes,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"remote_addr": r.RemoteAddr,
+			"request_id":  requestID,
+		})
+	})
+}
+
+// combinedLogLine formats a request in the Combined Log Format:
+//
+//	host ident user [time] "request line" status bytes "referer" "user agent"
+//
+// The user is the one the request authenticated as, so a username sent with
+// a bad password is not logged. Missing values are "-".
+func combinedLogLine(r *http.Request, start time.Time, status int, bytes int64) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	user, _ := context.Get(r, "USER").(string)
+
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s "%s" "%s"`,
+		orDash(host),
+		escapeLogField(orDash(user)),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, escapeLogValue(r.URL.RequestURI()), r.Proto,
+		status,
+		size,
+		escapeLogValue(orDash(r.Referer())),
+		escapeLogValue(orDash(r.UserAgent())))
+}
+
+// orDash returns v, or "-" if it is empty.
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// escapeLogValue escapes quotes and backslashes in v so it can be quoted in
+// a log line.
+func escapeLogValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v)
+}
+
+// escapeLogField escapes v so it can be logged as an unquoted field. Spaces,
+// quotes, backslashes and unprintable bytes are written as \xhh, so a field
+// can't be mistaken for the ones after it.
+func escapeLogField(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\\' {
+			fmt.Fprintf(&b, `\x%02x`, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
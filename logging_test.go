@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/context"
+)
+
+func TestLogRequestsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger = NewKVLogger(&buf)
+	Config().LogFormat = "json"
+	defer func() {
+		logger = NewKVLogger(ioutil.Discard)
+		Config().LogFormat = "text"
+	}()
+
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+
+	req, _ := http.NewRequest("POST", "/user/repo/locks", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	context.Set(req, "RequestID", "test-request-id")
+	defer context.Clear(req)
+
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected log line to be json, got error: %s (%q)", err, buf.String())
+	}
+
+	expected := map[string]interface{}{
+		"method":      "POST",
+		"path":        "/user/repo/locks",
+		"status":      float64(201),
+		"bytes":       float64(5),
+		"remote_addr": "10.0.0.1:1234",
+		"request_id":  "test-request-id",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("expected %s to be %v, got: %v", k, v, entry[k])
+		}
+	}
+
+	if _, ok := entry["duration_ms"].(float64); !ok {
+		t.Errorf("expected duration_ms to be logged, got: %v", entry["duration_ms"])
+	}
+}
+
+func TestLogRequestsText(t *testing.T) {
+	var buf bytes.Buffer
+	logger = NewKVLogger(&buf)
+	defer func() {
+		logger = NewKVLogger(ioutil.Discard)
+	}()
+
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+
+	req, _ := http.NewRequest("GET", "/user/repo/locks", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, field := range []string{"method=GET", "path=/user/repo/locks", "status=200", "bytes=5"} {
+		if !bytes.Contains(buf.Bytes(), []byte(field)) {
+			t.Errorf("expected log line to contain %q, got: %s", field, buf.String())
+		}
+	}
+}
+
+func TestLogRequestsCombined(t *testing.T) {
+	var buf bytes.Buffer
+	logger = NewKVLogger(&buf)
+	Config().LogFormat = "combined"
+	defer func() {
+		logger = NewKVLogger(ioutil.Discard)
+		Config().LogFormat = "text"
+	}()
+
+	// The handler stands in for authentication, accepting only testPass
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && pass == testPass {
+			context.Set(r, "USER", user)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+
+	req, _ := http.NewRequest("POST", "/user/repo/locks?limit=1", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.SetBasicAuth(testUser, testPass)
+	defer context.Clear(req)
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("User-Agent", `git-lfs/2.0 "test"`)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	combined := regexp.MustCompile(`^10\.0\.0\.1 - ` + testUser + ` \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /user/repo/locks\?limit=1 HTTP/1\.1" 201 5 "http://example\.com/" "git-lfs/2\.0 \\"test\\""\n$`)
+	if !combined.Match(buf.Bytes()) {
+		t.Errorf("expected a combined log line, got: %q", buf.String())
+	}
+
+	buf.Reset()
+	req, _ = http.NewRequest("GET", "/user/repo/locks", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	anonymous := regexp.MustCompile(`^10\.0\.0\.2 - - \[[^\]]+\] "GET /user/repo/locks HTTP/1\.1" 201 5 "-" "-"\n$`)
+	if !anonymous.Match(buf.Bytes()) {
+		t.Errorf("expected missing values to be logged as -, got: %q", buf.String())
+	}
+
+	// A username sent with a bad password was never authenticated
+	buf.Reset()
+	req, _ = http.NewRequest("GET", "/user/repo/locks", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.SetBasicAuth("mallory", "wrong")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !anonymous.Match(buf.Bytes()) {
+		t.Errorf("expected an unauthenticated user to be logged as -, got: %q", buf.String())
+	}
+
+	buf.Reset()
+	req, _ = http.NewRequest("GET", "/user/repo/locks", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.SetBasicAuth(`a "b"\c`, testPass)
+	defer context.Clear(req)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	escaped := regexp.MustCompile(`^10\.0\.0\.2 - a\\x20\\x22b\\x22\\x5cc \[`)
+	if !escaped.Match(buf.Bytes()) {
+		t.Errorf("expected the user to be escaped, got: %q", buf.String())
+	}
+}
@@ -14,6 +14,20 @@ const (
 	contentMediaType = "application/vnd.git-lfs"
 	metaMediaType    = contentMediaType + "+json"
 	version          = "0.3.0"
+
+	// readOnlyRetryAfter is the Retry-After value, in seconds, sent when a
+	// write is rejected because the server is in read-only mode.
+	readOnlyRetryAfter = "120"
+
+	// maxLockIdAttempts is how many random ids are tried when creating a lock.
+	maxLockIdAttempts = 5
+
+	// maxLockAnnotationLength is the longest annotation, in bytes, a lock
+	// can be created with.
+	maxLockAnnotationLength = 256
+
+	// minPasswordLength is the shortest password users can change theirs to.
+	minPasswordLength = 8
 )
 
 var (
@@ -38,25 +52,10 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-func wrapHttps(l net.Listener, cert, key string) (net.Listener, error) {
-	var err error
-
-	config := &tls.Config{}
-
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
-	}
-
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(cert, key)
-	if err != nil {
-		return nil, err
-	}
-
+func wrapHttps(l net.Listener, certs *certReloader) net.Listener {
 	netListener := l.(*TrackingListener).Listener
 
-	tlsListener := tls.NewListener(tcpKeepAliveListener{netListener.(*net.TCPListener)}, config)
-	return tlsListener, nil
+	return tls.NewListener(tcpKeepAliveListener{netListener.(*net.TCPListener)}, certs.tlsConfig())
 }
 
 func main() {
@@ -65,54 +64,102 @@ func main() {
 		os.Exit(0)
 	}
 
+	if isCommand(os.Args[1:]) {
+		metaStore, err := NewConfiguredMetaStore()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open the meta store: "+err.Error())
+			os.Exit(1)
+		}
+		err = runCommand(metaStore, os.Stdout, os.Args[1:])
+		metaStore.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if Config().ConfigFile != "" {
+		c, err := loadConfiguration(Config().ConfigFile)
+		if err != nil {
+			logger.Fatal(kv{"fn": "main", "err": "Could not read the config file: " + err.Error()})
+		}
+		setConfig(c)
+	}
+
+	if err := Config().Validate(); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": err.Error()})
+	}
+	for _, warning := range Config().Warnings() {
+		logger.Log(kv{"fn": "main", "warning": warning})
+	}
+
 	var listener net.Listener
 
-	tl, err := NewTrackingListener(Config.Listen)
+	tl, err := NewTrackingListener(Config().Listen)
 	if err != nil {
 		logger.Fatal(kv{"fn": "main", "err": "Could not create listener: " + err.Error()})
 	}
 
 	listener = tl
 
-	if Config.IsHTTPS() {
+	var certs *certReloader
+	if Config().IsHTTPS() {
 		logger.Log(kv{"fn": "main", "msg": "Using https"})
-		listener, err = wrapHttps(tl, Config.Cert, Config.Key)
+		certs, err = newCertReloader(Config().Cert, Config().Key)
 		if err != nil {
 			logger.Fatal(kv{"fn": "main", "err": "Could not create https listener: " + err.Error()})
 		}
+		listener = wrapHttps(tl, certs)
 	}
 
-	metaStore, err := NewMetaStore(Config.MetaDB)
+	metaStore, err := NewConfiguredMetaStore()
 	if err != nil {
 		logger.Fatal(kv{"fn": "main", "err": "Could not open the meta store: " + err.Error()})
 	}
 
-	contentStore, err := NewContentStore(Config.ContentPath)
+	if Config().IsSoftDeleting() && !Config().IsReadOnly() {
+		purged, err := metaStore.Purge(Config().TombstoneMaxAgeDuration(), false)
+		if err != nil {
+			logger.Log(kv{"fn": "main", "err": "Could not purge deleted objects: " + err.Error()})
+		} else if len(purged) > 0 {
+			logger.Log(kv{"fn": "main", "msg": "purged deleted objects", "count": len(purged)})
+		}
+	}
+
+	contentStore, err := NewConfiguredContentStore()
 	if err != nil {
 		logger.Fatal(kv{"fn": "main", "err": "Could not open the content store: " + err.Error()})
 	}
 
+	app := NewApp(contentStore, metaStore)
+
+	// Graceful shutdown. SIGHUP reloads the configuration and certificate
+	// instead.
+	done := make(chan struct{})
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
-	go func(c chan os.Signal, listener net.Listener) {
-		for {
-			sig := <-c
-			switch sig {
-			case syscall.SIGHUP: // Graceful shutdown
-				tl.Close()
-			}
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	reloadOnHangup(certs)
+	go func() {
+		sig := <-c
+		logger.Log(kv{"fn": "main", "msg": "shutting down", "signal": sig.String()})
+		if err := app.Shutdown(Config().ShutdownTimeoutDuration()); err != nil {
+			logger.Log(kv{"fn": "main", "err": "Could not drain requests: " + err.Error()})
 		}
-	}(c, tl)
+		close(done)
+	}()
 
-	logger.Log(kv{"fn": "main", "msg": "listening", "pid": os.Getpid(), "addr": Config.Listen, "version": version})
+	logger.Log(kv{"fn": "main", "msg": "listening", "pid": os.Getpid(), "addr": Config().Listen, "version": version})
 
-	app := NewApp(contentStore, metaStore)
-	if Config.IsUsingTus() {
+	if Config().IsUsingTus() {
 		tusServer.Start()
 	}
-	app.Serve(listener)
+	if err := app.Serve(listener); err != nil {
+		logger.Fatal(kv{"fn": "main", "err": "Could not serve: " + err.Error()})
+	}
+	<-done
 	tl.WaitForChildren()
-	if Config.IsUsingTus() {
+	if Config().IsUsingTus() {
 		tusServer.Stop()
 	}
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var errTxNotWritable = errors.New("Transaction is read-only")
+
+// memoryMetaDB is the LFS_METADB value that keeps the meta store in memory.
+const memoryMetaDB = ":memory:"
+
+// NewConfiguredMetaStore creates the MetaStore selected by Config.MetaDB,
+// either a boltdb file or memoryMetaDB.
+func NewConfiguredMetaStore() (*MetaStore, error) {
+	if Config().MetaDB == memoryMetaDB {
+		return NewMemoryMetaStore()
+	}
+	return NewMetaStore(Config().MetaDB)
+}
+
+// NewMemoryMetaStore creates a MetaStore that is only kept in memory, for
+// tests and ephemeral servers. It behaves like a MetaStore on a new boltdb
+// file, except that it can't be compacted.
+func NewMemoryMetaStore() (*MetaStore, error) {
+	s := &MetaStore{mem: newMemoryDB()}
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// memoryDB stores buckets in maps. Like boltdb it allows one writer at a time,
+// though readers wait for it. Writes change the data in place and record how
+// to undo each change, so a failed transaction can be rolled back without
+// copying the data first.
+type memoryDB struct {
+	mu   sync.RWMutex
+	root *memoryBucket
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{root: newMemoryBucket()}
+}
+
+func (db *memoryDB) View(fn func(kvTx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fn(memoryTx{root: db.root})
+}
+
+func (db *memoryDB) Update(fn func(kvTx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	undo := &undoLog{}
+	committed := false
+	defer func() {
+		if !committed {
+			undo.rollback()
+		}
+	}()
+
+	if err := fn(memoryTx{root: db.root, undo: undo}); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// undoLog reverses the changes of a write transaction that fails.
+type undoLog []func()
+
+func (u *undoLog) add(fn func()) {
+	*u = append(*u, fn)
+}
+
+// rollback undoes the changes, latest first.
+func (u undoLog) rollback() {
+	for i := len(u) - 1; i >= 0; i-- {
+		u[i]()
+	}
+}
+
+type memoryBucket struct {
+	values  map[string][]byte
+	buckets map[string]*memoryBucket
+}
+
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{values: make(map[string][]byte), buckets: make(map[string]*memoryBucket)}
+}
+
+// keys returns the keys of the bucket's values and nested buckets in order.
+func (b *memoryBucket) keys() []string {
+	keys := make([]string, 0, len(b.values)+len(b.buckets))
+	for k := range b.values {
+		keys = append(keys, k)
+	}
+	for k := range b.buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// memoryTx is a transaction on a memoryDB. undo is nil for read-only
+// transactions.
+type memoryTx struct {
+	root *memoryBucket
+	undo *undoLog
+}
+
+func (t memoryTx) Bucket(name []byte) kvBucket {
+	return memoryBucketRef{b: t.root, undo: t.undo}.Bucket(name)
+}
+
+func (t memoryTx) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	return memoryBucketRef{b: t.root, undo: t.undo}.CreateBucketIfNotExists(name)
+}
+
+func (t memoryTx) Size() int64 {
+	return 0
+}
+
+// memoryBucketRef is a bucket as seen from a transaction.
+type memoryBucketRef struct {
+	b    *memoryBucket
+	undo *undoLog
+}
+
+func (r memoryBucketRef) Get(key []byte) []byte {
+	return r.b.values[string(key)]
+}
+
+func (r memoryBucketRef) Put(key, value []byte) error {
+	if r.undo == nil {
+		return errTxNotWritable
+	}
+	r.keepValue(string(key))
+	r.b.values[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (r memoryBucketRef) Delete(key []byte) error {
+	if r.undo == nil {
+		return errTxNotWritable
+	}
+	r.keepValue(string(key))
+	delete(r.b.values, string(key))
+	return nil
+}
+
+// keepValue records how to put back the value of key as it is now. Values
+// are never changed in place, so the old slice can be restored as it is.
+func (r memoryBucketRef) keepValue(key string) {
+	b := r.b
+	old, existed := b.values[key]
+	r.undo.add(func() {
+		if existed {
+			b.values[key] = old
+		} else {
+			delete(b.values, key)
+		}
+	})
+}
+
+// keepBucket records how to put back the nested bucket name as it is now.
+func (r memoryBucketRef) keepBucket(name string) {
+	b := r.b
+	old, existed := b.buckets[name]
+	r.undo.add(func() {
+		if existed {
+			b.buckets[name] = old
+		} else {
+			delete(b.buckets, name)
+		}
+	})
+}
+
+func (r memoryBucketRef) ForEach(fn func(k, v []byte) error) error {
+	for _, k := range r.b.keys() {
+		if err := fn([]byte(k), r.b.values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r memoryBucketRef) Cursor() kvCursor {
+	keys := r.b.keys()
+	return &memoryCursor{b: r.b, keys: keys, pos: len(keys)}
+}
+
+func (r memoryBucketRef) Bucket(name []byte) kvBucket {
+	nested, ok := r.b.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return memoryBucketRef{b: nested, undo: r.undo}
+}
+
+func (r memoryBucketRef) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	if nested := r.Bucket(name); nested != nil {
+		return nested, nil
+	}
+	if r.undo == nil {
+		return nil, errTxNotWritable
+	}
+
+	r.keepBucket(string(name))
+	nested := newMemoryBucket()
+	r.b.buckets[string(name)] = nested
+	return memoryBucketRef{b: nested, undo: r.undo}, nil
+}
+
+func (r memoryBucketRef) DeleteBucket(name []byte) error {
+	if r.undo == nil {
+		return errTxNotWritable
+	}
+	r.keepBucket(string(name))
+	delete(r.b.buckets, string(name))
+	return nil
+}
+
+type memoryCursor struct {
+	b    *memoryBucket
+	keys []string
+	pos  int
+}
+
+func (c *memoryCursor) Last() ([]byte, []byte) {
+	c.pos = len(c.keys) - 1
+	return c.current()
+}
+
+func (c *memoryCursor) Prev() ([]byte, []byte) {
+	c.pos--
+	return c.current()
+}
+
+func (c *memoryCursor) Seek(seek []byte) ([]byte, []byte) {
+	c.pos = sort.SearchStrings(c.keys, string(seek))
+	return c.current()
+}
+
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	c.pos++
+	return c.current()
+}
+
+func (c *memoryCursor) current() ([]byte, []byte) {
+	if c.pos < 0 || c.pos >= len(c.keys) {
+		return nil, nil
+	}
+	k := c.keys[c.pos]
+	return []byte(k), c.b.values[k]
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestMemoryMetaStoreLocks runs the lock tests against an in-memory store.
+func TestMemoryMetaStoreLocks(t *testing.T) {
+	useMemoryMetaStore = true
+	defer func() { useMemoryMetaStore = false }()
+
+	tests := map[string]func(*testing.T){
+		"Locks":                       TestLocks,
+		"FilteredLocks":               TestFilteredLocks,
+		"FilteredLocksOwner":          TestFilteredLocksOwner,
+		"FilteredLocksNormalizedPath": TestFilteredLocksNormalizedPath,
+		"AddLocksNormalizedPath":      TestAddLocksNormalizedPathConcurrent,
+		"AddLocks":                    TestAddLocks,
+		"AddLocksIdInUse":             TestAddLocksIdInUse,
+		"AddLocksPathLocked":          TestAddLocksPathLocked,
+		"AddLocksBatch":               TestAddLocksBatch,
+		"LocksModified":               TestLocksModified,
+		"RenameLock":                  TestRenameLock,
+		"RepoLockLimit":               TestRepoLockLimit,
+		"UserLockLimit":               TestUserLockLimit,
+		"DeleteLock":                  TestDeleteLock,
+		"DeleteLockNotOwner":          TestDeleteLockNotOwner,
+		"DeleteLockNotOwnerForce":     TestDeleteLockNotOwnerForce,
+		"DeleteLockNonExisting":       TestDeleteLockNonExisting,
+		"DeleteLockLockedAt":          TestDeleteLockLockedAt,
+		"DeleteLockByPath":            TestDeleteLockByPath,
+		"DeleteLockByPathNotOwner":    TestDeleteLockByPathNotOwner,
+		"DeleteLockByPathNonExisting": TestDeleteLockByPathNonExisting,
+		"DeleteUserKeepLocks":         TestDeleteUserKeepLocks,
+		"DeleteUserReleaseLocks":      TestDeleteUserReleaseLocks,
+		"AuditForceDelete":            TestAuditForceDelete,
+		"AuditLogNewestFirst":         TestAuditLogNewestFirst,
+		"LockStore":                   TestLockStore,
+	}
+	for name, test := range tests {
+		t.Run(name, test)
+	}
+}
+
+func TestMemoryMetaStoreRollback(t *testing.T) {
+	store, err := NewMemoryMetaStore()
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+	defer store.Close()
+
+	Config().MaxRepoLocks = "1"
+	defer func() { Config().MaxRepoLocks = "0" }()
+
+	// The second lock goes over the limit, so neither is kept
+	_, err = store.AddLocks(testRepo, NewTestLock("lock-1", "a.bin", testUser), NewTestLock("lock-2", "b.bin", testUser))
+	if err != errLockLimit {
+		t.Fatalf("expected errLockLimit, got: %v", err)
+	}
+
+	locks, err := store.Locks(testRepo)
+	if err != nil || len(locks) != 0 {
+		t.Errorf("expected a failed transaction to leave no locks, got: %v (%v)", locks, err)
+	}
+
+	// Values and buckets that a failed transaction changed are put back
+	db := store.mem
+	err = db.Update(func(tx kvTx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("test"))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("nested")); err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte("old"))
+	})
+	if err != nil {
+		t.Fatalf("error writing test bucket: %s", err)
+	}
+
+	errFail := errors.New("fail")
+	err = db.Update(func(tx kvTx) error {
+		b := tx.Bucket([]byte("test"))
+		b.Put([]byte("key"), []byte("new"))
+		b.Put([]byte("other"), []byte("new"))
+		b.DeleteBucket([]byte("nested"))
+		tx.CreateBucketIfNotExists([]byte("created"))
+		return errFail
+	})
+	if err != errFail {
+		t.Fatalf("expected the transaction error, got: %v", err)
+	}
+
+	db.View(func(tx kvTx) error {
+		b := tx.Bucket([]byte("test"))
+		if v := string(b.Get([]byte("key"))); v != "old" {
+			t.Errorf("expected key to be restored to old, got: %q", v)
+		}
+		if v := b.Get([]byte("other")); v != nil {
+			t.Errorf("expected other to be removed, got: %q", v)
+		}
+		if b.Bucket([]byte("nested")) == nil {
+			t.Errorf("expected the deleted bucket to be restored")
+		}
+		if tx.Bucket([]byte("created")) != nil {
+			t.Errorf("expected the created bucket to be removed")
+		}
+		return nil
+	})
+
+	if _, err := store.Compact(); err != errNotCompactable {
+		t.Errorf("expected compacting to be unsupported, got: %v", err)
+	}
+}
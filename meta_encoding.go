@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+// MetaObjects are stored as gob in an envelope: metaEnvelopeMarker, then a
+// version byte, then the encoded object. A gob stream never starts with a
+// zero byte, so records stored before the envelope was added are told apart
+// and decoded as version 1.
+const (
+	metaEnvelopeMarker = 0
+	metaVersion1       = 1
+
+	// metaVersion is the version new records are stored as.
+	metaVersion = metaVersion1
+)
+
+var errMetaVersion = errors.New("Unsupported meta object version")
+
+// encodeMeta encodes meta as a record of the current version.
+func encodeMeta(meta *MetaObject) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{metaEnvelopeMarker, metaVersion})
+	if err := gob.NewEncoder(buf).Encode(meta); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMeta decodes a record made by encodeMeta, of any version, into meta,
+// upgrading it to the current version.
+func decodeMeta(data []byte, meta *MetaObject) error {
+	version := byte(metaVersion1)
+	if len(data) > 0 && data[0] == metaEnvelopeMarker {
+		if len(data) < 2 {
+			return errMetaVersion
+		}
+		version, data = data[1], data[2:]
+	}
+
+	switch version {
+	case metaVersion1:
+		// Fields added since, like UploadedBy or Tags, are left empty
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(meta)
+	default:
+		return errMetaVersion
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+func TestEncodeMeta(t *testing.T) {
+	meta := &MetaObject{Oid: contentOid, Size: contentSize, HashAlgo: "sha256", UploadedBy: testUser, Tags: []string{"release"}}
+	data, err := encodeMeta(meta)
+	if err != nil {
+		t.Fatalf("expected encodeMeta to succeed, got : %s", err)
+	}
+	if data[0] != metaEnvelopeMarker || data[1] != metaVersion {
+		t.Errorf("expected the record to start with the envelope, got: %v", data[:2])
+	}
+
+	var decoded MetaObject
+	if err := decodeMeta(data, &decoded); err != nil {
+		t.Fatalf("expected decodeMeta to succeed, got : %s", err)
+	}
+	if decoded.Oid != meta.Oid || decoded.UploadedBy != testUser || !decoded.HasTag("release") {
+		t.Errorf("expected the object to round trip, got: %+v", decoded)
+	}
+}
+
+func TestDecodeMetaVersion1(t *testing.T) {
+	// A version 1 record written before UploadedBy, CreatedAt and Tags were
+	// added
+	v1 := struct {
+		Oid       string
+		Size      int64
+		HashAlgo  string
+		Existing  bool
+		DeletedAt time.Time
+	}{Oid: contentOid, Size: contentSize, HashAlgo: "sha256"}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&v1); err != nil {
+		t.Fatalf("error encoding object: %s", err)
+	}
+
+	for name, data := range map[string][]byte{
+		"enveloped":   append([]byte{metaEnvelopeMarker, metaVersion1}, payload.Bytes()...),
+		"unversioned": payload.Bytes(),
+	} {
+		var meta MetaObject
+		if err := decodeMeta(data, &meta); err != nil {
+			t.Errorf("%s: expected decodeMeta to succeed, got : %s", name, err)
+			continue
+		}
+		if meta.Oid != contentOid || meta.Size != contentSize || meta.UploadedBy != "" || len(meta.Tags) != 0 {
+			t.Errorf("%s: expected the version 1 fields with the new ones empty, got: %+v", name, meta)
+		}
+	}
+
+	var meta MetaObject
+	if err := decodeMeta(append([]byte{metaEnvelopeMarker, 99}, payload.Bytes()...), &meta); err != errMetaVersion {
+		t.Errorf("expected an unknown version to be rejected, got : %v", err)
+	}
+}
@@ -2,44 +2,126 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 // MetaStore implements a metadata storage. It stores user credentials and Meta information
-// for objects. The storage is handled by boltdb.
+// for objects. The storage is handled by boltdb, or kept in memory by stores
+// made with NewMemoryMetaStore.
 type MetaStore struct {
-	db *bolt.DB
+	db   *bolt.DB
+	mem  *memoryDB
+	auth Authenticator
+
+	// content is where object content is deleted from when
+	// Config.DeleteContent is set, see SetContentStore.
+	content ContentStore
+
+	// swap is held for writing while the database file is replaced, and
+	// for reading by every transaction.
+	swap sync.RWMutex
 }
 
 var (
-	errNoBucket       = errors.New("Bucket not found")
-	errObjectNotFound = errors.New("Object not found")
-	errNotOwner       = errors.New("Attempt to delete other user's lock")
+	errNoBucket        = errors.New("Bucket not found")
+	errObjectNotFound  = errors.New("Object not found")
+	errNotOwner        = errors.New("Attempt to delete other user's lock")
+	errReadOnly        = errors.New("Server is in read-only mode")
+	errQuotaExceeded   = errors.New("Storage quota exceeded")
+	errObjectTooLarge  = errors.New("Object is larger than the maximum object size")
+	errSizeChanged     = errors.New("Object already exists with a different size")
+	errLockLimit       = errors.New("Lock limit reached, unlock some files before locking more")
+	errLockChanged     = errors.New("Lock has changed since it was last read")
+	errLockIdExists    = errors.New("Lock id already in use")
+	errPathLocked      = errors.New("Path is already locked")
+	errWrongPassword   = errors.New("Current password is incorrect")
+	errWeakPassword    = fmt.Errorf("New password must be at least %d characters", minPasswordLength)
+	errInvalidLockPath = errors.New("Invalid lock path, expected a path relative to the repository root")
+	errLockPathTooLong = errors.New("Lock path is longer than the maximum lock path length")
+	errLockPathDenied  = errors.New("Lock path is not allowed by the server's lock path rules")
+	errPathRequired    = errors.New("Path is required to upload while locks are enforced")
+	errDatabaseLocked  = errors.New("Timed out opening the meta store, the database file is likely in use by another process")
+	errMetaDBIsDir     = errors.New("The meta store path is a directory, it must name the database file")
+	errInvalidOid      = errors.New("Invalid oid, expected a lowercase hex digest")
+	errUnknownHashAlgo = errors.New("Unsupported hash algorithm")
+	errInvalidTag      = errors.New("Invalid tag, tags can't be empty")
 )
 
+// oidPattern matches valid object ids, the hex digest of the content.
+var oidPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// defaultHashAlgo is the hash algorithm of objects that don't name one.
+const defaultHashAlgo = "sha256"
+
+// hashAlgos are the hash algorithms objects can be named by.
+var hashAlgos = map[string]struct {
+	size int // length of the hex digest
+	new  func() hash.Hash
+}{
+	"sha256":  {sha256.Size * 2, sha256.New},
+	"blake2b": {blake2bSize * 2, newBlake2b},
+}
+
 var (
 	usersBucket   = []byte("users")
 	objectsBucket = []byte("objects")
 	locksBucket   = []byte("locks")
+	usageBucket   = []byte("usage")
+	refsBucket    = []byte("refs")
+	// lockCountsBucket holds the number of locks each user owns, so lock
+	// limits can be checked without reading every repo's locks.
+	lockCountsBucket = []byte("lock_counts")
+	// locksModifiedBucket holds when each repo's locks last changed, so lock
+	// listings can be cached by clients.
+	locksModifiedBucket = []byte("locks_modified")
+	// auditBucket holds the AuditEntry log of force deleted locks.
+	auditBucket = []byte("audit")
 )
 
-// NewMetaStore creates a new MetaStore using the boltdb database at dbFile.
+// NewMetaStore creates a new MetaStore using the boltdb database at dbFile,
+// migrating it to the current schema version. errDatabaseLocked is returned if the database is still locked by another
+// process after Config.MetaDBTimeout.
 func NewMetaStore(dbFile string) (*MetaStore, error) {
-	db, err := bolt.Open(dbFile, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	db, err := openDB(dbFile)
+	if err == bolt.ErrTimeout {
+		return nil, errDatabaseLocked
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	db.Update(func(tx *bolt.Tx) error {
+	s := &MetaStore{db: db}
+	if err := s.init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// init creates the store's buckets and migrates it to the current schema
+// version.
+func (s *MetaStore) init() error {
+	s.auth = newAuthenticator(s)
+	return s.update(func(tx kvTx) error {
 		if _, err := tx.CreateBucketIfNotExists(usersBucket); err != nil {
 			return err
 		}
@@ -52,10 +134,162 @@ func NewMetaStore(dbFile string) (*MetaStore, error) {
 			return err
 		}
 
-		return nil
+		if _, err := tx.CreateBucketIfNotExists(usageBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(refsBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(lockCountsBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(locksModifiedBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(auditBucket); err != nil {
+			return err
+		}
+
+		return migrate(tx)
 	})
+}
+
+// openDB opens the boltdb database at path, waiting up to
+// Config.MetaDBTimeout for another process to release it. A missing database
+// is created with Config.MetaDBMode, along with its directory.
+func openDB(path string) (*bolt.DB, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil, errMetaDBIsDir
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), Config().MetaDBDirFileMode()); err != nil {
+		return nil, fmt.Errorf("Could not create the meta store directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, Config().MetaDBFileMode(), &bolt.Options{Timeout: Config().MetaDBTimeoutDuration()})
+	if err != nil && err != bolt.ErrTimeout {
+		return nil, fmt.Errorf("Could not open the meta store: %w", err)
+	}
+	if db != nil {
+		db.NoSync = Config().MetaDBNoSync()
+	}
+	return db, err
+}
+
+// view runs fn in a read-only transaction, recording its duration and
+// counting it as open while it runs.
+func (s *MetaStore) view(fn func(kvTx) error) error {
+	s.swap.RLock()
+	defer s.swap.RUnlock()
+	defer dbTxDuration.Since(time.Now(), "view")
+
+	tracked := func(tx kvTx) error {
+		dbOpenTx.Add(1, "view")
+		defer dbOpenTx.Add(-1, "view")
+		return fn(tx)
+	}
+	if s.mem != nil {
+		return s.mem.View(tracked)
+	}
+	return s.db.View(func(tx *bolt.Tx) error { return tracked(boltTx{tx}) })
+}
+
+// update runs fn in a read-write transaction, recording its duration, how
+// long it waited for the database's single writer and whether it was rolled
+// back.
+func (s *MetaStore) update(fn func(kvTx) error) error {
+	s.swap.RLock()
+	defer s.swap.RUnlock()
+	start := time.Now()
+	defer dbTxDuration.Since(start, "update")
+
+	tracked := func(tx kvTx) error {
+		dbWriteWait.Since(start)
+		dbOpenTx.Add(1, "update")
+		defer dbOpenTx.Add(-1, "update")
+
+		err := fn(tx)
+		if err != nil {
+			dbRollbacks.Inc()
+		}
+		return err
+	}
+	if s.mem != nil {
+		return s.mem.Update(tracked)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error { return tracked(boltTx{tx}) })
+}
+
+// scanBatchSize is how many records scanBatches reads in each transaction.
+// Tests make it smaller to cover scans of several batches.
+var scanBatchSize = 500
+
+// scanBatches walks the top level bucket called name in key order, calling
+// read for each record and then flush after every scanBatchSize records,
+// once the read transaction holding them has ended. Slow work such as writing
+// to a client or checking the content store goes in flush, so it doesn't
+// keep a transaction open and compaction waiting. Records changed during the
+// scan may or may not be seen.
+func (s *MetaStore) scanBatches(name []byte, read func(tx kvTx, k, v []byte) error, flush func() error) error {
+	var after []byte
+	for {
+		n := 0
+		err := s.view(func(tx kvTx) error {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				return errNoBucket
+			}
+
+			c := bucket.Cursor()
+			k, v := c.Seek(after)
+			if after != nil && bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+			for ; k != nil && n < scanBatchSize; k, v = c.Next() {
+				if err := read(tx, k, v); err != nil {
+					return err
+				}
+				after = append(after[:0], k...)
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if n < scanBatchSize {
+			return nil
+		}
+	}
+}
 
-	return &MetaStore{db: db}, nil
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("Dry run")
+
+// updateOrDryRun is update, except that when dryRun is set the transaction is
+// rolled back once fn succeeds, so destructive operations can report what
+// they would change while leaving the store as it is.
+func (s *MetaStore) updateOrDryRun(dryRun bool, fn func(kvTx) error) error {
+	err := s.update(func(tx kvTx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return nil
+	}
+	return err
 }
 
 // Get retrieves the Meta information for an object given information in
@@ -69,9 +303,13 @@ func (s *MetaStore) Get(v *RequestVars) (*MetaObject, error) {
 // RequestVars
 // DO NOT CHECK authentication, as it is supposed to have been done before
 func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
+	if err := validateOid(v.HashAlgo, v.Oid); err != nil {
+		return nil, err
+	}
+
 	var meta MetaObject
 
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx kvTx) error {
 		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
@@ -82,8 +320,14 @@ func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
 			return errObjectNotFound
 		}
 
-		dec := gob.NewDecoder(bytes.NewBuffer(value))
-		return dec.Decode(&meta)
+		if err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+
+		if meta.Deleted() {
+			return errObjectNotFound
+		}
+		return nil
 	})
 
 	if err != nil {
@@ -93,33 +337,38 @@ func (s *MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
 	return &meta, nil
 }
 
-// Put writes meta information from RequestVars to the store.
-func (s *MetaStore) Put(v *RequestVars) (*MetaObject, error) {
-	// Check if it exists first
-	if meta, err := s.Get(v); err == nil {
-		meta.Existing = true
-		return meta, nil
-	}
-
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	meta := MetaObject{Oid: v.Oid, Size: v.Size}
-	err := enc.Encode(meta)
-	if err != nil {
-		return nil, err
-	}
+// GetMany retrieves the Meta information for several objects in a single
+// transaction. Objects that don't exist, including soft deleted objects and
+// invalid oids, are left out of the returned map.
+// DO NOT CHECK authentication, as it is supposed to have been done before
+func (s *MetaStore) GetMany(oids []string) (map[string]*MetaObject, error) {
+	objects := make(map[string]*MetaObject, len(oids))
 
-	err = s.db.Update(func(tx *bolt.Tx) error {
+	err := s.view(func(tx kvTx) error {
 		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err = bucket.Put([]byte(v.Oid), buf.Bytes())
-		if err != nil {
-			return err
-		}
+		for _, oid := range oids {
+			if validateOid("", oid) != nil {
+				continue
+			}
+
+			value := bucket.Get([]byte(oid))
+			if len(value) == 0 {
+				continue
+			}
+
+			var meta MetaObject
+			if err := decodeMeta(value, &meta); err != nil {
+				return err
+			}
 
+			if !meta.Deleted() {
+				objects[oid] = &meta
+			}
+		}
 		return nil
 	})
 
@@ -127,284 +376,1625 @@ func (s *MetaStore) Put(v *RequestVars) (*MetaObject, error) {
 		return nil, err
 	}
 
-	return &meta, nil
+	return objects, nil
 }
 
-// Delete removes the meta information from RequestVars to the store.
-func (s *MetaStore) Delete(v *RequestVars) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+// Put writes meta information from RequestVars to the store and records that
+// the repo in v references the object. The object's size is added to the
+// storage used by v.Uploader, the authenticated user, when it is first
+// stored, and errQuotaExceeded is returned if that would take the uploader
+// over Config.UserQuota. New objects
+// larger than Config.MaxObjectSize are rejected with errObjectTooLarge.
+// Putting an existing object with a different size fails with
+// errSizeChanged, and nothing is changed. Putting a soft deleted object
+// stores it again as a new object.
+//
+// Puts of the same object that race are merged the same way whichever
+// transaction commits first: the first stores the object and the others
+// find it existing. The object keeps the earliest CreatedAt of the puts, as
+// a put's time is taken before it waits for its transaction, while the
+// uploader stays the one whose storage usage it counts towards.
+func (s *MetaStore) Put(v *RequestVars) (*MetaObject, error) {
+	algo := v.HashAlgo
+	if algo == "" {
+		algo = defaultHashAlgo
+	}
+	if err := validateOid(algo, v.Oid); err != nil {
+		return nil, err
+	}
+
+	if Config().IsReadOnly() {
+		// Existing objects can still be reported, nothing else can be written
+		meta, err := s.Get(v)
+		if err != nil {
+			return nil, errReadOnly
+		}
+		if meta.Size != v.Size {
+			return nil, errSizeChanged
+		}
+		meta.Existing = true
+		return meta, nil
+	}
+
+	meta := MetaObject{Oid: v.Oid, Size: v.Size, HashAlgo: algo, UploadedBy: v.Uploader, CreatedAt: time.Now().UTC()}
+	err := s.update(func(tx kvTx) error {
 		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err := bucket.Delete([]byte(v.Oid))
-		if err != nil {
-			return err
+		refs := tx.Bucket(refsBucket)
+		if refs == nil {
+			return errNoBucket
 		}
 
-		return nil
-	})
+		if value := bucket.Get([]byte(v.Oid)); len(value) > 0 {
+			var existing MetaObject
+			if err := decodeMeta(value, &existing); err != nil {
+				return err
+			}
+			if !existing.Deleted() {
+				if existing.Size != v.Size {
+					return errSizeChanged
+				}
+				if meta.CreatedAt.Before(existing.CreatedAt) {
+					existing.CreatedAt = meta.CreatedAt
+					if err := putMeta(bucket, &existing); err != nil {
+						return err
+					}
+				}
+				meta = existing
+				meta.Existing = true
+				return addRef(refs, v)
+			}
+		}
 
-	return err
-}
+		if max := Config().MaxObjectBytes(); max > 0 && v.Size > max {
+			return errObjectTooLarge
+		}
 
-// AddLocks write locks to the store for the repo.
-func (s *MetaStore) AddLocks(repo string, l ...Lock) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
-		if bucket == nil {
+		usage := tx.Bucket(usageBucket)
+		if usage == nil {
 			return errNoBucket
 		}
 
-		var locks []Lock
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
-				return err
-			}
+		used := getUsage(usage, v.Uploader)
+		if quota := Config().UserQuotaBytes(); quota > 0 && used+v.Size > quota {
+			return errQuotaExceeded
 		}
-		locks = append(locks, l...)
-		sort.Sort(LocksByCreatedAt(locks))
-		data, err := json.Marshal(&locks)
-		if err != nil {
+
+		if err := putMeta(bucket, &meta); err != nil {
 			return err
 		}
 
-		return bucket.Put([]byte(repo), data)
-	})
-	return err
-}
-
-// Locks retrieves locks for the repo from the store
-func (s *MetaStore) Locks(repo string) ([]Lock, error) {
-	var locks []Lock
-	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
-		if bucket == nil {
-			return errNoBucket
+		if err := putUsage(usage, v.Uploader, used+v.Size); err != nil {
+			return err
 		}
 
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
-				return err
-			}
-		}
-		return nil
+		return addRef(refs, v)
 	})
-	return locks, err
-}
 
-// FilteredLocks return filtered locks for the repo
-func (s *MetaStore) FilteredLocks(repo, path, cursor, limit string) (locks []Lock, next string, err error) {
-	locks, err = s.Locks(repo)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	if cursor != "" {
-		lastSeen := -1
-		for i, l := range locks {
-			if l.Id == cursor {
-				lastSeen = i
-				break
-			}
-		}
+	return &meta, nil
+}
 
-		if lastSeen > -1 {
-			locks = locks[lastSeen:]
-		} else {
-			err = fmt.Errorf("cursor (%s) not found", cursor)
-			return
-		}
+// Delete removes the reference from the repo in v to the object. Once no repo
+// references the object its meta information is removed from the store, and
+// its size is subtracted from the storage used by its uploader. When
+// Config.SoftDelete is set the meta information is kept with a tombstone
+// instead, so the object can be brought back with Restore until it is purged.
+// The content is removed once the meta information is, as for deleteContent.
+func (s *MetaStore) Delete(v *RequestVars) error {
+	removed, err := s.removeObjectRef(v)
+	if err != nil {
+		return err
 	}
 
-	if path != "" {
-		var filtered []Lock
-		for _, l := range locks {
-			if l.Path == path {
-				filtered = append(filtered, l)
-			}
-		}
+	s.deleteContent(removed)
+	return nil
+}
 
-		locks = filtered
-	}
+// DeleteUnstored undoes the reference to an object that an upload made when
+// the upload fails. It is Delete without removing any content, so a failed
+// upload can never remove content stored by another one.
+func (s *MetaStore) DeleteUnstored(v *RequestVars) error {
+	_, err := s.removeObjectRef(v)
+	return err
+}
 
-	if limit != "" {
-		var size int
-		size, err = strconv.Atoi(limit)
-		if err != nil || size < 0 {
-			locks = make([]Lock, 0)
-			err = fmt.Errorf("Invalid limit amount: %s", limit)
-			return
-		}
+// removeObjectRef removes the reference from the repo in v to the object, and
+// the object too once nothing references it, returning the objects removed.
+func (s *MetaStore) removeObjectRef(v *RequestVars) ([]*MetaObject, error) {
+	if err := validateOid(v.HashAlgo, v.Oid); err != nil {
+		return nil, err
+	}
 
-		size = int(math.Min(float64(size), float64(len(locks))))
-		if size+1 < len(locks) {
-			next = locks[size].Id
-		}
-		locks = locks[:size]
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
 	}
 
-	return locks, next, nil
-}
+	var removed []*MetaObject
+	err := s.update(func(tx kvTx) error {
+		removed = nil
 
-// DeleteLock removes lock for the repo by id from the store
-func (s *MetaStore) DeleteLock(repo, user, id string, force bool) (*Lock, error) {
-	var deleted *Lock
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(locksBucket)
+		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		var locks []Lock
-		data := bucket.Get([]byte(repo))
-		if data != nil {
-			if err := json.Unmarshal(data, &locks); err != nil {
-				return err
-			}
+		refs := tx.Bucket(refsBucket)
+		if refs == nil {
+			return errNoBucket
 		}
-		newLocks := make([]Lock, 0, len(locks))
 
-		var lock Lock
-		for _, l := range locks {
-			if l.Id == id {
-				if l.Owner.Name != user && !force {
-					return errNotOwner
-				}
-				lock = l
-			} else if len(l.Id) > 0 {
-				newLocks = append(newLocks, l)
-			}
+		remaining, err := removeRef(refs, v)
+		if err != nil || remaining > 0 {
+			return err
 		}
-		if lock.Id == "" {
+
+		value := bucket.Get([]byte(v.Oid))
+		if len(value) == 0 {
 			return nil
 		}
-		deleted = &lock
 
-		if len(newLocks) == 0 {
-			return bucket.Delete([]byte(repo))
+		var meta MetaObject
+		if err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+		if meta.Deleted() {
+			return nil
 		}
 
-		data, err := json.Marshal(&newLocks)
-		if err != nil {
+		if err := removeMeta(tx, bucket, &meta); err != nil {
 			return err
 		}
-		return bucket.Put([]byte(repo), data)
+		if !meta.Deleted() {
+			removed = append(removed, &meta)
+		}
+		return nil
 	})
-	return deleted, err
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
 }
 
-type LocksByCreatedAt []Lock
+// SetContentStore sets the ContentStore that Delete, DeleteMany and Purge
+// remove an object's content from when Config.DeleteContent is set.
+func (s *MetaStore) SetContentStore(content ContentStore) {
+	s.content = content
+}
 
-func (c LocksByCreatedAt) Len() int           { return len(c) }
-func (c LocksByCreatedAt) Less(i, j int) bool { return c[i].LockedAt.Before(c[j].LockedAt) }
-func (c LocksByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+// DeleteMany removes the objects with the given oids in a single transaction,
+// along with every repo's reference to them, returning the oids removed. Oids
+// that don't exist, including soft deleted objects and invalid oids, are
+// ignored. As with Delete, objects are only tombstoned when Config.SoftDelete
+// is set, and their size is subtracted from the storage used by their
+// uploaders. Removed objects lose their content as for deleteContent. With
+// dryRun the oids that would be removed are returned and nothing is changed.
+func (s *MetaStore) DeleteMany(oids []string, dryRun bool) ([]string, error) {
+	if Config().IsReadOnly() && !dryRun {
+		return nil, errReadOnly
+	}
 
-// Close closes the underlying boltdb.
-func (s *MetaStore) Close() {
-	s.db.Close()
-}
+	var deleted []string
+	var removed []*MetaObject
+	err := s.updateOrDryRun(dryRun, func(tx kvTx) error {
+		deleted, removed = nil, nil
 
-// AddUser adds user credentials to the meta store.
-func (s *MetaStore) AddUser(user, pass string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(usersBucket)
+		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err := bucket.Put([]byte(user), []byte(pass))
-		if err != nil {
-			return err
+		refs := tx.Bucket(refsBucket)
+		if refs == nil {
+			return errNoBucket
 		}
-		return nil
-	})
 
-	return err
+		for _, oid := range oids {
+			if validateOid("", oid) != nil {
+				continue
+			}
+
+			value := bucket.Get([]byte(oid))
+			if len(value) == 0 {
+				continue
+			}
+
+			var meta MetaObject
+			if err := decodeMeta(value, &meta); err != nil {
+				return err
+			}
+			if meta.Deleted() {
+				continue
+			}
+
+			if refs.Bucket([]byte(oid)) != nil {
+				if err := refs.DeleteBucket([]byte(oid)); err != nil {
+					return err
+				}
+			}
+
+			if err := removeMeta(tx, bucket, &meta); err != nil {
+				return err
+			}
+			if !meta.Deleted() {
+				removed = append(removed, &meta)
+			}
+			deleted = append(deleted, oid)
+		}
+		return nil
+	})
+	if err != nil || dryRun {
+		return deleted, err
+	}
+
+	s.deleteContent(removed)
+	return deleted, nil
+}
+
+// Restore removes the tombstone from a soft deleted object, making it
+// available again. errObjectNotFound is returned if there is no soft deleted
+// object with the oid. The object's size is not added back to any user's
+// storage usage.
+func (s *MetaStore) Restore(oid string) (*MetaObject, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	var meta MetaObject
+	err := s.update(func(tx kvTx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+
+		if err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+		if !meta.Deleted() {
+			return errObjectNotFound
+		}
+
+		meta.DeletedAt = time.Time{}
+		return putMeta(bucket, &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// SetTags replaces the tags of the object with oid, dropping duplicates and
+// sorting them. An empty list removes the object's tags. errObjectNotFound
+// is returned if there is no such object, or it is soft deleted.
+func (s *MetaStore) SetTags(oid string, tags []string) (*MetaObject, error) {
+	var sorted []string
+	for _, tag := range tags {
+		if tag == "" {
+			return nil, errInvalidTag
+		}
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+	tags = nil
+	for i, tag := range sorted {
+		if i == 0 || tag != sorted[i-1] {
+			tags = append(tags, tag)
+		}
+	}
+
+	return s.updateMeta(oid, func(meta *MetaObject) {
+		meta.Tags = tags
+	})
+}
+
+// SetContentType records the content type of the object with oid, as sent
+// or sniffed when its content was first uploaded. A type already recorded is
+// kept, so uploading the content again can't change it for everyone else.
+// errObjectNotFound is returned if there is no such object, or it is soft
+// deleted.
+func (s *MetaStore) SetContentType(oid, contentType string) (*MetaObject, error) {
+	return s.updateMeta(oid, func(meta *MetaObject) {
+		if meta.ContentType == "" {
+			meta.ContentType = contentType
+		}
+	})
+}
+
+// updateMeta changes the stored meta information of a live object with fn.
+func (s *MetaStore) updateMeta(oid string, fn func(*MetaObject)) (*MetaObject, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	var meta MetaObject
+	err := s.update(func(tx kvTx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		value := bucket.Get([]byte(oid))
+		if len(value) == 0 {
+			return errObjectNotFound
+		}
+
+		if err := decodeMeta(value, &meta); err != nil {
+			return err
+		}
+		if meta.Deleted() {
+			return errObjectNotFound
+		}
+
+		fn(&meta)
+		return putMeta(bucket, &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// Purge removes soft deleted objects whose tombstone is older than maxAge
+// from the store, returning the oids removed. Purged objects lose their
+// content as for deleteContent. With dryRun the oids that would be removed
+// are returned and nothing is changed.
+func (s *MetaStore) Purge(maxAge time.Duration, dryRun bool) ([]string, error) {
+	if Config().IsReadOnly() && !dryRun {
+		return nil, errReadOnly
+	}
+
+	var purged []string
+	var removed []*MetaObject
+	cutoff := time.Now().Add(-maxAge)
+	err := s.updateOrDryRun(dryRun, func(tx kvTx) error {
+		purged, removed = nil, nil
+
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			meta := &MetaObject{}
+			if err := decodeMeta(v, meta); err != nil {
+				logCorruptRecord(objectsBucket, k, err)
+				return nil
+			}
+			if meta.Deleted() && !meta.DeletedAt.After(cutoff) {
+				removed = append(removed, meta)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, meta := range removed {
+			if err := bucket.Delete([]byte(meta.Oid)); err != nil {
+				return err
+			}
+			purged = append(purged, meta.Oid)
+		}
+		return nil
+	})
+	if err != nil || dryRun {
+		return purged, err
+	}
+
+	s.deleteContent(removed)
+	return purged, nil
+}
+
+// deleteContent removes the content of objects that have been removed from
+// the store, when Config.DeleteContent is set. It runs once the removal has
+// committed, so content is never lost for an object that is still recorded,
+// and skips objects that have been stored again since. Failures are logged,
+// as the objects are gone either way and only orphaned content is left.
+func (s *MetaStore) deleteContent(removed []*MetaObject) {
+	if s.content == nil || !Config().IsDeletingContent() {
+		return
+	}
+
+	for _, meta := range removed {
+		var stored bool
+		err := s.view(func(tx kvTx) error {
+			bucket := tx.Bucket(objectsBucket)
+			if bucket == nil {
+				return errNoBucket
+			}
+			stored = len(bucket.Get([]byte(meta.Oid))) > 0
+			return nil
+		})
+		if err == nil && !stored {
+			err = s.content.Delete(meta)
+		}
+		if err != nil {
+			logger.Log(kv{"fn": "deleteContent", "oid": meta.Oid, "err": err.Error()})
+		}
+	}
+}
+
+// removeMeta removes meta from the objects bucket, or tombstones it when
+// Config.SoftDelete is set, and releases the storage it was charged for.
+func removeMeta(tx kvTx, bucket kvBucket, meta *MetaObject) error {
+	var err error
+	if Config().IsSoftDeleting() {
+		meta.DeletedAt = time.Now().UTC()
+		err = putMeta(bucket, meta)
+	} else {
+		err = bucket.Delete([]byte(meta.Oid))
+	}
+	if err != nil {
+		return err
+	}
+
+	usage := tx.Bucket(usageBucket)
+	if usage == nil {
+		return errNoBucket
+	}
+	return releaseUsage(usage, meta)
+}
+
+func putMeta(bucket kvBucket, meta *MetaObject) error {
+	data, err := encodeMeta(meta)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(meta.Oid), data)
+}
+
+// validateOid returns errInvalidOid unless oid is a lowercase hex digest of
+// the hash algorithm algo, so that nothing else is ever used as a key in the
+// objects bucket. An empty algo accepts a digest of any supported algorithm,
+// for requests that only name the object by oid.
+func validateOid(algo, oid string) error {
+	if !oidPattern.MatchString(oid) {
+		return errInvalidOid
+	}
+
+	if algo == "" {
+		for _, a := range hashAlgos {
+			if len(oid) == a.size {
+				return nil
+			}
+		}
+		return errInvalidOid
+	}
+
+	a, ok := hashAlgos[algo]
+	if !ok {
+		return errUnknownHashAlgo
+	}
+	if len(oid) != a.size {
+		return errInvalidOid
+	}
+	return nil
+}
+
+// RefCount returns the number of repos referencing the object.
+func (s *MetaStore) RefCount(oid string) (int, error) {
+	var count int
+	err := s.view(func(tx kvTx) error {
+		refs := tx.Bucket(refsBucket)
+		if refs == nil {
+			return errNoBucket
+		}
+
+		if objRefs := refs.Bucket([]byte(oid)); objRefs != nil {
+			count = countKeys(objRefs)
+		}
+		return nil
+	})
+	return count, err
+}
+
+// addRef records that the repo in v references the object. Each repo holds at
+// most one reference, so repeated uploads to the same repo are not counted.
+func addRef(refs kvBucket, v *RequestVars) error {
+	objRefs, err := refs.CreateBucketIfNotExists([]byte(v.Oid))
+	if err != nil {
+		return err
+	}
+	return objRefs.Put(refKey(v), []byte{})
+}
+
+// removeRef removes the reference from the repo in v to the object, returning
+// the number of references left.
+func removeRef(refs kvBucket, v *RequestVars) (int, error) {
+	objRefs := refs.Bucket([]byte(v.Oid))
+	if objRefs == nil {
+		return 0, nil
+	}
+
+	if err := objRefs.Delete(refKey(v)); err != nil {
+		return 0, err
+	}
+
+	remaining := countKeys(objRefs)
+	if remaining == 0 {
+		return 0, refs.DeleteBucket([]byte(v.Oid))
+	}
+	return remaining, nil
+}
+
+func refKey(v *RequestVars) []byte {
+	return []byte(v.User + "/" + v.Repo)
+}
+
+func countKeys(bucket kvBucket) int {
+	var count int
+	bucket.ForEach(func(k, v []byte) error {
+		count++
+		return nil
+	})
+	return count
+}
+
+// Usage returns the number of bytes of object content stored by user.
+func (s *MetaStore) Usage(user string) (int64, error) {
+	var used int64
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(usageBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		used = getUsage(bucket, user)
+		return nil
+	})
+	return used, err
+}
+
+func getUsage(bucket kvBucket, user string) int64 {
+	used, _ := strconv.ParseInt(string(bucket.Get([]byte(user))), 10, 64)
+	return used
+}
+
+// releaseUsage subtracts the size of a removed object from the storage used
+// by the user it was charged to, its uploader.
+func releaseUsage(bucket kvBucket, meta *MetaObject) error {
+	used := getUsage(bucket, meta.UploadedBy) - meta.Size
+	if used < 0 {
+		used = 0
+	}
+	return putUsage(bucket, meta.UploadedBy, used)
+}
+
+// putUsage records the storage used by user. Objects uploaded without an
+// authenticated user are not accounted for.
+func putUsage(bucket kvBucket, user string, used int64) error {
+	if user == "" {
+		return nil
+	}
+	return bucket.Put([]byte(user), []byte(strconv.FormatInt(used, 10)))
+}
+
+func getLockCount(bucket kvBucket, user string) int {
+	count, _ := strconv.Atoi(string(bucket.Get([]byte(user))))
+	return count
+}
+
+// putLockCount records the number of locks owned by user.
+func putLockCount(bucket kvBucket, user string, count int) error {
+	if count <= 0 {
+		return bucket.Delete([]byte(user))
+	}
+	return bucket.Put([]byte(user), []byte(strconv.Itoa(count)))
+}
+
+// touchLocks records that the locks for repo changed. The time is kept to the
+// second, as in Last-Modified headers, and always moves forward by at least a
+// second so that changes within a second of a listing aren't missed.
+func touchLocks(tx kvTx, repo string) error {
+	bucket := tx.Bucket(locksModifiedBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	modified := time.Now().UTC().Truncate(time.Second)
+	if prev, err := time.Parse(time.RFC3339, string(bucket.Get([]byte(repo)))); err == nil && !modified.After(prev) {
+		modified = prev.Add(time.Second)
+	}
+	return bucket.Put([]byte(repo), []byte(modified.Format(time.RFC3339)))
+}
+
+// LocksModified returns when the locks for repo last changed, or the zero
+// time if they haven't changed since the server started tracking it.
+func (s *MetaStore) LocksModified(repo string) (time.Time, error) {
+	var modified time.Time
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(locksModifiedBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if data := bucket.Get([]byte(repo)); data != nil {
+			t, err := time.Parse(time.RFC3339, string(data))
+			if err != nil {
+				return err
+			}
+			modified = t
+		}
+		return nil
+	})
+	return modified, err
+}
+
+// withinLockLimits returns false if adding a lock to a repo with repoLocks
+// locks, for a user that owns userLocks locks, would go over
+// Config.MaxRepoLocks or Config.MaxUserLocks.
+func withinLockLimits(repoLocks, userLocks int) bool {
+	if limit := Config().RepoLockLimit(); limit > 0 && repoLocks >= limit {
+		return false
+	}
+	if limit := Config().UserLockLimit(); limit > 0 && userLocks >= limit {
+		return false
+	}
+	return true
+}
+
+// AddLocks write locks to the store for the repo, returning them as stored.
+// errLockIdExists is returned if the id of any of the locks is already used in
+// the repo, errPathLocked if any of their paths is already locked, and
+// errLockLimit if the locks would take the repo or an owner over the lock
+// limits. When Config.ReLockOwnSuccess is set, a lock on a path its owner
+// already holds is returned as the existing lock instead of being added.
+// Paths are cleaned, and rejected if invalid, as in cleanLockPath.
+func (s *MetaStore) AddLocks(repo string, l ...Lock) ([]Lock, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	l = append([]Lock(nil), l...)
+	for i := range l {
+		cleaned, err := cleanLockPath(l[i].Path)
+		if err != nil {
+			return nil, err
+		}
+		l[i].Path = cleaned
+	}
+
+	var stored []Lock
+	err := s.update(func(tx kvTx) error {
+		stored = nil
+
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		counts := tx.Bucket(lockCountsBucket)
+		if counts == nil {
+			return errNoBucket
+		}
+
+		var locks []Lock
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+
+		owned := make(map[string]int)
+		for _, lock := range l {
+			if lockIdInUse(locks, lock.Id) {
+				return errLockIdExists
+			}
+
+			owner := lock.Owner.Name
+			if existing := findLockByPath(locks, lock.Path); existing != nil {
+				if Config().IsReLockOwnSuccess() && existing.Owner.Name == owner {
+					stored = append(stored, *existing)
+					continue
+				}
+				return errPathLocked
+			}
+
+			if _, ok := owned[owner]; !ok {
+				owned[owner] = getLockCount(counts, owner)
+			}
+			if !withinLockLimits(len(locks), owned[owner]) {
+				return errLockLimit
+			}
+			owned[owner]++
+
+			locks = append(locks, lock)
+			stored = append(stored, lock)
+		}
+
+		if len(owned) == 0 {
+			return nil
+		}
+
+		for owner, count := range owned {
+			if err := putLockCount(counts, owner, count); err != nil {
+				return err
+			}
+		}
+
+		if err := touchLocks(tx, repo); err != nil {
+			return err
+		}
+
+		sort.Stable(LocksByCreatedAt(locks))
+		data, err := json.Marshal(&locks)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(repo), data)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// AddLocksBatch locks each of paths in the repo for owner in a single
+// transaction. Paths that are already locked, including paths repeated in the
+// batch, are returned as conflicts while the remaining paths are still locked.
+// Nothing is locked if the batch would go over the lock limits, and
+// errLockLimit is returned, or if any of the paths are invalid, as in
+// cleanLockPath.
+func (s *MetaStore) AddLocksBatch(repo string, paths []string, owner string) ([]Lock, []LockConflict, error) {
+	if Config().IsReadOnly() {
+		return nil, nil, errReadOnly
+	}
+
+	paths = append([]string(nil), paths...)
+	for i := range paths {
+		cleaned, err := cleanLockPath(paths[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		paths[i] = cleaned
+	}
+
+	var created []Lock
+	var conflicts []LockConflict
+	err := s.update(func(tx kvTx) error {
+		created, conflicts = nil, nil
+
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		counts := tx.Bucket(lockCountsBucket)
+		if counts == nil {
+			return errNoBucket
+		}
+
+		var locks []Lock
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+
+		owned := getLockCount(counts, owner)
+		lockedAt := time.Now().UTC().Truncate(time.Second)
+		for _, p := range paths {
+			if existing := findLockByPath(locks, p); existing != nil {
+				conflicts = append(conflicts, LockConflict{Path: p, Lock: existing})
+				continue
+			}
+
+			if !withinLockLimits(len(locks), owned) {
+				return errLockLimit
+			}
+			owned++
+
+			lock := Lock{
+				Id:       randomLockId(),
+				Path:     p,
+				Owner:    User{Name: owner},
+				LockedAt: lockedAt,
+			}
+			for lockIdInUse(locks, lock.Id) {
+				lock.Id = randomLockId()
+			}
+
+			locks = append(locks, lock)
+			created = append(created, lock)
+		}
+
+		if len(created) == 0 {
+			return nil
+		}
+
+		if err := putLockCount(counts, owner, owned); err != nil {
+			return err
+		}
+
+		if err := touchLocks(tx, repo); err != nil {
+			return err
+		}
+
+		sort.Stable(LocksByCreatedAt(locks))
+		data, err := json.Marshal(&locks)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(repo), data)
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return created, conflicts, nil
+}
+
+// Lock returns the lock with id in the repo, or nil if there isn't one.
+func (s *MetaStore) Lock(repo, id string) (*Lock, error) {
+	locks, err := s.Locks(repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range locks {
+		if l.Id == id {
+			return &l, nil
+		}
+	}
+	return nil, nil
+}
+
+// Locks retrieves locks for the repo from the store
+func (s *MetaStore) Locks(repo string) ([]Lock, error) {
+	var locks []Lock
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return locks, err
+}
+
+// LockCount returns how many of the repo's locks are on matchpath, or how many
+// locks the repo has if matchpath is empty. Only the lock paths are decoded.
+func (s *MetaStore) LockCount(repo, matchpath string) (int, error) {
+	var count int
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		data := bucket.Get([]byte(repo))
+		if data == nil {
+			return nil
+		}
+
+		var paths []struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(data, &paths); err != nil {
+			return err
+		}
+
+		if matchpath == "" {
+			count = len(paths)
+			return nil
+		}
+		key := lockPathKey(matchpath)
+		for _, p := range paths {
+			if lockPathKey(p.Path) == key {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// FilteredLocks return filtered locks for the repo. Empty path and owner
+// values match every lock. The search stops with ctx's error if ctx is done.
+// A page ends before the lock named by next, a cursor made by lockCursor.
+// Resuming from a cursor starts at the first lock that isn't before its place
+// in LocksByCreatedAt order, so locks deleted between pages don't make any
+// other lock be skipped or seen twice.
+func (s *MetaStore) FilteredLocks(ctx context.Context, repo, path, owner, cursor, limit string) (locks []Lock, next string, err error) {
+	locks, err = s.Locks(repo)
+	if err != nil {
+		return
+	}
+
+	// Locks stored before ties were ordered by id may be out of order
+	sort.Stable(LocksByCreatedAt(locks))
+
+	if cursor != "" {
+		lockedAt, id, ok := parseLockCursor(cursor)
+		if !ok {
+			err = errInvalidCursor
+			return
+		}
+		start := sort.Search(len(locks), func(i int) bool { return !lockBefore(locks[i], lockedAt, id) })
+		locks = locks[start:]
+	}
+
+	if path != "" || owner != "" {
+		key := lockPathKey(path)
+		var filtered []Lock
+		for _, l := range locks {
+			if err = ctx.Err(); err != nil {
+				return nil, "", err
+			}
+			if path != "" && lockPathKey(l.Path) != key {
+				continue
+			}
+			if owner != "" && l.Owner.Name != owner {
+				continue
+			}
+			filtered = append(filtered, l)
+		}
+
+		locks = filtered
+	}
+
+	if limit != "" {
+		var size int
+		size, err = strconv.Atoi(limit)
+		if err != nil || size < 0 {
+			locks = make([]Lock, 0)
+			err = fmt.Errorf("Invalid limit amount: %s", limit)
+			return
+		}
+
+		// An empty page has no next page, or a limit of 0 would hand out
+		// the same cursor forever
+		size = int(math.Min(float64(size), float64(len(locks))))
+		if size > 0 && size < len(locks) {
+			next = lockCursor(locks[size])
+		}
+		locks = locks[:size]
+	}
+
+	return locks, next, nil
+}
+
+// DeleteLock removes lock for the repo by id from the store. If lockedAt
+// isn't zero the lock is only removed if it was locked at that time, and
+// errLockChanged is returned if it wasn't or the lock no longer exists.
+func (s *MetaStore) DeleteLock(repo, user, id string, force bool, lockedAt time.Time) (*Lock, error) {
+	return s.deleteLock(repo, user, force, lockedAt, func(l Lock) bool { return l.Id == id })
+}
+
+// DeleteLockByPath removes the lock on path for the repo from the store,
+// comparing paths as FilteredLocks does. Ownership and lockedAt are checked
+// as in DeleteLock.
+func (s *MetaStore) DeleteLockByPath(repo, user, path string, force bool, lockedAt time.Time) (*Lock, error) {
+	key := lockPathKey(path)
+	return s.deleteLock(repo, user, force, lockedAt, func(l Lock) bool { return lockPathKey(l.Path) == key })
+}
+
+// deleteLock removes the first lock for the repo that matches. nil is
+// returned if no lock matches, errNotOwner if the lock belongs to another
+// user and force isn't set, and errLockChanged if lockedAt is set and
+// doesn't match the lock. Force deleting another user's lock is recorded in
+// the audit log.
+func (s *MetaStore) deleteLock(repo, user string, force bool, lockedAt time.Time, match func(Lock) bool) (*Lock, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	var deleted *Lock
+	err := s.update(func(tx kvTx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var locks []Lock
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+		newLocks := make([]Lock, 0, len(locks))
+
+		var lock Lock
+		for _, l := range locks {
+			if lock.Id == "" && match(l) {
+				// locked_at is only sent to clients to the second
+				if !lockedAt.IsZero() && !l.LockedAt.Truncate(time.Second).Equal(lockedAt) {
+					return errLockChanged
+				}
+				if l.Owner.Name != user && !force {
+					return errNotOwner
+				}
+				lock = l
+			} else if len(l.Id) > 0 {
+				newLocks = append(newLocks, l)
+			}
+		}
+		if lock.Id == "" {
+			if !lockedAt.IsZero() {
+				return errLockChanged
+			}
+			return nil
+		}
+		deleted = &lock
+
+		counts := tx.Bucket(lockCountsBucket)
+		if counts == nil {
+			return errNoBucket
+		}
+		owner := lock.Owner.Name
+		if err := putLockCount(counts, owner, getLockCount(counts, owner)-1); err != nil {
+			return err
+		}
+
+		if err := touchLocks(tx, repo); err != nil {
+			return err
+		}
+
+		if owner != user {
+			err := recordAudit(tx, &AuditEntry{
+				Actor:     user,
+				Owner:     owner,
+				Repo:      repo,
+				LockId:    lock.Id,
+				Path:      lock.Path,
+				DeletedAt: time.Now().UTC(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(newLocks) == 0 {
+			return bucket.Delete([]byte(repo))
+		}
+
+		data, err := json.Marshal(&newLocks)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(repo), data)
+	})
+	return deleted, err
+}
+
+// LockClear deletes every lock in the repo, returning the locks deleted. The
+// lock counts of their owners are lowered to match. Clearing a repo without
+// locks does nothing.
+func (s *MetaStore) LockClear(repo string) ([]Lock, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	var cleared []Lock
+	err := s.update(func(tx kvTx) error {
+		cleared = nil
+
+		bucket, counts := tx.Bucket(locksBucket), tx.Bucket(lockCountsBucket)
+		if bucket == nil || counts == nil {
+			return errNoBucket
+		}
+
+		data := bucket.Get([]byte(repo))
+		if data == nil {
+			return nil
+		}
+
+		var locks []Lock
+		if err := json.Unmarshal(data, &locks); err != nil {
+			return err
+		}
+
+		owned := make(map[string]int)
+		for _, l := range locks {
+			owned[l.Owner.Name]++
+		}
+		for owner, n := range owned {
+			if err := putLockCount(counts, owner, getLockCount(counts, owner)-n); err != nil {
+				return err
+			}
+		}
+		cleared = locks
+
+		if err := touchLocks(tx, repo); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(repo))
+	})
+	return cleared, err
+}
+
+// RenameLock moves the lock with id in the repo to newPath, keeping its id and
+// locked_at time. nil is returned if there is no lock with id, errNotOwner if
+// the lock belongs to another user and force isn't set, and errPathLocked if
+// another lock is already held on newPath. newPath is cleaned, and rejected
+// if invalid, as in cleanLockPath.
+func (s *MetaStore) RenameLock(repo, user, id, newPath string, force bool) (*Lock, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	newPath, err := cleanLockPath(newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var renamed *Lock
+	err = s.update(func(tx kvTx) error {
+		renamed = nil
+
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var locks []Lock
+		data := bucket.Get([]byte(repo))
+		if data != nil {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return err
+			}
+		}
+
+		index := -1
+		for i, l := range locks {
+			if l.Id == id {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil
+		}
+		if locks[index].Owner.Name != user && !force {
+			return errNotOwner
+		}
+		if existing := findLockByPath(locks, newPath); existing != nil && existing.Id != id {
+			return errPathLocked
+		}
+
+		locks[index].Path = newPath
+		lock := locks[index]
+		renamed = &lock
+
+		if err := touchLocks(tx, repo); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(&locks)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(repo), data)
+	})
+	return renamed, err
+}
+
+// findLockByPath returns a copy of the lock on p, comparing paths with
+// lockPathKey, or nil if p is not locked.
+func findLockByPath(locks []Lock, p string) *Lock {
+	key := lockPathKey(p)
+	for _, l := range locks {
+		if lockPathKey(l.Path) == key {
+			lock := l
+			return &lock
+		}
+	}
+	return nil
+}
+
+func lockIdInUse(locks []Lock, id string) bool {
+	for _, l := range locks {
+		if l.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanLockPath returns p cleaned with path.Clean, the form lock paths are
+// stored in. Empty paths, paths with null bytes and paths that aren't within
+// the repository, such as absolute ones, are rejected with
+// errInvalidLockPath, paths longer than Config.MaxLockPathLength with
+// errLockPathTooLong, and paths Config.IsLockPathAllowed refuses with
+// errLockPathDenied.
+func cleanLockPath(p string) (string, error) {
+	if limit := Config().LockPathLimit(); limit > 0 && len(p) > limit {
+		return "", errLockPathTooLong
+	}
+	if p == "" || strings.ContainsRune(p, 0) {
+		return "", errInvalidLockPath
+	}
+
+	cleaned := path.Clean(p)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "/") || strings.HasPrefix(cleaned, "../") {
+		return "", errInvalidLockPath
+	}
+	if !Config().IsLockPathAllowed(cleaned) {
+		return "", errLockPathDenied
+	}
+	return cleaned, nil
+}
+
+// lockPathKey returns the form of a lock path used when comparing locks,
+// cleaned with path.Clean so that paths given in queries and locks stored
+// before paths were cleaned compare like new locks. When
+// Config.NormalizeLockPaths is set, paths are also lowercased so that case
+// variants of the same file conflict with each other. The lock itself keeps
+// the case the client sent.
+func lockPathKey(p string) string {
+	p = path.Clean(p)
+	if Config().IsNormalizingLockPaths() {
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
+// LocksByCreatedAt orders locks by when they were locked, and locks made in
+// the same instant by id, so that every lock has a fixed place in the order
+// for cursors to resume from.
+type LocksByCreatedAt []Lock
+
+func (c LocksByCreatedAt) Len() int      { return len(c) }
+func (c LocksByCreatedAt) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (c LocksByCreatedAt) Less(i, j int) bool { return lockBefore(c[i], c[j].LockedAt, c[j].Id) }
+
+// lockBefore returns true if l comes before the place of a lock locked at
+// lockedAt with id in LocksByCreatedAt order. Times are compared to the
+// second, as they are stored.
+func lockBefore(l Lock, lockedAt time.Time, id string) bool {
+	a, b := l.LockedAt.Truncate(time.Second), lockedAt.Truncate(time.Second)
+	if !a.Equal(b) {
+		return a.Before(b)
+	}
+	return l.Id < id
+}
+
+// lockCursor returns the cursor naming l's place in LocksByCreatedAt order:
+// when it was locked in nanoseconds and its id. The place stays meaningful
+// after l is deleted.
+func lockCursor(l Lock) string {
+	return strconv.FormatInt(l.LockedAt.UnixNano(), 10) + ":" + l.Id
+}
+
+// parseLockCursor returns the lock time and id in a cursor made by
+// lockCursor.
+func parseLockCursor(cursor string) (time.Time, string, bool) {
+	i := strings.Index(cursor, ":")
+	if i < 0 {
+		return time.Time{}, "", false
+	}
+	nanos, err := strconv.ParseInt(cursor[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, nanos), cursor[i+1:], true
+}
+
+// Close closes the underlying boltdb.
+func (s *MetaStore) Close() {
+	s.swap.Lock()
+	defer s.swap.Unlock()
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// userRecord is how a user is stored in the users bucket, keyed by login.
+type userRecord struct {
+	Password    string `json:"password"`
+	DisplayName string `json:"display_name,omitempty"`
 }
 
-// DeleteUser removes user credentials from the meta store.
-func (s *MetaStore) DeleteUser(user string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+// AddUser adds user credentials to the meta store. displayName is the name
+// shown as the owner of the user's locks, and may be empty to use the login.
+func (s *MetaStore) AddUser(user, pass, displayName string) error {
+	if Config().IsReadOnly() {
+		return errReadOnly
+	}
+
+	err := s.update(func(tx kvTx) error {
 		bucket := tx.Bucket(usersBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err := bucket.Delete([]byte(user))
-		return err
+		data, err := json.Marshal(&userRecord{Password: pass, DisplayName: displayName})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), data)
 	})
 
 	return err
 }
 
+// ChangePassword replaces the password of a user in the meta store with
+// newPass, after checking that oldPass is their current password. It returns
+// errWrongPassword if it isn't, or if the user isn't in the meta store, and
+// errWeakPassword if newPass is shorter than minPasswordLength.
+func (s *MetaStore) ChangePassword(user, oldPass, newPass string) error {
+	if Config().IsReadOnly() {
+		return errReadOnly
+	}
+	if len(newPass) < minPasswordLength {
+		return errWeakPassword
+	}
+
+	return s.update(func(tx kvTx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var record userRecord
+		data := bucket.Get([]byte(user))
+		if data == nil {
+			secureCompare(dummyPassword, oldPass)
+			return errWrongPassword
+		}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if !secureCompare(record.Password, oldPass) {
+			return errWrongPassword
+		}
+
+		record.Password = newPass
+		data, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), data)
+	})
+}
+
+// DeleteUser removes user credentials from the meta store. It returns the
+// locks owned by the user, by repo. If releaseLocks is true those locks are
+// deleted along with the user, otherwise they are left in place.
+func (s *MetaStore) DeleteUser(user string, releaseLocks bool) (map[string][]Lock, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	var owned map[string][]Lock
+	err := s.update(func(tx kvTx) error {
+		owned = make(map[string][]Lock)
+
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if err := bucket.Delete([]byte(user)); err != nil {
+			return err
+		}
+
+		locksBkt := tx.Bucket(locksBucket)
+		if locksBkt == nil {
+			return errNoBucket
+		}
+
+		remaining := make(map[string][]Lock)
+		err := locksBkt.ForEach(func(k, v []byte) error {
+			var locks []Lock
+			if err := json.Unmarshal(v, &locks); err != nil {
+				logCorruptRecord(locksBucket, k, err)
+				return nil
+			}
+
+			kept := make([]Lock, 0, len(locks))
+			for _, l := range locks {
+				if l.Owner.Name == user {
+					owned[string(k)] = append(owned[string(k)], l)
+				} else {
+					kept = append(kept, l)
+				}
+			}
+			if len(kept) != len(locks) {
+				remaining[string(k)] = kept
+			}
+			return nil
+		})
+		if err != nil || !releaseLocks {
+			return err
+		}
+
+		for repo, locks := range remaining {
+			if err := touchLocks(tx, repo); err != nil {
+				return err
+			}
+
+			if len(locks) == 0 {
+				if err := locksBkt.Delete([]byte(repo)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			data, err := json.Marshal(&locks)
+			if err != nil {
+				return err
+			}
+			if err := locksBkt.Put([]byte(repo), data); err != nil {
+				return err
+			}
+		}
+
+		counts := tx.Bucket(lockCountsBucket)
+		if counts == nil {
+			return errNoBucket
+		}
+		return putLockCount(counts, user, 0)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return owned, nil
+}
+
+// countRepoLocks returns how many locks there are in locks by repo.
+func countRepoLocks(locks map[string][]Lock) int {
+	var n int
+	for _, l := range locks {
+		n += len(l)
+	}
+	return n
+}
+
+// UserExists returns true if the user is in the meta store.
+func (s *MetaStore) UserExists(user string) (bool, error) {
+	var exists bool
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		exists = bucket.Get([]byte(user)) != nil
+		return nil
+	})
+	return exists, err
+}
+
 // MetaUser encapsulates information about a meta store user
 type MetaUser struct {
-	Name string
+	Name        string
+	DisplayName string
 }
 
 // Users returns all MetaUsers in the meta store
 func (s *MetaStore) Users() ([]*MetaUser, error) {
 	var users []*MetaUser
 
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx kvTx) error {
 		bucket := tx.Bucket(usersBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		bucket.ForEach(func(k, v []byte) error {
-			users = append(users, &MetaUser{string(k)})
+		return bucket.ForEach(func(k, v []byte) error {
+			var record userRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				logCorruptRecord(usersBucket, k, err)
+				return nil
+			}
+			users = append(users, &MetaUser{Name: string(k), DisplayName: record.DisplayName})
 			return nil
 		})
-		return nil
 	})
 
 	return users, err
 }
 
-// Objects returns all MetaObjects in the meta store
-func (s *MetaStore) Objects() ([]*MetaObject, error) {
+// DisplayNames returns the display names of the users that have one, keyed
+// by login.
+func (s *MetaStore) DisplayNames() (map[string]string, error) {
+	users, err := s.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, u := range users {
+		if u.DisplayName != "" {
+			names[u.Name] = u.DisplayName
+		}
+	}
+	return names, nil
+}
+
+// Objects returns all MetaObjects in the meta store, leaving out soft deleted
+// objects.
+func (s *MetaStore) Objects(ctx context.Context) ([]*MetaObject, error) {
+	return s.ObjectsBySize(ctx, 0, math.MaxInt64)
+}
+
+// ObjectsBySize returns the MetaObjects in the meta store with a size from
+// min to max bytes, inclusive, leaving out soft deleted objects. Objects that
+// can't be decoded are logged and skipped. The scan stops with ctx's error if
+// ctx is done.
+func (s *MetaStore) ObjectsBySize(ctx context.Context, min, max int64) ([]*MetaObject, error) {
 	var objects []*MetaObject
 
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx kvTx) error {
 		bucket := tx.Bucket(objectsBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		bucket.ForEach(func(k, v []byte) error {
-			var meta MetaObject
-			dec := gob.NewDecoder(bytes.NewBuffer(v))
-			err := dec.Decode(&meta)
-			if err != nil {
+		return bucket.ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
-			objects = append(objects, &meta)
+
+			var meta MetaObject
+			if err := decodeMeta(v, &meta); err != nil {
+				logCorruptRecord(objectsBucket, k, err)
+				return nil
+			}
+			if !meta.Deleted() && meta.Size >= min && meta.Size <= max {
+				objects = append(objects, &meta)
+			}
 			return nil
 		})
-		return nil
 	})
 
-	return objects, err
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
 }
 
-// AllLocks return all locks in the store, lock path is prepended with repo
-func (s *MetaStore) AllLocks() ([]Lock, error) {
+// AllLocks return all locks in the store, lock path is prepended with repo.
+// Repos whose locks can't be decoded are logged and skipped. The scan stops
+// with ctx's error if ctx is done.
+func (s *MetaStore) AllLocks(ctx context.Context) ([]Lock, error) {
 	var locks []Lock
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx kvTx) error {
 		bucket := tx.Bucket(locksBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		bucket.ForEach(func(k, v []byte) error {
+		return bucket.ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			var l []Lock
 			if err := json.Unmarshal(v, &l); err != nil {
-				return err
+				logCorruptRecord(locksBucket, k, err)
+				return nil
 			}
 			for _, lv := range l {
 				lv.Path = fmt.Sprintf("%s:%s", k, lv.Path)
@@ -412,32 +2002,321 @@ func (s *MetaStore) AllLocks() ([]Lock, error) {
 			}
 			return nil
 		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+// LocksByOwner returns the locks owned by owner in every repo, with the lock
+// path prepended with repo as in AllLocks.
+func (s *MetaStore) LocksByOwner(owner string) ([]Lock, error) {
+	locks, err := s.AllLocks(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make([]Lock, 0)
+	for _, l := range locks {
+		if l.Owner.Name == owner {
+			owned = append(owned, l)
+		}
+	}
+	return owned, nil
+}
+
+// TransferLocks makes to the owner of every lock owned by from, in a single
+// transaction, returning the transferred locks by repo. Lock counts move with
+// the locks, but to's lock limit isn't applied. Transferring locks to their
+// owner transfers nothing.
+func (s *MetaStore) TransferLocks(from, to string) (map[string][]Lock, error) {
+	if Config().IsReadOnly() {
+		return nil, errReadOnly
+	}
+
+	var transferred map[string][]Lock
+	err := s.update(func(tx kvTx) error {
+		transferred = make(map[string][]Lock)
+		if from == to {
+			return nil
+		}
+
+		bucket, counts := tx.Bucket(locksBucket), tx.Bucket(lockCountsBucket)
+		if bucket == nil || counts == nil {
+			return errNoBucket
+		}
+
+		changed := make(map[string][]Lock)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var locks []Lock
+			if err := json.Unmarshal(v, &locks); err != nil {
+				logCorruptRecord(locksBucket, k, err)
+				return nil
+			}
+
+			var moved []Lock
+			for i := range locks {
+				if locks[i].Owner.Name == from {
+					locks[i].Owner = User{Name: to}
+					moved = append(moved, locks[i])
+				}
+			}
+			if len(moved) > 0 {
+				changed[string(k)] = locks
+				transferred[string(k)] = moved
+			}
+			return nil
+		})
+		if err != nil || len(changed) == 0 {
+			return err
+		}
 
-		return nil
+		for repo, locks := range changed {
+			if err := touchLocks(tx, repo); err != nil {
+				return err
+			}
+
+			data, err := json.Marshal(&locks)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(repo), data); err != nil {
+				return err
+			}
+		}
+
+		n := countRepoLocks(transferred)
+		if err := putLockCount(counts, from, getLockCount(counts, from)-n); err != nil {
+			return err
+		}
+		return putLockCount(counts, to, getLockCount(counts, to)+n)
 	})
-	return locks, err
+
+	if err != nil {
+		return nil, err
+	}
+	return transferred, nil
+}
+
+// CountObjects returns the number of objects in the meta store, leaving out
+// soft deleted objects.
+func (s *MetaStore) CountObjects() (int, error) {
+	var count int
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(objectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var meta MetaObject
+			if err := decodeMeta(v, &meta); err != nil {
+				logCorruptRecord(objectsBucket, k, err)
+				return nil
+			}
+			if !meta.Deleted() {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// CountLocks returns the number of locks in the meta store, across all repos.
+func (s *MetaStore) CountLocks() (int, error) {
+	var count int
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(locksBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var locks []Lock
+			if err := json.Unmarshal(v, &locks); err != nil {
+				logCorruptRecord(locksBucket, k, err)
+				return nil
+			}
+			count += len(locks)
+			return nil
+		})
+	})
+	return count, err
+}
+
+// MetaStats summarizes the contents of the meta store.
+type MetaStats struct {
+	Users       int        `json:"users"`
+	Objects     int        `json:"objects"`
+	ObjectsSize int64      `json:"objects_size"`
+	Locks       int        `json:"locks"`
+	OldestLock  *time.Time `json:"oldest_lock,omitempty"`
+	NewestLock  *time.Time `json:"newest_lock,omitempty"`
+	DBSize      int64      `json:"db_size"`
 }
 
-// Authenticate authorizes user with password and returns the user name
-func (s *MetaStore) Authenticate(user, password string) (string, bool) {
-	// check admin
-	if len(user) > 0 && len(password) > 0 {
-		if ok := checkBasicAuth(user, password, true); ok {
-			return user, true
+// Stats returns counts of the users, objects and locks in the meta store,
+// along with the size of the database file. Soft deleted objects are not
+// counted.
+func (s *MetaStore) Stats() (*MetaStats, error) {
+	stats := &MetaStats{}
+	err := s.view(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		objects := tx.Bucket(objectsBucket)
+		locks := tx.Bucket(locksBucket)
+		if users == nil || objects == nil || locks == nil {
+			return errNoBucket
+		}
+
+		stats.Users = countKeys(users)
+		stats.DBSize = tx.Size()
+
+		err := objects.ForEach(func(k, v []byte) error {
+			var meta MetaObject
+			if err := decodeMeta(v, &meta); err != nil {
+				logCorruptRecord(objectsBucket, k, err)
+				return nil
+			}
+			if !meta.Deleted() {
+				stats.Objects++
+				stats.ObjectsSize += meta.Size
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
+
+		return locks.ForEach(func(k, v []byte) error {
+			var repoLocks []Lock
+			if err := json.Unmarshal(v, &repoLocks); err != nil {
+				logCorruptRecord(locksBucket, k, err)
+				return nil
+			}
+			for _, l := range repoLocks {
+				lockedAt := l.LockedAt.UTC()
+				if stats.OldestLock == nil || lockedAt.Before(*stats.OldestLock) {
+					stats.OldestLock = &lockedAt
+				}
+				if stats.NewestLock == nil || lockedAt.After(*stats.NewestLock) {
+					stats.NewestLock = &lockedAt
+				}
+			}
+			stats.Locks += len(repoLocks)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// ValidateUser returns true if password is valid for user. Admins are checked
+// first, then the configured Authenticators. Empty users and passwords are
+// never valid.
+func (s *MetaStore) ValidateUser(user, password string) bool {
+	_, ok := s.validateUser(user, password)
+	return ok
+}
+
+// validateUser is ValidateUser, also returning whether user is an admin.
+func (s *MetaStore) validateUser(user, password string) (admin, ok bool) {
+	if user == "" || password == "" {
+		secureCompare(dummyPassword, password)
+		return false, false
+	}
+
+	if checkBasicAuth(user, password, true) {
+		return true, true
+	}
+	return false, s.auth.Validate(user, password)
+}
+
+// authenticate validates the credentials in the value of a Basic
+// Authorization header, or the token in a Bearer one, returning the user and
+// whether they are an admin. Users authenticated with a token are never
+// admins.
+func (s *MetaStore) authenticate(authorization string) (user string, admin, ok bool) {
+	if token, ok := parseBearerToken(authorization); ok {
+		user, err := validateToken(token, time.Now())
+		return user, false, err == nil
+	}
+
+	user, password, ok := parseBasicAuth(authorization)
+	if !ok {
+		return "", false, false
+	}
+
+	admin, ok = s.validateUser(user, password)
+	return user, admin, ok
+}
+
+// parseBasicAuth returns the user and password in the value of a Basic
+// Authorization header.
+func parseBasicAuth(authorization string) (user, password string, ok bool) {
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", "", false
 	}
 
+	decoded, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Validate checks user and password against the users in the meta store.
+func (s *MetaStore) Validate(user, password string) bool {
 	value := ""
 
-	s.db.View(func(tx *bolt.Tx) error {
+	s.view(func(tx kvTx) error {
 		bucket := tx.Bucket(usersBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		value = string(bucket.Get([]byte(user)))
+		data := bucket.Get([]byte(user))
+		if data == nil {
+			return nil
+		}
+
+		var record userRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		value = record.Password
 		return nil
 	})
 
-	return user, value != "" && value == password
+	// Unknown users are still compared, against a dummy password, so the
+	// response time doesn't reveal whether the user exists.
+	if value == "" {
+		secureCompare(dummyPassword, password)
+		return false
+	}
+
+	return secureCompare(value, password)
+}
+
+// dummyPassword is compared against when authenticating an unknown user.
+const dummyPassword = "lfs-test-server-dummy-password"
+
+// secureCompare reports whether a and b are equal, taking the same time
+// whatever their contents. Both are hashed first so that their lengths are
+// not leaked either.
+func secureCompare(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
 }
@@ -1,16 +1,143 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
 
 var (
 	metaStoreTest *MetaStore
+	// useMemoryMetaStore makes setupMeta create an in-memory store
+	useMemoryMetaStore bool
 )
 
+const (
+	otherOid = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	// blake2bOid is the BLAKE2b-512 digest of "test content"
+	blake2bOid = "3b077f22c156b622ae1f4343bb71227b6373c22fa8a0ae42ab80bc6e2fcb7c1d409c1c647ba39164b699ebf84e519492cab2fd52cb798462f3b9e3d64884dd30"
+)
+
+func TestNewMetaStoreLocked(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().MetaDBTimeout = "50ms"
+	defer func() { Config().MetaDBTimeout = "1s" }()
+
+	store, err := NewMetaStore("test-meta-store.db")
+	if err != errDatabaseLocked {
+		if store != nil {
+			store.Close()
+		}
+		t.Fatalf("expected errDatabaseLocked opening a locked database, got: %v", err)
+	}
+}
+
+func TestNewMetaStoreCreatesDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs-meta")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	Config().MetaDBMode = "0640"
+	Config().MetaDBDirMode = "0750"
+	defer func() {
+		Config().MetaDBMode = "0600"
+		Config().MetaDBDirMode = "0700"
+	}()
+
+	dbFile := filepath.Join(dir, "nested", "meta", "lfs.db")
+	store, err := NewMetaStore(dbFile)
+	if err != nil {
+		t.Fatalf("expected NewMetaStore to create the directory, got : %s", err)
+	}
+	store.Close()
+
+	// The umask can only take permissions away
+	for path, mode := range map[string]os.FileMode{filepath.Dir(dbFile): 0750, dbFile: 0640} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("expected %s to exist, got : %s", path, err)
+		}
+		if perm := info.Mode().Perm(); perm&^mode != 0 {
+			t.Errorf("expected %s to have at most mode %o, got: %o", path, mode, perm)
+		}
+	}
+
+	if _, err := NewMetaStore(dir); err != errMetaDBIsDir {
+		t.Errorf("expected errMetaDBIsDir opening a directory, got: %v", err)
+	}
+}
+
+func TestNewMetaStoreSyncModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs-meta")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { Config().MetaDBSync = "full" }()
+
+	for mode, noSync := range map[string]bool{"full": false, "none": true} {
+		Config().MetaDBSync = mode
+
+		store, err := NewMetaStore(filepath.Join(dir, mode+".db"))
+		if err != nil {
+			t.Fatalf("%s: expected NewMetaStore to succeed, got : %s", mode, err)
+		}
+		if store.db.NoSync != noSync {
+			t.Errorf("%s: expected NoSync %t, got %t", mode, noSync, store.db.NoSync)
+		}
+
+		if _, err := store.Put(&RequestVars{Oid: contentOid, Size: contentSize}); err != nil {
+			t.Errorf("%s: expected put to succeed, got : %s", mode, err)
+		}
+		if meta, err := store.Get(&RequestVars{Oid: contentOid}); err != nil || meta.Size != contentSize {
+			t.Errorf("%s: expected to get the object back, got %+v (%v)", mode, meta, err)
+		}
+		store.Close()
+	}
+}
+
+func TestNewMetaStorePermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions aren't enforced for root")
+	}
+
+	dir, err := ioutil.TempDir("", "lfs-meta")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatalf("error changing permissions: %s", err)
+	}
+	defer os.Chmod(dir, 0700)
+
+	for _, dbFile := range []string{filepath.Join(dir, "lfs.db"), filepath.Join(dir, "nested", "lfs.db")} {
+		store, err := NewMetaStore(dbFile)
+		if store != nil {
+			store.Close()
+		}
+		if !errors.Is(err, os.ErrPermission) {
+			t.Errorf("expected permission to be denied for %s, got : %v", dbFile, err)
+		}
+	}
+}
+
 func TestGetMeta(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
@@ -29,6 +156,110 @@ func TestGetMeta(t *testing.T) {
 	}
 }
 
+func TestGetManyMeta(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	objects, err := metaStoreTest.GetMany([]string{contentOid, nonExistingOid, "not-an-oid"})
+	if err != nil {
+		t.Fatalf("expected GetMany to succeed, got : %s", err)
+	}
+
+	if len(objects) != 1 {
+		t.Fatalf("expected only the existing object to be returned, got: %v", objects)
+	}
+
+	meta, ok := objects[contentOid]
+	if !ok {
+		t.Fatalf("expected content oid to be returned, got: %v", objects)
+	}
+	if meta.Oid != contentOid || meta.Size != contentSize {
+		t.Errorf("expected meta to match, got: %+v", meta)
+	}
+}
+
+func TestObjectsBySize(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: otherOid, Size: contentSize + 10}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+
+	cases := []struct {
+		min, max int64
+		expected []string
+	}{
+		{0, math.MaxInt64, []string{otherOid, contentOid}},
+		{contentSize, contentSize, []string{contentOid}},
+		{contentSize + 1, contentSize + 10, []string{otherOid}},
+		{contentSize + 11, math.MaxInt64, nil},
+	}
+
+	for _, c := range cases {
+		objects, err := metaStoreTest.ObjectsBySize(context.Background(), c.min, c.max)
+		if err != nil {
+			t.Fatalf("expected ObjectsBySize to succeed, got : %s", err)
+		}
+
+		var oids []string
+		for _, o := range objects {
+			oids = append(oids, o.Oid)
+		}
+		if fmt.Sprint(oids) != fmt.Sprint(c.expected) {
+			t.Errorf("expected objects %v between %d and %d bytes, got: %v", c.expected, c.min, c.max, oids)
+		}
+	}
+}
+
+func TestObjectsCancelled(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for _, oid := range []string{otherOid, nonExistingOid} {
+		if _, err := metaStoreTest.Put(&RequestVars{Oid: oid, Size: contentSize}); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
+	}
+
+	ctx := &cancelAfterContext{Context: context.Background(), checks: 1}
+	objects, err := metaStoreTest.Objects(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected the scan to be cancelled, got : %v", err)
+	}
+	if objects != nil {
+		t.Errorf("expected no objects from a cancelled scan, got: %d", len(objects))
+	}
+	if ctx.calls != 2 {
+		t.Errorf("expected the scan to stop at the second of 3 objects, got %d checks", ctx.calls)
+	}
+}
+
+func TestLocksCancelled(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	seedUserLocks(t)
+
+	ctx := &cancelAfterContext{Context: context.Background(), checks: 1}
+	locks, err := metaStoreTest.AllLocks(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected the scan to be cancelled, got : %v", err)
+	}
+	if locks != nil {
+		t.Errorf("expected no locks from a cancelled scan, got: %d", len(locks))
+	}
+	if ctx.calls != 2 {
+		t.Errorf("expected the scan to stop at the second of 2 repos, got %d checks", ctx.calls)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := metaStoreTest.FilteredLocks(cancelled, testRepo, "", testUser, "", ""); err != context.Canceled {
+		t.Errorf("expected the lock search to be cancelled, got : %v", err)
+	}
+}
+
 func TestPutMeta(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
@@ -65,176 +296,1852 @@ func TestPutMeta(t *testing.T) {
 	}
 }
 
-func TestLocks(t *testing.T) {
+func TestPutMetaSizeChanged(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	for i := 0; i < 5; i++ {
-		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), fmt.Sprintf("user-%d", i))
-		if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
-			t.Errorf("expected AddLocks to succeed, got : %s", err)
-		}
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Repo: "repo1", Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
 	}
 
-	locks, err := metaStoreTest.Locks(testRepo)
+	_, err := metaStoreTest.Put(&RequestVars{User: testUser, Repo: "repo2", Oid: nonExistingOid, Size: 43})
+	if err != errSizeChanged {
+		t.Fatalf("expected errSizeChanged, got : %v", err)
+	}
+
+	meta, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
 	if err != nil {
-		t.Errorf("expected Locks to succeed, got : %s", err)
+		t.Fatalf("expected to be able to retreive the object, got : %s", err)
 	}
-	if len(locks) != 5 {
-		t.Errorf("expected returned lock count to match, got: %d", len(locks))
+	if meta.Size != 42 {
+		t.Errorf("expected the stored size to be kept, got: %d", meta.Size)
+	}
+	if count, err := metaStoreTest.RefCount(nonExistingOid); err != nil || count != 1 {
+		t.Errorf("expected the rejected put to add no ref, got %d (%v)", count, err)
 	}
 }
 
-func TestFilteredLocks(t *testing.T) {
+func TestRefCount(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	testLocks := make([]Lock, 0, 5)
-	for i := 0; i < 5; i++ {
-		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), fmt.Sprintf("user-%d", i))
-		testLocks = append(testLocks, lock)
+	repo1 := &RequestVars{User: testUser, Repo: "repo1", Oid: nonExistingOid, Size: 42}
+	repo2 := &RequestVars{User: testUser1, Repo: "repo2", Oid: nonExistingOid, Size: 42}
+
+	for _, v := range []*RequestVars{repo1, repo2, repo1} {
+		if _, err := metaStoreTest.Put(v); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
 	}
-	if err := metaStoreTest.AddLocks(testRepo, testLocks...); err != nil {
-		t.Errorf("expected AddLocks to succeed, got : %s", err)
+
+	assertRefCount(t, nonExistingOid, 2)
+
+	if err := metaStoreTest.Delete(repo1); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+	assertRefCount(t, nonExistingOid, 1)
+
+	if _, err := metaStoreTest.Get(repo2); err != nil {
+		t.Errorf("expected object referenced by another repo to remain, got : %s", err)
+	}
+
+	if err := metaStoreTest.Delete(repo2); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+	assertRefCount(t, nonExistingOid, 0)
+
+	if _, err := metaStoreTest.Get(repo2); err != errObjectNotFound {
+		t.Errorf("expected object to be removed after the last reference, got : %v", err)
+	}
+}
+
+func TestDeleteContent(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	client := newMockS3Client()
+	content := NewS3ContentStore(client, "")
+	metaStoreTest.SetContentStore(content)
+	key := content.key(nonExistingOid)
+
+	repo1 := &RequestVars{User: testUser, Repo: "repo1", Oid: nonExistingOid, Size: 4}
+	repo2 := &RequestVars{User: testUser1, Repo: "repo2", Oid: nonExistingOid, Size: 4}
+	for _, v := range []*RequestVars{repo1, repo2} {
+		if _, err := metaStoreTest.Put(v); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
+	}
+	client.objects[key] = []byte("data")
+
+	Config().DeleteContent = "true"
+	defer func() { Config().DeleteContent = "false" }()
+
+	if err := metaStoreTest.Delete(repo1); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+	if _, ok := client.objects[key]; !ok {
+		t.Errorf("expected content referenced by another repo to remain")
+	}
+
+	if err := metaStoreTest.Delete(repo2); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+	if _, ok := client.objects[key]; ok {
+		t.Errorf("expected content to be removed with the last reference")
+	}
+
+	// Without LFS_DELETECONTENT, or when soft deleting, content is kept
+	for _, c := range []struct{ deleteContent, softDelete string }{{"false", "false"}, {"true", "true"}} {
+		Config().DeleteContent, Config().SoftDelete = c.deleteContent, c.softDelete
+		if _, err := metaStoreTest.Put(repo1); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
+		client.objects[key] = []byte("data")
+
+		if err := metaStoreTest.Delete(repo1); err != nil {
+			t.Fatalf("expected delete to succeed, got : %s", err)
+		}
+		if _, ok := client.objects[key]; !ok {
+			t.Errorf("expected content to be kept with %+v", c)
+		}
+	}
+
+	// Purging the tombstone removes the content kept for it
+	if _, err := metaStoreTest.Purge(0, false); err != nil {
+		t.Fatalf("expected purge to succeed, got : %s", err)
+	}
+	if _, ok := client.objects[key]; ok {
+		t.Errorf("expected content to be removed with its tombstone")
+	}
+	Config().SoftDelete = "false"
+
+	if _, err := metaStoreTest.Put(repo1); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
 	}
+	client.objects[key] = []byte("data")
+	if _, err := metaStoreTest.DeleteMany([]string{nonExistingOid}, false); err != nil {
+		t.Fatalf("expected DeleteMany to succeed, got : %s", err)
+	}
+	if _, ok := client.objects[key]; ok {
+		t.Errorf("expected DeleteMany to remove the content")
+	}
+}
 
-	locks, next, err := metaStoreTest.FilteredLocks(testRepo, "", "", "3")
+func assertRefCount(t *testing.T, oid string, expected int) {
+	count, err := metaStoreTest.RefCount(oid)
 	if err != nil {
-		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+		t.Fatalf("expected RefCount to succeed, got : %s", err)
 	}
-	if len(locks) != 3 {
-		t.Errorf("expected locks count to match limit, got: %d", len(locks))
+	if count != expected {
+		t.Errorf("expected ref count to be %d, got: %d", expected, count)
 	}
-	if next == "" {
-		t.Errorf("expected next to exist")
+}
+
+func TestDeleteMany(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for _, v := range []*RequestVars{
+		{User: testUser, Uploader: testUser, Repo: "repo1", Oid: nonExistingOid, Size: 42},
+		{User: testUser1, Uploader: testUser1, Repo: "repo2", Oid: nonExistingOid, Size: 42},
+	} {
+		if _, err := metaStoreTest.Put(v); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
 	}
 
-	locks, next, err = metaStoreTest.FilteredLocks(testRepo, "", next, "2")
+	deleted, err := metaStoreTest.DeleteMany([]string{contentOid, nonExistingOid, otherOid, "not-an-oid", contentOid}, false)
 	if err != nil {
-		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+		t.Fatalf("expected DeleteMany to succeed, got : %s", err)
 	}
-	if len(locks) != 2 {
-		t.Errorf("expected locks count to match limit, got: %d", len(locks))
+	if len(deleted) != 2 {
+		t.Errorf("expected only the existing objects to be returned, got: %v", deleted)
 	}
-	if next != "" {
-		t.Errorf("expected next to not exist, got: %s", next)
+
+	for _, oid := range []string{contentOid, nonExistingOid} {
+		if _, err := metaStoreTest.Get(&RequestVars{Oid: oid}); err != errObjectNotFound {
+			t.Errorf("expected %s to be deleted, got : %v", oid, err)
+		}
+	}
+	assertRefCount(t, nonExistingOid, 0)
+
+	if used, err := metaStoreTest.Usage(testUser); err != nil || used != 0 {
+		t.Errorf("expected the uploader's usage to be released, got %d (%v)", used, err)
 	}
 }
 
-func TestAddLocks(t *testing.T) {
+func TestDeleteManyDryRun(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
-		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Repo: "repo1", Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
 	}
 
-	locks, _, err := metaStoreTest.FilteredLocks(testRepo, lock.Path, "", "1")
+	deleted, err := metaStoreTest.DeleteMany([]string{contentOid, nonExistingOid, otherOid}, true)
 	if err != nil {
-		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+		t.Fatalf("expected DeleteMany to succeed, got : %s", err)
 	}
-	if len(locks) != 1 {
-		t.Errorf("expected lock to be existed")
+	if len(deleted) != 2 || deleted[0] != contentOid || deleted[1] != nonExistingOid {
+		t.Errorf("expected the existing objects to be returned, got: %v", deleted)
 	}
-	if locks[0].Id != lockId {
-		t.Errorf("expected lockId to match, got: %s", locks[0])
+
+	for _, oid := range []string{contentOid, nonExistingOid} {
+		if _, err := metaStoreTest.Get(&RequestVars{Oid: oid}); err != nil {
+			t.Errorf("expected %s to be kept on a dry run, got : %v", oid, err)
+		}
 	}
+	assertRefCount(t, nonExistingOid, 1)
 }
 
-func TestDeleteLock(t *testing.T) {
+func TestSoftDeleteRestore(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
-		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	Config().SoftDelete = "true"
+	defer func() { Config().SoftDelete = "false" }()
+
+	if err := metaStoreTest.Delete(&RequestVars{Oid: contentOid}); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: contentOid}); err != errObjectNotFound {
+		t.Errorf("expected deleted object to not be found, got : %v", err)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser, lock.Id, false)
+	objects, err := metaStoreTest.Objects(context.Background())
 	if err != nil {
-		t.Errorf("expected DeleteLock to succeed, got : %s", err)
+		t.Fatalf("expected Objects to succeed, got : %s", err)
 	}
-	if deleted == nil || deleted.Id != lock.Id {
-		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+	if len(objects) != 0 {
+		t.Errorf("expected deleted object to not be listed, got: %d objects", len(objects))
+	}
+
+	meta, err := metaStoreTest.Restore(contentOid)
+	if err != nil {
+		t.Fatalf("expected restore to succeed, got : %s", err)
+	}
+	if meta.Deleted() {
+		t.Errorf("expected restored object to not be deleted")
+	}
+
+	meta, err = metaStoreTest.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("expected restored object to be found, got : %s", err)
+	}
+	if meta.Size != contentSize {
+		t.Errorf("expected to get content size, got: %d", meta.Size)
+	}
+
+	if _, err := metaStoreTest.Restore(contentOid); err != errObjectNotFound {
+		t.Errorf("expected restoring an object that isn't deleted to fail, got : %v", err)
 	}
 }
 
-func TestDeleteLockNotOwner(t *testing.T) {
+func TestSetTags(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
-		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	meta, err := metaStoreTest.SetTags(contentOid, []string{"release", "assets", "release"})
+	if err != nil {
+		t.Fatalf("expected SetTags to succeed, got : %s", err)
+	}
+	if !reflect.DeepEqual(meta.Tags, []string{"assets", "release"}) {
+		t.Errorf("expected sorted tags without duplicates, got: %v", meta.Tags)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser1, lock.Id, false)
-	if err == nil || deleted != nil {
-		t.Errorf("expected DeleteLock to failed")
+	meta, err = metaStoreTest.Get(&RequestVars{Oid: contentOid})
+	if err != nil {
+		t.Fatalf("expected the object to be found, got : %s", err)
+	}
+	if !meta.HasTag("assets") || !meta.HasTag("release") || meta.HasTag("other") {
+		t.Errorf("expected the tags to be stored, got: %v", meta.Tags)
 	}
 
-	if err != errNotOwner {
-		t.Errorf("expected DeleteLock error match, got: %s", err)
+	if _, err := metaStoreTest.SetTags(contentOid, []string{""}); err != errInvalidTag {
+		t.Errorf("expected an empty tag to be rejected, got : %v", err)
+	}
+	if _, err := metaStoreTest.SetTags(nonExistingOid, []string{"release"}); err != errObjectNotFound {
+		t.Errorf("expected tagging a missing object to fail, got : %v", err)
+	}
+
+	meta, err = metaStoreTest.SetTags(contentOid, nil)
+	if err != nil {
+		t.Fatalf("expected SetTags to succeed, got : %s", err)
+	}
+	if len(meta.Tags) != 0 {
+		t.Errorf("expected the tags to be removed, got: %v", meta.Tags)
 	}
 }
 
-func TestDeleteLockNotOwnerForce(t *testing.T) {
+func TestSoftDeletePurge(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
-		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	Config().SoftDelete = "true"
+	defer func() { Config().SoftDelete = "false" }()
+
+	if err := metaStoreTest.Delete(&RequestVars{Oid: contentOid}); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser1, lock.Id, true)
+	purged, err := metaStoreTest.Purge(time.Hour, false)
 	if err != nil {
-		t.Errorf("expected DeleteLock(force) to succeed, got : %s", err)
+		t.Fatalf("expected purge to succeed, got : %s", err)
 	}
-	if deleted == nil || deleted.Id != lock.Id {
-		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+	if len(purged) != 0 {
+		t.Errorf("expected recently deleted object to be kept, got: %v purged", purged)
+	}
+
+	purged, err = metaStoreTest.Purge(0, true)
+	if err != nil {
+		t.Fatalf("expected dry run purge to succeed, got : %s", err)
+	}
+	if len(purged) != 1 || purged[0] != contentOid {
+		t.Errorf("expected deleted object to be listed on a dry run, got: %v", purged)
+	}
+
+	purged, err = metaStoreTest.Purge(0, false)
+	if err != nil {
+		t.Fatalf("expected purge to succeed, got : %s", err)
+	}
+	if len(purged) != 1 {
+		t.Errorf("expected deleted object to be purged after a dry run, got: %v purged", purged)
+	}
+
+	if _, err := metaStoreTest.Restore(contentOid); err != errObjectNotFound {
+		t.Errorf("expected purged object to not be restorable, got : %v", err)
 	}
 }
 
-func TestDeleteLockNonExisting(t *testing.T) {
+func TestSoftDeletePutAgain(t *testing.T) {
 	setupMeta()
 	defer teardownMeta()
 
-	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
-		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	Config().SoftDelete = "true"
+	defer func() { Config().SoftDelete = "false" }()
+
+	if err := metaStoreTest.Delete(&RequestVars{Oid: contentOid}); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
 	}
 
-	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser, nonExistingLockId, false)
+	meta, err := metaStoreTest.Put(&RequestVars{Oid: contentOid, Size: contentSize})
 	if err != nil {
-		t.Errorf("expected DeleteLock to succeed, got : %s", err)
+		t.Fatalf("expected put to succeed, got : %s", err)
 	}
-	if deleted != nil {
-		t.Errorf("expected nil returned, got : %s", deleted)
+	if meta.Existing {
+		t.Errorf("expected deleted object to be stored as a new object")
 	}
-}
 
-func NewTestLock(id, path, user string) Lock {
-	return Lock{
-		Id:   id,
-		Path: path,
-		Owner: User{
-			Name: user,
-		},
-		LockedAt: time.Now(),
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: contentOid}); err != nil {
+		t.Errorf("expected object to be found, got : %s", err)
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if !metaStoreTest.ValidateUser(testUser, testPass) {
+		t.Errorf("expected %s to authenticate", testUser)
+	}
+	if metaStoreTest.ValidateUser(testUser, testPass+"123") {
+		t.Errorf("expected a wrong password to be rejected")
+	}
+	if metaStoreTest.ValidateUser("nobody", "") {
+		t.Errorf("expected an unknown user to be rejected")
+	}
+	if metaStoreTest.ValidateUser("nobody", dummyPassword) {
+		t.Errorf("expected an unknown user to be rejected with the dummy password")
+	}
+}
+
+func TestAuthenticateHeader(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().AdminUser = "gandalf"
+	Config().AdminPass = "mithrandir"
+	defer func() { Config().AdminUser = ""; Config().AdminPass = "" }()
+
+	basic := func(user, pass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	}
+
+	// The header and ValidateUser agree on the same credentials
+	credentials := []struct {
+		user, pass string
+		admin      bool
+	}{
+		{testUser, testPass, false},
+		{testUser, testPass + "123", false},
+		{"gandalf", "mithrandir", true},
+		{"gandalf", testPass, false},
+		{"nobody", dummyPassword, false},
+		{testUser, "", false},
+	}
+	for _, c := range credentials {
+		user, admin, ok := metaStoreTest.authenticate(basic(c.user, c.pass))
+		if ok != metaStoreTest.ValidateUser(c.user, c.pass) {
+			t.Errorf("expected %s:%s to give the same result from both entry points", c.user, c.pass)
+		}
+		if ok && (user != c.user || admin != c.admin) {
+			t.Errorf("expected %s:%s to authenticate as %s (admin %v), got %s (admin %v)", c.user, c.pass, c.user, c.admin, user, admin)
+		}
+	}
+
+	for _, header := range []string{"", "Bearer token", "Basic !!!", "Basic " + base64.StdEncoding.EncodeToString([]byte(testUser))} {
+		if _, _, ok := metaStoreTest.authenticate(header); ok {
+			t.Errorf("expected the header %q to be rejected", header)
+		}
+	}
+	if user, _, ok := metaStoreTest.authenticate("basic " + base64.StdEncoding.EncodeToString([]byte(testUser+":"+testPass))); !ok || user != testUser {
+		t.Errorf("expected the scheme to be case insensitive")
+	}
+}
+
+func TestSecureCompare(t *testing.T) {
+	cases := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"baggins", "baggins", true},
+		{"baggins", "baggins1", false},
+		{"baggins", "Baggins", false},
+		{"", "", true},
+		{"", "baggins", false},
+	}
+
+	for _, c := range cases {
+		if got := secureCompare(c.a, c.b); got != c.equal {
+			t.Errorf("secureCompare(%q, %q) = %v, expected %v", c.a, c.b, got, c.equal)
+		}
+	}
+}
+
+func TestChangePasswordUnknownUser(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if err := metaStoreTest.ChangePassword("nobody", "anything", "long enough"); err != errWrongPassword {
+		t.Errorf("expected errWrongPassword for a user not in the store, got : %v", err)
+	}
+}
+
+func TestValidateOid(t *testing.T) {
+	cases := map[string]error{
+		contentOid:                  nil,
+		strings.ToUpper(contentOid): errInvalidOid,
+		contentOid[:63]:             errInvalidOid,
+		contentOid + "0":            errInvalidOid,
+		"g" + contentOid[1:]:        errInvalidOid,
+		"../../" + contentOid[6:]:   errInvalidOid,
+		"":                          errInvalidOid,
+		blake2bOid:                  errInvalidOid,
+	}
+
+	for oid, expected := range cases {
+		if err := validateOid("sha256", oid); err != expected {
+			t.Errorf("validateOid(sha256, %q) = %v, expected %v", oid, err, expected)
+		}
+	}
+}
+
+func TestValidateOidHashAlgo(t *testing.T) {
+	cases := []struct {
+		algo, oid string
+		expected  error
+	}{
+		{"blake2b", blake2bOid, nil},
+		{"blake2b", contentOid, errInvalidOid},
+		{"blake2b", blake2bOid[:127], errInvalidOid},
+		{"md5", contentOid[:32], errUnknownHashAlgo},
+		// Without an algorithm a digest of any supported one is valid
+		{"", contentOid, nil},
+		{"", blake2bOid, nil},
+		{"", contentOid[:32], errInvalidOid},
+	}
+
+	for _, c := range cases {
+		if err := validateOid(c.algo, c.oid); err != c.expected {
+			t.Errorf("validateOid(%q, %q) = %v, expected %v", c.algo, c.oid, err, c.expected)
+		}
+	}
+}
+
+func TestPutMetaUploader(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	before := time.Now().UTC().Add(-time.Second)
+	meta, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42, User: "owner", Uploader: testUser})
+	if err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if meta.UploadedBy != testUser || meta.CreatedAt.Before(before) {
+		t.Errorf("expected the uploader and creation time to be recorded, got: %+v", meta)
+	}
+
+	// Putting the object again keeps who first uploaded it
+	meta, err = metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42, User: "owner", Uploader: testUser1})
+	if err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if !meta.Existing || meta.UploadedBy != testUser {
+		t.Errorf("expected the first uploader to be kept, got: %+v", meta)
+	}
+
+	meta, err = metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
+	if err != nil {
+		t.Fatalf("expected to be able to retreive new put, got : %s", err)
+	}
+	if meta.UploadedBy != testUser || meta.CreatedAt.IsZero() {
+		t.Errorf("expected the uploader and creation time to be stored, got: %+v", meta)
+	}
+
+	// Objects stored before uploads were recorded still decode
+	old := struct {
+		Oid       string
+		Size      int64
+		HashAlgo  string
+		Existing  bool
+		DeletedAt time.Time
+	}{Oid: otherOid, Size: 42, HashAlgo: "sha256"}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&old); err != nil {
+		t.Fatalf("error encoding object: %s", err)
+	}
+	err = metaStoreTest.update(func(tx kvTx) error {
+		return tx.Bucket(objectsBucket).Put([]byte(otherOid), buf.Bytes())
+	})
+	if err != nil {
+		t.Fatalf("error storing object: %s", err)
+	}
+
+	meta, err = metaStoreTest.Get(&RequestVars{Oid: otherOid})
+	if err != nil {
+		t.Fatalf("expected to be able to retreive object, got : %s", err)
+	}
+	if meta.UploadedBy != "" || !meta.CreatedAt.IsZero() {
+		t.Errorf("expected an old object to have no uploader, got: %+v", meta)
+	}
+}
+
+func TestPutMetaEarliestCreatedAt(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	// An object stored by a put that started later than this one
+	later := time.Now().UTC().Add(time.Minute)
+	err := metaStoreTest.update(func(tx kvTx) error {
+		return putMeta(tx.Bucket(objectsBucket), &MetaObject{Oid: nonExistingOid, Size: 42, HashAlgo: "sha256", UploadedBy: testUser1, CreatedAt: later})
+	})
+	if err != nil {
+		t.Fatalf("error storing object: %s", err)
+	}
+
+	meta, err := metaStoreTest.Put(&RequestVars{User: testUser, Repo: "repo", Oid: nonExistingOid, Size: 42, Uploader: testUser})
+	if err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if !meta.Existing || !meta.CreatedAt.Before(later) {
+		t.Errorf("expected the existing object with the earlier creation time, got: %+v", meta)
+	}
+	if meta.UploadedBy != testUser1 {
+		t.Errorf("expected the uploader to be kept, got: %q", meta.UploadedBy)
+	}
+
+	stored, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
+	if err != nil {
+		t.Fatalf("expected the object to be found, got : %s", err)
+	}
+	if !stored.CreatedAt.Equal(meta.CreatedAt) {
+		t.Errorf("expected the earlier creation time to be stored, got: %s", stored.CreatedAt)
+	}
+}
+
+func TestPutMetaConcurrent(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	const puts = 8
+	type result struct {
+		meta *MetaObject
+		err  error
+	}
+	results := make(chan result, puts)
+	for i := 0; i < puts; i++ {
+		go func(i int) {
+			meta, err := metaStoreTest.Put(&RequestVars{User: testUser, Repo: fmt.Sprintf("repo-%d", i), Oid: nonExistingOid, Size: 42})
+			results <- result{meta, err}
+		}(i)
+	}
+
+	var stored int
+	var earliest time.Time
+	for i := 0; i < puts; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("expected every put to succeed, got : %s", r.err)
+		}
+		if !r.meta.Existing {
+			stored++
+		}
+		if earliest.IsZero() || r.meta.CreatedAt.Before(earliest) {
+			earliest = r.meta.CreatedAt
+		}
+	}
+	if stored != 1 {
+		t.Errorf("expected exactly one put to store the object, got %d", stored)
+	}
+	assertRefCount(t, nonExistingOid, puts)
+
+	meta, err := metaStoreTest.Get(&RequestVars{Oid: nonExistingOid})
+	if err != nil {
+		t.Fatalf("expected the object to be found, got : %s", err)
+	}
+	if meta.Size != 42 || meta.CreatedAt.After(earliest) {
+		t.Errorf("expected the object to keep the earliest creation time %s, got: %+v", earliest, meta)
+	}
+
+	// Racing puts with different sizes: one stores the object, the other is
+	// rejected
+	errs := make(chan error, 2)
+	for _, size := range []int64{10, 20} {
+		go func(size int64) {
+			_, err := metaStoreTest.Put(&RequestVars{User: testUser, Repo: "repo", Oid: otherOid, Size: size})
+			errs <- err
+		}(size)
+	}
+	first, second := <-errs, <-errs
+	if (first == nil) == (second == nil) || (first != nil && first != errSizeChanged) || (second != nil && second != errSizeChanged) {
+		t.Errorf("expected one put to succeed and the other to fail with errSizeChanged, got: %v, %v", first, second)
+	}
+}
+
+func TestPutMetaHashAlgo(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	meta, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42})
+	if err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if meta.HashAlgo != "sha256" {
+		t.Errorf("expected hash algorithm to default to sha256, got: %q", meta.HashAlgo)
+	}
+
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: blake2bOid, Size: 42}); err != errInvalidOid {
+		t.Errorf("expected a blake2b oid to be invalid as sha256, got: %v", err)
+	}
+
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: blake2bOid, Size: 42, HashAlgo: "blake2b"}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+
+	meta, err = metaStoreTest.Get(&RequestVars{Oid: blake2bOid})
+	if err != nil {
+		t.Fatalf("expected get to succeed, got : %s", err)
+	}
+	if meta.HashAlgo != "blake2b" {
+		t.Errorf("expected hash algorithm to be stored, got: %q", meta.HashAlgo)
+	}
+}
+
+func TestInvalidOid(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	v := &RequestVars{Oid: strings.ToUpper(nonExistingOid), Size: 42}
+	if _, err := metaStoreTest.Put(v); err != errInvalidOid {
+		t.Errorf("expected Put to fail with errInvalidOid, got: %v", err)
+	}
+	if _, err := metaStoreTest.Get(v); err != errInvalidOid {
+		t.Errorf("expected Get to fail with errInvalidOid, got: %v", err)
+	}
+	if err := metaStoreTest.Delete(v); err != errInvalidOid {
+		t.Errorf("expected Delete to fail with errInvalidOid, got: %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Uploader: testUser, Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Uploader: testUser, Oid: otherOid, Size: 8}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+
+	// Putting an existing object must not count it twice
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Uploader: testUser, Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+
+	used, err := metaStoreTest.Usage(testUser)
+	if err != nil {
+		t.Fatalf("expected Usage to succeed, got : %s", err)
+	}
+	if used != 50 {
+		t.Errorf("expected usage to be 50, got: %d", used)
+	}
+
+	if err := metaStoreTest.Delete(&RequestVars{User: testUser, Uploader: testUser, Oid: nonExistingOid}); err != nil {
+		t.Fatalf("expected delete to succeed, got : %s", err)
+	}
+
+	used, err = metaStoreTest.Usage(testUser)
+	if err != nil {
+		t.Fatalf("expected Usage to succeed, got : %s", err)
+	}
+	if used != 8 {
+		t.Errorf("expected usage to be 8 after delete, got: %d", used)
+	}
+}
+
+func TestUsageQuota(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().UserQuota = "50"
+	defer func() { Config().UserQuota = "0" }()
+
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Uploader: testUser, Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Uploader: testUser, Oid: otherOid, Size: 9}); err != errQuotaExceeded {
+		t.Errorf("expected put over quota to fail with errQuotaExceeded, got : %v", err)
+	}
+
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser1, Uploader: testUser1, Oid: otherOid, Size: 9}); err != nil {
+		t.Errorf("expected put by another user to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.Put(&RequestVars{User: testUser, Uploader: testUser, Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Errorf("expected put of an existing object to succeed, got : %s", err)
+	}
+}
+
+func TestUsageChargesUploader(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().UserQuota = "50"
+	defer func() { Config().UserQuota = "0" }()
+
+	// The quota follows the authenticated uploader, whatever namespace the
+	// object is uploaded under
+	for _, user := range []string{testUser1, ""} {
+		if _, err := metaStoreTest.Put(&RequestVars{User: user, Uploader: testUser, Oid: nonExistingOid, Size: 42}); err != nil {
+			t.Fatalf("expected put to succeed, got : %s", err)
+		}
+		if _, err := metaStoreTest.Put(&RequestVars{User: user, Uploader: testUser, Oid: otherOid, Size: 9}); err != errQuotaExceeded {
+			t.Errorf("expected put over the uploader's quota to fail with errQuotaExceeded, got : %v", err)
+		}
+	}
+
+	for user, expected := range map[string]int64{testUser: 42, testUser1: 0} {
+		if used, err := metaStoreTest.Usage(user); err != nil || used != expected {
+			t.Errorf("expected %s to use %d bytes, got %d (%v)", user, expected, used, err)
+		}
+	}
+
+	// Deleting releases the uploader's usage, whoever deletes the object
+	for _, user := range []string{testUser1, ""} {
+		if err := metaStoreTest.Delete(&RequestVars{User: user, Uploader: testUser1, Oid: nonExistingOid}); err != nil {
+			t.Fatalf("expected delete to succeed, got : %s", err)
+		}
+	}
+	if used, err := metaStoreTest.Usage(testUser); err != nil || used != 0 {
+		t.Errorf("expected the uploader's usage to be released, got %d (%v)", used, err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for i := 0; i < 5; i++ {
+		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), fmt.Sprintf("user-%d", i))
+		if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+			t.Errorf("expected AddLocks to succeed, got : %s", err)
+		}
+	}
+
+	locks, err := metaStoreTest.Locks(testRepo)
+	if err != nil {
+		t.Errorf("expected Locks to succeed, got : %s", err)
+	}
+	if len(locks) != 5 {
+		t.Errorf("expected returned lock count to match, got: %d", len(locks))
+	}
+}
+
+func TestFilteredLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	testLocks := make([]Lock, 0, 5)
+	for i := 0; i < 5; i++ {
+		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), fmt.Sprintf("user-%d", i))
+		testLocks = append(testLocks, lock)
+	}
+	if _, err := metaStoreTest.AddLocks(testRepo, testLocks...); err != nil {
+		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	locks, next, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", "", "3")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 3 {
+		t.Errorf("expected locks count to match limit, got: %d", len(locks))
+	}
+	if next == "" {
+		t.Errorf("expected next to exist")
+	}
+
+	locks, next, err = metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", next, "2")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 2 {
+		t.Errorf("expected locks count to match limit, got: %d", len(locks))
+	}
+	if next != "" {
+		t.Errorf("expected next to not exist, got: %s", next)
+	}
+
+	locks, next, err = metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", "", "4")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 4 {
+		t.Errorf("expected locks count to match limit, got: %d", len(locks))
+	}
+	all, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", "", "")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if next != lockCursor(all[4]) {
+		t.Errorf("expected next to be the last lock, got: %q", next)
+	}
+}
+
+func TestFilteredLocksDeletedBetweenPages(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	var testLocks []Lock
+	for i := 0; i < 8; i++ {
+		testLocks = append(testLocks, NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), testUser))
+	}
+	if _, err := metaStoreTest.AddLocks(testRepo, testLocks...); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	all, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", "", "")
+	if err != nil {
+		t.Fatalf("expected FilteredLocks to succeed, got : %s", err)
+	}
+
+	seen := make(map[string]int)
+	deleted := make(map[string]bool)
+	remove := func(l Lock) {
+		if _, err := metaStoreTest.DeleteLock(testRepo, testUser, l.Id, false, time.Time{}); err != nil {
+			t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+		}
+		deleted[l.Id] = true
+	}
+
+	cursor := ""
+	for page := 0; ; page++ {
+		locks, next, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", cursor, "1")
+		if err != nil {
+			t.Fatalf("expected FilteredLocks to succeed, got : %s", err)
+		}
+		for _, l := range locks {
+			seen[l.Id]++
+		}
+		if next == "" {
+			break
+		}
+
+		// Delete the lock the cursor names, then one already seen
+		for _, l := range all {
+			if lockCursor(l) == next && page%2 == 0 {
+				remove(l)
+			}
+		}
+		if page%3 == 0 && len(locks) > 0 {
+			remove(locks[0])
+		}
+		cursor = next
+	}
+
+	for _, l := range all {
+		switch {
+		case deleted[l.Id] && seen[l.Id] > 1:
+			t.Errorf("expected deleted lock %s to be seen at most once, seen %d times", l.Path, seen[l.Id])
+		case !deleted[l.Id] && seen[l.Id] != 1:
+			t.Errorf("expected lock %s to be seen once, seen %d times", l.Path, seen[l.Id])
+		}
+	}
+}
+
+func TestCleanLockPath(t *testing.T) {
+	for p, expected := range map[string]error{
+		"":                        errInvalidLockPath,
+		"a\x00b":                  errInvalidLockPath,
+		"/abs/path":               errInvalidLockPath,
+		"..":                      errInvalidLockPath,
+		"a/../../b":               errInvalidLockPath,
+		strings.Repeat("a", 4097): errLockPathTooLong,
+		"a/./b/../c.bin":          nil,
+		"..dotted/name.bin":       nil,
+		strings.Repeat("a", 4096): nil,
+	} {
+		if _, err := cleanLockPath(p); err != expected {
+			t.Errorf("expected %q to give %v, got %v", p, expected, err)
+		}
+	}
+
+	if cleaned, _ := cleanLockPath("a/./b/../c.bin"); cleaned != "a/c.bin" {
+		t.Errorf("expected the path to be cleaned, got %q", cleaned)
+	}
+
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), "", testUser)); err != errInvalidLockPath {
+		t.Errorf("expected AddLocks to reject an empty path, got : %v", err)
+	}
+	if _, _, err := metaStoreTest.AddLocksBatch(testRepo, []string{"ok.bin", "/abs.bin"}, testUser); err != errInvalidLockPath {
+		t.Errorf("expected AddLocksBatch to reject an absolute path, got : %v", err)
+	}
+	if locks, err := metaStoreTest.Locks(testRepo); err != nil || len(locks) != 0 {
+		t.Errorf("expected nothing to be locked, got %d (%v)", len(locks), err)
+	}
+}
+
+func TestLockCount(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if count, err := metaStoreTest.LockCount(testRepo, ""); err != nil || count != 0 {
+		t.Errorf("expected a repo without locks to count 0, got %d (%v)", count, err)
+	}
+
+	for i := 0; i < 5; i++ {
+		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), testUser)
+		if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+			t.Errorf("expected AddLocks to succeed, got : %s", err)
+		}
+	}
+
+	if count, err := metaStoreTest.LockCount(testRepo, ""); err != nil || count != 5 {
+		t.Errorf("expected every lock to be counted, got %d (%v)", count, err)
+	}
+	if count, err := metaStoreTest.LockCount(testRepo, "path-3"); err != nil || count != 1 {
+		t.Errorf("expected the lock on the path to be counted, got %d (%v)", count, err)
+	}
+	if count, err := metaStoreTest.LockCount(testRepo, "path-9"); err != nil || count != 0 {
+		t.Errorf("expected no locks on an unlocked path, got %d (%v)", count, err)
+	}
+}
+
+func TestLockClear(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	seedUserLocks(t)
+
+	cleared, err := metaStoreTest.LockClear(testRepo)
+	if err != nil {
+		t.Fatalf("expected LockClear to succeed, got : %s", err)
+	}
+	if len(cleared) != 2 {
+		t.Errorf("expected 2 locks to be cleared, got %d", len(cleared))
+	}
+
+	if locks, err := metaStoreTest.Locks(testRepo); err != nil || len(locks) != 0 {
+		t.Errorf("expected the repo to have no locks, got %d (%v)", len(locks), err)
+	}
+	if locks, err := metaStoreTest.Locks("other-repo"); err != nil || len(locks) != 1 {
+		t.Errorf("expected the other repo to keep its lock, got %d (%v)", len(locks), err)
+	}
+	if problems, err := metaStoreTest.VerifyLockIntegrity(); err != nil || len(problems) != 0 {
+		t.Errorf("expected lock counts to match the remaining locks, got: %+v (%v)", problems, err)
+	}
+
+	if cleared, err := metaStoreTest.LockClear(testRepo); err != nil || len(cleared) != 0 {
+		t.Errorf("expected clearing a repo without locks to clear 0, got %d (%v)", len(cleared), err)
+	}
+}
+
+func TestFilteredLocksEmptyPage(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	seedUserLocks(t)
+
+	locks, next, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", "", "0")
+	if err != nil {
+		t.Fatalf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 0 || next != "" {
+		t.Errorf("expected an empty page without a next cursor, got %d locks and %q", len(locks), next)
+	}
+}
+
+func TestFilteredLocksOwner(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	for i := 0; i < 5; i++ {
+		owner := testUser
+		if i%2 == 1 {
+			owner = testUser1
+		}
+		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), owner)
+		if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+			t.Errorf("expected AddLocks to succeed, got : %s", err)
+		}
+	}
+
+	locks, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "", testUser1, "", "")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 2 {
+		t.Errorf("expected owner's locks to be returned, got: %d", len(locks))
+	}
+	for _, l := range locks {
+		if l.Owner.Name != testUser1 {
+			t.Errorf("expected only %s's locks, got: %s", testUser1, l.Owner.Name)
+		}
+	}
+
+	locks, _, err = metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", "", "")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 5 {
+		t.Errorf("expected all locks to be returned, got: %d", len(locks))
+	}
+
+	locks, _, err = metaStoreTest.FilteredLocks(context.Background(), testRepo, "path-1", testUser, "", "")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("expected no locks for a path owned by someone else, got: %d", len(locks))
+	}
+}
+
+func TestAddLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	locks, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, lock.Path, "", "", "1")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 {
+		t.Errorf("expected lock to be existed")
+	}
+	if locks[0].Id != lockId {
+		t.Errorf("expected lockId to match, got: %s", locks[0])
+	}
+}
+
+func TestAddLocksPathLocked(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	for _, owner := range []string{testUser, testUser1} {
+		if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), lockPath, owner)); err != errPathLocked {
+			t.Errorf("expected locking %s's path as %s to fail with errPathLocked, got: %v", testUser, owner, err)
+		}
+	}
+
+	Config().ReLockOwnIsSuccess = "true"
+	defer func() { Config().ReLockOwnIsSuccess = "false" }()
+
+	stored, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), lockPath, testUser))
+	if err != nil || len(stored) != 1 || stored[0].Id != lockId {
+		t.Errorf("expected relocking to return the existing lock, got %+v (%v)", stored, err)
+	}
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), lockPath, testUser1)); err != errPathLocked {
+		t.Errorf("expected another user's relock to fail with errPathLocked, got: %v", err)
+	}
+	if count, err := metaStoreTest.LockCount(testRepo, ""); err != nil || count != 1 {
+		t.Errorf("expected a single lock, got %d (%v)", count, err)
+	}
+
+	if added := addLocksConcurrently(t, "race.bin", "race.bin", "race.bin", "race.bin", "race.bin", "race.bin", "race.bin", "race.bin"); added != 1 {
+		t.Errorf("expected exactly one concurrent lock on a path to succeed, got %d", added)
+	}
+}
+
+// addLocksConcurrently locks each of paths in testRepo at the same time, for
+// a different owner each, and returns how many locks were added. Locking a
+// path that is already locked must fail with errPathLocked.
+func addLocksConcurrently(t *testing.T, paths ...string) int {
+	errs := make(chan error, len(paths))
+	for i, p := range paths {
+		go func(i int, p string) {
+			_, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), p, fmt.Sprintf("user-%d", i)))
+			errs <- err
+		}(i, p)
+	}
+
+	added := 0
+	for range paths {
+		switch err := <-errs; err {
+		case nil:
+			added++
+		case errPathLocked:
+		default:
+			t.Fatalf("expected AddLocks to succeed or fail with errPathLocked, got : %s", err)
+		}
+	}
+	return added
+}
+
+func TestAddLocksNormalizedPathConcurrent(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().NormalizeLockPaths = "true"
+	defer func() { Config().NormalizeLockPaths = "false" }()
+
+	// Case variants of a path are the same path, however they race
+	if added := addLocksConcurrently(t, "Assets/Level.umap", "assets/level.umap", "ASSETS/./Level.umap", "assets/LEVEL.umap"); added != 1 {
+		t.Errorf("expected exactly one of the case variants to be locked, got %d", added)
+	}
+	if count, err := metaStoreTest.LockCount(testRepo, ""); err != nil || count != 1 {
+		t.Errorf("expected a single lock, got %d (%v)", count, err)
+	}
+}
+
+func TestFilteredLocksNormalizedPath(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, "Assets/Level.umap", testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	locks, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "assets/./level.umap", "", "", "1")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("expected case variant to not match without normalization, got: %d", len(locks))
+	}
+
+	Config().NormalizeLockPaths = "true"
+	defer func() { Config().NormalizeLockPaths = "false" }()
+
+	locks, _, err = metaStoreTest.FilteredLocks(context.Background(), testRepo, "assets/./level.umap", "", "", "1")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 {
+		t.Fatalf("expected case variant to match with normalization, got: %d", len(locks))
+	}
+	if locks[0].Path != "Assets/Level.umap" {
+		t.Errorf("expected original path to be kept, got: %s", locks[0].Path)
+	}
+}
+
+func TestLocksModified(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	modified, err := metaStoreTest.LocksModified(testRepo)
+	if err != nil {
+		t.Fatalf("expected LocksModified to succeed, got : %s", err)
+	}
+	if !modified.IsZero() {
+		t.Errorf("expected no modified time before locking, got: %s", modified)
+	}
+
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(lockId, lockPath, testUser)); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	added, err := metaStoreTest.LocksModified(testRepo)
+	if err != nil || added.IsZero() {
+		t.Fatalf("expected modified time after locking, got: %s (%v)", added, err)
+	}
+
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser, lockId, false, time.Time{}); err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+	deleted, err := metaStoreTest.LocksModified(testRepo)
+	if err != nil || !deleted.After(added) {
+		t.Errorf("expected modified time to move on after unlocking, got: %s (%v)", deleted, err)
+	}
+}
+
+func TestRenameLock(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	_, err := metaStoreTest.AddLocks(testRepo,
+		NewTestLock(lockId, lockPath, testUser),
+		NewTestLock("other-lock", "other.bin", testUser1))
+	if err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	lock, err := metaStoreTest.RenameLock(testRepo, testUser, lockId, "renamed.bin", false)
+	if err != nil {
+		t.Fatalf("expected RenameLock to succeed, got : %s", err)
+	}
+	if lock == nil || lock.Id != lockId || lock.Path != "renamed.bin" {
+		t.Fatalf("expected the lock to keep its id under the new path, got: %+v", lock)
+	}
+
+	locks, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "renamed.bin", "", "", "")
+	if err != nil || len(locks) != 1 || locks[0].Id != lockId {
+		t.Errorf("expected the lock to be found by its new path, got: %+v (%v)", locks, err)
+	}
+	locks, _, err = metaStoreTest.FilteredLocks(context.Background(), testRepo, lockPath, "", "", "")
+	if err != nil || len(locks) != 0 {
+		t.Errorf("expected the old path to be unlocked, got: %+v (%v)", locks, err)
+	}
+
+	if _, err := metaStoreTest.RenameLock(testRepo, testUser, lockId, "other.bin", false); err != errPathLocked {
+		t.Errorf("expected renaming onto a locked path to fail with errPathLocked, got: %v", err)
+	}
+
+	if _, err := metaStoreTest.RenameLock(testRepo, testUser, "other-lock", "mine.bin", false); err != errNotOwner {
+		t.Errorf("expected renaming another user's lock to fail with errNotOwner, got: %v", err)
+	}
+	if lock, err := metaStoreTest.RenameLock(testRepo, testUser, "other-lock", "mine.bin", true); err != nil || lock.Owner.Name != testUser1 {
+		t.Errorf("expected force renaming another user's lock to keep its owner, got: %+v (%v)", lock, err)
+	}
+
+	if lock, err := metaStoreTest.RenameLock(testRepo, testUser, nonExistingLockId, "missing.bin", false); err != nil || lock != nil {
+		t.Errorf("expected no lock to be renamed for an unknown id, got: %+v (%v)", lock, err)
+	}
+}
+
+func TestAddLocksIdInUse(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(lockId, lockPath, testUser)); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(lockId, "other/path", testUser1)); err != errLockIdExists {
+		t.Errorf("expected AddLocks with a used id to fail with errLockIdExists, got : %v", err)
+	}
+
+	if _, err := metaStoreTest.AddLocks("other-repo", NewTestLock(lockId, "other/path", testUser1)); err != nil {
+		t.Errorf("expected AddLocks with the same id in another repo to succeed, got : %s", err)
+	}
+
+	locks, err := metaStoreTest.Locks(testRepo)
+	if err != nil {
+		t.Fatalf("expected Locks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 {
+		t.Errorf("expected colliding lock to not be stored, got: %d", len(locks))
+	}
+}
+
+func TestRepoLockLimit(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().MaxRepoLocks = "2"
+	defer func() { Config().MaxRepoLocks = "0" }()
+
+	first := NewTestLock(randomLockId(), "path-1", testUser)
+	second := NewTestLock(randomLockId(), "path-2", testUser1)
+	if _, err := metaStoreTest.AddLocks(testRepo, first, second); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	third := NewTestLock(randomLockId(), "path-3", testUser1)
+	if _, err := metaStoreTest.AddLocks(testRepo, third); err != errLockLimit {
+		t.Errorf("expected AddLocks to fail with errLockLimit, got: %v", err)
+	}
+	if _, _, err := metaStoreTest.AddLocksBatch(testRepo, []string{"path-3"}, testUser); err != errLockLimit {
+		t.Errorf("expected AddLocksBatch to fail with errLockLimit, got: %v", err)
+	}
+
+	if _, err := metaStoreTest.AddLocks("other-repo", third); err != nil {
+		t.Errorf("expected the limit to be per repo, got: %s", err)
+	}
+
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser, first.Id, false, time.Time{}); err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+	if _, _, err := metaStoreTest.AddLocksBatch(testRepo, []string{"path-3"}, testUser); err != nil {
+		t.Errorf("expected locking to succeed after unlocking, got: %s", err)
+	}
+}
+
+func TestUserLockLimit(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	Config().MaxUserLocks = "2"
+	defer func() { Config().MaxUserLocks = "0" }()
+
+	first := NewTestLock(randomLockId(), "path-1", testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, first); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	if _, _, err := metaStoreTest.AddLocksBatch("other-repo", []string{"path-2"}, testUser); err != nil {
+		t.Fatalf("expected AddLocksBatch to succeed, got : %s", err)
+	}
+
+	// The limit counts locks across all repos
+	third := NewTestLock(randomLockId(), "path-3", testUser)
+	if _, err := metaStoreTest.AddLocks("third-repo", third); err != errLockLimit {
+		t.Errorf("expected AddLocks to fail with errLockLimit, got: %v", err)
+	}
+
+	other := NewTestLock(randomLockId(), "path-4", testUser1)
+	if _, err := metaStoreTest.AddLocks("third-repo", other); err != nil {
+		t.Errorf("expected the limit to be per user, got: %s", err)
+	}
+
+	// Forced unlocks count against the owner, not the user unlocking
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser1, first.Id, true, time.Time{}); err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.AddLocks("third-repo", third); err != nil {
+		t.Errorf("expected locking to succeed after unlocking, got: %s", err)
+	}
+}
+
+func TestAddLocksBatch(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	existing := NewTestLock(lockId, lockPath, testUser1)
+	if _, err := metaStoreTest.AddLocks(testRepo, existing); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	paths := []string{"path-1", lockPath, "path-2", "path-1"}
+	created, conflicts, err := metaStoreTest.AddLocksBatch(testRepo, paths, testUser)
+	if err != nil {
+		t.Fatalf("expected AddLocksBatch to succeed, got : %s", err)
+	}
+
+	if len(created) != 2 {
+		t.Fatalf("expected 2 locks to be created, got: %d", len(created))
+	}
+	for i, p := range []string{"path-1", "path-2"} {
+		if created[i].Path != p || created[i].Owner.Name != testUser || created[i].Id == "" {
+			t.Errorf("expected lock on %s owned by %s, got: %+v", p, testUser, created[i])
+		}
+	}
+
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts, got: %d", len(conflicts))
+	}
+	if conflicts[0].Path != lockPath || conflicts[0].Lock.Id != lockId {
+		t.Errorf("expected conflict with the existing lock, got: %+v", conflicts[0])
+	}
+	if conflicts[1].Path != "path-1" || conflicts[1].Lock.Id != created[0].Id {
+		t.Errorf("expected conflict with the lock created in the batch, got: %+v", conflicts[1])
+	}
+
+	locks, err := metaStoreTest.Locks(testRepo)
+	if err != nil {
+		t.Fatalf("expected Locks to succeed, got : %s", err)
+	}
+	if len(locks) != 3 {
+		t.Errorf("expected 3 locks to be stored, got: %d", len(locks))
+	}
+}
+
+func TestDeleteLock(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser, lock.Id, false, time.Time{})
+	if err != nil {
+		t.Errorf("expected DeleteLock to succeed, got : %s", err)
+	}
+	if deleted == nil || deleted.Id != lock.Id {
+		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+	}
+}
+
+func TestDeleteLockNotOwner(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser1, lock.Id, false, time.Time{})
+	if err == nil || deleted != nil {
+		t.Errorf("expected DeleteLock to failed")
+	}
+
+	if err != errNotOwner {
+		t.Errorf("expected DeleteLock error match, got: %s", err)
+	}
+}
+
+func TestDeleteLockNotOwnerForce(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser1, lock.Id, true, time.Time{})
+	if err != nil {
+		t.Errorf("expected DeleteLock(force) to succeed, got : %s", err)
+	}
+	if deleted == nil || deleted.Id != lock.Id {
+		t.Errorf("expected deleted lock to be returned, got : %s", deleted)
+	}
+}
+
+func TestDeleteLockNonExisting(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Errorf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser, nonExistingLockId, false, time.Time{})
+	if err != nil {
+		t.Errorf("expected DeleteLock to succeed, got : %s", err)
+	}
+	if deleted != nil {
+		t.Errorf("expected nil returned, got : %s", deleted)
+	}
+}
+
+func TestDeleteLockLockedAt(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	lock.LockedAt = time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLock(testRepo, testUser, lockId, false, lock.LockedAt.Add(time.Minute))
+	if err != errLockChanged {
+		t.Errorf("expected DeleteLock to fail with errLockChanged, got: %v", err)
+	}
+	if deleted != nil {
+		t.Errorf("expected nil returned, got : %v", deleted)
+	}
+
+	deleted, err = metaStoreTest.DeleteLock(testRepo, testUser, lockId, false, lock.LockedAt)
+	if err != nil {
+		t.Fatalf("expected DeleteLock to succeed, got : %s", err)
+	}
+	if deleted == nil || deleted.Id != lockId {
+		t.Errorf("expected deleted lock to be returned, got : %v", deleted)
+	}
+
+	// A lock that is already gone doesn't match either
+	_, err = metaStoreTest.DeleteLock(testRepo, testUser, lockId, false, lock.LockedAt)
+	if err != errLockChanged {
+		t.Errorf("expected DeleteLock to fail with errLockChanged, got: %v", err)
+	}
+}
+
+func TestDeleteLockByPath(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLockByPath(testRepo, testUser, lockPath, false, time.Time{})
+	if err != nil {
+		t.Errorf("expected DeleteLockByPath to succeed, got : %s", err)
+	}
+	if deleted == nil || deleted.Id != lockId {
+		t.Errorf("expected deleted lock to be returned, got : %v", deleted)
+	}
+
+	locks, err := metaStoreTest.Locks(testRepo)
+	if err != nil {
+		t.Errorf("expected Locks to succeed, got : %s", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("expected lock to be removed, got: %d locks", len(locks))
+	}
+}
+
+func TestLockPathsCompareCleaned(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	// A lock stored before paths were cleaned
+	lock := NewTestLock(lockId, "this/./is/lock//path", testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	locks, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "./"+lockPath, "", "", "")
+	if err != nil || len(locks) != 1 {
+		t.Errorf("expected the unclean query to find the lock, got %v (%v)", locks, err)
+	}
+	if count, err := metaStoreTest.LockCount(testRepo, lockPath); err != nil || count != 1 {
+		t.Errorf("expected the lock to be counted, got %d (%v)", count, err)
+	}
+
+	_, conflicts, err := metaStoreTest.AddLocksBatch(testRepo, []string{lockPath}, testUser1)
+	if err != nil || len(conflicts) != 1 {
+		t.Errorf("expected the stored lock to conflict with a new one, got %v (%v)", conflicts, err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLockByPath(testRepo, testUser, "this/is/../is/lock/path", false, time.Time{})
+	if err != nil || deleted == nil || deleted.Id != lockId {
+		t.Errorf("expected the lock to be deleted by an unclean path, got %v (%v)", deleted, err)
+	}
+}
+
+func TestDeleteLockByPathNotOwner(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLockByPath(testRepo, testUser1, lockPath, false, time.Time{})
+	if err != errNotOwner {
+		t.Errorf("expected DeleteLockByPath to fail with errNotOwner, got: %v", err)
+	}
+	if deleted != nil {
+		t.Errorf("expected no lock to be deleted, got : %v", deleted)
+	}
+
+	deleted, err = metaStoreTest.DeleteLockByPath(testRepo, testUser1, lockPath, true, time.Time{})
+	if err != nil {
+		t.Errorf("expected DeleteLockByPath(force) to succeed, got : %s", err)
+	}
+	if deleted == nil || deleted.Id != lockId {
+		t.Errorf("expected deleted lock to be returned, got : %v", deleted)
+	}
+}
+
+func TestDeleteLockByPathNonExisting(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	deleted, err := metaStoreTest.DeleteLockByPath(testRepo, testUser, "nonexistent", false, time.Time{})
+	if err != nil {
+		t.Errorf("expected DeleteLockByPath to succeed, got : %s", err)
+	}
+	if deleted != nil {
+		t.Errorf("expected no lock to be deleted, got : %v", deleted)
+	}
+}
+
+func TestDeleteUserKeepLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	seedUserLocks(t)
+
+	owned, err := metaStoreTest.DeleteUser(testUser, false)
+	if err != nil {
+		t.Errorf("expected DeleteUser to succeed, got : %s", err)
+	}
+	if countRepoLocks(owned) != 2 {
+		t.Errorf("expected owned lock count to be 2, got: %d", countRepoLocks(owned))
+	}
+
+	locks, err := metaStoreTest.AllLocks(context.Background())
+	if err != nil {
+		t.Errorf("expected AllLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 3 {
+		t.Errorf("expected locks to be kept, got: %d", len(locks))
+	}
+}
+
+func TestDeleteUserReleaseLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	seedUserLocks(t)
+
+	owned, err := metaStoreTest.DeleteUser(testUser, true)
+	if err != nil {
+		t.Errorf("expected DeleteUser to succeed, got : %s", err)
+	}
+	if countRepoLocks(owned) != 2 {
+		t.Errorf("expected released lock count to be 2, got: %d", countRepoLocks(owned))
+	}
+
+	locks, err := metaStoreTest.AllLocks(context.Background())
+	if err != nil {
+		t.Errorf("expected AllLocks to succeed, got : %s", err)
+	}
+	if len(locks) != 1 || locks[0].Owner.Name != testUser1 {
+		t.Errorf("expected only the other user's lock to remain, got: %v", locks)
+	}
+
+	if metaStoreTest.ValidateUser(testUser, testPass) {
+		t.Errorf("expected user to be deleted")
+	}
+}
+
+func TestDeleteUserWithoutLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	owned, err := metaStoreTest.DeleteUser(testUser, true)
+	if err != nil {
+		t.Errorf("expected DeleteUser to succeed, got : %s", err)
+	}
+	if countRepoLocks(owned) != 0 {
+		t.Errorf("expected no locks to be owned, got: %d", countRepoLocks(owned))
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	lock := NewTestLock(lockId, lockPath, testUser)
+	if _, err := metaStoreTest.AddLocks(testRepo, lock); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+
+	Config().ReadOnly = "true"
+	defer func() { Config().ReadOnly = "false" }()
+
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42}); err != errReadOnly {
+		t.Errorf("expected Put to fail with errReadOnly, got: %v", err)
+	}
+	if err := metaStoreTest.Delete(&RequestVars{Oid: contentOid}); err != errReadOnly {
+		t.Errorf("expected Delete to fail with errReadOnly, got: %v", err)
+	}
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), "path", testUser)); err != errReadOnly {
+		t.Errorf("expected AddLocks to fail with errReadOnly, got: %v", err)
+	}
+	if _, err := metaStoreTest.DeleteLock(testRepo, testUser, lockId, false, time.Time{}); err != errReadOnly {
+		t.Errorf("expected DeleteLock to fail with errReadOnly, got: %v", err)
+	}
+	if err := metaStoreTest.AddUser(testUser1, testPass1, ""); err != errReadOnly {
+		t.Errorf("expected AddUser to fail with errReadOnly, got: %v", err)
+	}
+	if _, err := metaStoreTest.DeleteUser(testUser, false); err != errReadOnly {
+		t.Errorf("expected DeleteUser to fail with errReadOnly, got: %v", err)
+	}
+
+	if _, err := metaStoreTest.Get(&RequestVars{Oid: contentOid}); err != nil {
+		t.Errorf("expected Get to succeed, got: %s", err)
+	}
+	if _, err := metaStoreTest.Objects(context.Background()); err != nil {
+		t.Errorf("expected Objects to succeed, got: %s", err)
+	}
+	locks, _, err := metaStoreTest.FilteredLocks(context.Background(), testRepo, "", "", "", "")
+	if err != nil {
+		t.Errorf("expected FilteredLocks to succeed, got: %s", err)
+	}
+	if len(locks) != 1 {
+		t.Errorf("expected lock to be listed, got: %d", len(locks))
+	}
+}
+
+func TestStats(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	oldest := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	newest := oldest.Add(48 * time.Hour)
+	for i, lockedAt := range []time.Time{newest, oldest, oldest.Add(time.Hour)} {
+		lock := NewTestLock(randomLockId(), fmt.Sprintf("path-%d", i), testUser)
+		lock.LockedAt = lockedAt
+		if _, err := metaStoreTest.AddLocks(fmt.Sprintf("repo-%d", i%2), lock); err != nil {
+			t.Fatalf("expected AddLocks to succeed, got : %s", err)
+		}
+	}
+
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+
+	stats, err := metaStoreTest.Stats()
+	if err != nil {
+		t.Fatalf("expected Stats to succeed, got : %s", err)
+	}
+
+	if stats.Users != 1 {
+		t.Errorf("expected 1 user, got: %d", stats.Users)
+	}
+	if stats.Objects != 2 || stats.ObjectsSize != contentSize+42 {
+		t.Errorf("expected 2 objects of %d bytes, got: %d of %d bytes", contentSize+42, stats.Objects, stats.ObjectsSize)
+	}
+	if stats.Locks != 3 {
+		t.Errorf("expected 3 locks, got: %d", stats.Locks)
+	}
+	if stats.OldestLock == nil || !stats.OldestLock.Equal(oldest) {
+		t.Errorf("expected oldest lock at %s, got: %v", oldest, stats.OldestLock)
+	}
+	if stats.NewestLock == nil || !stats.NewestLock.Equal(newest) {
+		t.Errorf("expected newest lock at %s, got: %v", newest, stats.NewestLock)
+	}
+	if stats.DBSize <= 0 {
+		t.Errorf("expected the database size, got: %d", stats.DBSize)
+	}
+}
+
+func TestTransferLocks(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	seedUserLocks(t)
+
+	locks, err := metaStoreTest.LocksByOwner(testUser)
+	if err != nil {
+		t.Fatalf("expected LocksByOwner to succeed, got : %s", err)
+	}
+	if len(locks) != 2 {
+		t.Fatalf("expected %s to own 2 locks, got: %+v", testUser, locks)
+	}
+	for _, l := range locks {
+		if l.Path != testRepo+":path-1" && l.Path != "other-repo:path-2" {
+			t.Errorf("expected paths prefixed with their repo, got: %q", l.Path)
+		}
+	}
+
+	if transferred, err := metaStoreTest.TransferLocks(testUser, testUser); err != nil || len(transferred) != 0 {
+		t.Errorf("expected transferring locks to their owner to do nothing, got %+v (%v)", transferred, err)
+	}
+
+	transferred, err := metaStoreTest.TransferLocks(testUser, testUser1)
+	if err != nil {
+		t.Fatalf("expected TransferLocks to succeed, got : %s", err)
+	}
+	if n := countRepoLocks(transferred); n != 2 {
+		t.Errorf("expected 2 locks to be transferred, got: %d", n)
+	}
+	for repo, locks := range transferred {
+		for _, l := range locks {
+			if l.Owner.Name != testUser1 {
+				t.Errorf("expected %s's lock %q to be owned by %s, got: %s", repo, l.Path, testUser1, l.Owner.Name)
+			}
+		}
+	}
+
+	if locks, err := metaStoreTest.LocksByOwner(testUser); err != nil || len(locks) != 0 {
+		t.Errorf("expected %s to own no locks, got: %+v (%v)", testUser, locks, err)
+	}
+	if locks, err := metaStoreTest.LocksByOwner(testUser1); err != nil || len(locks) != 3 {
+		t.Errorf("expected %s to own every lock, got: %+v (%v)", testUser1, locks, err)
+	}
+	if problems, err := metaStoreTest.VerifyLockIntegrity(); err != nil || len(problems) != 0 {
+		t.Errorf("expected lock counts to follow the locks, got: %+v (%v)", problems, err)
+	}
+
+	if transferred, err := metaStoreTest.TransferLocks(testUser, testUser1); err != nil || len(transferred) != 0 {
+		t.Errorf("expected nothing left to transfer, got %+v (%v)", transferred, err)
+	}
+}
+
+func seedUserLocks(t *testing.T) {
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), "path-1", testUser)); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.AddLocks("other-repo", NewTestLock(randomLockId(), "path-2", testUser)); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.AddLocks(testRepo, NewTestLock(randomLockId(), "path-3", testUser1)); err != nil {
+		t.Fatalf("expected AddLocks to succeed, got : %s", err)
+	}
+}
+
+// cancelAfterContext is a context that is cancelled once Err has been called
+// checks times, to stop a scan part way through.
+type cancelAfterContext struct {
+	context.Context
+	checks int
+	calls  int
+}
+
+func (c *cancelAfterContext) Err() error {
+	c.calls++
+	if c.calls > c.checks {
+		return context.Canceled
+	}
+	return nil
+}
+
+func NewTestLock(id, path, user string) Lock {
+	return Lock{
+		Id:   id,
+		Path: path,
+		Owner: User{
+			Name: user,
+		},
+		LockedAt: time.Now(),
 	}
 }
 
 func setupMeta() {
-	store, err := NewMetaStore("test-meta-store.db")
+	var store *MetaStore
+	var err error
+	if useMemoryMetaStore {
+		store, err = NewMemoryMetaStore()
+	} else {
+		store, err = NewMetaStore("test-meta-store.db")
+	}
 	if err != nil {
 		fmt.Printf("error initializing test meta store: %s\n", err)
 		os.Exit(1)
 	}
 
 	metaStoreTest = store
-	if err := metaStoreTest.AddUser(testUser, testPass); err != nil {
+	if err := metaStoreTest.AddUser(testUser, testPass, ""); err != nil {
 		teardownMeta()
 		fmt.Printf("error adding test user to meta store: %s\n", err)
 		os.Exit(1)
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The metrics below are exported in the Prometheus text exposition format on
+// /metrics when Config.Metrics is enabled.
+var (
+	httpRequests = newCounter("lfs_http_requests_total",
+		"Total number of HTTP requests by handler, method and status.",
+		"handler", "method", "status")
+	httpDuration = newHistogram("lfs_http_request_duration_seconds",
+		"HTTP request latency by handler.",
+		"handler")
+	lockOperations = newCounter("lfs_lock_operations_total",
+		"Total number of successful lock operations.",
+		"op")
+	objectOperations = newCounter("lfs_object_operations_total",
+		"Total number of successful object transfers.",
+		"op")
+	dbTxDuration = newHistogram("lfs_boltdb_transaction_duration_seconds",
+		"Duration of boltdb transactions.",
+		"type")
+	dbOpenTx = newGauge("lfs_boltdb_open_transactions",
+		"Current number of open boltdb transactions.",
+		"type")
+	dbWriteWait = newHistogram("lfs_boltdb_write_wait_seconds",
+		"Time spent waiting for the boltdb write transaction.")
+	dbRollbacks = newCounter("lfs_boltdb_rollbacks_total",
+		"Total number of boltdb write transactions rolled back.")
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// counter is a monotonically increasing value partitioned by a set of labels.
+type counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the counter for the given label values.
+func (c *counter) Inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, key, c.values[key])
+	}
+}
+
+// gauge is a value that can go up and down, partitioned by a set of labels.
+type gauge struct {
+	counter
+}
+
+func newGauge(name, help string, labels ...string) *gauge {
+	return &gauge{counter{name: name, help: help, labels: labels, values: make(map[string]float64)}}
+}
+
+// Add adds delta to the gauge for the given label values.
+func (g *gauge) Add(delta float64, labelValues ...string) {
+	key := formatLabels(g.labels, labelValues)
+
+	g.mu.Lock()
+	g.values[key] += delta
+	g.mu.Unlock()
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %v\n", g.name, key, g.values[key])
+	}
+}
+
+// histogram samples observations into cumulative buckets, partitioned by a
+// set of labels.
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func newHistogram(name, help string, labels ...string) *histogram {
+	return &histogram{name: name, help: help, labels: labels, buckets: defaultBuckets, series: make(map[string]*histogramSeries)}
+}
+
+// Observe records a single observation for the given label values.
+func (h *histogram) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Since observes the time elapsed since start, in seconds.
+func (h *histogram) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, k := range keys {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			le := formatLabels(bucketLabels, append(append([]string{}, s.labelValues...), fmt.Sprint(upper)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, le, s.counts[i])
+		}
+		inf := formatLabels(bucketLabels, append(append([]string{}, s.labelValues...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, inf, s.count)
+
+		labels := formatLabels(h.labels, s.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, labels, s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// instrumentRequests wraps h and records request counts and latencies, labeled
+// with the name of the route that handles the request.
+func (a *App) instrumentRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := "notfound"
+		var match mux.RouteMatch
+		if a.router.Match(r, &match) && match.Route.GetName() != "" {
+			handler = match.Route.GetName()
+		}
+
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpRequests.Inc(handler, r.Method, fmt.Sprint(status))
+		httpDuration.Since(start, handler)
+	})
+}
+
+// MetricsHandler writes all metrics in the Prometheus text format.
+func (a *App) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !Config().IsMetricsEnabled() {
+		writeStatus(w, r, 404)
+		return
+	}
+
+	objects, err := a.metaStore.CountObjects()
+	if err != nil {
+		writeStatus(w, r, 500)
+		return
+	}
+
+	locks, err := a.metaStore.CountLocks()
+	if err != nil {
+		writeStatus(w, r, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	bw := bufio.NewWriter(w)
+	httpRequests.write(bw)
+	httpDuration.write(bw)
+	lockOperations.write(bw)
+	objectOperations.write(bw)
+	dbTxDuration.write(bw)
+	dbOpenTx.write(bw)
+	dbWriteWait.write(bw)
+	dbRollbacks.write(bw)
+
+	fmt.Fprintf(bw, "# HELP lfs_locks Current number of locks.\n# TYPE lfs_locks gauge\nlfs_locks %d\n", locks)
+	fmt.Fprintf(bw, "# HELP lfs_objects Current number of objects.\n# TYPE lfs_objects gauge\nlfs_objects %d\n", objects)
+	bw.Flush()
+}
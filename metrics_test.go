@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	Config().Metrics = "true"
+	defer func() { Config().Metrics = "false" }()
+
+	if _, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil); err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	res, err := api("GET", "/metrics", "", "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+
+	for _, metric := range []string{
+		`lfs_http_requests_total{handler="get_content",method="GET",status="200"}`,
+		`lfs_object_operations_total{op="get"}`,
+		`lfs_boltdb_transaction_duration_seconds_count{type="view"}`,
+		"lfs_locks ",
+		"lfs_objects ",
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("expected metrics to contain %s, got:\n%s", metric, body)
+		}
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	res, err := api("GET", "/metrics", "", "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404, got %d", res.StatusCode)
+	}
+}
+
+func TestMetaStoreTransactionMetrics(t *testing.T) {
+	setupMeta()
+	defer teardownMeta()
+
+	waits := histogramCount(dbWriteWait)
+	updates := histogramCount(dbTxDuration, "update")
+	rollbacks := counterValue(dbRollbacks)
+
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 42}); err != nil {
+		t.Fatalf("expected put to succeed, got : %s", err)
+	}
+	if _, err := metaStoreTest.Put(&RequestVars{Oid: nonExistingOid, Size: 43}); err != errSizeChanged {
+		t.Fatalf("expected errSizeChanged, got : %v", err)
+	}
+
+	if n := histogramCount(dbWriteWait) - waits; n != 2 {
+		t.Errorf("expected 2 write waits to be observed, got %d", n)
+	}
+	if n := histogramCount(dbTxDuration, "update") - updates; n != 2 {
+		t.Errorf("expected 2 update transactions to be observed, got %d", n)
+	}
+	if n := counterValue(dbRollbacks) - rollbacks; n != 1 {
+		t.Errorf("expected 1 rollback to be counted, got %v", n)
+	}
+
+	var open float64
+	err := metaStoreTest.view(func(tx kvTx) error {
+		open = gaugeValue(dbOpenTx, "view")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected view to succeed, got : %s", err)
+	}
+	if open < 1 {
+		t.Errorf("expected the view to be counted as open, got %v", open)
+	}
+	if n := gaugeValue(dbOpenTx, "view"); n != open-1 {
+		t.Errorf("expected the view to be counted as closed, got %v", n)
+	}
+}
+
+func histogramCount(h *histogram, labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func counterValue(c *counter, labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[formatLabels(c.labels, labelValues)]
+}
+
+func gaugeValue(g *gauge, labelValues ...string) float64 {
+	return counterValue(&g.counter, labelValues...)
+}
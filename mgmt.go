@@ -25,17 +25,17 @@ type pageData struct {
 }
 
 func (a *App) addMgmt(r *mux.Router) {
-	r.HandleFunc("/mgmt", basicAuth(a.indexHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/objects", basicAuth(a.objectsHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/raw/{oid}", basicAuth(a.objectsRawHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/locks", basicAuth(a.locksHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/users", basicAuth(a.usersHandler)).Methods("GET")
-	r.HandleFunc("/mgmt/add", basicAuth(a.addUserHandler)).Methods("POST")
-	r.HandleFunc("/mgmt/del", basicAuth(a.delUserHandler)).Methods("POST")
+	r.HandleFunc("/mgmt", basicAuth(a.indexHandler)).Methods("GET").Name("mgmt_index")
+	r.HandleFunc("/mgmt/objects", objectListing(basicAuth(a.objectsHandler))).Methods("GET").Name("mgmt_objects")
+	r.HandleFunc("/mgmt/raw/{oid}", basicAuth(a.objectsRawHandler)).Methods("GET").Name("mgmt_raw_object")
+	r.HandleFunc("/mgmt/locks", basicAuth(a.locksHandler)).Methods("GET").Name("mgmt_locks")
+	r.HandleFunc("/mgmt/users", basicAuth(a.usersHandler)).Methods("GET").Name("mgmt_users")
+	r.HandleFunc("/mgmt/add", basicAuth(a.addUserHandler)).Methods("POST").Name("mgmt_add_user")
+	r.HandleFunc("/mgmt/del", basicAuth(a.delUserHandler)).Methods("POST").Name("mgmt_delete_user")
 
 	cssBox = rice.MustFindBox("mgmt/css")
 	templateBox = rice.MustFindBox("mgmt/templates")
-	r.HandleFunc("/mgmt/css/{file}", basicAuth(cssHandler))
+	r.HandleFunc("/mgmt/css/{file}", basicAuth(cssHandler)).Name("mgmt_css")
 }
 
 func cssHandler(w http.ResponseWriter, r *http.Request) {
@@ -57,15 +57,17 @@ func checkBasicAuth(user string, pass string, ok bool) bool {
 		return false
 	}
 
-	if user != Config.AdminUser || pass != Config.AdminPass {
+	expected, found := Config().AdminCredentials()[user]
+	if !found {
+		secureCompare(dummyPassword, pass)
 		return false
 	}
-	return true
+	return secureCompare(expected, pass)
 }
 
 func basicAuth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if Config.AdminUser == "" || Config.AdminPass == "" {
+		if !Config().HasAdmins() {
 			writeStatus(w, r, 404)
 			return
 		}
@@ -74,24 +76,35 @@ func basicAuth(h http.HandlerFunc) http.HandlerFunc {
 
 		ret := checkBasicAuth(user, pass, ok)
 		if !ret {
-			w.Header().Set("WWW-Authenticate", "Basic realm=mgmt")
+			w.Header().Set("WWW-Authenticate", basicChallenge("mgmt"))
 			writeStatus(w, r, 401)
 			return
 		}
 
+		logAdminAction(r, user)
 		h(w, r)
-		logRequest(r, 200)
 	}
 }
 
+// logAdminAction records which admin performed a privileged request.
+func logAdminAction(r *http.Request, admin string) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return
+	}
+	logger.Log(kv{"fn": "admin", "admin": admin, "method": r.Method, "path": r.URL.Path})
+}
+
 func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	if err := render(w, "config.tmpl", pageData{Name: "index", Config: Config}); err != nil {
+	if err := render(w, "config.tmpl", pageData{Name: "index", Config: Config()}); err != nil {
 		writeStatus(w, r, 404)
 	}
 }
 
 func (a *App) objectsHandler(w http.ResponseWriter, r *http.Request) {
-	objects, err := a.metaStore.Objects()
+	ctx, cancel := scanContext(r)
+	defer cancel()
+
+	objects, err := a.metaStore.Objects(ctx)
 	if err != nil {
 		fmt.Fprintf(w, "Error retrieving objects: %s", err)
 		return
@@ -127,7 +140,10 @@ func (a *App) objectsRawHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) locksHandler(w http.ResponseWriter, r *http.Request) {
-	locks, err := a.metaStore.AllLocks()
+	ctx, cancel := scanContext(r)
+	defer cancel()
+
+	locks, err := a.lockStore.AllLocks(ctx)
 	if err != nil {
 		fmt.Fprintf(w, "Error retrieving locks: %s", err)
 		return
@@ -158,7 +174,11 @@ func (a *App) addUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.metaStore.AddUser(user, pass); err != nil {
+	if err := a.metaStore.AddUser(user, pass, ""); err != nil {
+		if err == errReadOnly {
+			w.Header().Set("Retry-After", readOnlyRetryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		fmt.Fprintf(w, "Error adding user: %s", err)
 		return
 	}
@@ -173,10 +193,20 @@ func (a *App) delUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.metaStore.DeleteUser(user); err != nil {
+	releaseLocks := isTrue(r.FormValue("release_locks"))
+	owned, err := a.metaStore.DeleteUser(user, releaseLocks)
+	if err != nil {
+		if err == errReadOnly {
+			w.Header().Set("Retry-After", readOnlyRetryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		fmt.Fprintf(w, "Error deleting user: %s", err)
 		return
 	}
+	if releaseLocks {
+		a.notifyLocks("lock.deleted", owned)
+	}
+	logger.Log(kv{"fn": "delUserHandler", "user": user, "locks": countRepoLocks(owned), "released": releaseLocks})
 
 	http.Redirect(w, r, "/mgmt/users", 302)
 }
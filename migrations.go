@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var errSchemaTooNew = errors.New("The meta store was written by a newer version of the server")
+
+var (
+	metaBucket       = []byte("meta")
+	schemaVersionKey = []byte("schema_version")
+)
+
+// migration upgrades the meta store by one schema version.
+type migration func(tx kvTx) error
+
+// migrations upgrade the meta store from each schema version to the next.
+// The schema version of a meta store is the number of migrations applied to
+// it, so new migrations must only ever be appended.
+var migrations = []migration{
+	// 1: the schema from before the meta store was versioned
+	func(tx kvTx) error { return nil },
+	// 2: users are stored as JSON records instead of a bare password
+	migrateUserRecords,
+	// 3: the number of locks each user owns is kept in lockCountsBucket
+	migrateLockCounts,
+}
+
+// currentSchemaVersion is the schema version this server writes.
+var currentSchemaVersion = len(migrations)
+
+// migrate applies the migrations the meta store hasn't had yet, in order, and
+// records the new schema version. Databases from before versioning are at
+// version 0.
+func migrate(tx kvTx) error {
+	bucket, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	version := getSchemaVersion(bucket)
+	if version > currentSchemaVersion {
+		return errSchemaTooNew
+	}
+	if version == currentSchemaVersion {
+		return nil
+	}
+
+	for i := version; i < currentSchemaVersion; i++ {
+		if err := migrations[i](tx); err != nil {
+			return fmt.Errorf("Migrating the meta store to version %d: %s", i+1, err)
+		}
+	}
+
+	logger.Log(kv{"fn": "migrate", "from": version, "to": currentSchemaVersion})
+	return bucket.Put(schemaVersionKey, []byte(strconv.Itoa(currentSchemaVersion)))
+}
+
+// migrateUserRecords wraps the password stored for each user in a
+// userRecord.
+func migrateUserRecords(tx kvTx) error {
+	bucket := tx.Bucket(usersBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	records := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		data, err := json.Marshal(&userRecord{Password: string(v)})
+		if err != nil {
+			return err
+		}
+		records[string(k)] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for user, data := range records {
+		if err := bucket.Put([]byte(user), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLockCounts counts the locks each user owns across all repos.
+func migrateLockCounts(tx kvTx) error {
+	locks := tx.Bucket(locksBucket)
+	counts := tx.Bucket(lockCountsBucket)
+	if locks == nil || counts == nil {
+		return errNoBucket
+	}
+
+	owned := make(map[string]int)
+	err := locks.ForEach(func(k, v []byte) error {
+		var repoLocks []Lock
+		if err := json.Unmarshal(v, &repoLocks); err != nil {
+			return err
+		}
+		for _, l := range repoLocks {
+			owned[l.Owner.Name]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for user, count := range owned {
+		if err := putLockCount(counts, user, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getSchemaVersion(bucket kvBucket) int {
+	version, _ := strconv.Atoi(string(bucket.Get(schemaVersionKey)))
+	return version
+}
+
+// SchemaVersion returns the schema version of the meta store.
+func (s *MetaStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.view(func(tx kvTx) error {
+		bucket := tx.Bucket(metaBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		version = getSchemaVersion(bucket)
+		return nil
+	})
+	return version, err
+}
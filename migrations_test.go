@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestMigrateUnversioned(t *testing.T) {
+	// A database written before versioning has the buckets but no version
+	db, err := bolt.Open("test-migrate.db", 0600, nil)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer os.Remove("test-migrate.db")
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists(usersBucket)
+		if err != nil {
+			return err
+		}
+		if err := users.Put([]byte(testUser), []byte(testPass)); err != nil {
+			return err
+		}
+
+		locks, err := tx.CreateBucketIfNotExists(locksBucket)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal([]Lock{NewTestLock(lockId, lockPath, testUser)})
+		if err != nil {
+			return err
+		}
+		return locks.Put([]byte(testRepo), data)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("error seeding database: %s", err)
+	}
+
+	store, err := NewMetaStore("test-migrate.db")
+	if err != nil {
+		t.Fatalf("expected unversioned database to open, got: %s", err)
+	}
+	defer store.Close()
+
+	version, err := store.SchemaVersion()
+	if err != nil {
+		t.Fatalf("expected SchemaVersion to succeed, got: %s", err)
+	}
+	if version != currentSchemaVersion {
+		t.Errorf("expected database to be migrated to version %d, got: %d", currentSchemaVersion, version)
+	}
+
+	if !store.ValidateUser(testUser, testPass) {
+		t.Errorf("expected existing user to be kept")
+	}
+
+	Config().MaxUserLocks = "1"
+	defer func() { Config().MaxUserLocks = "0" }()
+	if _, err := store.AddLocks(testRepo, NewTestLock(randomLockId(), "other.bin", testUser)); err != errLockLimit {
+		t.Errorf("expected existing locks to be counted, got: %v", err)
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	db, err := bolt.Open("test-migrate.db", 0600, nil)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer os.Remove("test-migrate.db")
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(schemaVersionKey, []byte(strconv.Itoa(currentSchemaVersion+1)))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("error seeding database: %s", err)
+	}
+
+	store, err := NewMetaStore("test-migrate.db")
+	if err != errSchemaTooNew {
+		if store != nil {
+			store.Close()
+		}
+		t.Fatalf("expected errSchemaTooNew opening a newer database, got: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// rateLimiterCleanupInterval is how often idle buckets are dropped.
+const rateLimiterCleanupInterval = 5 * time.Minute
+
+// rateLimiter implements per-key token bucket rate limiting. Limits are read
+// from Config on every call so they can be changed at runtime.
+type rateLimiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lastCleanup: time.Now(), now: time.Now}
+}
+
+// Allow takes a token from the bucket for key. If the bucket is empty it
+// returns false and how long the caller should wait before trying again.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	rate, burst := Config().RateLimitRate(), Config().RateLimitBurst()
+	if rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.cleanup(now, burst, rate)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// Refund gives back a token taken from the bucket for key by Allow.
+func (l *rateLimiter) Refund(key string) {
+	burst := Config().RateLimitBurst()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(burst, b.tokens+1)
+	}
+}
+
+// cleanup drops the buckets that have refilled completely, as they behave
+// exactly like a new bucket would.
+func (l *rateLimiter) cleanup(now time.Time, burst, rate float64) {
+	if now.Sub(l.lastCleanup) < rateLimiterCleanupInterval {
+		return
+	}
+	l.lastCleanup = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// remoteIPKey identifies the client making the request by its remote IP.
+func remoteIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// limitRequests applies the rate limit to every request by remote IP before
+// it is authenticated, so failed logins and the admin, management and metrics
+// endpoints are throttled too. Requests that authenticate as a user get the
+// token back, as requireAuth and readAuth limit them per user instead.
+func (a *App) limitRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := remoteIPKey(r)
+		if !a.allowRequest(w, r, key) {
+			return
+		}
+
+		h.ServeHTTP(w, r)
+
+		if user, ok := context.Get(r, "USER").(string); ok && user != "" {
+			a.limiter.Refund(key)
+		}
+	})
+}
+
+// allowUser applies the rate limit of the authenticated user to r. Anonymous
+// requests have already been limited by limitRequests.
+func (a *App) allowUser(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := context.Get(r, "USER").(string)
+	if !ok || user == "" {
+		return true
+	}
+	return a.allowRequest(w, r, "user:"+user)
+}
+
+// allowRequest takes a token for key, responding with 429 and returning false
+// if the client has made too many requests.
+func (a *App) allowRequest(w http.ResponseWriter, r *http.Request, key string) bool {
+	ok, wait := a.limiter.Allow(key)
+	if ok {
+		return true
+	}
+
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	writeStatus(w, r, http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	Config().RateLimit = "1"
+	Config().RateBurst = "2"
+	defer func() {
+		Config().RateLimit = "0"
+		Config().RateBurst = "0"
+	}()
+
+	now := time.Now()
+	l := newRateLimiter()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("user:bilbo"); !ok {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+	}
+
+	ok, wait := l.Allow("user:bilbo")
+	if ok {
+		t.Fatalf("expected request to be limited once the bucket is empty")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("expected to wait up to a second, got: %s", wait)
+	}
+
+	if ok, _ := l.Allow("user:bilbo1"); !ok {
+		t.Errorf("expected another client to be allowed")
+	}
+
+	now = now.Add(wait)
+	if ok, _ := l.Allow("user:bilbo"); !ok {
+		t.Errorf("expected request to be allowed after waiting")
+	}
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	Config().RateLimit = "1"
+	Config().RateBurst = "1"
+	defer func() {
+		Config().RateLimit = "0"
+		Config().RateBurst = "0"
+	}()
+
+	res, err := api("GET", "/user/repo/locks", metaMediaType, testUser1, testPass1, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/user/repo/locks", metaMediaType, testUser1, testPass1, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 429 {
+		t.Fatalf("expected status 429, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After of 1 second, got %q", res.Header.Get("Retry-After"))
+	}
+}
+
+func TestRateLimitedBeforeAuth(t *testing.T) {
+	Config().RateLimit = "1"
+	Config().RateBurst = "2"
+	defer func() {
+		Config().RateLimit = "0"
+		Config().RateBurst = "0"
+	}()
+	setupAdmin()
+	defer teardownAdmin()
+
+	server := httptest.NewServer(NewApp(testContentStore, testMetaStore))
+	defer server.Close()
+
+	get := func(path, user, pass string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Accept", metaMediaType)
+		req.SetBasicAuth(user, pass)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	for i := 0; i < 2; i++ {
+		if res := get("/user/repo/locks", testUser1, testPass1); res.StatusCode != 200 {
+			t.Fatalf("expected authenticated request %d to get 200, got %d", i, res.StatusCode)
+		}
+	}
+
+	if res := get("/user/repo/locks", testUser1, "wrong"); res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+	if res := get("/admin/locks", testUser1, "wrong"); res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+
+	if res := get("/user/repo/locks", testUser1, "wrong"); res.StatusCode != 429 {
+		t.Errorf("expected failed logins to be limited, got %d", res.StatusCode)
+	}
+	if res := get("/metrics", "", ""); res.StatusCode != 429 {
+		t.Errorf("expected metrics to be limited, got %d", res.StatusCode)
+	}
+}
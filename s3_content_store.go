@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNoS3Bucket = errors.New("LFS_S3BUCKET must be set to store content in S3")
+
+// s3Client is the part of the S3 API used by S3ContentStore.
+type s3Client interface {
+	PutObject(key string, body io.ReadSeeker, size int64) error
+	GetObject(key string, fromByte int64) (io.ReadCloser, error)
+	HeadObject(key string) (int64, error)
+	DeleteObject(key string) error
+}
+
+// S3ContentStore stores content in an S3 bucket, keyed by oid with the same
+// layout as FileContentStore.
+type S3ContentStore struct {
+	client s3Client
+	prefix string
+}
+
+// NewS3ContentStore creates an S3ContentStore storing objects under prefix.
+func NewS3ContentStore(client s3Client, prefix string) *S3ContentStore {
+	return &S3ContentStore{client: client, prefix: prefix}
+}
+
+// Get retrieves the content from S3. If fromByte > 0, the reader starts from
+// that byte.
+func (s *S3ContentStore) Get(meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	return s.client.GetObject(s.key(meta.Oid), fromByte)
+}
+
+// Put writes the content to S3. The content is spooled to a temporary file
+// first so that its size and hash can be checked before anything is uploaded.
+func (s *S3ContentStore) Put(meta *MetaObject, r io.Reader) error {
+	if Config().IsReadOnly() {
+		return errReadOnly
+	}
+
+	file, err := ioutil.TempFile("", "lfs-s3-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := meta.Hash()
+	written, err := io.Copy(io.MultiWriter(hash, file), r)
+	if err != nil {
+		return err
+	}
+
+	if written != meta.Size {
+		return errSizeMismatch
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != meta.Oid {
+		return errHashMismatch
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return s.client.PutObject(s.key(meta.Oid), file, written)
+}
+
+// Exists returns true if the object is in S3 with the expected size.
+func (s *S3ContentStore) Exists(meta *MetaObject) bool {
+	size, err := s.client.HeadObject(s.key(meta.Oid))
+	return err == nil && size == meta.Size
+}
+
+// Size returns the size of the object in S3.
+func (s *S3ContentStore) Size(meta *MetaObject) (int64, error) {
+	return s.client.HeadObject(s.key(meta.Oid))
+}
+
+// Delete removes the object from S3.
+func (s *S3ContentStore) Delete(meta *MetaObject) error {
+	return s.client.DeleteObject(s.key(meta.Oid))
+}
+
+func (s *S3ContentStore) key(oid string) string {
+	return path.Join(s.prefix, filepath.ToSlash(transformKey(oid)))
+}
+
+// s3HTTPClient talks to the S3 REST API, using path style URLs and signing
+// requests with AWS Signature Version 4.
+type s3HTTPClient struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+func newS3HTTPClient() (*s3HTTPClient, error) {
+	if Config().S3Bucket == "" {
+		return nil, errNoS3Bucket
+	}
+
+	return &s3HTTPClient{
+		endpoint:  Config().S3EndpointURL(),
+		bucket:    Config().S3Bucket,
+		region:    Config().S3Region,
+		accessKey: Config().S3AccessKey,
+		secretKey: Config().S3SecretKey,
+		client:    &http.Client{Transport: newS3Transport(Config().S3TimeoutDuration())},
+		now:       time.Now,
+	}, nil
+}
+
+// newS3Transport returns a transport that gives up on S3 requests that take
+// longer than timeout to connect or to start responding. There is no limit
+// on the whole request, which would cut off transfers of large objects.
+func newS3Transport(timeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	transport.ExpectContinueTimeout = time.Second
+	return transport
+}
+
+func (c *s3HTTPClient) PutObject(key string, body io.ReadSeeker, size int64) error {
+	req, err := http.NewRequest("PUT", c.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return s3StatusError(req, res)
+	}
+	return nil
+}
+
+func (c *s3HTTPClient) GetObject(key string, fromByte int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", c.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if fromByte > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", fromByte))
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 206 {
+		res.Body.Close()
+		return nil, s3StatusError(req, res)
+	}
+	return res.Body, nil
+}
+
+func (c *s3HTTPClient) HeadObject(key string) (int64, error) {
+	req, err := http.NewRequest("HEAD", c.objectURL(key), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return 0, s3StatusError(req, res)
+	}
+	return res.ContentLength, nil
+}
+
+// DeleteObject removes the object with key. S3 answers 204 whether or not
+// there was one.
+func (c *s3HTTPClient) DeleteObject(key string) error {
+	req, err := http.NewRequest("DELETE", c.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 204 && res.StatusCode != 200 {
+		return s3StatusError(req, res)
+	}
+	return nil
+}
+
+func (c *s3HTTPClient) objectURL(key string) string {
+	return fmt.Sprintf("%s/%s/%s", c.endpoint, c.bucket, key)
+}
+
+func (c *s3HTTPClient) do(req *http.Request) (*http.Response, error) {
+	c.sign(req)
+	return c.client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req. The payload is not
+// signed, its hash is checked before uploading instead.
+func (c *s3HTTPClient) sign(req *http.Request) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, c.region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3StatusError(req *http.Request, res *http.Response) error {
+	if res.StatusCode == 404 {
+		return errObjectNotFound
+	}
+	return fmt.Errorf("S3 %s %s returned status %d", req.Method, req.URL.Path, res.StatusCode)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// mockS3Client keeps objects in memory.
+type mockS3Client struct {
+	objects map[string][]byte
+}
+
+func newMockS3Client() *mockS3Client {
+	return &mockS3Client{objects: make(map[string][]byte)}
+}
+
+func (c *mockS3Client) PutObject(key string, body io.ReadSeeker, size int64) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	c.objects[key] = data
+	return nil
+}
+
+func (c *mockS3Client) GetObject(key string, fromByte int64) (io.ReadCloser, error) {
+	data, ok := c.objects[key]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[fromByte:])), nil
+}
+
+func (c *mockS3Client) HeadObject(key string) (int64, error) {
+	data, ok := c.objects[key]
+	if !ok {
+		return 0, errObjectNotFound
+	}
+	return int64(len(data)), nil
+}
+
+func (c *mockS3Client) DeleteObject(key string) error {
+	delete(c.objects, key)
+	return nil
+}
+
+func TestS3ContentStorePut(t *testing.T) {
+	client := newMockS3Client()
+	store := NewS3ContentStore(client, "lfs")
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := store.Put(m, bytes.NewBufferString("test content")); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	key := "lfs/6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+	if string(client.objects[key]) != "test content" {
+		t.Fatalf("expected content to be stored at %s, got: %v", key, client.objects)
+	}
+
+	if !store.Exists(m) {
+		t.Errorf("expected content to exist after putting")
+	}
+}
+
+func TestS3ContentStorePutSizeMismatch(t *testing.T) {
+	client := newMockS3Client()
+	store := NewS3ContentStore(client, "")
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 14,
+	}
+
+	if err := store.Put(m, bytes.NewBufferString("test content")); err != errSizeMismatch {
+		t.Fatalf("expected put with bogus size to fail with errSizeMismatch, got: %v", err)
+	}
+
+	if len(client.objects) != 0 || store.Exists(m) {
+		t.Fatalf("expected content to not be uploaded after putting bogus size")
+	}
+}
+
+func TestS3ContentStorePutHashMismatch(t *testing.T) {
+	client := newMockS3Client()
+	store := NewS3ContentStore(client, "")
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 13,
+	}
+
+	if err := store.Put(m, bytes.NewBufferString("bogus content")); err != errHashMismatch {
+		t.Fatalf("expected put with bogus content to fail with errHashMismatch, got: %v", err)
+	}
+
+	if len(client.objects) != 0 {
+		t.Fatalf("expected content to not be uploaded after putting bogus content")
+	}
+}
+
+func TestS3ContentStoreGet(t *testing.T) {
+	store := NewS3ContentStore(newMockS3Client(), "")
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if err := store.Put(m, bytes.NewBufferString("test content")); err != nil {
+		t.Fatalf("expected put to succeed, got: %s", err)
+	}
+
+	r, err := store.Get(m, 5)
+	if err != nil {
+		t.Fatalf("expected get to succeed, got: %s", err)
+	}
+	defer r.Close()
+
+	by, _ := ioutil.ReadAll(r)
+	if string(by) != "content" {
+		t.Fatalf("expected to read content from byte 5, got: %s", string(by))
+	}
+}
+
+func TestS3ContentStoreExists(t *testing.T) {
+	client := newMockS3Client()
+	store := NewS3ContentStore(client, "")
+
+	m := &MetaObject{
+		Oid:  "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72",
+		Size: 12,
+	}
+
+	if store.Exists(m) {
+		t.Fatalf("expected content to not exist before putting")
+	}
+
+	// Content of the wrong size, e.g. a truncated upload, isn't reported
+	client.objects["6a/e8/a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"] = []byte("test")
+	if store.Exists(m) {
+		t.Fatalf("expected content of the wrong size to not exist")
+	}
+}
+
+func TestS3HTTPClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer s3.Close()
+	defer close(release)
+
+	saved := *Config()
+	defer func() { *Config() = saved }()
+	Config().S3Bucket = "bucket"
+	Config().S3Endpoint = s3.URL
+	Config().S3Timeout = "50ms"
+
+	client, err := newS3HTTPClient()
+	if err != nil {
+		t.Fatalf("expected newS3HTTPClient to succeed, got : %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.HeadObject("stalled")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected a request that doesn't respond to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the request to time out")
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bufio"
+	ctxpkg "context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"math/big"
+	"mime"
 	"net"
 	"net/http"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/context"
@@ -21,26 +27,89 @@ import (
 type RequestVars struct {
 	Oid      string
 	Size     int64
+	HashAlgo string `json:"hash_algo,omitempty"`
 	User     string
 	Password string
 	Repo     string
+	// Path is the file an object is uploaded for, if the client sends it, so
+	// that locks on the path can be enforced. See Config.EnforceLocks.
+	Path string `json:"path,omitempty"`
+	// Uploader is the authenticated user making the request, never taken
+	// from the request body.
+	Uploader string `json:"-"`
+	// BaseURL is the URL the client reached the server at, that links are
+	// made from. See externalURL.
+	BaseURL string `json:"-"`
 }
 
 type BatchVars struct {
 	Transfers []string       `json:"transfers,omitempty"`
 	Operation string         `json:"operation"`
+	HashAlgo  string         `json:"hash_algo,omitempty"`
 	Objects   []*RequestVars `json:"objects"`
 }
 
 // MetaObject is object metadata as seen by the object and metadata stores.
 type MetaObject struct {
-	Oid      string `json:"oid"`
-	Size     int64  `json:"size"`
-	Existing bool
+	Oid       string `json:"oid"`
+	Size      int64  `json:"size"`
+	HashAlgo  string `json:"hash_algo,omitempty"`
+	Existing  bool
+	DeletedAt time.Time
+	// UploadedBy and CreatedAt record who first stored the object and when.
+	// They are empty for objects stored before they were recorded.
+	UploadedBy string
+	CreatedAt  time.Time
+	// Tags are set by admins to group objects, see MetaStore.SetTags.
+	Tags []string
+	// ContentType is the media type of the content, recorded when it is
+	// uploaded. It is empty for objects uploaded before it was recorded, see
+	// MediaType.
+	ContentType string
+}
+
+// defaultContentType is the media type of objects with no known type.
+const defaultContentType = "application/octet-stream"
+
+// sniffLen is how much of an upload http.DetectContentType looks at.
+const sniffLen = 512
+
+// MediaType returns the content type of the object, or defaultContentType if
+// it isn't known.
+func (m *MetaObject) MediaType() string {
+	if m.ContentType == "" {
+		return defaultContentType
+	}
+	return m.ContentType
+}
+
+// Deleted returns true if the object has been soft deleted.
+func (m *MetaObject) Deleted() bool {
+	return !m.DeletedAt.IsZero()
+}
+
+// HasTag returns true if the object is tagged with tag.
+func (m *MetaObject) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash returns a new hash of the algorithm the object's oid is a digest of.
+// Objects stored before the algorithm was recorded are SHA-256.
+func (m *MetaObject) Hash() hash.Hash {
+	if a, ok := hashAlgos[m.HashAlgo]; ok {
+		return a.new()
+	}
+	return hashAlgos[defaultHashAlgo].new()
 }
 
 type BatchResponse struct {
 	Transfer string            `json:"transfer,omitempty"`
+	HashAlgo string            `json:"hash_algo,omitempty"`
 	Objects  []*Representation `json:"objects"`
 }
 
@@ -52,6 +121,18 @@ type Representation struct {
 	Error   *ObjectError     `json:"error,omitempty"`
 }
 
+// ErrorResponse is the body of every error response, in the shape the git-lfs
+// API uses for errors.
+type ErrorResponse struct {
+	Message          string `json:"message"`
+	RequestID        string `json:"request_id"`
+	DocumentationURL string `json:"documentation_url"`
+}
+
+// documentationURL is sent with every error to point clients at the API
+// the server implements.
+const documentationURL = "https://github.com/github/git-lfs/tree/master/docs/api#readme"
+
 type ObjectError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
@@ -66,10 +147,59 @@ type Lock struct {
 	Path     string    `json:"path"`
 	Owner    User      `json:"owner"`
 	LockedAt time.Time `json:"locked_at"`
+	// Annotation is a short note given when the lock was created, such as
+	// the reason for it or a ticket reference
+	Annotation string `json:"annotation,omitempty"`
+	// DecimalId is the id as a decimal number, only sent in responses when
+	// asked for with ?idformat=dec
+	DecimalId string `json:"id_dec,omitempty"`
+}
+
+// lockTimeFormats are the formats accepted when decoding a lock's locked_at
+// field. Locks are always written as RFC3339 in UTC, but older records may
+// use Go's default time format.
+var lockTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+}
+
+// MarshalJSON encodes the lock with its locked_at field as an RFC3339 UTC
+// timestamp.
+func (l Lock) MarshalJSON() ([]byte, error) {
+	type lock Lock
+	return json.Marshal(&struct {
+		lock
+		LockedAt string `json:"locked_at"`
+	}{lock(l), l.LockedAt.UTC().Format(time.RFC3339)})
+}
+
+// UnmarshalJSON decodes a lock, reparsing locked_at timestamps written in any
+// of lockTimeFormats. A timestamp that cannot be parsed is left as the zero
+// time rather than failing the whole decode.
+func (l *Lock) UnmarshalJSON(data []byte) error {
+	type lock Lock
+	aux := &struct {
+		*lock
+		LockedAt string `json:"locked_at"`
+	}{lock: (*lock)(l)}
+
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	l.LockedAt = time.Time{}
+	for _, layout := range lockTimeFormats {
+		if t, err := time.Parse(layout, aux.LockedAt); err == nil {
+			l.LockedAt = t
+			break
+		}
+	}
+	return nil
 }
 
 type LockRequest struct {
-	Path string `json:"path"`
+	Path       string `json:"path"`
+	Annotation string `json:"annotation,omitempty"`
 }
 
 type LockResponse struct {
@@ -77,6 +207,34 @@ type LockResponse struct {
 	Message string `json:"message,omitempty"`
 }
 
+type BatchLockRequest struct {
+	Paths []string `json:"paths"`
+}
+
+// LockConflict reports a path in a batch lock request that is already locked.
+type LockConflict struct {
+	Path string `json:"path"`
+	Lock *Lock  `json:"lock,omitempty"`
+}
+
+type BatchLockResponse struct {
+	Locks     []Lock         `json:"locks"`
+	Conflicts []LockConflict `json:"conflicts,omitempty"`
+	Message   string         `json:"message,omitempty"`
+}
+
+// RenameLockRequest moves a lock to a new path.
+type RenameLockRequest struct {
+	Path  string `json:"path"`
+	Force bool   `json:"force"`
+}
+
+// ChangePasswordRequest is the body accepted by POST /user/password.
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
 type UnlockRequest struct {
 	Force bool `json:"force"`
 }
@@ -92,6 +250,11 @@ type LockList struct {
 	Message    string `json:"message,omitempty"`
 }
 
+// LockCountResponse answers a lock listing made with ?count=true.
+type LockCountResponse struct {
+	Count int `json:"count"`
+}
+
 type VerifiableLockRequest struct {
 	Cursor string `json:"cursor,omitempty"`
 	Limit  int    `json:"limit,omitempty"`
@@ -130,11 +293,7 @@ func (v *RequestVars) internalLink(subpath string) string {
 
 	path += fmt.Sprintf("/%s/%s", subpath, v.Oid)
 
-	if Config.IsHTTPS() {
-		return fmt.Sprintf("%s://%s%s", Config.Scheme, Config.Host, path)
-	}
-
-	return fmt.Sprintf("http://%s%s", Config.Host, path)
+	return v.baseURL() + path
 }
 
 func (v *RequestVars) tusLink() string {
@@ -145,14 +304,69 @@ func (v *RequestVars) tusLink() string {
 	return link
 }
 
+// ObjectVerifyLink builds a URL to verify the object once it is uploaded.
+func (v *RequestVars) ObjectVerifyLink() string {
+	return v.internalLink("objects") + "/verify"
+}
+
 func (v *RequestVars) VerifyLink() string {
 	path := fmt.Sprintf("/verify/%s", v.Oid)
 
-	if Config.IsHTTPS() {
-		return fmt.Sprintf("%s://%s%s", Config.Scheme, Config.Host, path)
+	return v.baseURL() + path
+}
+
+func (v *RequestVars) baseURL() string {
+	if v.BaseURL != "" {
+		return v.BaseURL
+	}
+	return Config().BaseURL()
+}
+
+// externalURL returns the URL the client reached the server at, without a
+// trailing slash. That's Config.ExternalURL if it is set. Otherwise, when a
+// proxy sets any of X-Forwarded-Proto, X-Forwarded-Host or
+// X-Forwarded-Prefix, the URL is made from them, using the Host header for a
+// missing host. Without them it is Config.BaseURL.
+func externalURL(r *http.Request) string {
+	if Config().ExternalURL != "" {
+		return strings.TrimSuffix(Config().ExternalURL, "/")
+	}
+
+	proto := forwardedHeader(r, "X-Forwarded-Proto")
+	host := forwardedHeader(r, "X-Forwarded-Host")
+	prefix := strings.Trim(forwardedHeader(r, "X-Forwarded-Prefix"), "/")
+	if proto == "" && host == "" && prefix == "" {
+		return Config().BaseURL()
+	}
+
+	if proto == "" {
+		proto = "http"
+		if Config().IsHTTPS() {
+			proto = Config().Scheme
+		}
+	}
+	if host == "" {
+		host = r.Host
+	}
+	if host == "" {
+		host = Config().Host
 	}
 
-	return fmt.Sprintf("http://%s%s", Config.Host, path)
+	base := proto + "://" + host
+	if prefix != "" {
+		base += "/" + prefix
+	}
+	return base
+}
+
+// forwardedHeader returns the first value of a header a proxy may have added
+// to, such as "https, http" for X-Forwarded-Proto after two proxies.
+func forwardedHeader(r *http.Request, name string) string {
+	value := r.Header.Get(name)
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
 }
 
 // link provides a structure used to build a hypermedia representation of an HTTP link.
@@ -165,61 +379,117 @@ type link struct {
 // App links a Router, ContentStore, and MetaStore to provide the LFS server.
 type App struct {
 	router       *mux.Router
-	contentStore *ContentStore
+	handler      http.Handler
+	server       *http.Server
+	inFlight     int64
+	contentStore ContentStore
 	metaStore    *MetaStore
+	lockStore    LockStore
+	limiter      *rateLimiter
+	webhooks     *webhookNotifier
+	idempotency  *idempotencyKeys
 }
 
-// NewApp creates a new App using the ContentStore and MetaStore provided
-func NewApp(content *ContentStore, meta *MetaStore) *App {
-	app := &App{contentStore: content, metaStore: meta}
+// NewApp creates a new App using the ContentStore and MetaStore provided. The
+// MetaStore is also the LockStore, and deletes content from the ContentStore.
+func NewApp(content ContentStore, meta *MetaStore) *App {
+	meta.SetContentStore(content)
+	app := &App{contentStore: content, metaStore: meta, lockStore: meta, limiter: newRateLimiter(), webhooks: newWebhookNotifier(), idempotency: newIdempotencyKeys()}
+	app.server = &http.Server{Handler: app}
 
 	r := mux.NewRouter()
+	r.KeepContext = true
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, r, http.StatusNotFound)
+	})
 
-	r.HandleFunc("/{user}/{repo}/objects/batch", app.requireAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/objects/batch", app.readAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher).Name("batch")
 
 	route := "/{user}/{repo}/objects/{oid}"
-	r.HandleFunc(route, app.requireAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
-	r.HandleFunc(route, app.requireAuth(app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
-	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.readAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher).Name("get_content")
+	r.HandleFunc(route, app.readAuth(app.GetMetaHandler)).Methods("GET").MatcherFunc(MetaMatcher).Name("get_meta")
+	r.HandleFunc(route, app.readAuth(app.HeadMetaHandler)).Methods("HEAD").MatcherFunc(MetaMatcher).Name("head_meta")
+	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher).Name("put_content")
+	r.HandleFunc(route+"/verify", app.requireAuth(app.VerifyObjectHandler)).Methods("POST").MatcherFunc(MetaMatcher).Name("verify_content")
 
-	r.HandleFunc("/{user}/{repo}/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher).Name("post_object")
 
-	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(app.LocksHandler)).Methods("GET").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks/verify", app.requireAuth(app.LocksVerifyHandler)).Methods("POST").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(app.CreateLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
-	r.HandleFunc("/{user}/{repo}/locks/{id}/unlock", app.requireAuth(app.DeleteLockHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/{user}/{repo}/locks", app.readAuth(knownRepo(gzipResponse(app.LocksHandler)))).Methods("GET").MatcherFunc(MetaMatcher).Name("list_locks")
+	r.HandleFunc("/{user}/{repo}/locks/verify", app.requireAuth(knownRepo(gzipResponse(app.LocksVerifyHandler)))).Methods("POST").MatcherFunc(MetaMatcher).Name("verify_locks")
+	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(knownRepo(app.CreateLockHandler))).Methods("POST").MatcherFunc(MetaMatcher).Name("create_lock")
+	r.HandleFunc("/{user}/{repo}/locks/batch", app.requireAuth(knownRepo(app.CreateLocksBatchHandler))).Methods("POST").MatcherFunc(MetaMatcher).Name("create_locks")
+	r.HandleFunc("/{user}/{repo}/locks/{id}/unlock", app.requireAuth(knownRepo(app.DeleteLockHandler))).Methods("POST").MatcherFunc(MetaMatcher).Name("delete_lock")
+	r.HandleFunc("/{user}/{repo}/locks/{id}/rename", app.requireAuth(knownRepo(app.RenameLockHandler))).Methods("POST").MatcherFunc(MetaMatcher).Name("rename_lock")
+	r.HandleFunc("/{user}/{repo}/locks", app.requireAuth(knownRepo(app.DeleteLockByPathHandler))).Methods("DELETE").MatcherFunc(MetaMatcher).Name("delete_lock_by_path")
 
-	r.HandleFunc("/objects/batch", app.requireAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/objects/batch", app.readAuth(app.BatchHandler)).Methods("POST").MatcherFunc(MetaMatcher).Name("batch")
 
 	route = "/objects/{oid}"
-	r.HandleFunc(route, app.requireAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
-	r.HandleFunc(route, app.requireAuth(app.GetMetaHandler)).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
-	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher)
+	r.HandleFunc(route, app.readAuth(app.GetContentHandler)).Methods("GET", "HEAD").MatcherFunc(ContentMatcher).Name("get_content")
+	r.HandleFunc(route, app.readAuth(app.GetMetaHandler)).Methods("GET").MatcherFunc(MetaMatcher).Name("get_meta")
+	r.HandleFunc(route, app.readAuth(app.HeadMetaHandler)).Methods("HEAD").MatcherFunc(MetaMatcher).Name("head_meta")
+	r.HandleFunc(route, app.requireAuth(app.PutHandler)).Methods("PUT").MatcherFunc(ContentMatcher).Name("put_content")
+	r.HandleFunc(route+"/verify", app.requireAuth(app.VerifyObjectHandler)).Methods("POST").MatcherFunc(MetaMatcher).Name("verify_content")
+
+	r.HandleFunc("/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher).Name("post_object")
+
+	r.HandleFunc("/verify/{oid}", app.VerifyHandler).Methods("POST").Name("verify_object")
 
-	r.HandleFunc("/objects", app.requireAuth(app.PostHandler)).Methods("POST").MatcherFunc(MetaMatcher)
+	r.HandleFunc("/metrics", app.MetricsHandler).Methods("GET").Name("metrics")
 
-	r.HandleFunc("/verify/{oid}", app.VerifyHandler).Methods("POST")
+	r.HandleFunc("/authenticate", adminAuth(app.AuthenticateHandler)).Methods("POST").Name("authenticate")
+	r.HandleFunc("/user/password", app.requireAuth(app.ChangePasswordHandler)).Methods("POST").Name("change_password")
 
 	app.addMgmt(r)
+	app.addAdmin(r)
 
 	app.router = r
+	app.handler = logRequests(cors(app.instrumentRequests(app.limitRequests(r))))
 
 	return app
 }
 
 func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer context.Clear(r)
+
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err == nil {
 		context.Set(r, "RequestID", fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
 	}
 
-	a.router.ServeHTTP(w, r)
+	atomic.AddInt64(&a.inFlight, 1)
+	defer atomic.AddInt64(&a.inFlight, -1)
+
+	a.handler.ServeHTTP(w, r)
 }
 
-// Serve calls http.Serve with the provided Listener and the app's router
+// Serve accepts connections on the provided Listener and serves them with the
+// app's router until Shutdown is called.
 func (a *App) Serve(l net.Listener) error {
-	return http.Serve(l, a)
+	if err := a.server.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits up to timeout for the
+// requests in progress to finish, then closes the meta store.
+func (a *App) Shutdown(timeout time.Duration) error {
+	inFlight := atomic.LoadInt64(&a.inFlight)
+
+	ctx, cancel := ctxpkg.WithTimeout(ctxpkg.Background(), timeout)
+	defer cancel()
+
+	err := a.server.Shutdown(ctx)
+	remaining := atomic.LoadInt64(&a.inFlight)
+	logger.Log(kv{"fn": "shutdown", "drained": inFlight - remaining, "remaining": remaining})
+
+	deadline, _ := ctx.Deadline()
+	a.webhooks.Close(time.Until(deadline))
+
+	a.metaStore.Close()
+	return err
 }
 
 // GetContentHandler gets the content from the content store
@@ -227,33 +497,100 @@ func (a *App) GetContentHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
 	meta, err := a.metaStore.Get(rv)
 	if err != nil {
-		writeStatus(w, r, 404)
+		writeObjectError(w, r, err)
 		return
 	}
 
 	// Support resume download using Range header
-	var fromByte int64
+	start, end := int64(0), meta.Size-1
 	statusCode := 200
 	if rangeHdr := r.Header.Get("Range"); rangeHdr != "" {
-		regex := regexp.MustCompile(`bytes=(\d+)\-.*`)
-		match := regex.FindStringSubmatch(rangeHdr)
-		if match != nil && len(match) > 1 {
+		first, last, ok := parseRange(rangeHdr, meta.Size)
+		if ok && first > last {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.Size))
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+			return
+		}
+		if ok {
+			start, end = first, last
 			statusCode = 206
-			fromByte, _ = strconv.ParseInt(match[1], 10, 32)
-			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", fromByte, meta.Size-1, int64(meta.Size)-fromByte))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, meta.Size))
 		}
 	}
 
-	content, err := a.contentStore.Get(meta, fromByte)
+	content, err := a.contentStore.Get(meta, start)
 	if err != nil {
 		writeStatus(w, r, 404)
 		return
 	}
 	defer content.Close()
 
+	// Content is served with the type recorded for it, but as a sandboxed
+	// attachment that isn't sniffed, so that uploaded HTML or scripts never
+	// run on the server's origin
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", "attachment")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
 	w.WriteHeader(statusCode)
-	io.Copy(w, content)
-	logRequest(r, statusCode)
+	io.Copy(w, io.LimitReader(content, end-start+1))
+	objectOperations.Inc("get")
+}
+
+// parseRange parses a Range header with a single byte range for content of
+// size bytes, returning the first and last bytes of the range. ok is false if
+// the header should be ignored and the whole content sent, because it is
+// malformed or asks for several ranges. An unsatisfiable range is returned
+// with first > last.
+func parseRange(header string, size int64) (first, last int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.Index(spec, "-")
+	if dash < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	from, to := spec[:dash], spec[dash+1:]
+
+	if from == "" {
+		// A suffix range, the last n bytes
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		if n == 0 || size == 0 {
+			return 1, 0, true
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+
+	first, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+	last = size - 1
+	if to != "" {
+		last, err = strconv.ParseInt(to, 10, 64)
+		if err != nil || last < first {
+			return 0, 0, false
+		}
+		if last > size-1 {
+			last = size - 1
+		}
+	}
+	if first >= size {
+		return 1, 0, true
+	}
+	return first, last, true
 }
 
 // GetMetaHandler retrieves metadata about the object
@@ -261,26 +598,73 @@ func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
 	meta, err := a.metaStore.Get(rv)
 	if err != nil {
-		writeStatus(w, r, 404)
+		writeObjectError(w, r, err)
+		return
+	}
+
+	// Objects never change once stored, so the oid is a strong validator
+	etag := fmt.Sprintf(`"%s"`, meta.Oid)
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	w.Header().Set("Content-Type", metaMediaType)
 
-	if r.Method == "GET" {
-		enc := json.NewEncoder(w)
-		enc.Encode(a.Represent(rv, meta, true, false, false))
+	enc := json.NewEncoder(w)
+	enc.Encode(a.Represent(rv, meta, true, false, false))
+}
+
+// HeadMetaHandler lets clients check whether the server has an object without
+// transferring its meta data. The Content-Length is the size of the object.
+func (a *App) HeadMetaHandler(w http.ResponseWriter, r *http.Request) {
+	rv := unpack(r)
+	meta, err := a.metaStore.Get(rv)
+	if err != nil {
+		writeObjectError(w, r, err)
+		return
 	}
 
-	logRequest(r, 200)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, meta.Oid))
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.WriteHeader(http.StatusOK)
 }
 
 // PostHandler instructs the client how to upload data
 func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
+
+	lock, err := a.otherUsersLock(r, rv)
+	if err != nil {
+		writeError(w, r, lockCheckStatus(err), err.Error())
+		return
+	}
+	if lock != nil {
+		writeError(w, r, http.StatusLocked, lockedMessage(lock))
+		return
+	}
+
 	meta, err := a.metaStore.Put(rv)
+	if err == errReadOnly {
+		writeReadOnly(w, r)
+		return
+	}
+	if err == errQuotaExceeded {
+		writeStatus(w, r, http.StatusInsufficientStorage)
+		return
+	}
+	if err == errObjectTooLarge {
+		writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if err == errSizeChanged {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
 	if err != nil {
-		writeStatus(w, r, 404)
+		writeObjectError(w, r, err)
 		return
 	}
 
@@ -294,17 +678,22 @@ func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) {
 
 	enc := json.NewEncoder(w)
 	enc.Encode(a.Represent(rv, meta, meta.Existing, true, false))
-	logRequest(r, sentStatus)
 }
 
 // BatchHandler provides the batch api
 func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
 	bv := unpackBatch(r)
 
+	// Anonymous requests may only download
+	if bv.Operation != "download" && !Config().IsPublic() && isAnonymousRead(r) {
+		writeUnauthorized(w, r)
+		return
+	}
+
 	var responseObjects []*Representation
 
 	var useTus bool
-	if bv.Operation == "upload" && Config.IsUsingTus() {
+	if bv.Operation == "upload" && Config().IsUsingTus() {
 		for _, t := range bv.Transfers {
 			if t == "tus" {
 				useTus = true
@@ -315,22 +704,53 @@ func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create a response object
 	for _, object := range bv.Objects {
+		if validateOid(object.HashAlgo, object.Oid) != nil || object.Size < 0 {
+			responseObjects = append(responseObjects, representError(object, http.StatusUnprocessableEntity, "Invalid object"))
+			continue
+		}
+
 		meta, err := a.metaStore.Get(object)
 		if err == nil && a.contentStore.Exists(meta) { // Object is found and exists
 			responseObjects = append(responseObjects, a.Represent(object, meta, true, false, false))
 			continue
 		}
 
-		// Object is not found
+		// Object is not found, only uploads can create it
+		if bv.Operation == "download" {
+			responseObjects = append(responseObjects, representError(object, http.StatusNotFound, "Object does not exist"))
+			continue
+		}
+
+		lock, err := a.otherUsersLock(r, object)
+		if err != nil {
+			responseObjects = append(responseObjects, representError(object, lockCheckStatus(err), err.Error()))
+			continue
+		}
+		if lock != nil {
+			responseObjects = append(responseObjects, representError(object, http.StatusLocked, lockedMessage(lock)))
+			continue
+		}
+
 		meta, err = a.metaStore.Put(object)
-		if err == nil {
+		switch err {
+		case nil:
 			responseObjects = append(responseObjects, a.Represent(object, meta, meta.Existing, true, useTus))
+		case errReadOnly:
+			responseObjects = append(responseObjects, representError(object, http.StatusServiceUnavailable, err.Error()))
+		case errQuotaExceeded:
+			responseObjects = append(responseObjects, representError(object, http.StatusInsufficientStorage, err.Error()))
+		case errObjectTooLarge:
+			responseObjects = append(responseObjects, representError(object, http.StatusRequestEntityTooLarge, err.Error()))
+		case errSizeChanged:
+			responseObjects = append(responseObjects, representError(object, http.StatusUnprocessableEntity, err.Error()))
+		default:
+			responseObjects = append(responseObjects, representError(object, http.StatusInternalServerError, err.Error()))
 		}
 	}
 
 	w.Header().Set("Content-Type", metaMediaType)
 
-	respobj := &BatchResponse{Objects: responseObjects}
+	respobj := &BatchResponse{HashAlgo: bv.HashAlgo, Objects: responseObjects}
 	// Respond with TUS support if advertised
 	if useTus {
 		respobj.Transfer = "tus"
@@ -338,26 +758,119 @@ func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) {
 
 	enc := json.NewEncoder(w)
 	enc.Encode(respobj)
-	logRequest(r, 200)
 }
 
-// PutHandler receives data from the client and puts it into the content store
+// otherUsersLock returns the lock on the path an object is uploaded for, if
+// Config.EnforceLocks is set and another user holds it. The path is cleaned
+// as lock paths are. Objects sent without a path can't be checked, so they
+// are rejected with errPathRequired, and paths outside the repository with
+// errInvalidLockPath.
+func (a *App) otherUsersLock(r *http.Request, rv *RequestVars) (*Lock, error) {
+	if !Config().IsEnforcingLocks() {
+		return nil, nil
+	}
+	if rv.Path == "" {
+		return nil, errPathRequired
+	}
+
+	p, err := cleanLockPath(rv.Path)
+	switch err {
+	case nil:
+	case errLockPathTooLong, errLockPathDenied:
+		// Paths that can't be locked are never locked by anyone
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	ctx, cancel := scanContext(r)
+	defer cancel()
+
+	locks, _, err := a.lockStore.FilteredLocks(ctx, rv.Repo, p, "", "", "1")
+	if err != nil || len(locks) == 0 || locks[0].Owner.Name == rv.Uploader {
+		return nil, err
+	}
+	return &locks[0], nil
+}
+
+func lockedMessage(l *Lock) string {
+	return fmt.Sprintf("%s is locked by %s", l.Path, l.Owner.Name)
+}
+
+// lockCheckStatus returns the status for an error from otherUsersLock.
+func lockCheckStatus(err error) int {
+	switch {
+	case err == errPathRequired || err == errInvalidLockPath:
+		return http.StatusUnprocessableEntity
+	case isScanAborted(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// PutHandler receives data from the client and puts it into the content store.
+// The body is streamed to the store, which checks its size and hash against
+// the object as it goes; content that doesn't match is rejected with 422.
 func (a *App) PutHandler(w http.ResponseWriter, r *http.Request) {
 	rv := unpack(r)
 	meta, err := a.metaStore.Get(rv)
 	if err != nil {
-		writeStatus(w, r, 404)
+		writeObjectError(w, r, err)
 		return
 	}
 
-	if err := a.contentStore.Put(meta, r.Body); err != nil {
-		a.metaStore.Delete(rv)
-		w.WriteHeader(500)
-		fmt.Fprintf(w, `{"message":"%s"}`, err)
+	// Stop reading bodies that go on past the maximum object size, whatever
+	// size was declared
+	var body io.Reader = r.Body
+	if max := Config().MaxObjectBytes(); max > 0 {
+		body = http.MaxBytesReader(w, r.Body, max)
+	}
+	contentType, body := uploadContentType(r, body)
+
+	if err := a.contentStore.Put(meta, body); err != nil {
+		if err == errReadOnly {
+			writeReadOnly(w, r)
+			return
+		}
+		// Content already stored, by an earlier upload or one racing this
+		// one, keeps its meta information
+		if !a.contentStore.Exists(meta) {
+			a.metaStore.DeleteUnstored(rv)
+		}
+		if err == errHashMismatch || err == errSizeMismatch {
+			writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if _, ok := err.(*http.MaxBytesError); ok {
+			writeError(w, r, http.StatusRequestEntityTooLarge, errObjectTooLarge.Error())
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	logRequest(r, 200)
+	// The content is stored either way, so a failure here only loses the type
+	if _, err := a.metaStore.SetContentType(meta.Oid, contentType); err != nil {
+		logger.Log(kv{"fn": "PutHandler", "oid": meta.Oid, "err": "Could not record the content type: " + err.Error()})
+	}
+
+	objectOperations.Inc("put")
+}
+
+// uploadContentType returns the media type of an upload, from its
+// Content-Type header or, if that is missing or only says the content is
+// binary, sniffed from the start of body. It returns the body to read the
+// content from in place of body.
+func uploadContentType(r *http.Request, body io.Reader) (string, io.Reader) {
+	if header := r.Header.Get("Content-Type"); header != "" {
+		if mediaType, _, err := mime.ParseMediaType(header); err == nil && mediaType != defaultContentType {
+			return header, body
+		}
+	}
+
+	buffered := bufio.NewReaderSize(body, sniffLen)
+	start, _ := buffered.Peek(sniffLen)
+	return http.DetectContentType(start), buffered
 }
 
 func (a *App) VerifyHandler(w http.ResponseWriter, r *http.Request) {
@@ -368,34 +881,136 @@ func (a *App) VerifyHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		logger.Fatal(kv{"fn": "VerifyHandler", "err": fmt.Sprintf("Failed to verify %s: %v", oid, err)})
 	}
+}
+
+// VerifyObjectHandler answers the verify action of an upload, confirming
+// that the content store has the object's content at the size recorded for
+// it. The object and size in the body must match the stored object, or 422
+// is returned. 404 is returned if the object or its content is missing.
+func (a *App) VerifyObjectHandler(w http.ResponseWriter, r *http.Request) {
+	var req RequestVars
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	logRequest(r, 200)
+	meta, err := a.metaStore.Get(&RequestVars{Oid: mux.Vars(r)["oid"], HashAlgo: req.HashAlgo})
+	if err != nil {
+		writeObjectError(w, r, err)
+		return
+	}
+	if req.Oid != meta.Oid || req.Size != meta.Size {
+		writeError(w, r, http.StatusUnprocessableEntity, "Object does not match the stored object's oid and size")
+		return
+	}
+
+	size, err := a.contentStore.Size(meta)
+	switch {
+	case err == errObjectNotFound:
+		writeStatus(w, r, http.StatusNotFound)
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	case size != meta.Size:
+		writeError(w, r, http.StatusUnprocessableEntity, errSizeMismatch.Error())
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
 }
 
 func (a *App) LocksHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repo := vars["repo"]
 
+	// Read before the locks, so a change in between makes the listing look
+	// older rather than newer than it is
+	modified, err := a.lockStore.LocksModified(repo)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !modified.IsZero() {
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+
+	if isTrue(r.FormValue("count")) {
+		a.lockCountHandler(w, r, repo)
+		return
+	}
+
+	cursor, err := decodeCursor(repo, r.FormValue("cursor"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	decimal, ok := decimalIdFormat(r)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "Invalid id format: "+r.URL.Query().Get("idformat"))
+		return
+	}
+
+	order := r.URL.Query().Get("sort")
+	if !validLockSort(order) {
+		writeError(w, r, http.StatusBadRequest, "Invalid sort: "+order)
+		return
+	}
+
 	enc := json.NewEncoder(w)
-	ll := &LockList{}
+	ll := &LockList{Locks: []Lock{}}
 
 	w.Header().Set("Content-Type", metaMediaType)
 
-	locks, nextCursor, err := a.metaStore.FilteredLocks(repo,
+	ctx, cancel := scanContext(r)
+	defer cancel()
+
+	locks, nextCursor, err := a.lockStore.FilteredLocks(ctx, repo,
 		r.FormValue("path"),
-		r.FormValue("cursor"),
+		r.FormValue("owner"),
+		cursor,
 		r.FormValue("limit"))
 
-	if err != nil {
+	if isScanAborted(err) {
+		writeScanError(w, r, err)
+		return
+	} else if err != nil {
 		ll.Message = err.Error()
 	} else {
-		ll.Locks = locks
-		ll.NextCursor = nextCursor
+		// An empty listing is "locks": [] without a next_cursor, never null
+		if len(locks) > 0 {
+			sortLocks(locks, order)
+			ll.Locks = a.displayLocks(locks)
+			if decimal {
+				ll.Locks = withDecimalIds(ll.Locks)
+			}
+			ll.NextCursor = encodeCursor(repo, nextCursor)
+		}
+		lockOperations.Inc("list")
 	}
 
 	enc.Encode(ll)
+}
+
+// lockCountHandler answers a lock listing made with ?count=true with the
+// number of locks that match its path, without listing them.
+func (a *App) lockCountHandler(w http.ResponseWriter, r *http.Request, repo string) {
+	if r.FormValue("owner") != "" {
+		writeError(w, r, http.StatusBadRequest, "Locks can't be counted by owner")
+		return
+	}
 
-	logRequest(r, 200)
+	count, err := a.lockStore.LockCount(repo, r.FormValue("path"))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", metaMediaType)
+	json.NewEncoder(w).Encode(&LockCountResponse{Count: count})
+	lockOperations.Inc("count")
 }
 
 func (a *App) LocksVerifyHandler(w http.ResponseWriter, r *http.Request) {
@@ -403,26 +1018,48 @@ func (a *App) LocksVerifyHandler(w http.ResponseWriter, r *http.Request) {
 	repo := vars["repo"]
 	user := context.Get(r, "USER")
 
-	dec := json.NewDecoder(r.Body)
 	enc := json.NewEncoder(w)
 
 	w.Header().Set("Content-Type", metaMediaType)
 
 	reqBody := &VerifiableLockRequest{}
-	if err := dec.Decode(reqBody); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		enc.Encode(&VerifiableLockList{Message: err.Error()})
+	if !decodeLockRequest(w, r, reqBody) {
 		return
 	}
 
-	ll := &VerifiableLockList{}
-	locks, nextCursor, err := a.metaStore.FilteredLocks(repo, "",
-		reqBody.Cursor,
-		strconv.Itoa(reqBody.Limit))
+	// A missing limit decodes as 0, which means no limit rather than an
+	// empty page
+	limit := ""
+	if reqBody.Limit != 0 {
+		limit = strconv.Itoa(reqBody.Limit)
+	}
+
+	cursor, err := decodeCursor(repo, reqBody.Cursor)
 	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	decimal, ok := decimalIdFormat(r)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "Invalid id format: "+r.URL.Query().Get("idformat"))
+		return
+	}
+
+	ctx, cancel := scanContext(r)
+	defer cancel()
+
+	ll := &VerifiableLockList{}
+	locks, nextCursor, err := a.lockStore.FilteredLocks(ctx, repo, "", "",
+		cursor,
+		limit)
+	if isScanAborted(err) {
+		writeScanError(w, r, err)
+		return
+	} else if err != nil {
 		ll.Message = err.Error()
 	} else {
-		ll.NextCursor = nextCursor
+		ll.NextCursor = encodeCursor(repo, nextCursor)
 
 		for _, l := range locks {
 			if l.Owner.Name == user {
@@ -431,11 +1068,15 @@ func (a *App) LocksVerifyHandler(w http.ResponseWriter, r *http.Request) {
 				ll.Theirs = append(ll.Theirs, l)
 			}
 		}
+		ll.Ours = a.displayLocks(ll.Ours)
+		ll.Theirs = a.displayLocks(ll.Theirs)
+		if decimal {
+			ll.Ours = withDecimalIds(ll.Ours)
+			ll.Theirs = withDecimalIds(ll.Theirs)
+		}
 	}
 
 	enc.Encode(ll)
-
-	logRequest(r, 200)
 }
 
 func (a *App) CreateLockHandler(w http.ResponseWriter, r *http.Request) {
@@ -443,49 +1084,132 @@ func (a *App) CreateLockHandler(w http.ResponseWriter, r *http.Request) {
 	repo := vars["repo"]
 	user := context.Get(r, "USER").(string)
 
-	dec := json.NewDecoder(r.Body)
 	enc := json.NewEncoder(w)
 
 	w.Header().Set("Content-Type", metaMediaType)
 
 	var lockRequest LockRequest
-	if err := dec.Decode(&lockRequest); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		enc.Encode(&LockResponse{Message: err.Error()})
+	if !decodeLockRequest(w, r, &lockRequest) {
 		return
 	}
-
-	locks, _, err := a.metaStore.FilteredLocks(repo, lockRequest.Path, "", "1")
+	path, err := cleanLockPath(lockRequest.Path)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		enc.Encode(&LockResponse{Message: err.Error()})
+		writeLockError(w, r, err)
 		return
 	}
-	if len(locks) > 0 {
-		w.WriteHeader(http.StatusConflict)
-		enc.Encode(&LockResponse{Message: "lock already created"})
+	lockRequest.Path = path
+	if len(lockRequest.Annotation) > maxLockAnnotationLength {
+		writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("Lock annotation is longer than %d bytes", maxLockAnnotationLength))
 		return
 	}
 
+	// A retry of a create that succeeded gets the lock it made, as long as
+	// it is still there
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key != "" {
+		key = idempotencyKey(user, repo, key)
+		if entry, ok := a.idempotency.Get(key); ok {
+			if entry.path != lockRequest.Path {
+				writeError(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was already used for another path")
+				return
+			}
+
+			l, err := a.lockStore.Lock(repo, entry.lockId)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if l != nil {
+				w.WriteHeader(http.StatusCreated)
+				enc.Encode(&LockResponse{Lock: a.displayLock(*l)})
+				return
+			}
+		}
+	}
+
 	lock := &Lock{
-		Id:       randomLockId(),
-		Path:     lockRequest.Path,
-		Owner:    User{Name: user},
-		LockedAt: time.Now(),
+		Path:       lockRequest.Path,
+		Owner:      User{Name: user},
+		LockedAt:   time.Now().UTC().Truncate(time.Second),
+		Annotation: lockRequest.Annotation,
 	}
 
-	if err := a.metaStore.AddLocks(repo, *lock); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		enc.Encode(&LockResponse{Message: err.Error()})
+	// Lock ids are random, retry in the unlikely case of a collision
+	var stored []Lock
+	for attempt := 0; attempt < maxLockIdAttempts; attempt++ {
+		lock.Id = randomLockId()
+		if stored, err = a.lockStore.AddLocks(repo, *lock); err != errLockIdExists {
+			break
+		}
+	}
+	if err == errPathLocked {
+		writeError(w, r, http.StatusConflict, "lock already created")
+		return
+	}
+	if err != nil {
+		writeLockError(w, r, err)
 		return
 	}
 
+	// The requester already held the lock, see Config.ReLockOwnSuccess
+	if stored[0].Id != lock.Id {
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(&LockResponse{Lock: a.displayLock(stored[0])})
+		return
+	}
+
+	if key != "" {
+		a.idempotency.Put(key, lock.Path, lock.Id)
+	}
+
+	lockOperations.Inc("add")
+	a.webhooks.NotifyLock("lock.created", repo, *lock)
+
 	w.WriteHeader(http.StatusCreated)
 	enc.Encode(&LockResponse{
-		Lock: lock,
+		Lock: a.displayLock(*lock),
 	})
+}
+
+// CreateLocksBatchHandler locks several paths at once. Paths that are already
+// locked are reported as conflicts without failing the rest of the batch.
+func (a *App) CreateLocksBatchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	user := context.Get(r, "USER").(string)
+
+	enc := json.NewEncoder(w)
 
-	logRequest(r, 200)
+	w.Header().Set("Content-Type", metaMediaType)
+
+	var batchRequest BatchLockRequest
+	if !decodeLockRequest(w, r, &batchRequest) {
+		return
+	}
+
+	locks, conflicts, err := a.lockStore.AddLocksBatch(repo, batchRequest.Paths, user)
+	if err != nil {
+		writeLockError(w, r, err)
+		return
+	}
+
+	for _, l := range locks {
+		lockOperations.Inc("add")
+		a.webhooks.NotifyLock("lock.created", repo, l)
+	}
+
+	if len(locks) == 0 && len(conflicts) > 0 {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	for i, c := range conflicts {
+		conflicts[i].Lock = a.displayLock(*c.Lock)
+	}
+	enc.Encode(&BatchLockResponse{
+		Locks:     a.displayLocks(locks),
+		Conflicts: conflicts,
+	})
 }
 
 func (a *App) DeleteLockHandler(w http.ResponseWriter, r *http.Request) {
@@ -494,44 +1218,287 @@ func (a *App) DeleteLockHandler(w http.ResponseWriter, r *http.Request) {
 	lockId := vars["id"]
 	user := context.Get(r, "USER").(string)
 
-	dec := json.NewDecoder(r.Body)
-	enc := json.NewEncoder(w)
-
 	w.Header().Set("Content-Type", metaMediaType)
 
 	var unlockRequest UnlockRequest
 
 	if len(lockId) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		enc.Encode(&UnlockResponse{Message: "invalid lock id"})
+		writeError(w, r, http.StatusBadRequest, "invalid lock id")
 		return
 	}
 
-	if err := dec.Decode(&unlockRequest); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		enc.Encode(&UnlockResponse{Message: err.Error()})
+	if !decodeLockRequest(w, r, &unlockRequest) {
 		return
 	}
 
-	l, err := a.metaStore.DeleteLock(repo, user, lockId, unlockRequest.Force)
+	lockedAt, err := ifMatchLockedAt(r)
 	if err != nil {
-		if err == errNotOwner {
-			w.WriteHeader(http.StatusForbidden)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	l, err := a.lockStore.DeleteLock(repo, user, lockId, unlockRequest.Force || isAdmin(r), lockedAt)
+	a.writeUnlockResponse(w, r, repo, l, err)
+}
+
+// DeleteLockByPathHandler unlocks the path given in the query, for tools that
+// don't know the lock id.
+func (a *App) DeleteLockByPathHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	path := r.FormValue("path")
+	user := context.Get(r, "USER").(string)
+
+	w.Header().Set("Content-Type", metaMediaType)
+
+	if len(path) == 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid lock path")
+		return
+	}
+
+	lockedAt, err := ifMatchLockedAt(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	l, err := a.lockStore.DeleteLockByPath(repo, user, path, isTrue(r.FormValue("force")) || isAdmin(r), lockedAt)
+	a.writeUnlockResponse(w, r, repo, l, err)
+}
+
+// RenameLockHandler moves a lock to the path in the request, keeping its id.
+// Only the owner may rename a lock, unless force is set or the user is an
+// admin.
+func (a *App) RenameLockHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	lockId := vars["id"]
+	user := context.Get(r, "USER").(string)
+
+	w.Header().Set("Content-Type", metaMediaType)
+
+	var renameRequest RenameLockRequest
+	if !decodeLockRequest(w, r, &renameRequest) {
+		return
+	}
+	if len(renameRequest.Path) == 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid lock path")
+		return
+	}
+
+	l, err := a.lockStore.RenameLock(repo, user, lockId, renameRequest.Path, renameRequest.Force || isAdmin(r))
+	if err != nil {
+		writeLockError(w, r, err)
+		return
+	}
+	if l == nil {
+		writeError(w, r, http.StatusNotFound, "unable to find lock")
+		return
+	}
+
+	json.NewEncoder(w).Encode(&LockResponse{Lock: a.displayLock(*l)})
+}
+
+// ChangePasswordHandler lets a user stored in the meta store change their own
+// password. The current password must be given along with the new one.
+func (a *App) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := context.Get(r, "USER").(string)
+	if user == "" {
+		writeUnauthorized(w, r)
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch err := a.metaStore.ChangePassword(user, req.OldPassword, req.NewPassword); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errWrongPassword:
+		writeError(w, r, http.StatusForbidden, err.Error())
+	case errWeakPassword:
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+	case errReadOnly:
+		writeReadOnly(w, r)
+	default:
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// decodeLockRequest decodes the JSON body of a lock request into v. If it
+// can't, an error is written and false returned. Bodies larger than
+// Config.MaxLockRequestBytes are rejected with 413.
+func decodeLockRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body := r.Body
+	if max := Config().MaxLockRequestBytes(); max > 0 {
+		body = http.MaxBytesReader(w, r.Body, max)
+	}
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Lock request is too large")
+			return false
 		}
-		enc.Encode(&UnlockResponse{Message: err.Error()})
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// ifMatchLockedAt returns the locked_at time a client expects the lock it is
+// unlocking to have, sent as an If-Match header, or the zero time if the
+// header isn't set.
+func ifMatchLockedAt(r *http.Request) (time.Time, error) {
+	value := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	lockedAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid If-Match, expected the lock's locked_at: %s", value)
+	}
+	return lockedAt, nil
+}
+
+// writeUnlockResponse writes the result of deleting a lock. A nil lock
+// without an error means the lock wasn't found.
+func (a *App) writeUnlockResponse(w http.ResponseWriter, r *http.Request, repo string, l *Lock, err error) {
+	if err != nil {
+		writeLockError(w, r, err)
 		return
 	}
 	if l == nil {
-		w.WriteHeader(http.StatusNotFound)
-		enc.Encode(&UnlockResponse{Message: "unable to find lock"})
+		writeError(w, r, http.StatusNotFound, "unable to find lock")
 		return
 	}
 
-	enc.Encode(&UnlockResponse{Lock: l})
+	lockOperations.Inc("delete")
+	a.webhooks.NotifyLock("lock.deleted", repo, *l)
+
+	json.NewEncoder(w).Encode(&UnlockResponse{Lock: a.displayLock(*l)})
+}
+
+// scanContext returns the context for the store scans made while serving r.
+// It is done when the client goes away, or after Config.ScanTimeout if that
+// is set.
+func scanContext(r *http.Request) (ctxpkg.Context, ctxpkg.CancelFunc) {
+	if timeout := Config().ScanTimeoutDuration(); timeout > 0 {
+		return ctxpkg.WithTimeout(r.Context(), timeout)
+	}
+	return ctxpkg.WithCancel(r.Context())
+}
 
-	logRequest(r, 200)
+// isScanAborted returns true if err is from a scan stopped by its context.
+func isScanAborted(err error) bool {
+	return err == ctxpkg.Canceled || err == ctxpkg.DeadlineExceeded
+}
+
+// writeScanError writes the error from a store scan, with 503 if the scan was
+// stopped by its context.
+func writeScanError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	if isScanAborted(err) {
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, r, status, err.Error())
+}
+
+// writeLockError writes the error from changing locks with the matching
+// status.
+func writeLockError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errNotOwner, errLockLimit:
+		writeError(w, r, http.StatusForbidden, err.Error())
+	case errLockChanged:
+		writeError(w, r, http.StatusPreconditionFailed, err.Error())
+	case errPathLocked:
+		writeError(w, r, http.StatusConflict, err.Error())
+	case errInvalidLockPath, errLockPathTooLong, errLockPathDenied:
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+	case errReadOnly:
+		writeReadOnly(w, r)
+	default:
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// displayLocks returns copies of locks with each owner's display name in
+// place of their login, for responses. Locks keep the login as the owner
+// since that is what ownership is checked against. Owners without a display
+// name, or that aren't local users, are shown by login.
+func (a *App) displayLocks(locks []Lock) []Lock {
+	names, err := a.metaStore.DisplayNames()
+	if err != nil || len(names) == 0 {
+		return locks
+	}
+
+	shown := make([]Lock, len(locks))
+	for i, l := range locks {
+		if name, ok := names[l.Owner.Name]; ok {
+			l.Owner.Name = name
+		}
+		shown[i] = l
+	}
+	return shown
+}
+
+// decimalIdFormat returns true if the request asks for lock ids in decimal
+// with ?idformat=dec, and false for the default hex format. ok is false for
+// unknown formats.
+func decimalIdFormat(r *http.Request) (decimal, ok bool) {
+	switch r.URL.Query().Get("idformat") {
+	case "", "hex":
+		return false, true
+	case "dec":
+		return true, true
+	}
+	return false, false
+}
+
+// withDecimalIds returns copies of locks with DecimalId set, for tools that
+// can't handle hex ids. Ids that aren't hex, such as ones given by older
+// clients, are left without one.
+func withDecimalIds(locks []Lock) []Lock {
+	shown := make([]Lock, len(locks))
+	for i, l := range locks {
+		if n, ok := new(big.Int).SetString(l.Id, 16); ok && n.Sign() >= 0 {
+			l.DecimalId = n.String()
+		}
+		shown[i] = l
+	}
+	return shown
+}
+
+// validLockSort returns true if order is a lock list sort order: "" or "id"
+// for the order locks were created in, "path", or "time" for the most recently
+// locked first.
+func validLockSort(order string) bool {
+	switch order {
+	case "", "id", "path", "time":
+		return true
+	}
+	return false
+}
+
+// sortLocks sorts locks in place by order. Paginated listings only sort each
+// page, as cursors follow the order locks were created in, so a sort other
+// than "id" isn't stable across pages.
+func sortLocks(locks []Lock, order string) {
+	switch order {
+	case "path":
+		sort.SliceStable(locks, func(i, j int) bool { return locks[i].Path < locks[j].Path })
+	case "time":
+		sort.SliceStable(locks, func(i, j int) bool { return locks[i].LockedAt.After(locks[j].LockedAt) })
+	}
+}
+
+// displayLock is displayLocks for a single lock.
+func (a *App) displayLock(l Lock) *Lock {
+	return &a.displayLocks([]Lock{l})[0]
 }
 
 // Represent takes a RequestVars and Meta and turns it into a Representation suitable
@@ -553,27 +1520,104 @@ func (a *App) Represent(rv *RequestVars, meta *MetaObject, download, upload, use
 		rep.Actions["upload"] = &link{Href: rv.UploadLink(useTus), Header: header}
 		if useTus {
 			rep.Actions["verify"] = &link{Href: rv.VerifyLink(), Header: header}
+		} else {
+			rep.Actions["verify"] = &link{Href: rv.ObjectVerifyLink(), Header: map[string]string{"Accept": metaMediaType}}
 		}
 	}
 	return rep
 }
 
+// representError describes an object the batch API can't act on.
+func representError(rv *RequestVars, code int, message string) *Representation {
+	return &Representation{
+		Oid:   rv.Oid,
+		Size:  rv.Size,
+		Error: &ObjectError{Code: code, Message: message},
+	}
+}
+
 func (a *App) requireAuth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !Config.IsPublic() {
-			user, password, _ := r.BasicAuth()
-			if user, ret := a.metaStore.Authenticate(user, password); !ret {
-				w.Header().Set("WWW-Authenticate", "Basic realm=git-lfs-server")
-				writeStatus(w, r, 401)
-				return
-			} else {
-				context.Set(r, "USER", user)
-			}
+		if !Config().IsPublic() && !a.authenticate(w, r) {
+			return
+		}
+
+		if !a.allowUser(w, r) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// knownRepo answers lock requests for repos that aren't in Config.KnownRepos
+// with a 404 when Config.RequireKnownRepo is set, so that a mistyped repo
+// doesn't get locks of its own.
+func knownRepo(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if Config().IsRequiringKnownRepo() && !Config().IsKnownRepo(vars["user"], vars["repo"]) {
+			writeError(w, r, http.StatusNotFound, "Repository not found")
+			return
 		}
 		h(w, r)
 	}
 }
 
+// readAuth is requireAuth for handlers that read, which anonymous requests
+// may use when Config.IsPublicRead. Requests with credentials are still
+// authenticated, so they act as their user.
+func (a *App) readAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Config().IsPublic() && !isAnonymousRead(r) && !a.authenticate(w, r) {
+			return
+		}
+
+		if !a.allowUser(w, r) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isAnonymousRead returns true if r is allowed to read without credentials.
+func isAnonymousRead(r *http.Request) bool {
+	return Config().IsPublicRead() && r.Header.Get("Authorization") == ""
+}
+
+// authenticate checks the credentials of r, recording the user in the request
+// context. It responds with 401 and returns false if they aren't valid.
+func (a *App) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	user, admin, ok := a.metaStore.authenticate(r.Header.Get("Authorization"))
+	if !ok {
+		writeUnauthorized(w, r)
+		return false
+	}
+
+	context.Set(r, "USER", user)
+	context.Set(r, "ADMIN", admin)
+	return true
+}
+
+// isAdmin returns true if r was authenticated as an admin. Admins can act on
+// any user's locks as if they had set force.
+func isAdmin(r *http.Request) bool {
+	admin, _ := context.Get(r, "ADMIN").(bool)
+	return admin
+}
+
+// writeUnauthorized asks the client for credentials, in Config.AuthRealm.
+// Requests that are authenticated but not allowed get a 403 instead.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", basicChallenge(Config().AuthRealm))
+	writeStatus(w, r, 401)
+}
+
+// basicChallenge is the WWW-Authenticate value asking for Basic credentials
+// in realm.
+func basicChallenge(realm string) string {
+	return "Basic realm=" + strconv.Quote(realm)
+}
+
 // ContentMatcher provides a mux.MatcherFunc that only allows requests that contain
 // an Accept header with the contentMediaType
 func ContentMatcher(r *http.Request, m *mux.RouteMatch) bool {
@@ -590,7 +1634,28 @@ func MetaMatcher(r *http.Request, m *mux.RouteMatch) bool {
 	return mt == metaMediaType
 }
 
+// etagMatches returns true if the If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// randomLockId returns the id of a new lock, either 40 random hex digits or,
+// with Config.LockIdFormat "uuid", a random (version 4) UUID.
 func randomLockId() string {
+	if Config().IsUsingUUIDLockIds() {
+		var id [16]byte
+		rand.Read(id[:])
+		id[6] = id[6]&0x0f | 0x40
+		id[8] = id[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	}
+
 	var id [20]byte
 	rand.Read(id[:])
 	return fmt.Sprintf("%x", id[:])
@@ -598,10 +1663,13 @@ func randomLockId() string {
 
 func unpack(r *http.Request) *RequestVars {
 	vars := mux.Vars(r)
+	uploader, _ := context.Get(r, "USER").(string)
 	rv := &RequestVars{
-		User: vars["user"],
-		Repo: vars["repo"],
-		Oid:  vars["oid"],
+		User:     vars["user"],
+		Repo:     vars["repo"],
+		Oid:      vars["oid"],
+		Uploader: uploader,
+		BaseURL:  externalURL(r),
 	}
 
 	if r.Method == "POST" { // Maybe also check if +json
@@ -614,6 +1682,8 @@ func unpack(r *http.Request) *RequestVars {
 
 		rv.Oid = p.Oid
 		rv.Size = p.Size
+		rv.HashAlgo = p.HashAlgo
+		rv.Path = p.Path
 	}
 
 	return rv
@@ -631,28 +1701,58 @@ func unpackBatch(r *http.Request) *BatchVars {
 		return &bv
 	}
 
+	// Objects use the algorithm named for the whole batch, or sha256 if
+	// there is none
+	if bv.HashAlgo == "" {
+		bv.HashAlgo = defaultHashAlgo
+	}
+
+	uploader, _ := context.Get(r, "USER").(string)
 	for i := 0; i < len(bv.Objects); i++ {
 		bv.Objects[i].User = vars["user"]
 		bv.Objects[i].Repo = vars["repo"]
+		bv.Objects[i].Uploader = uploader
+		bv.Objects[i].BaseURL = externalURL(r)
+		if bv.Objects[i].HashAlgo == "" {
+			bv.Objects[i].HashAlgo = bv.HashAlgo
+		}
 	}
 
 	return &bv
 }
 
-func writeStatus(w http.ResponseWriter, r *http.Request, status int) {
-	message := http.StatusText(status)
-
-	mediaParts := strings.Split(r.Header.Get("Accept"), ";")
-	mt := mediaParts[0]
-	if strings.HasSuffix(mt, "+json") {
-		message = `{"message":"` + message + `"}`
+// writeObjectError responds to a request for an object that couldn't be
+// looked up: 422 for a malformed oid, 404 otherwise.
+func writeObjectError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errInvalidOid || err == errUnknownHashAlgo {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
 	}
+	writeStatus(w, r, 404)
+}
 
-	w.WriteHeader(status)
-	fmt.Fprint(w, message)
-	logRequest(r, status)
+// writeReadOnly rejects a request that would modify the server while it is in
+// read-only mode.
+func writeReadOnly(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", readOnlyRetryAfter)
+	writeError(w, r, http.StatusServiceUnavailable, errReadOnly.Error())
 }
 
-func logRequest(r *http.Request, status int) {
-	logger.Log(kv{"method": r.Method, "url": r.URL, "status": status, "request_id": context.Get(r, "RequestID")})
+func writeStatus(w http.ResponseWriter, r *http.Request, status int) {
+	writeError(w, r, status, http.StatusText(status))
+}
+
+// writeError writes status with an ErrorResponse carrying message as the
+// body. Every error the server returns goes through here, so clients always
+// get the same shape.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	requestID, _ := context.Get(r, "RequestID").(string)
+
+	w.Header().Set("Content-Type", metaMediaType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{
+		Message:          message,
+		RequestID:        requestID,
+		DocumentationURL: documentationURL,
+	})
 }
@@ -2,13 +2,23 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGetAuthed(t *testing.T) {
@@ -50,7 +60,7 @@ func TestGetAuthedWithRange(t *testing.T) {
 		t.Fatalf("expected status 206, got %d", res.StatusCode)
 	}
 	if cr := res.Header.Get("Content-Range"); len(cr) > 0 {
-		expected := fmt.Sprintf("bytes %d-%d/%d", fromByte, len(content)-1, len(content)-fromByte)
+		expected := fmt.Sprintf("bytes %d-%d/%d", fromByte, len(content)-1, len(content))
 		if cr != expected {
 			t.Fatalf("expected Content-Range header of %q, got %q", expected, cr)
 		}
@@ -68,6 +78,49 @@ func TestGetAuthedWithRange(t *testing.T) {
 	}
 }
 
+func TestGetAuthedWithRanges(t *testing.T) {
+	cases := []struct {
+		rangeHdr     string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{"bytes=5-9", 206, fmt.Sprintf("bytes 5-9/%d", len(content)), content[5:10]},
+		{"bytes=-4", 206, fmt.Sprintf("bytes %d-%d/%d", len(content)-4, len(content)-1, len(content)), content[len(content)-4:]},
+		{"bytes=5-1000", 206, fmt.Sprintf("bytes 5-%d/%d", len(content)-1, len(content)), content[5:]},
+		{"bytes=0-1,5-9", 200, "", content},
+		{fmt.Sprintf("bytes=%d-", len(content)), 416, fmt.Sprintf("bytes */%d", len(content)), ""},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest("GET", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		req.Header.Set("Range", c.rangeHdr)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		by, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.rangeHdr, c.status, res.StatusCode)
+			continue
+		}
+		if cr := res.Header.Get("Content-Range"); cr != c.contentRange {
+			t.Errorf("%s: expected Content-Range header of %q, got %q", c.rangeHdr, c.contentRange, cr)
+		}
+		if c.status != 416 && string(by) != c.body {
+			t.Errorf("%s: expected content %q, got %q", c.rangeHdr, c.body, by)
+		}
+	}
+}
+
 func TestGetUnAuthed(t *testing.T) {
 	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, "", "", nil)
 	if err != nil {
@@ -90,6 +143,79 @@ func TestGetBadAuth(t *testing.T) {
 	}
 }
 
+func TestPublicReadAnonymousRead(t *testing.T) {
+	Config().PublicRead = "true"
+	defer func() { Config().PublicRead = "false" }()
+
+	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected anonymous download to succeed, got status %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/user/repo/locks", metaMediaType, "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected anonymous lock listing to succeed, got status %d", res.StatusCode)
+	}
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"download","objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize))
+	res, err = api("POST", "/user/repo/objects/batch", metaMediaType, "", "", buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected anonymous batch download to succeed, got status %d", res.StatusCode)
+	}
+
+	// Credentials that are given are still checked
+	res, err = api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass+"123", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestPublicReadAnonymousWrite(t *testing.T) {
+	Config().PublicRead = "true"
+	defer func() { Config().PublicRead = "false" }()
+
+	lock, err := createLockInRepo(testUser, testPass, "public-read-repo", "anonymous.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	requests := []struct {
+		method, path, accept, body string
+	}{
+		{"PUT", "/user/repo/objects/" + contentOid, contentMediaType, content},
+		{"POST", "/user/repo/objects/batch", metaMediaType, fmt.Sprintf(`{"operation":"upload","objects":[{"oid":"%s","size":%d}]}`, contentOid, contentSize)},
+		{"POST", "/user/public-read-repo/locks", metaMediaType, `{"path":"other.bin"}`},
+		{"POST", "/user/public-read-repo/locks/" + lock.Id + "/unlock", metaMediaType, `{"force":true}`},
+		{"POST", "/user/public-read-repo/locks/verify", metaMediaType, `{}`},
+	}
+	for _, req := range requests {
+		res, err := api(req.method, req.path, req.accept, "", "", bytes.NewBufferString(req.body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 401 {
+			t.Errorf("expected anonymous %s %s to be rejected with 401, got %d", req.method, req.path, res.StatusCode)
+		}
+	}
+
+	locks, err := testMetaStore.Locks("public-read-repo")
+	if err != nil || len(locks) != 1 {
+		t.Errorf("expected only the authenticated lock to exist, got: %v (%v)", locks, err)
+	}
+}
+
 func TestGetMetaAuthed(t *testing.T) {
 	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, metaMediaType, testUser, testPass, nil)
 	if err != nil {
@@ -118,6 +244,136 @@ func TestGetMetaAuthed(t *testing.T) {
 	}
 }
 
+func TestGetMetaNotModified(t *testing.T) {
+	res, err := api("GET", "/bilbo/repo/objects/"+contentOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag header")
+	}
+
+	req, err := http.NewRequest("GET", lfsServer.URL+"/bilbo/repo/objects/"+contentOid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("If-None-Match", etag)
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 304 {
+		t.Fatalf("expected status 304, got %d", res.StatusCode)
+	}
+
+	req.SetBasicAuth(testUser, testPass+"123")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401 without valid credentials, got %d", res.StatusCode)
+	}
+}
+
+func TestHeadMeta(t *testing.T) {
+	res, err := api("HEAD", "/bilbo/repo/objects/"+contentOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if res.ContentLength != contentSize {
+		t.Errorf("expected Content-Length of %d, got %d", contentSize, res.ContentLength)
+	}
+}
+
+func TestHeadMetaMissing(t *testing.T) {
+	res, err := api("HEAD", "/bilbo/repo/objects/"+nonExistingOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404, got %d", res.StatusCode)
+	}
+}
+
+func TestHeadMetaUnAuthed(t *testing.T) {
+	res, err := api("HEAD", "/bilbo/repo/objects/"+contentOid, metaMediaType, "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestGetMetaInvalidOid(t *testing.T) {
+	res, err := api("GET", "/bilbo/repo/objects/not-an-oid", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422, got %d", res.StatusCode)
+	}
+
+	var body struct{ Message string }
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Message != errInvalidOid.Error() {
+		t.Errorf("expected invalid oid message, got: %q (%v)", body.Message, err)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	metaRes, err := api("GET", "/user/repo/objects/"+nonExistingOid, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, metaRes, 404, "Not Found")
+
+	buf := bytes.NewBufferString(`{"force":false}`)
+	lockRes, err := api("POST", "/user/repo/locks/"+nonExistingLockId+"/unlock", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, lockRes, 404, "unable to find lock")
+}
+
+func assertErrorResponse(t *testing.T, res *http.Response, status int, message string) {
+	if res.StatusCode != status {
+		t.Fatalf("expected status %d, got %d", status, res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != metaMediaType {
+		t.Errorf("expected content type %s, got: %s", metaMediaType, ct)
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("expected response body to be an error, got error: %s", err)
+	}
+	if len(body) != 3 {
+		t.Errorf("expected message, request_id and documentation_url, got: %v", body)
+	}
+	if body["message"] != message {
+		t.Errorf("expected message %q, got: %q", message, body["message"])
+	}
+	if body["request_id"] == "" {
+		t.Errorf("expected a request id, got: %v", body)
+	}
+	if body["documentation_url"] != documentationURL {
+		t.Errorf("expected documentation url, got: %v", body)
+	}
+}
+
 func TestGetMetaUnAuthed(t *testing.T) {
 	res, err := api("GET", "/user/repo/objects/"+contentOid, metaMediaType, "", "", nil)
 	if err != nil {
@@ -203,6 +459,84 @@ func TestPostAuthedExistingObject(t *testing.T) {
 	}
 }
 
+func TestPostExistingObjectSizeChanged(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize+1))
+	res, err := api("POST", "/bilbo/repo/objects", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 422, errSizeChanged.Error())
+}
+
+func TestPostObjectLinks(t *testing.T) {
+	defer func() { Config().ExternalURL = "" }()
+
+	host := strings.TrimPrefix(lfsServer.URL, "http://")
+	cases := map[string]struct {
+		externalURL string
+		headers     map[string]string
+		base        string
+	}{
+		"external url": {
+			"https://lfs.example.com/git-lfs/", map[string]string{"X-Forwarded-Host": "ignored.example.com"},
+			"https://lfs.example.com/git-lfs",
+		},
+		"forwarded headers": {
+			"", map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "proxy.example.com", "X-Forwarded-Prefix": "/lfs/"},
+			"https://proxy.example.com/lfs",
+		},
+		"forwarded proto with the host header": {
+			"", map[string]string{"X-Forwarded-Proto": "https"},
+			"https://" + host,
+		},
+		"without a proxy": {
+			"", nil,
+			"http://localhost:8080",
+		},
+	}
+
+	for name, c := range cases {
+		Config().ExternalURL = c.externalURL
+
+		req, err := http.NewRequest("POST", lfsServer.URL+"/bilbo/repo/objects", bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize)))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Accept", metaMediaType)
+		req.SetBasicAuth(testUser, testPass)
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+
+		var meta Representation
+		if err := json.NewDecoder(res.Body).Decode(&meta); err != nil {
+			t.Fatalf("%s: expected response body to be Representation, got error: %s", name, err)
+		}
+		if href := meta.Actions["download"].Href; href != c.base+"/bilbo/repo/objects/"+contentOid {
+			t.Errorf("%s: expected the download link to start with %s, got %s", name, c.base, href)
+		}
+	}
+}
+
+func TestPostOverQuota(t *testing.T) {
+	Config().UserQuota = "100"
+	defer func() { Config().UserQuota = "0" }()
+
+	buf := bytes.NewBufferString(`{"oid":"d6b6b7a0d5e12c2a4e09c8a0a1f3d5e9b1c7f06a2d3e4f5a6b7c8d9e0f1a2b3c", "size":1234}`)
+	res, err := api("POST", "/quota/repo/objects", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 507 {
+		t.Fatalf("expected status 507, got %d", res.StatusCode)
+	}
+}
+
 func TestPostUnAuthed(t *testing.T) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s", "size":%d}`, contentOid, contentSize))
 	res, err := api("POST", "/bilbo/readonly/objects", metaMediaType, "", "", buf)
@@ -215,6 +549,71 @@ func TestPostUnAuthed(t *testing.T) {
 	}
 }
 
+func TestBatchMixed(t *testing.T) {
+	missingOid := "0b4b8a6c5e2d3f1a9c7e5b3d1f9a7c5e3b1d9f7a5c3e1b9d7f5a3c1e9b7d5f3a"
+	newOid := "3c1e9b7d5f3a0b4b8a6c5e2d3f1a9c7e5b3d1f9a7c5e3b1d9f7a5c3e1b9d7f5a"
+
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"operation":"download","objects":[
+		{"oid":"%s","size":%d},
+		{"oid":"%s","size":10},
+		{"oid":"not-an-oid","size":10}]}`, contentOid, contentSize, missingOid))
+	res, err := api("POST", "/bilbo/batch/objects/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var batch BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("expected response body to be BatchResponse, got error: %s", err)
+	}
+	if len(batch.Objects) != 3 {
+		t.Fatalf("expected 3 objects, got: %d", len(batch.Objects))
+	}
+
+	if download, ok := batch.Objects[0].Actions["download"]; !ok || download.Href != "http://localhost:8080/bilbo/batch/objects/"+contentOid {
+		t.Errorf("expected download link for existing object, got: %v", batch.Objects[0].Actions)
+	}
+	if e := batch.Objects[1].Error; e == nil || e.Code != 404 {
+		t.Errorf("expected 404 error for missing object, got: %v", e)
+	}
+	if e := batch.Objects[2].Error; e == nil || e.Code != 422 {
+		t.Errorf("expected 422 error for invalid object, got: %v", e)
+	}
+
+	if _, err := testMetaStore.Get(&RequestVars{Oid: missingOid}); err != errObjectNotFound {
+		t.Errorf("expected download of a missing object to not create it, got: %v", err)
+	}
+
+	buf = bytes.NewBufferString(fmt.Sprintf(`{"operation":"upload","objects":[
+		{"oid":"%s","size":%d},
+		{"oid":"%s","size":10}]}`, contentOid, contentSize, newOid))
+	res, err = api("POST", "/bilbo/batch/objects/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	batch = BatchResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("expected response body to be BatchResponse, got error: %s", err)
+	}
+	if len(batch.Objects) != 2 {
+		t.Fatalf("expected 2 objects, got: %d", len(batch.Objects))
+	}
+
+	if _, ok := batch.Objects[0].Actions["upload"]; ok {
+		t.Errorf("expected no upload link for existing object")
+	}
+	if upload, ok := batch.Objects[1].Actions["upload"]; !ok || upload.Href != "http://localhost:8080/bilbo/batch/objects/"+newOid {
+		t.Errorf("expected upload link for new object, got: %v", batch.Objects[1].Actions)
+	}
+	if verify, ok := batch.Objects[1].Actions["verify"]; !ok || verify.Href != "http://localhost:8080/bilbo/batch/objects/"+newOid+"/verify" {
+		t.Errorf("expected verify link for new object, got: %v", batch.Objects[1].Actions)
+	}
+}
+
 func TestPut(t *testing.T) {
 	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/repo/objects/"+contentOid, nil)
 	if err != nil {
@@ -249,71 +648,989 @@ func TestPut(t *testing.T) {
 	}
 }
 
-func TestMediaTypesRequired(t *testing.T) {
-	m := []string{"GET", "PUT", "POST", "HEAD"}
-	for _, method := range m {
-		res, err := api(method, "/user/repo/objects/"+contentOid, "", testUser, testPass, nil)
+func TestPutContentType(t *testing.T) {
+	cases := map[string]struct {
+		body, header, expected string
+	}{
+		"sent":    {"\x89PNG not really", "image/png", "image/png"},
+		"sniffed": {"plain words", "application/octet-stream", "text/plain; charset=utf-8"},
+		"binary":  {"\x00\x01\x02\x03", "", "application/octet-stream"},
+	}
+
+	for name, c := range cases {
+		oid := fmt.Sprintf("%x", sha256.Sum256([]byte(c.body)))
+		if _, err := testMetaStore.Put(&RequestVars{User: "user", Repo: "typed-repo", Oid: oid, Size: int64(len(c.body))}); err != nil {
+			t.Fatalf("%s: error adding object: %s", name, err)
+		}
+
+		req, err := http.NewRequest("PUT", lfsServer.URL+"/user/typed-repo/objects/"+oid, bytes.NewBufferString(c.body))
 		if err != nil {
-			t.Fatalf("request error: %s", err)
+			t.Fatalf("%s: request error: %s", name, err)
 		}
-		if res.StatusCode != 404 {
-			t.Fatalf("expected status 404, got %d", res.StatusCode)
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+		if c.header != "" {
+			req.Header.Set("Content-Type", c.header)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: response error: %s", name, err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("%s: expected status 200, got %d", name, res.StatusCode)
+		}
+
+		meta, err := testMetaStore.Get(&RequestVars{Oid: oid})
+		if err != nil || meta.ContentType != c.expected {
+			t.Errorf("%s: expected content type %q to be recorded, got %+v (%v)", name, c.expected, meta, err)
+		}
+
+		res, err = api("GET", "/user/typed-repo/objects/"+oid, contentMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("%s: request error: %s", name, err)
+		}
+		for header, expected := range map[string]string{
+			"Content-Type":            c.expected,
+			"X-Content-Type-Options":  "nosniff",
+			"Content-Disposition":     "attachment",
+			"Content-Security-Policy": "sandbox",
+		} {
+			if v := res.Header.Get(header); v != expected {
+				t.Errorf("%s: expected the download to have %s %q, got %q", name, header, expected, v)
+			}
 		}
 	}
-}
 
-func TestMediaTypesParsed(t *testing.T) {
-	accept := contentMediaType + "; charset=utf-8"
-	res, err := api("GET", "/user/repo/objects/"+contentOid, accept, testUser, testPass, nil)
+	// Uploading again keeps the type recorded first
+	body := cases["sent"].body
+	oid := fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+	req, err := http.NewRequest("PUT", lfsServer.URL+"/user/typed-repo/objects/"+oid, bytes.NewBufferString(body))
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
+	req.SetBasicAuth(testUser1, testPass1)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "text/html")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
 	if res.StatusCode != 200 {
 		t.Fatalf("expected status 200, got %d", res.StatusCode)
 	}
-}
+	if meta, err := testMetaStore.Get(&RequestVars{Oid: oid}); err != nil || meta.ContentType != "image/png" {
+		t.Errorf("expected the first content type to be kept, got %+v (%v)", meta, err)
+	}
 
-func TestLocksList(t *testing.T) {
-	res, err := api("GET", "/user/repo/locks", metaMediaType, testUser, testPass, nil)
+	// Objects stored without a recorded type are served as binary
+	body = "untyped content"
+	oid = fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+	meta, err := testMetaStore.Put(&RequestVars{User: "user", Repo: "typed-repo", Oid: oid, Size: int64(len(body))})
+	if err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+	if err := testContentStore.Put(meta, bytes.NewBufferString(body)); err != nil {
+		t.Fatalf("error storing content: %s", err)
+	}
+	res, err = api("GET", "/user/typed-repo/objects/"+oid, contentMediaType, testUser, testPass, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
+	if v := res.Header.Get("Content-Type"); v != defaultContentType {
+		t.Errorf("expected an untyped download to be %s, got %q", defaultContentType, v)
+	}
+}
 
-	if res.StatusCode != 200 {
-		t.Fatalf("expected status 200, got %d", res.StatusCode)
+func TestVerifyObject(t *testing.T) {
+	verify := func(oid string, size int64) *http.Response {
+		buf := bytes.NewBufferString(fmt.Sprintf(`{"oid":"%s","size":%d}`, oid, size))
+		res, err := api("POST", "/user/repo/objects/"+oid+"/verify", metaMediaType, testUser, testPass, buf)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		return res
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Fatalf("expected response to contain content, got error: %s", err)
+	if res := verify(contentOid, contentSize); res.StatusCode != 200 {
+		t.Errorf("expected status 200 for stored content, got %d", res.StatusCode)
 	}
 
-	var list LockList
-	if err := json.Unmarshal(body, &list); err != nil {
-		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	if res := verify("7c1e9a3f5b2d4c6e8a0f1b3d5e7c9a2f4b6d8e0a1c3f5b7d9e2a4c6f8b0d1e3a", contentSize); res.StatusCode != 404 {
+		t.Errorf("expected status 404 for a missing object, got %d", res.StatusCode)
 	}
-	if len(list.Locks) != 1 {
-		t.Errorf("expected returned lock count to match, got: %d", len(list.Locks))
+
+	oid := "5b9f3c1e7a2d4f6b8c0e1a3d5f7b9c2e4a6d8f0b1c3e5a7d9f2b4c6e8a0d1f3b"
+	if _, err := testMetaStore.Put(&RequestVars{User: "user", Repo: "repo", Oid: oid, Size: contentSize}); err != nil {
+		t.Fatalf("error adding object: %s", err)
 	}
-	if list.Locks[0].Id != lockId {
-		t.Errorf("expected lockId to match, got: %s", list.Locks[0].Id)
+	if res := verify(oid, contentSize); res.StatusCode != 404 {
+		t.Errorf("expected status 404 for an object without content, got %d", res.StatusCode)
 	}
+
+	assertErrorResponse(t, verify(contentOid, contentSize+1), 422, "Object does not match the stored object's oid and size")
 }
 
-func TestLocksListUnAuthed(t *testing.T) {
-	res, err := api("GET", "/user/repo/locks", metaMediaType, "", "", nil)
+func TestPutHashMismatch(t *testing.T) {
+	oid := "8f4e8c1a4f0bfb1cdd5d4e3c0a7e2cf5e2f3bb5e1a0d3f3c2a8c3a8b3e1f6c6d"
+	if _, err := testMetaStore.Put(&RequestVars{User: "user", Repo: "put-repo", Oid: oid, Size: contentSize}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	res, err := putContent("/user/put-repo/objects/"+oid, content)
 	if err != nil {
-		t.Fatalf("request error: %s", err)
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422, got %d", res.StatusCode)
 	}
 
-	if res.StatusCode != 401 {
-		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	if testContentStore.Exists(&MetaObject{Oid: oid, Size: contentSize}) {
+		t.Errorf("expected mismatched content to not be stored")
 	}
 }
 
-func TestLocksVerify(t *testing.T) {
-	buf := bytes.NewBufferString(fmt.Sprintf(`{"cursor": "", "limit": 0}`))
-	res, err := api("POST", "/user/repo/locks/verify", metaMediaType, testUser, testPass, buf)
+func TestPutMismatchKeepsStoredObject(t *testing.T) {
+	Config().DeleteContent = "true"
+	defer func() { Config().DeleteContent = "false" }()
+
+	body := "kept content"
+	oid := fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+	meta := &MetaObject{Oid: oid, Size: int64(len(body))}
+	if _, err := testMetaStore.Put(&RequestVars{User: "user", Repo: "kept-repo", Oid: oid, Size: meta.Size}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	res, err := putContent("/user/kept-repo/objects/"+oid, body)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	// A bad upload of an object that is already stored must leave it alone
+	res, err = putContent("/user/kept-repo/objects/"+oid, "kept c0ntent")
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422, got %d", res.StatusCode)
+	}
+
+	if !testContentStore.Exists(meta) {
+		t.Errorf("expected the stored content to survive a bad upload")
+	}
+	if _, err := testMetaStore.Get(&RequestVars{User: "user", Repo: "kept-repo", Oid: oid}); err != nil {
+		t.Errorf("expected the object to survive a bad upload, got: %s", err)
+	}
+}
+
+func TestPutTruncated(t *testing.T) {
+	oid := "1d9a3b5f7c2e4a6b8d0f1e3c5a7b9d2f4e6a8c0b1d3f5e7a9c2b4d6f8e0a1c3b"
+	if _, err := testMetaStore.Put(&RequestVars{User: "user", Repo: "put-repo", Oid: oid, Size: 1000}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	res, err := putContent("/user/put-repo/objects/"+oid, content)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	if res.StatusCode != 422 {
+		t.Fatalf("expected status 422, got %d", res.StatusCode)
+	}
+
+	if testContentStore.Exists(&MetaObject{Oid: oid, Size: 1000}) {
+		t.Errorf("expected truncated content to not be stored")
+	}
+}
+
+func TestBatchMaxObjectSize(t *testing.T) {
+	Config().MaxObjectSize = "100"
+	defer func() { Config().MaxObjectSize = "0" }()
+
+	buf := bytes.NewBufferString(`{"operation":"upload","objects":[{"oid":"3f2c1d0e9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e","size":1000}]}`)
+	res, err := api("POST", "/user/big-repo/objects/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var resp BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatalf("expected response body to be a batch response, got error: %s", err)
+	}
+	if len(resp.Objects) != 1 || resp.Objects[0].Error == nil || resp.Objects[0].Error.Code != 413 {
+		t.Fatalf("expected the object to be rejected with 413, got: %+v", resp.Objects)
+	}
+
+	buf = bytes.NewBufferString(`{"oid":"3f2c1d0e9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e", "size":1000}`)
+	res, err = api("POST", "/user/big-repo/objects", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 413, errObjectTooLarge.Error())
+}
+
+func TestBatchEnforceLocks(t *testing.T) {
+	if _, err := createLockInRepo(testUser, testPass, "enforced-repo", "locked.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	upload := func(user, pass, oid string) *Representation {
+		buf := bytes.NewBufferString(`{"operation":"upload","objects":[{"oid":"` + oid + `","size":10,"path":"locked.bin"}]}`)
+		res, err := api("POST", "/user/enforced-repo/objects/batch", metaMediaType, user, pass, buf)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		var resp BatchResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatalf("expected response body to be a batch response, got error: %s", err)
+		}
+		if len(resp.Objects) != 1 {
+			t.Fatalf("expected 1 object, got: %+v", resp.Objects)
+		}
+		return resp.Objects[0]
+	}
+
+	// Locks aren't enforced by default
+	if obj := upload(testUser1, testPass1, "1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f801"); obj.Error != nil {
+		t.Errorf("expected the upload to be allowed, got: %+v", obj.Error)
+	}
+
+	Config().EnforceLocks = "true"
+	defer func() { Config().EnforceLocks = "false" }()
+
+	if obj := upload(testUser, testPass, "1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f802"); obj.Error != nil {
+		t.Errorf("expected the owner's upload to be allowed, got: %+v", obj.Error)
+	}
+
+	obj := upload(testUser1, testPass1, "1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f803")
+	if obj.Error == nil || obj.Error.Code != 423 || obj.Error.Message != "locked.bin is locked by "+testUser {
+		t.Errorf("expected another user's upload to be rejected with 423, got: %+v", obj.Error)
+	}
+
+	buf := bytes.NewBufferString(`{"oid":"1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f803","size":10,"path":"locked.bin"}`)
+	res, err := api("POST", "/user/enforced-repo/objects", metaMediaType, testUser1, testPass1, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 423, "locked.bin is locked by "+testUser)
+
+	// Paths are compared as lock paths are, and must be sent
+	for _, c := range []struct {
+		path    string
+		status  int
+		message string
+	}{
+		{`,"path":"./locked.bin"`, 423, "locked.bin is locked by " + testUser},
+		{``, 422, errPathRequired.Error()},
+		{`,"path":"../locked.bin"`, 422, errInvalidLockPath.Error()},
+	} {
+		buf := bytes.NewBufferString(`{"oid":"1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f803","size":10` + c.path + `}`)
+		res, err := api("POST", "/user/enforced-repo/objects", metaMediaType, testUser1, testPass1, buf)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		assertErrorResponse(t, res, c.status, c.message)
+	}
+}
+
+func TestLockRequestTooLarge(t *testing.T) {
+	Config().MaxLockRequestSize = "100"
+	defer func() { Config().MaxLockRequestSize = "65536" }()
+
+	lock, err := createLockInRepo(testUser, testPass, "large-request-repo", "large.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	large := `{"path":"` + strings.Repeat("a", 200) + `"}`
+	paths := []string{
+		"/user/large-request-repo/locks",
+		"/user/large-request-repo/locks/batch",
+		"/user/large-request-repo/locks/verify",
+		"/user/large-request-repo/locks/" + lock.Id + "/unlock",
+	}
+	for _, path := range paths {
+		res, err := api("POST", path, metaMediaType, testUser, testPass, bytes.NewBufferString(large))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		assertErrorResponse(t, res, 413, "Lock request is too large")
+	}
+
+	locks, err := testMetaStore.Locks("large-request-repo")
+	if err != nil || len(locks) != 1 {
+		t.Errorf("expected only the first lock to exist, got: %v (%v)", locks, err)
+	}
+}
+
+func TestRequireKnownRepo(t *testing.T) {
+	// Off by default, any repo can be locked in
+	if _, err := createLockInRepo(testUser, testPass, "unlisted-repo", "a.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	Config().RequireKnownRepo = "true"
+	Config().KnownRepos = "user/known-repo, user/other-known-repo"
+	defer func() {
+		Config().RequireKnownRepo = "false"
+		Config().KnownRepos = ""
+	}()
+
+	if _, err := createLockInRepo(testUser, testPass, "known-repo", "a.bin"); err != nil {
+		t.Fatalf("error creating lock in a known repo: %s", err)
+	}
+
+	for _, repo := range []string{"unlisted-repo", "knwon-repo"} {
+		res, err := api("GET", "/user/"+repo+"/locks", metaMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		assertErrorResponse(t, res, 404, "Repository not found")
+
+		res, err = api("POST", "/user/"+repo+"/locks", metaMediaType, testUser, testPass, bytes.NewBufferString(`{"path":"b.bin"}`))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		assertErrorResponse(t, res, 404, "Repository not found")
+	}
+
+	// The same repo name under another user is a different repo
+	res, err := api("GET", "/someone/known-repo/locks", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 404, "Repository not found")
+
+	if locks, err := testMetaStore.Locks("knwon-repo"); err != nil || len(locks) != 0 {
+		t.Errorf("expected no locks in the unknown repo, got: %v (%v)", locks, err)
+	}
+	if locks, err := testMetaStore.Locks("unlisted-repo"); err != nil || len(locks) != 1 {
+		t.Errorf("expected the lock from before to be kept, got: %v (%v)", locks, err)
+	}
+}
+
+func TestPutMaxObjectSize(t *testing.T) {
+	oid := "7e6d5c4b3a291807f6e5d4c3b2a19087f6e5d4c3b2a19087f6e5d4c3b2a19087"
+	if _, err := testMetaStore.Put(&RequestVars{User: "user", Repo: "big-repo", Oid: oid, Size: 10}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	Config().MaxObjectSize = "100"
+	defer func() { Config().MaxObjectSize = "0" }()
+
+	// The declared size is within the limit, the body isn't
+	res, err := putContent("/user/big-repo/objects/"+oid, strings.Repeat("a", 1000))
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	assertErrorResponse(t, res, 413, errObjectTooLarge.Error())
+
+	if testContentStore.Exists(&MetaObject{Oid: oid, Size: 10}) {
+		t.Errorf("expected oversized content to not be stored")
+	}
+}
+
+func TestMediaTypesRequired(t *testing.T) {
+	m := []string{"GET", "PUT", "POST", "HEAD"}
+	for _, method := range m {
+		res, err := api(method, "/user/repo/objects/"+contentOid, "", testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 404 {
+			t.Fatalf("expected status 404, got %d", res.StatusCode)
+		}
+	}
+}
+
+func TestMediaTypesParsed(t *testing.T) {
+	accept := contentMediaType + "; charset=utf-8"
+	res, err := api("GET", "/user/repo/objects/"+contentOid, accept, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+}
+
+func TestLocksList(t *testing.T) {
+	res, err := api("GET", "/user/repo/locks", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("expected response to contain content, got error: %s", err)
+	}
+
+	var list LockList
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 1 {
+		t.Errorf("expected returned lock count to match, got: %d", len(list.Locks))
+	}
+	if list.Locks[0].Id != lockId {
+		t.Errorf("expected lockId to match, got: %s", list.Locks[0].Id)
+	}
+}
+
+func TestLocksListIfModifiedSince(t *testing.T) {
+	if _, err := createLockInRepo(testUser, testPass, "modified-repo", "first.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	res, err := listLocksIfModifiedSince("/user/modified-repo/locks", "")
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	modified := res.Header.Get("Last-Modified")
+	if modified == "" {
+		t.Fatalf("expected a Last-Modified header")
+	}
+
+	res, err = listLocksIfModifiedSince("/user/modified-repo/locks", modified)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 304 {
+		t.Fatalf("expected status 304, got %d", res.StatusCode)
+	}
+
+	// Changes within the same second are still picked up
+	if _, err := createLockInRepo(testUser, testPass, "modified-repo", "second.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	res, err = listLocksIfModifiedSince("/user/modified-repo/locks", modified)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 after a change, got %d", res.StatusCode)
+	}
+
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 2 {
+		t.Errorf("expected both locks to be listed, got: %+v", list.Locks)
+	}
+	if res.Header.Get("Last-Modified") == modified {
+		t.Errorf("expected Last-Modified to move on, got: %s", modified)
+	}
+}
+
+func listLocksIfModifiedSince(path, since string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", lfsServer.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	if since != "" {
+		req.Header.Set("If-Modified-Since", since)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestLocksListDecimalIds(t *testing.T) {
+	lock, err := createLockInRepo(testUser, testPass, "decimal-repo", "decimal.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	id, _ := new(big.Int).SetString(lock.Id, 16)
+
+	for format, expected := range map[string]string{"": "", "hex": "", "dec": id.String()} {
+		res, err := api("GET", "/user/decimal-repo/locks?idformat="+format, metaMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+
+		var list LockList
+		if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+			t.Fatalf("expected response body to be LockList, got error: %s", err)
+		}
+		if len(list.Locks) != 1 || list.Locks[0].Id != lock.Id {
+			t.Fatalf("%q: expected the hex id to be kept, got: %+v", format, list.Locks)
+		}
+		if list.Locks[0].DecimalId != expected {
+			t.Errorf("%q: expected decimal id %q, got %q", format, expected, list.Locks[0].DecimalId)
+		}
+	}
+
+	res, err := api("GET", "/user/decimal-repo/locks?idformat=octal", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 400, "Invalid id format: octal")
+}
+
+func TestLocksListSorted(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	locks := []Lock{
+		{Id: "sort-1", Path: "b.bin", Owner: User{Name: testUser}, LockedAt: now.Add(-2 * time.Hour)},
+		{Id: "sort-2", Path: "c.bin", Owner: User{Name: testUser}, LockedAt: now.Add(-3 * time.Hour)},
+		{Id: "sort-3", Path: "a.bin", Owner: User{Name: testUser}, LockedAt: now.Add(-1 * time.Hour)},
+	}
+	if _, err := testMetaStore.AddLocks("sorted-repo", locks...); err != nil {
+		t.Fatalf("error adding locks: %s", err)
+	}
+
+	tests := map[string][]string{
+		"":     {"sort-2", "sort-1", "sort-3"},
+		"id":   {"sort-2", "sort-1", "sort-3"},
+		"path": {"sort-3", "sort-1", "sort-2"},
+		"time": {"sort-3", "sort-1", "sort-2"},
+	}
+	for order, expected := range tests {
+		res, err := api("GET", "/user/sorted-repo/locks?sort="+order, metaMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+
+		var list LockList
+		if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+			t.Fatalf("expected response body to be LockList, got error: %s", err)
+		}
+		var ids []string
+		for _, l := range list.Locks {
+			ids = append(ids, l.Id)
+		}
+		if strings.Join(ids, ",") != strings.Join(expected, ",") {
+			t.Errorf("%q: expected locks in the order %v, got %v", order, expected, ids)
+		}
+	}
+
+	res, err := api("GET", "/user/sorted-repo/locks?sort=owner", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 400, "Invalid sort: owner")
+}
+
+func TestCreateLockLimit(t *testing.T) {
+	Config().MaxRepoLocks = "1"
+	defer func() { Config().MaxRepoLocks = "0" }()
+
+	if _, err := createLockInRepo(testUser, testPass, "limited-repo", "first.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	buf := bytes.NewBufferString(`{"path":"second.bin"}`)
+	res, err := api("POST", "/user/limited-repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if lockResponse.Message != errLockLimit.Error() {
+		t.Errorf("expected lock limit message, got: %q", lockResponse.Message)
+	}
+}
+
+func TestCreateLockInvalidPath(t *testing.T) {
+	Config().MaxLockPathLength = "16"
+	defer func() { Config().MaxLockPathLength = "4096" }()
+
+	for name, c := range map[string]struct {
+		path    string
+		message string
+	}{
+		"empty":          {"", errInvalidLockPath.Error()},
+		"null byte":      {`a\u0000b.bin`, errInvalidLockPath.Error()},
+		"absolute":       {"/etc/passwd", errInvalidLockPath.Error()},
+		"outside":        {"../other/a.bin", errInvalidLockPath.Error()},
+		"too long":       {strings.Repeat("a", 17), errLockPathTooLong.Error()},
+		"only dot parts": {"./a/..", errInvalidLockPath.Error()},
+	} {
+		buf := bytes.NewBufferString(`{"path":"` + c.path + `"}`)
+		res, err := api("POST", "/user/invalid-path-repo/locks", metaMediaType, testUser, testPass, buf)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 422 {
+			t.Errorf("%s: expected status 422, got %d", name, res.StatusCode)
+			continue
+		}
+		assertErrorResponse(t, res, 422, c.message)
+	}
+
+	lock, err := createLockInRepo(testUser, testPass, "invalid-path-repo", "./dir//a.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	if lock.Path != "dir/a.bin" {
+		t.Errorf("expected the lock path to be cleaned, got %q", lock.Path)
+	}
+}
+
+func TestLocksEmpty(t *testing.T) {
+	if _, err := createLockInRepo(testUser, testPass, "empty-page-repo", "a.bin"); err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	for _, path := range []string{
+		"/user/never-locked-repo/locks",
+		"/user/empty-page-repo/locks?path=unlocked.bin",
+		"/user/empty-page-repo/locks?limit=0",
+	} {
+		res, err := api("GET", path, metaMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200 for %s, got %d", path, res.StatusCode)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("expected response to contain content, got error: %s", err)
+		}
+		if string(body) != `{"locks":[]}`+"\n" {
+			t.Errorf("expected an empty lock list without a next_cursor for %s, got: %s", path, body)
+		}
+	}
+}
+
+func TestLocksCount(t *testing.T) {
+	for _, path := range []string{"count-1.bin", "count-2.bin", "count-3.bin"} {
+		if _, err := createLockInRepo(testUser, testPass, "count-repo", path); err != nil {
+			t.Fatalf("error creating lock: %s", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		count int
+	}{
+		{"count=true", 3},
+		{"count=true&path=count-2.bin", 1},
+		{"count=true&path=unlocked.bin", 0},
+	} {
+		res, err := api("GET", "/user/count-repo/locks?"+tc.query, metaMediaType, testUser, testPass, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200 for %s, got %d", tc.query, res.StatusCode)
+		}
+
+		var count LockCountResponse
+		if err := json.NewDecoder(res.Body).Decode(&count); err != nil {
+			t.Fatalf("expected response body to be LockCountResponse, got error: %s", err)
+		}
+		if count.Count != tc.count {
+			t.Errorf("expected %s to count %d locks, got %d", tc.query, tc.count, count.Count)
+		}
+	}
+
+	res, err := api("GET", "/user/count-repo/locks?count=true&owner="+testUser, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 400, "Locks can't be counted by owner")
+}
+
+func TestCreateLockReLockOwn(t *testing.T) {
+	lock, err := createLockInRepo(testUser, testPass, "relock-repo", "relocked.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	relock := func(user, pass string) *http.Response {
+		buf := bytes.NewBufferString(`{"path":"relocked.bin"}`)
+		res, err := api("POST", "/user/relock-repo/locks", metaMediaType, user, pass, buf)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		return res
+	}
+
+	assertErrorResponse(t, relock(testUser, testPass), 409, "lock already created")
+
+	Config().ReLockOwnIsSuccess = "true"
+	defer func() { Config().ReLockOwnIsSuccess = "false" }()
+
+	res := relock(testUser, testPass)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if lockResponse.Lock.Id != lock.Id {
+		t.Errorf("expected the existing lock %s, got: %+v", lock.Id, lockResponse.Lock)
+	}
+
+	assertErrorResponse(t, relock(testUser1, testPass1), 409, "lock already created")
+}
+
+func TestCreateLockPathRules(t *testing.T) {
+	Config().LockPathAllow = "assets/**"
+	Config().LockPathDeny = "**/*.tmp"
+	defer func() {
+		Config().LockPathAllow = ""
+		Config().LockPathDeny = ""
+	}()
+
+	if _, err := createLockInRepo(testUser, testPass, "rules-repo", "assets/models/ship.fbx"); err != nil {
+		t.Errorf("expected a path under the allow list to be locked, got: %s", err)
+	}
+
+	for name, path := range map[string]string{"denied": "assets/models/ship.tmp", "not allowed": "src/main.go"} {
+		buf := bytes.NewBufferString(`{"path":"` + path + `"}`)
+		res, err := api("POST", "/user/rules-repo/locks", metaMediaType, testUser, testPass, buf)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 422 {
+			t.Errorf("%s: expected status 422, got %d", name, res.StatusCode)
+		}
+	}
+
+	// Without an allow list only denied paths are refused
+	Config().LockPathAllow = ""
+	if _, err := createLockInRepo(testUser, testPass, "rules-repo", "src/main.go"); err != nil {
+		t.Errorf("expected any path that isn't denied to be locked, got: %s", err)
+	}
+
+	buf := bytes.NewBufferString(`{"paths":["src/other.go","build/out.tmp"]}`)
+	res, err := api("POST", "/user/rules-repo/locks/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 422, errLockPathDenied.Error())
+}
+
+func TestCreateLockAnnotation(t *testing.T) {
+	buf := bytes.NewBufferString(`{"path":"annotated.bin","annotation":"JIRA-123 reworking the level"}`)
+	res, err := api("POST", "/user/annotated-repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if lockResponse.Lock.Annotation != "JIRA-123 reworking the level" {
+		t.Errorf("expected the created lock to have the annotation, got: %q", lockResponse.Lock.Annotation)
+	}
+
+	res, err = api("GET", "/user/annotated-repo/locks?path=annotated.bin", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 1 || list.Locks[0].Annotation != "JIRA-123 reworking the level" {
+		t.Errorf("expected the listed lock to have the annotation, got: %+v", list.Locks)
+	}
+
+	res, err = api("POST", "/user/annotated-repo/locks/verify", metaMediaType, testUser, testPass, bytes.NewBufferString(`{}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var verifiable VerifiableLockList
+	if err := json.NewDecoder(res.Body).Decode(&verifiable); err != nil {
+		t.Fatalf("expected response body to be VerifiableLockList, got error: %s", err)
+	}
+	if len(verifiable.Ours) != 1 || verifiable.Ours[0].Annotation != "JIRA-123 reworking the level" {
+		t.Errorf("expected the verified lock to have the annotation, got: %+v", verifiable.Ours)
+	}
+
+	buf = bytes.NewBufferString(fmt.Sprintf(`{"path":"too-long.bin","annotation":"%s"}`, strings.Repeat("a", maxLockAnnotationLength+1)))
+	res, err = api("POST", "/user/annotated-repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 422, fmt.Sprintf("Lock annotation is longer than %d bytes", maxLockAnnotationLength))
+}
+
+func TestDeleteLockIfMatch(t *testing.T) {
+	lock, err := createLockInRepo(testUser, testPass, "if-match-repo", "if-match.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	path := "/user/if-match-repo/locks/" + lock.Id + "/unlock"
+	lockedAt := lock.LockedAt.Format(time.RFC3339)
+
+	res, err := unlockIfMatch(path, lock.LockedAt.Add(time.Minute).Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 412 {
+		t.Fatalf("expected status 412 for a different locked_at, got %d", res.StatusCode)
+	}
+
+	res, err = unlockIfMatch(path, "yesterday")
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for an invalid If-Match, got %d", res.StatusCode)
+	}
+
+	res, err = unlockIfMatch(path, `"`+lockedAt+`"`)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 for a matching locked_at, got %d", res.StatusCode)
+	}
+
+	// A second client racing to unlock learns the lock changed
+	res, err = unlockIfMatch(path, lockedAt)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 412 {
+		t.Fatalf("expected status 412 for a lock that is gone, got %d", res.StatusCode)
+	}
+}
+
+func unlockIfMatch(path, ifMatch string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", lfsServer.URL+path, bytes.NewBufferString(`{"force":false}`))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("If-Match", ifMatch)
+	return http.DefaultClient.Do(req)
+}
+
+func TestLocksOwnerDisplayName(t *testing.T) {
+	if err := testMetaStore.AddUser("samwise", "gamgee", "Samwise Gamgee"); err != nil {
+		t.Fatalf("error adding user: %s", err)
+	}
+	defer testMetaStore.DeleteUser("samwise", true)
+
+	named, err := createLockInRepo("samwise", "gamgee", "display-repo", "named.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	if named.Owner.Name != "Samwise Gamgee" {
+		t.Errorf("expected owner name to be the display name, got: %s", named.Owner.Name)
+	}
+
+	unnamed, err := createLockInRepo(testUser, testPass, "display-repo", "unnamed.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	if unnamed.Owner.Name != testUser {
+		t.Errorf("expected owner name to be the login, got: %s", unnamed.Owner.Name)
+	}
+
+	res, err := api("GET", "/user/display-repo/locks", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	owners := make(map[string]string)
+	for _, l := range list.Locks {
+		owners[l.Path] = l.Owner.Name
+	}
+	if owners["named.bin"] != "Samwise Gamgee" || owners["unnamed.bin"] != testUser {
+		t.Errorf("expected listed owner names to match, got: %v", owners)
+	}
+
+	// Ownership is still checked against the login
+	res, err = api("GET", "/user/display-repo/locks?owner=samwise", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	list = LockList{}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 1 || list.Locks[0].Id != named.Id {
+		t.Errorf("expected filtering by login to find the lock, got: %v", list.Locks)
+	}
+
+	buf := bytes.NewBufferString(`{"force":false}`)
+	res, err = api("POST", "/user/display-repo/locks/"+named.Id+"/unlock", metaMediaType, "samwise", "gamgee", buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("expected owner to unlock with status 200, got %d", res.StatusCode)
+	}
+}
+
+func TestLocksListUnAuthed(t *testing.T) {
+	res, err := api("GET", "/user/repo/locks", metaMediaType, "", "", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestLocksListOwner(t *testing.T) {
+	if _, err := createLockInRepo(testUser1, testPass1, "owner-repo", "TestLocksListOwner-1"); err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+	if _, err := createLockInRepo(testUser, testPass, "owner-repo", "TestLocksListOwner-2"); err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	res, err := api("GET", "/user/owner-repo/locks?owner="+testUser1, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 1 || list.Locks[0].Owner.Name != testUser1 {
+		t.Errorf("expected only %s's lock to be returned, got: %v", testUser1, list.Locks)
+	}
+}
+
+func TestLocksVerify(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`{"cursor": "", "limit": 0}`))
+	res, err := api("POST", "/user/repo/locks/verify", metaMediaType, testUser, testPass, buf)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
 	}
@@ -333,6 +1650,84 @@ func TestLocksVerify(t *testing.T) {
 	}
 }
 
+func TestLocksVerifyPaginated(t *testing.T) {
+	var locks []Lock
+	for i, u := range [][2]string{{testUser, testPass}, {testUser1, testPass1}, {testUser, testPass}} {
+		l, err := createLockInRepo(u[0], u[1], "verify-repo", fmt.Sprintf("verify-%d.bin", i))
+		if err != nil {
+			t.Fatalf("error creating lock: %s", err)
+		}
+		locks = append(locks, *l)
+	}
+	// Locks made in the same second are paged in id order
+	sort.Stable(LocksByCreatedAt(locks))
+
+	list := verifyLocks(t, "verify-repo", `{"limit": 2}`)
+	assertVerifiedLocks(t, list, locks[:2])
+	if cursor, err := decodeCursor("verify-repo", list.NextCursor); err != nil || cursor != lockCursor(locks[2]) {
+		t.Fatalf("expected next cursor to be the third lock, got: %q", list.NextCursor)
+	}
+
+	list = verifyLocks(t, "verify-repo", fmt.Sprintf(`{"cursor": "%s", "limit": 2}`, list.NextCursor))
+	assertVerifiedLocks(t, list, locks[2:])
+	if list.NextCursor != "" {
+		t.Errorf("expected no next cursor on the last page, got: %q", list.NextCursor)
+	}
+
+	res, err := api("GET", "/user/verify-repo/locks?cursor="+lockCursor(locks[2]), metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	assertErrorResponse(t, res, 400, errInvalidCursor.Error())
+
+	list = verifyLocks(t, "verify-repo", `{}`)
+	if len(list.Ours)+len(list.Theirs) != 3 {
+		t.Errorf("expected all locks without a limit, got ours: %v, theirs: %v", list.Ours, list.Theirs)
+	}
+}
+
+// assertVerifiedLocks checks that a page of verified locks is expected, with
+// testUser's locks as ours and the others as theirs.
+func assertVerifiedLocks(t *testing.T, list VerifiableLockList, expected []Lock) {
+	var ours, theirs []string
+	for _, l := range expected {
+		if l.Owner.Name == testUser {
+			ours = append(ours, l.Id)
+		} else {
+			theirs = append(theirs, l.Id)
+		}
+	}
+	for _, page := range []struct {
+		name     string
+		locks    []Lock
+		expected []string
+	}{{"ours", list.Ours, ours}, {"theirs", list.Theirs, theirs}} {
+		var ids []string
+		for _, l := range page.locks {
+			ids = append(ids, l.Id)
+		}
+		if !reflect.DeepEqual(ids, page.expected) {
+			t.Errorf("expected %s to be %v, got: %v", page.name, page.expected, ids)
+		}
+	}
+}
+
+func verifyLocks(t *testing.T, repo, body string) VerifiableLockList {
+	res, err := api("POST", "/user/"+repo+"/locks/verify", metaMediaType, testUser, testPass, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var list VerifiableLockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be VerifiableLockList, got error: %s", err)
+	}
+	return list
+}
+
 func TestLocksVerifyUnAuthed(t *testing.T) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"cursor": "", "limit": 0}`))
 	res, err := api("POST", "/user/repo/locks/verify", metaMediaType, "", "", buf)
@@ -362,6 +1757,50 @@ func TestLock(t *testing.T) {
 	}
 }
 
+func TestLockLockedAtRFC3339(t *testing.T) {
+	buf := bytes.NewBufferString(`{"path":"TestLockLockedAtRFC3339"}`)
+	res, err := api("POST", "/user/repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var body struct {
+		Lock struct {
+			LockedAt string `json:"locked_at"`
+		} `json:"lock"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+
+	lockedAt, err := time.Parse(time.RFC3339, body.Lock.LockedAt)
+	if err != nil {
+		t.Fatalf("expected locked_at to be RFC3339, got %q: %s", body.Lock.LockedAt, err)
+	}
+	if lockedAt.Location() != time.UTC {
+		t.Errorf("expected locked_at to be in UTC, got %q", body.Lock.LockedAt)
+	}
+}
+
+func TestLockDecodeLegacyLockedAt(t *testing.T) {
+	expected := time.Date(2017, 6, 20, 15, 4, 5, 0, time.UTC)
+
+	var lock Lock
+	data := fmt.Sprintf(`{"id":"%s","path":"%s","owner":{"name":"%s"},"locked_at":"%s"}`, lockId, lockPath, testUser, expected.String())
+	if err := json.Unmarshal([]byte(data), &lock); err != nil {
+		t.Fatalf("expected legacy lock to decode, got error: %s", err)
+	}
+	if !lock.LockedAt.Equal(expected) {
+		t.Errorf("expected locked_at to be %s, got %s", expected, lock.LockedAt)
+	}
+	if lock.Id != lockId || lock.Path != lockPath || lock.Owner.Name != testUser {
+		t.Errorf("expected lock fields to be decoded, got: %v", lock)
+	}
+}
+
 func TestLockExists(t *testing.T) {
 	l, err := createLock(testUser, testPass, "TestLockExists")
 	if err != nil {
@@ -379,6 +1818,62 @@ func TestLockExists(t *testing.T) {
 	}
 }
 
+func TestLockExistsNormalizedPath(t *testing.T) {
+	Config().NormalizeLockPaths = "true"
+	defer func() { Config().NormalizeLockPaths = "false" }()
+
+	if _, err := createLock(testUser, testPass, "Assets/TestLockExistsNormalizedPath.umap"); err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	buf := bytes.NewBufferString(`{"path":"assets/testlockexistsnormalizedpath.umap"}`)
+	res, err := api("POST", "/user/repo/locks", metaMediaType, testUser1, testPass1, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 409 {
+		t.Fatalf("expected status 409, got %d", res.StatusCode)
+	}
+}
+
+func TestLocksBatch(t *testing.T) {
+	if _, err := createLockInRepo(testUser1, testPass1, "batch-repo", "TestLocksBatch-1"); err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	buf := bytes.NewBufferString(`{"paths":["TestLocksBatch-1","TestLocksBatch-2","TestLocksBatch-3"]}`)
+	res, err := api("POST", "/user/batch-repo/locks/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var batch BatchLockResponse
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		t.Fatalf("expected response body to be BatchLockResponse, got error: %s", err)
+	}
+	if len(batch.Locks) != 2 {
+		t.Errorf("expected 2 locks to be created, got: %d", len(batch.Locks))
+	}
+	if len(batch.Conflicts) != 1 || batch.Conflicts[0].Path != "TestLocksBatch-1" {
+		t.Errorf("expected a conflict on TestLocksBatch-1, got: %v", batch.Conflicts)
+	}
+
+	buf = bytes.NewBufferString(`{"paths":["TestLocksBatch-2"]}`)
+	res, err = api("POST", "/user/batch-repo/locks/batch", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+
+	if res.StatusCode != 409 {
+		t.Fatalf("expected status 409, got %d", res.StatusCode)
+	}
+}
+
 func TestLockUnAuthed(t *testing.T) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, "TestLockUnAuthed"))
 	res, err := api("POST", "/user/repo/locks", metaMediaType, "", "", buf)
@@ -421,6 +1916,162 @@ func TestUnlock(t *testing.T) {
 	}
 }
 
+func TestLockUUIDIds(t *testing.T) {
+	Config().LockIdFormat = "uuid"
+	defer func() { Config().LockIdFormat = "hex" }()
+
+	lock, err := createLockInRepo(testUser, testPass, "uuid-repo", "uuid.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if !uuidPattern.MatchString(lock.Id) {
+		t.Fatalf("expected a UUID lock id, got %q", lock.Id)
+	}
+
+	res, err := api("GET", "/user/uuid-repo/locks?id="+lock.Id, metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var list LockList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatalf("expected response body to be LockList, got error: %s", err)
+	}
+	if len(list.Locks) != 1 || list.Locks[0].Id != lock.Id {
+		t.Fatalf("expected the lock to be listed by its UUID, got: %+v", list.Locks)
+	}
+
+	buf := bytes.NewBufferString(`{"force":false}`)
+	res, err = api("POST", "/user/uuid-repo/locks/"+lock.Id+"/unlock", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	var unlockResponse UnlockResponse
+	if err := json.NewDecoder(res.Body).Decode(&unlockResponse); err != nil {
+		t.Fatalf("expected response body to be UnlockResponse, got error: %s", err)
+	}
+	if res.StatusCode != 200 || unlockResponse.Lock == nil || unlockResponse.Lock.Id != lock.Id {
+		t.Errorf("expected the lock to be deleted by its UUID, got %d: %+v", res.StatusCode, unlockResponse)
+	}
+}
+
+func TestLocksUnauthorized(t *testing.T) {
+	Config().AuthRealm = "lfs.example.com"
+	defer func() { Config().AuthRealm = "git-lfs-server" }()
+
+	for name, creds := range map[string][2]string{
+		"without credentials": {"", ""},
+		"wrong password":      {testUser, "wrong"},
+	} {
+		res, err := api("POST", "/user/realm-repo/locks", metaMediaType, creds[0], creds[1], bytes.NewBufferString(`{"path":"realm.bin"}`))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != 401 {
+			t.Errorf("%s: expected status 401, got %d", name, res.StatusCode)
+		}
+		if challenge := res.Header.Get("WWW-Authenticate"); challenge != `Basic realm="lfs.example.com"` {
+			t.Errorf("%s: expected a challenge for the configured realm, got %q", name, challenge)
+		}
+	}
+
+	lock, err := createLockInRepo(testUser, testPass, "realm-repo", "realm.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	res, err := api("POST", "/user/realm-repo/locks/"+lock.Id+"/unlock", metaMediaType, testUser1, testPass1, bytes.NewBufferString(`{}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403 for another user's lock, got %d", res.StatusCode)
+	}
+	if challenge := res.Header.Get("WWW-Authenticate"); challenge != "" {
+		t.Errorf("expected no challenge for an authenticated user, got %q", challenge)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	if err := testMetaStore.AddUser("samwise", "potatoes", ""); err != nil {
+		t.Fatalf("error adding user: %s", err)
+	}
+	defer testMetaStore.DeleteUser("samwise", false)
+
+	for name, c := range map[string]struct {
+		body    string
+		status  int
+		message string
+	}{
+		"wrong old password": {`{"old_password":"turnips","new_password":"second breakfast"}`, 403, errWrongPassword.Error()},
+		"weak new password":  {`{"old_password":"potatoes","new_password":"taters"}`, 422, errWeakPassword.Error()},
+	} {
+		res, err := api("POST", "/user/password", "", "samwise", "potatoes", bytes.NewBufferString(c.body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		if res.StatusCode != c.status {
+			t.Errorf("%s: expected status %d, got %d", name, c.status, res.StatusCode)
+			continue
+		}
+		assertErrorResponse(t, res, c.status, c.message)
+	}
+
+	res, err := api("POST", "/user/password", "", "samwise", "potatoes", bytes.NewBufferString(`{"old_password":"potatoes","new_password":"second breakfast"}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 204 {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+
+	if !testMetaStore.Validate("samwise", "second breakfast") {
+		t.Errorf("expected the new password to be valid")
+	}
+	if testMetaStore.Validate("samwise", "potatoes") {
+		t.Errorf("expected the old password to no longer be valid")
+	}
+}
+
+func TestUnlockByPath(t *testing.T) {
+	l, err := createLockInRepo(testUser, testPass, "unlock-path-repo", "TestUnlockByPath")
+	if err != nil {
+		t.Fatalf("create lock error: %s", err)
+	}
+
+	res, err := api("DELETE", "/user/unlock-path-repo/locks?path=TestUnlockByPath", metaMediaType, testUser1, testPass1, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403 for another user's lock, got %d", res.StatusCode)
+	}
+
+	res, err = api("DELETE", "/user/unlock-path-repo/locks?path=TestUnlockByPath", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var unlockResponse UnlockResponse
+	if err := json.NewDecoder(res.Body).Decode(&unlockResponse); err != nil {
+		t.Fatalf("expected response body to be UnlockResponse, got error: %s", err)
+	}
+	if unlockResponse.Lock == nil || unlockResponse.Lock.Id != l.Id {
+		t.Errorf("expected deleted lock to be returned, got: %v", unlockResponse.Lock)
+	}
+
+	res, err = api("DELETE", "/user/unlock-path-repo/locks?path=TestUnlockByPath", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 once unlocked, got %d", res.StatusCode)
+	}
+}
+
 func TestUnLockUnAuthed(t *testing.T) {
 	l, err := createLock(testUser, testPass, "TestUnLockUnAuthed")
 	if err != nil {
@@ -470,9 +2121,139 @@ func TestUnlockNotOwnerForce(t *testing.T) {
 	}
 }
 
+func TestReadOnlyMode(t *testing.T) {
+	Config().ReadOnly = "true"
+	defer func() { Config().ReadOnly = "false" }()
+
+	res, err := api("GET", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected download to succeed with status 200, got %d", res.StatusCode)
+	}
+
+	res, err = api("GET", "/user/repo/locks", metaMediaType, testUser, testPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected lock listing to succeed with status 200, got %d", res.StatusCode)
+	}
+
+	res, err = api("PUT", "/user/repo/objects/"+contentOid, contentMediaType, testUser, testPass, bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 503 {
+		t.Fatalf("expected upload to fail with status 503, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Retry-After") == "" {
+		t.Errorf("expected a Retry-After header")
+	}
+
+	buf := bytes.NewBufferString(`{"path":"TestReadOnlyMode"}`)
+	res, err = api("POST", "/user/repo/locks", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 503 {
+		t.Fatalf("expected lock creation to fail with status 503, got %d", res.StatusCode)
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	metaStore, err := NewMetaStore("lfs-shutdown-test.db")
+	if err != nil {
+		t.Fatalf("error creating meta store: %s", err)
+	}
+	defer os.Remove("lfs-shutdown-test.db")
+
+	contentStore, err := NewFileContentStore("lfs-content-shutdown-test")
+	if err != nil {
+		t.Fatalf("error creating content store: %s", err)
+	}
+	defer os.RemoveAll("lfs-content-shutdown-test")
+
+	if err := metaStore.AddUser(testUser, testPass, ""); err != nil {
+		t.Fatalf("error adding user: %s", err)
+	}
+	if _, err := metaStore.Put(&RequestVars{Oid: contentOid, Size: contentSize}); err != nil {
+		t.Fatalf("error adding object: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	url := "http://" + listener.Addr().String() + "/user/repo/objects/" + contentOid
+
+	app := NewApp(contentStore, metaStore)
+	go app.Serve(listener)
+
+	// Upload half the content, then hold the request open
+	body, bodyWriter := io.Pipe()
+	req, _ := http.NewRequest("PUT", url, body)
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+
+	uploaded := make(chan *http.Response)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("expected upload in progress to complete, got: %s", err)
+		}
+		uploaded <- res
+	}()
+	bodyWriter.Write([]byte(content[:5]))
+
+	waitFor(t, "upload to start", func() bool { return atomic.LoadInt64(&app.inFlight) == 1 })
+
+	shutdown := make(chan error)
+	go func() { shutdown <- app.Shutdown(time.Second) }()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	waitFor(t, "new requests to be refused", func() bool {
+		res, err := client.Get(url)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err != nil
+	})
+
+	bodyWriter.Write([]byte(content[5:]))
+	bodyWriter.Close()
+
+	if res := <-uploaded; res != nil && res.StatusCode != 200 {
+		t.Errorf("expected status 200, got %d", res.StatusCode)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("expected shutdown to succeed, got: %s", err)
+	}
+
+	if !contentStore.Exists(&MetaObject{Oid: contentOid, Size: contentSize}) {
+		t.Errorf("expected drained upload to be stored")
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
 func createLock(username, password, path string) (*Lock, error) {
+	return createLockInRepo(username, password, testRepo, path)
+}
+
+func createLockInRepo(username, password, repo, path string) (*Lock, error) {
 	buf := bytes.NewBufferString(fmt.Sprintf(`{"path":"%s"}`, path))
-	res, err := api("POST", "/user/repo/locks", metaMediaType, username, password, buf)
+	res, err := api("POST", "/user/"+repo+"/locks", metaMediaType, username, password, buf)
 	if err != nil {
 		return nil, fmt.Errorf("request error: %s", err)
 	}
@@ -493,6 +2274,17 @@ func createLock(username, password, path string) (*Lock, error) {
 	return lockResponse.Lock, nil
 }
 
+func putContent(path, body string) (*http.Response, error) {
+	req, err := http.NewRequest("PUT", lfsServer.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return http.DefaultClient.Do(req)
+}
+
 // simple http client for making api request
 func api(method, path, accept, username, password string, body *bytes.Buffer) (*http.Response, error) {
 	req, err := http.NewRequest(method, lfsServer.URL+path, nil)
@@ -515,7 +2307,7 @@ func api(method, path, accept, username, password string, body *bytes.Buffer) (*
 var (
 	lfsServer        *httptest.Server
 	testMetaStore    *MetaStore
-	testContentStore *ContentStore
+	testContentStore *FileContentStore
 )
 
 const (
@@ -543,7 +2335,7 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	testContentStore, err = NewContentStore("lfs-content-test")
+	testContentStore, err = NewFileContentStore("lfs-content-test")
 	if err != nil {
 		fmt.Printf("Error creating content store: %s", err)
 		os.Exit(1)
@@ -575,10 +2367,10 @@ func TestMain(m *testing.M) {
 }
 
 func seedMetaStore() error {
-	if err := testMetaStore.AddUser(testUser, testPass); err != nil {
+	if err := testMetaStore.AddUser(testUser, testPass, ""); err != nil {
 		return err
 	}
-	if err := testMetaStore.AddUser(testUser1, testPass1); err != nil {
+	if err := testMetaStore.AddUser(testUser1, testPass1, ""); err != nil {
 		return err
 	}
 
@@ -588,7 +2380,7 @@ func seedMetaStore() error {
 	}
 
 	lock := NewTestLock(lockId, lockPath, testUser)
-	if err := testMetaStore.AddLocks(testRepo, lock); err != nil {
+	if _, err := testMetaStore.AddLocks(testRepo, lock); err != nil {
 		return err
 	}
 
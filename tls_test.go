@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs-tls")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %s", err)
+	}
+
+	tl, err := NewTrackingListener("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating listener: %s", err)
+	}
+	server := &http.Server{Handler: lfsServer.Config.Handler}
+	go server.Serve(wrapHttps(tl, certs))
+	defer server.Close()
+
+	url := "https://" + tl.Addr().String() + "/user/repo/locks"
+
+	res := getTLS(t, url, first)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if res.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", res.Proto)
+	}
+
+	second := writeSelfSignedCert(t, certFile, keyFile, 2)
+	if err := certs.Reload(); err != nil {
+		t.Fatalf("error reloading certificate: %s", err)
+	}
+
+	res = getTLS(t, url, second)
+	if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("expected the reloaded certificate to be served, got serial %d", serial)
+	}
+}
+
+func TestCertReloaderKeepsCertOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs-tls")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %s", err)
+	}
+
+	os.Remove(keyFile)
+	if err := certs.Reload(); err == nil {
+		t.Fatalf("expected reloading without a key to fail")
+	}
+	if cert, _ := certs.GetCertificate(nil); cert == nil {
+		t.Errorf("expected the previous certificate to be kept")
+	}
+}
+
+// getTLS requests url over a new connection, trusting only cert.
+func getTLS(t *testing.T, url string, cert *x509.Certificate) *http.Response {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", metaMediaType)
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	res.Body.Close()
+	return res
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 with the given serial
+// number and its key to certFile and keyFile.
+func writeSelfSignedCert(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "lfs-test-server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error encoding key: %s", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatalf("error writing certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatalf("error writing key: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+	return cert
+}
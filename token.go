@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidToken = errors.New("Invalid token")
+	errTokenExpired = errors.New("Token has expired")
+)
+
+// tokenKey signs tokens when Config.TokenSecret isn't set. It changes on every
+// start, so tokens don't outlive the process.
+var tokenKey = make([]byte, 32)
+
+func init() {
+	rand.Read(tokenKey)
+}
+
+// AuthenticateRequest is the body accepted by POST /authenticate.
+type AuthenticateRequest struct {
+	User string `json:"user"`
+}
+
+// AuthenticateResponse is the git-lfs-authenticate style answer to POST
+// /authenticate: the header a client sends to act as the user, and when it
+// stops working.
+type AuthenticateResponse struct {
+	Header    map[string]string `json:"header"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	ExpiresIn int               `json:"expires_in"`
+}
+
+// newToken returns a token that authenticates as user until expires: the
+// user and expiry followed by an HMAC of them, base64 encoded. Tokens are
+// checked with the HMAC alone, without looking the user up.
+func newToken(user string, expires time.Time) string {
+	payload := user + "\x00" + strconv.FormatInt(expires.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(payload))
+}
+
+// validateToken returns the user of a token made by newToken, errInvalidToken
+// if it wasn't or errTokenExpired if it had expired by now.
+func validateToken(token string, now time.Time) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, tokenMAC(string(payload))) {
+		return "", errInvalidToken
+	}
+
+	fields := strings.SplitN(string(payload), "\x00", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return "", errInvalidToken
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return "", errTokenExpired
+	}
+	return fields[0], nil
+}
+
+func tokenMAC(payload string) []byte {
+	key := tokenKey
+	if Config().TokenSecret != "" {
+		key = []byte(Config().TokenSecret)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// parseBearerToken returns the token in the value of a Bearer Authorization
+// header.
+func parseBearerToken(authorization string) (string, bool) {
+	const prefix = "Bearer "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", false
+	}
+	return authorization[len(prefix):], true
+}
+
+// AuthenticateHandler issues a token for a user that is good for
+// Config.TokenTTL, for an SSH git-lfs-authenticate command to hand to the
+// client. Only admins may call it.
+func (a *App) AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
+	var req AuthenticateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.User == "" || strings.Contains(req.User, "\x00") {
+		writeError(w, r, http.StatusUnprocessableEntity, "Invalid username")
+		return
+	}
+
+	ttl := Config().TokenTTLDuration()
+	expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	writeJSON(w, r, http.StatusOK, &AuthenticateResponse{
+		Header:    map[string]string{"Authorization": "Bearer " + newToken(req.User, expires)},
+		ExpiresAt: expires,
+		ExpiresIn: int(ttl.Seconds()),
+	})
+}
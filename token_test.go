@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	res, err := api("POST", "/authenticate", "", testAdminUser, testAdminPass, bytes.NewBufferString(`{"user":"`+testUser+`"}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var auth AuthenticateResponse
+	if err := json.NewDecoder(res.Body).Decode(&auth); err != nil {
+		t.Fatalf("expected response body to be AuthenticateResponse, got error: %s", err)
+	}
+	if auth.ExpiresIn != 300 || time.Until(auth.ExpiresAt) > 5*time.Minute {
+		t.Errorf("expected the token to expire in 5 minutes, got %d (%s)", auth.ExpiresIn, auth.ExpiresAt)
+	}
+
+	res, err = createLockWithAuthorization("token-repo", "token.bin", auth.Header["Authorization"])
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("expected status 201, got %d", res.StatusCode)
+	}
+
+	var lockResponse LockResponse
+	if err := json.NewDecoder(res.Body).Decode(&lockResponse); err != nil {
+		t.Fatalf("expected response body to be LockResponse, got error: %s", err)
+	}
+	if lockResponse.Lock.Owner.Name != testUser {
+		t.Errorf("expected the lock to be owned by the token's user, got: %q", lockResponse.Lock.Owner.Name)
+	}
+}
+
+func TestAuthenticateRequiresAdmin(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	res, err := api("POST", "/authenticate", "", testUser, testPass, bytes.NewBufferString(`{"user":"`+testUser+`"}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestAuthenticateExpiredToken(t *testing.T) {
+	token := newToken(testUser, time.Now().Add(-time.Second))
+	if _, err := validateToken(token, time.Now()); err != errTokenExpired {
+		t.Errorf("expected errTokenExpired, got : %v", err)
+	}
+
+	res, err := createLockWithAuthorization("token-repo", "expired.bin", "Bearer "+token)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 401 {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestValidateTokenTampered(t *testing.T) {
+	token := newToken(testUser, time.Now().Add(time.Minute))
+	forged := newToken(testUser1, time.Now().Add(time.Minute))
+
+	tampered := forged[:strings.Index(forged, ".")] + token[strings.Index(token, "."):]
+	if _, err := validateToken(tampered, time.Now()); err != errInvalidToken {
+		t.Errorf("expected errInvalidToken, got : %v", err)
+	}
+	if user, err := validateToken(token, time.Now()); err != nil || user != testUser {
+		t.Errorf("expected the token to be valid for %s, got %q (%v)", testUser, user, err)
+	}
+}
+
+func createLockWithAuthorization(repo, path, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", lfsServer.URL+"/user/"+repo+"/locks", bytes.NewBufferString(`{"path":"`+path+`"}`))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", metaMediaType)
+	req.Header.Set("Authorization", authorization)
+	return http.DefaultClient.Do(req)
+}
@@ -35,7 +35,7 @@ func (t *TusServer) Start() {
 	}
 
 	t.dataPath = filepath.Join(os.TempDir(), "lfs_tusserver")
-	hostparts := strings.Split(Config.TusHost, ":")
+	hostparts := strings.Split(Config().TusHost, ":")
 	host := "localhost"
 	port := "1080"
 	if len(hostparts) > 0 {
@@ -128,7 +128,7 @@ func (t *TusServer) Create(oid string, size int64) (string, error) {
 }
 
 // Move the finished uploaded data from TUS to the content store (called by verify)
-func (t *TusServer) Finish(oid string, store *ContentStore) error {
+func (t *TusServer) Finish(oid string, store ContentStore) error {
 	t.serverMutex.Lock()
 	defer t.serverMutex.Unlock()
 
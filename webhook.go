@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookQueueSize is how many events can wait for delivery. Events are
+	// dropped when the queue is full so slow webhooks don't hold up requests.
+	webhookQueueSize = 100
+	// webhookAttempts is how many times an event is posted before giving up.
+	webhookAttempts = 3
+)
+
+// LockEvent is the payload posted to the webhook when a lock is created or
+// deleted.
+type LockEvent struct {
+	Event     string    `json:"event"`
+	Repo      string    `json:"repo"`
+	Lock      Lock      `json:"lock"`
+	Owner     string    `json:"owner"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type webhookDelivery struct {
+	url     string
+	secret  string
+	payload []byte
+}
+
+// webhookNotifier posts events to Config.WebhookURL in the background. The
+// URL and secret are read from Config when an event is queued so they can be
+// changed at runtime.
+type webhookNotifier struct {
+	queue   chan webhookDelivery
+	client  *http.Client
+	backoff time.Duration
+	// mu is held for writing by Close, so nothing is queued once the queue
+	// is closed
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newWebhookNotifier() *webhookNotifier {
+	n := &webhookNotifier{
+		queue:   make(chan webhookDelivery, webhookQueueSize),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+		done:    make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Close stops queueing events and waits up to timeout for the queued ones to
+// be delivered. Events still queued after that are dropped.
+func (n *webhookNotifier) Close(timeout time.Duration) {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+
+	select {
+	case <-n.done:
+	case <-time.After(timeout):
+		logger.Log(kv{"fn": "webhook", "err": fmt.Sprintf("timed out delivering events, dropping %d", len(n.queue))})
+	}
+}
+
+// NotifyLock queues a lock event for the webhook, if one is configured.
+func (n *webhookNotifier) NotifyLock(event, repo string, l Lock) {
+	if Config().WebhookURL == "" {
+		return
+	}
+
+	payload, err := json.Marshal(&LockEvent{
+		Event:     event,
+		Repo:      repo,
+		Lock:      l,
+		Owner:     l.Owner.Name,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		logger.Log(kv{"fn": "webhook", "event": event, "err": err})
+		return
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		logger.Log(kv{"fn": "webhook", "event": event, "err": "shutting down, dropping event"})
+		return
+	}
+
+	select {
+	case n.queue <- webhookDelivery{url: Config().WebhookURL, secret: Config().WebhookSecret, payload: payload}:
+	default:
+		logger.Log(kv{"fn": "webhook", "event": event, "err": "queue full, dropping event"})
+	}
+}
+
+// notifyLocks queues an event for each of locks, which are by repo.
+func (a *App) notifyLocks(event string, locks map[string][]Lock) {
+	for repo, repoLocks := range locks {
+		for _, l := range repoLocks {
+			a.webhooks.NotifyLock(event, repo, l)
+		}
+	}
+}
+
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+
+	for d := range n.queue {
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = n.post(d); err == nil {
+				break
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(time.Duration(attempt) * n.backoff)
+			}
+		}
+		if err != nil {
+			logger.Log(kv{"fn": "webhook", "url": d.url, "err": err})
+		}
+	}
+}
+
+func (n *webhookNotifier) post(d webhookDelivery) error {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.secret != "" {
+		req.Header.Set("X-LFS-Signature", webhookSignature(d.secret, d.payload))
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// webhookSignature returns the X-LFS-Signature header for payload: the hex
+// HMAC-SHA256 of the payload keyed with secret, prefixed with "sha256=".
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	body      []byte
+	signature string
+}
+
+func TestWebhookLockEvents(t *testing.T) {
+	received := make(chan webhookRequest, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- webhookRequest{body: body, signature: r.Header.Get("X-LFS-Signature")}
+	}))
+	defer hook.Close()
+
+	Config().WebhookURL = hook.URL
+	Config().WebhookSecret = "shire"
+	defer func() {
+		Config().WebhookURL = ""
+		Config().WebhookSecret = ""
+	}()
+
+	lock, err := createLockInRepo(testUser, testPass, "webhook-repo", "hooked.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	buf := bytes.NewBufferString(`{"force":false}`)
+	res, err := api("POST", "/user/webhook-repo/locks/"+lock.Id+"/unlock", metaMediaType, testUser, testPass, buf)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	for _, expected := range []string{"lock.created", "lock.deleted"} {
+		req := receiveWebhook(t, received)
+
+		if req.signature != webhookSignature("shire", req.body) {
+			t.Errorf("expected payload to be signed, got signature: %q", req.signature)
+		}
+
+		var event LockEvent
+		if err := json.Unmarshal(req.body, &event); err != nil {
+			t.Fatalf("expected payload to be a lock event, got error: %s", err)
+		}
+		if event.Event != expected || event.Repo != "webhook-repo" || event.Owner != testUser {
+			t.Errorf("expected %s event for %s in webhook-repo, got: %+v", expected, testUser, event)
+		}
+		if event.Lock.Id != lock.Id || event.Lock.Path != "hooked.bin" {
+			t.Errorf("expected event for the lock, got: %+v", event.Lock)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("expected event to have a timestamp")
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	received := make(chan webhookRequest, 10)
+	var calls int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- webhookRequest{body: body}
+	}))
+	defer hook.Close()
+
+	Config().WebhookURL = hook.URL
+	defer func() { Config().WebhookURL = "" }()
+
+	n := &webhookNotifier{
+		queue:   make(chan webhookDelivery, webhookQueueSize),
+		client:  http.DefaultClient,
+		backoff: time.Millisecond,
+		done:    make(chan struct{}),
+	}
+	go n.run()
+	defer n.Close(time.Second)
+
+	n.NotifyLock("lock.created", testRepo, NewTestLock(lockId, lockPath, testUser))
+
+	req := receiveWebhook(t, received)
+	var event LockEvent
+	if err := json.Unmarshal(req.body, &event); err != nil || event.Lock.Id != lockId {
+		t.Errorf("expected the event to be delivered on retry, got: %s (%v)", req.body, err)
+	}
+}
+
+func TestWebhookCloseDrainsQueue(t *testing.T) {
+	var delivered int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		delivered++
+	}))
+	defer hook.Close()
+
+	Config().WebhookURL = hook.URL
+	defer func() { Config().WebhookURL = "" }()
+
+	n := newWebhookNotifier()
+	for i := 0; i < 3; i++ {
+		n.NotifyLock("lock.created", testRepo, NewTestLock(lockId, lockPath, testUser))
+	}
+	n.Close(5 * time.Second)
+
+	if delivered != 3 {
+		t.Errorf("expected the queued events to be delivered before Close returns, got %d", delivered)
+	}
+
+	// Events after Close are dropped
+	n.NotifyLock("lock.deleted", testRepo, NewTestLock(lockId, lockPath, testUser))
+}
+
+func TestWebhookAdminLockEvents(t *testing.T) {
+	setupAdmin()
+	defer teardownAdmin()
+
+	received := make(chan webhookRequest, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- webhookRequest{body: body}
+	}))
+	defer hook.Close()
+
+	lock, err := createLockInRepo(testUser, testPass, "webhook-cleared-repo", "cleared.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+
+	Config().WebhookURL = hook.URL
+	defer func() { Config().WebhookURL = "" }()
+
+	res, err := api("DELETE", "/admin/repos/webhook-cleared-repo/locks", "", testAdminUser, testAdminPass, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	var event LockEvent
+	if err := json.Unmarshal(receiveWebhook(t, received).body, &event); err != nil {
+		t.Fatalf("expected payload to be a lock event, got error: %s", err)
+	}
+	if event.Event != "lock.deleted" || event.Repo != "webhook-cleared-repo" || event.Lock.Id != lock.Id {
+		t.Errorf("expected a lock.deleted event for the cleared lock, got: %+v", event)
+	}
+
+	if err := testMetaStore.AddUser("webhook-departed", "pass", ""); err != nil {
+		t.Fatalf("expected AddUser to succeed, got : %s", err)
+	}
+	defer testMetaStore.DeleteUser("webhook-departed", true)
+
+	Config().WebhookURL = ""
+	lock, err = createLockInRepo("webhook-departed", "pass", "webhook-transfer-repo", "transferred.bin")
+	if err != nil {
+		t.Fatalf("error creating lock: %s", err)
+	}
+	defer testMetaStore.LockClear("webhook-transfer-repo")
+	Config().WebhookURL = hook.URL
+
+	res, err = api("POST", "/admin/users/webhook-departed/locks/transfer", "", testAdminUser, testAdminPass, bytes.NewBufferString(`{"to":"`+testUser+`"}`))
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	event = LockEvent{}
+	if err := json.Unmarshal(receiveWebhook(t, received).body, &event); err != nil {
+		t.Fatalf("expected payload to be a lock event, got error: %s", err)
+	}
+	if event.Event != "lock.transferred" || event.Repo != "webhook-transfer-repo" || event.Lock.Id != lock.Id || event.Owner != testUser {
+		t.Errorf("expected a lock.transferred event naming the new owner, got: %+v", event)
+	}
+}
+
+func receiveWebhook(t *testing.T, received chan webhookRequest) webhookRequest {
+	select {
+	case req := <-received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for webhook")
+	}
+	return webhookRequest{}
+}